@@ -29,6 +29,18 @@ export default class CacheCardComponent extends React.Component {
                 let uploadThroughput = +cacheStat.uploadThroughputBytesPerSecond / 1000000 || 0;
                 return (
                   <div className="cache-sections">
+                    {+cacheStat.quotaHardLimitExceededCount > 0 && (
+                      <div className="cache-quota-warning">
+                        {cacheStat.quotaHardLimitExceededCount} uploads were rejected because your organization is over
+                        its cache quota.
+                      </div>
+                    )}
+                    {+cacheStat.quotaHardLimitExceededCount == 0 && +cacheStat.quotaSoftLimitExceededCount > 0 && (
+                      <div className="cache-quota-warning">
+                        Your organization is over the soft limit of its cache quota. Its oldest cache entries are being
+                        evicted, and uploads will be rejected once it reaches the hard limit.
+                      </div>
+                    )}
                     <div className="cache-section">
                       <div className="cache-title">Action cache (AC)</div>
                       <div className="cache-subtitle">Maps action hashes to action result metadata</div>
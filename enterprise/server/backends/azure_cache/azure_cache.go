@@ -0,0 +1,324 @@
+package azure_cache
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/autoclose"
+	"github.com/buildbuddy-io/buildbuddy/server/util/azureutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/cache_metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sync/errgroup"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// Blobs are uploaded in blocks of this size, so a Writer holds at
+	// most uploadMaxBuffers blocks in memory at once.
+	uploadBlockSizeBytes = 4 * 1024 * 1024
+	uploadMaxBuffers     = 2
+
+	maxDownloadRetries = 3
+)
+
+var (
+	cacheLabels = cache_metrics.MakeCacheLabels(cache_metrics.CloudCacheTier, "azure")
+)
+
+// AzureCache stores cache entries as block blobs in an Azure storage
+// container.
+//
+// Azure only supports expiring blobs through a lifecycle management policy
+// on the storage account, which can't be set through the blob API. If
+// ttlInDays is set, the policy should delete blobs some days after they
+// were last modified; the cache touches blobs as they are used so that
+// entries which are still needed don't expire.
+type AzureCache struct {
+	containerURL azblob.ContainerURL
+	ttlInDays    int64
+	prefix       string
+}
+
+func NewAzureCache(azureConfig *config.AzureCacheConfig) (*AzureCache, error) {
+	ctx := context.Background()
+	containerURL, err := azureutil.NewContainerURL(azureConfig.AccountName, azureConfig.AccountKey, azureConfig.Endpoint, azureConfig.ContainerName)
+	if err != nil {
+		return nil, err
+	}
+	if err := azureutil.CreateContainerIfNotExists(ctx, containerURL); err != nil {
+		return nil, err
+	}
+	if azureConfig.TTLDays > 0 {
+		log.Printf("Azure cache entries are kept fresh for %d days. Make sure the storage account has a lifecycle management rule deleting blobs in %q which haven't been modified for that long.", azureConfig.TTLDays, azureConfig.ContainerName)
+	}
+	log.Printf("Initialized Azure cache with container %q, ttl (days): %d", azureConfig.ContainerName, azureConfig.TTLDays)
+	return &AzureCache{
+		containerURL: containerURL,
+		ttlInDays:    azureConfig.TTLDays,
+	}, nil
+}
+
+func (a *AzureCache) key(ctx context.Context, d *repb.Digest) (string, error) {
+	hash, err := digest.Validate(d)
+	if err != nil {
+		return "", err
+	}
+	userPrefix, err := prefix.UserPrefixFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return userPrefix + a.prefix + hash, nil
+}
+
+func (a *AzureCache) WithPrefix(prefix string) interfaces.Cache {
+	newPrefix := filepath.Join(append(filepath.SplitList(a.prefix), prefix)...)
+	if len(newPrefix) > 0 && newPrefix[len(newPrefix)-1] != '/' {
+		newPrefix += "/"
+	}
+
+	return &AzureCache{
+		containerURL: a.containerURL,
+		ttlInDays:    a.ttlInDays,
+		prefix:       newPrefix,
+	}
+}
+
+func (a *AzureCache) download(ctx context.Context, d *repb.Digest, key string, offset int64) (io.ReadCloser, error) {
+	resp, err := a.containerURL.NewBlobURL(key).Download(ctx, offset, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if azureutil.IsNotFoundErr(err) {
+			return nil, status.NotFoundErrorf("Digest '%s/%d' not found in cache", d.GetHash(), d.GetSizeBytes())
+		}
+		return nil, err
+	}
+	return resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: maxDownloadRetries}), nil
+}
+
+func (a *AzureCache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	k, err := a.key(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	timer := cache_metrics.NewCacheTimer(cacheLabels)
+	body, err := a.download(ctx, d, k, 0)
+	if err != nil {
+		timer.ObserveGet(0, err)
+		return nil, err
+	}
+	defer body.Close()
+	b, err := ioutil.ReadAll(body)
+	timer.ObserveGet(len(b), err)
+	return b, err
+}
+
+func (a *AzureCache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	lock := sync.RWMutex{} // protects(foundMap)
+	foundMap := make(map[*repb.Digest][]byte, len(digests))
+	eg, ctx := errgroup.WithContext(ctx)
+
+	for _, d := range digests {
+		fetchFn := func(d *repb.Digest) {
+			eg.Go(func() error {
+				data, err := a.Get(ctx, d)
+				if status.IsNotFoundError(err) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				foundMap[d] = data
+				return nil
+			})
+		}
+		fetchFn(d)
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	return foundMap, nil
+}
+
+func (a *AzureCache) Set(ctx context.Context, d *repb.Digest, data []byte) error {
+	k, err := a.key(ctx, d)
+	if err != nil {
+		return err
+	}
+	timer := cache_metrics.NewCacheTimer(cacheLabels)
+	_, err = azblob.UploadBufferToBlockBlob(ctx, data, a.containerURL.NewBlockBlobURL(k), azblob.UploadToBlockBlobOptions{
+		BlockSize: uploadBlockSizeBytes,
+	})
+	timer.ObserveSet(len(data), err)
+	return err
+}
+
+func (a *AzureCache) SetMulti(ctx context.Context, kvs map[*repb.Digest][]byte) error {
+	eg, ctx := errgroup.WithContext(ctx)
+
+	for d, data := range kvs {
+		setFn := func(d *repb.Digest, data []byte) {
+			eg.Go(func() error {
+				return a.Set(ctx, d, data)
+			})
+		}
+		setFn(d, data)
+	}
+
+	return eg.Wait()
+}
+
+func (a *AzureCache) Delete(ctx context.Context, d *repb.Digest) error {
+	k, err := a.key(ctx, d)
+	if err != nil {
+		return err
+	}
+	timer := cache_metrics.NewCacheTimer(cacheLabels)
+	_, err = a.containerURL.NewBlobURL(k).Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	timer.ObserveDelete(err)
+	return err
+}
+
+// bumpTTLIfStale touches a blob which is more than halfway to expiring, so
+// that the lifecycle policy counts its age from now. Setting a blob's
+// metadata is the cheapest way to update its last modified time.
+func (a *AzureCache) bumpTTLIfStale(ctx context.Context, key string, lastModified time.Time) bool {
+	if a.ttlInDays <= 0 || int64(time.Since(lastModified).Hours()) < 24*a.ttlInDays/2 {
+		return true
+	}
+	_, err := a.containerURL.NewBlobURL(key).SetMetadata(ctx, azblob.Metadata{}, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if azureutil.IsNotFoundErr(err) {
+		return false
+	}
+	if err != nil {
+		log.Printf("Error bumping TTL for key %s: %s", key, err.Error())
+	}
+	return true
+}
+
+func (a *AzureCache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
+	k, err := a.key(ctx, d)
+	if err != nil {
+		return false, err
+	}
+	timer := cache_metrics.NewCacheTimer(cacheLabels)
+	props, err := a.containerURL.NewBlobURL(k).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if azureutil.IsNotFoundErr(err) {
+		timer.ObserveContains(nil)
+		return false, nil
+	}
+	timer.ObserveContains(err)
+	if err != nil {
+		return false, err
+	}
+	return a.bumpTTLIfStale(ctx, k, props.LastModified()), nil
+}
+
+func (a *AzureCache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
+	lock := sync.RWMutex{} // protects(foundMap)
+	foundMap := make(map[*repb.Digest]bool, len(digests))
+	eg, ctx := errgroup.WithContext(ctx)
+
+	for _, d := range digests {
+		fetchFn := func(d *repb.Digest) {
+			eg.Go(func() error {
+				exists, err := a.Contains(ctx, d)
+				if err != nil {
+					return err
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				foundMap[d] = exists
+				return nil
+			})
+		}
+		fetchFn(d)
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	return foundMap, nil
+}
+
+func (a *AzureCache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.Reader, error) {
+	k, err := a.key(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	// Only the bytes past offset are downloaded.
+	body, err := a.download(ctx, d, k, offset)
+	if err != nil {
+		return nil, err
+	}
+	timer := cache_metrics.NewCacheTimer(cacheLabels)
+	return timer.NewInstrumentedReader(autoclose.NewReader(body), d.GetSizeBytes()-offset), nil
+}
+
+type waitForUploadWriteCloser struct {
+	io.WriteCloser
+	finishedWrite chan struct{}
+	uploadErr     error // written before finishedWrite is closed
+	timer         *cache_metrics.CacheTimer
+	size          int64
+}
+
+func (w *waitForUploadWriteCloser) Close() error {
+	err := w.WriteCloser.Close()
+	if err != nil {
+		return err
+	}
+	<-w.finishedWrite
+	w.timer.ObserveWrite(w.size, w.uploadErr)
+	return w.uploadErr
+}
+
+func (a *AzureCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
+	k, err := a.key(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	closer := &waitForUploadWriteCloser{
+		WriteCloser:   w,
+		finishedWrite: make(chan struct{}),
+		timer:         cache_metrics.NewCacheTimer(cacheLabels),
+		size:          d.GetSizeBytes(),
+	}
+	// Blocks are staged as they fill up and committed once the writer is
+	// closed, so the blob only becomes visible when it is complete.
+	go func() {
+		_, err := azblob.UploadStreamToBlockBlob(ctx, r, a.containerURL.NewBlockBlobURL(k), azblob.UploadStreamToBlockBlobOptions{
+			BufferSize: uploadBlockSizeBytes,
+			MaxBuffers: uploadMaxBuffers,
+		})
+		if err != nil {
+			closer.uploadErr = err
+			r.CloseWithError(err)
+		}
+		close(closer.finishedWrite)
+	}()
+	return closer, nil
+}
+
+func (a *AzureCache) Start() error {
+	return nil
+}
+
+func (a *AzureCache) Stop() error {
+	return nil
+}
@@ -0,0 +1,201 @@
+package azure_cache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+
+	testazure "github.com/buildbuddy-io/buildbuddy/server/testutil/azure"
+	testdigest "github.com/buildbuddy-io/buildbuddy/server/testutil/digest"
+	testenv "github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+)
+
+const testContainer = "test-container"
+
+func newTestCache(t *testing.T) (*AzureCache, *testazure.Server) {
+	server := testazure.Run(t)
+	ac, err := NewAzureCache(&config.AzureCacheConfig{
+		AccountName:   testazure.AccountName,
+		AccountKey:    testazure.AccountKey,
+		ContainerName: testContainer,
+		Endpoint:      server.URL,
+		TTLDays:       30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac, server
+}
+
+func getAnonContext(t *testing.T) context.Context {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	if err != nil {
+		t.Fatalf("error attaching user prefix: %s", err)
+	}
+	return ctx
+}
+
+func TestSetAndGet(t *testing.T) {
+	ctx := getAnonContext(t)
+	ac, _ := newTestCache(t)
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	if err := ac.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ac.Get(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf) {
+		t.Fatalf("Get returned different data than was set")
+	}
+	exists, err := ac.Contains(ctx, d)
+	if err != nil || !exists {
+		t.Fatalf("Contains() = %t, %v; want true", exists, err)
+	}
+
+	missing, _ := testdigest.NewRandomDigestBuf(t, 1000)
+	if _, err := ac.Get(ctx, missing); !status.IsNotFoundError(err) {
+		t.Fatalf("Get(missing digest) returned %v, want NotFound", err)
+	}
+	exists, err = ac.Contains(ctx, missing)
+	if err != nil || exists {
+		t.Fatalf("Contains(missing digest) = %t, %v; want false", exists, err)
+	}
+
+	if err := ac.Delete(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ac.Get(ctx, d); !status.IsNotFoundError(err) {
+		t.Fatalf("Get returned %v after delete, want NotFound", err)
+	}
+}
+
+func TestReaderFetchesOnlyRequestedRange(t *testing.T) {
+	ctx := getAnonContext(t)
+	ac, server := newTestCache(t)
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	if err := ac.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{0, 1, 500, 999} {
+		server.ResetStats()
+
+		r, err := ac.Reader(ctx, d, offset)
+		if err != nil {
+			t.Fatalf("Reader(offset=%d) returned error: %s", offset, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, buf[offset:]) {
+			t.Fatalf("Reader(offset=%d) returned %d bytes, want %d", offset, len(got), len(buf)-int(offset))
+		}
+		if served := server.Stats().BytesServed; served != int64(len(buf))-offset {
+			t.Fatalf("Reader(offset=%d) downloaded %d bytes, want %d", offset, served, int64(len(buf))-offset)
+		}
+	}
+
+	missing, _ := testdigest.NewRandomDigestBuf(t, 1000)
+	if _, err := ac.Reader(ctx, missing, 0); !status.IsNotFoundError(err) {
+		t.Fatalf("Reader(missing digest) returned %v, want NotFound", err)
+	}
+}
+
+func TestWriterStagesBlocks(t *testing.T) {
+	ctx := getAnonContext(t)
+	for _, tc := range []struct {
+		size            int64
+		numStagedBlocks int
+	}{
+		{1000, 1},
+		{2*uploadBlockSizeBytes + 1, 3},
+	} {
+		ac, server := newTestCache(t)
+		d, buf := testdigest.NewRandomDigestBuf(t, tc.size)
+		w, err := ac.Writer(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(buf); i += 64 * 1024 {
+			end := i + 64*1024
+			if end > len(buf) {
+				end = len(buf)
+			}
+			if _, err := w.Write(buf[i:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if stats := server.Stats(); stats.NumStagedBlocks != tc.numStagedBlocks {
+			t.Fatalf("%d byte blob was uploaded in %d blocks, want %d", tc.size, stats.NumStagedBlocks, tc.numStagedBlocks)
+		}
+		got, err := ac.Get(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, buf) {
+			t.Fatalf("Get returned different data than was written")
+		}
+	}
+}
+
+func TestWriterReturnsUploadError(t *testing.T) {
+	ctx := getAnonContext(t)
+	ac, server := newTestCache(t)
+	server.SetFailRequests(true)
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	w, err := ac.Writer(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Fatalf("Close returned no error when the upload failed")
+	}
+}
+
+func TestContainsBumpsStaleBlobs(t *testing.T) {
+	ctx := getAnonContext(t)
+	ac, server := newTestCache(t)
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	if err := ac.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ac.key(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recent := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	server.SetLastModified(testContainer, key, recent)
+	if exists, err := ac.Contains(ctx, d); err != nil || !exists {
+		t.Fatalf("Contains() = %t, %v; want true", exists, err)
+	}
+	if got := server.LastModified(testContainer, key); !got.Equal(recent) {
+		t.Fatalf("Blob modified a day ago was touched, last modified %s", got)
+	}
+
+	stale := time.Now().Add(-20 * 24 * time.Hour)
+	server.SetLastModified(testContainer, key, stale)
+	if exists, err := ac.Contains(ctx, d); err != nil || !exists {
+		t.Fatalf("Contains() = %t, %v; want true", exists, err)
+	}
+	if got := server.LastModified(testContainer, key); time.Since(got) > time.Hour {
+		t.Fatalf("Blob modified 20 days ago wasn't touched, last modified %s", got)
+	}
+}
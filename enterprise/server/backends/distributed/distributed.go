@@ -9,7 +9,7 @@ import (
 	"sync"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cacheproxy"
-	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/heartbeat"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/peerdiscovery"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/util/consistent_hash"
@@ -33,47 +33,85 @@ type Cache struct {
 	prefix            string
 	cacheProxy        *cacheproxy.CacheProxy
 	consistentHash    *consistent_hash.ConsistentHash
-	heartbeatChannel  *heartbeat.HeartbeatChannel
+	peerDiscovery     peerdiscovery.PeerDiscovery
+	rebalancer        *rebalancer
 }
 
 // NewDistributedCache creates a new cache by wrapping the provided cache "c",
-// in a HTTP API and announcing its presence over redis to other distributed
-// cache nodes. Together, these distributed caches each maintain a consistent
-// hash ring which identifies the owner (and replicas) of any stored keys.
+// in a gRPC API and announcing its presence to other distributed cache nodes,
+// which are found using the peer discovery method set in the config (by
+// default, heartbeats over redis). Together, these distributed caches each
+// maintain a consistent hash ring which identifies the owner (and replicas) of
+// any stored keys. If "c" implements interfaces.KeyScanner and peers
+// authenticate each other (with mTLS or a peer secret), its contents are moved
+// to their new owners whenever the set of peers changes.
 //  - myAddr is the interface to listen on in "host:port" format.
 //  - groupName is a string namespace which the distributed cache nodes must
 // match to peer.
 //  - replicationFactor is an int specifying how many copies of each key will
 // be stored across unique caches.
 func NewDistributedCache(env environment.Env, c interfaces.Cache, myAddr, groupName string, replicationFactor int) (*Cache, error) {
-	chash := consistent_hash.NewConsistentHash()
+	proxy, err := cacheproxy.NewCacheProxy(env, c, myAddr)
+	if err != nil {
+		return nil, err
+	}
 	dc := &Cache{
 		local:             c,
-		cacheProxy:        cacheproxy.NewCacheProxy(env, c, myAddr),
+		cacheProxy:        proxy,
 		myAddr:            myAddr,
 		groupName:         groupName,
-		consistentHash:    chash,
-		heartbeatChannel:  heartbeat.NewHeartbeatChannel(env.GetPubSub(), myAddr, groupName, chash.Set),
+		consistentHash:    consistent_hash.NewConsistentHash(),
 		replicationFactor: replicationFactor,
 	}
+	if !proxy.PeersAuthenticated() {
+		log.Printf("Distributed cache %q: peers are not authenticated; rebalancing is disabled", myAddr)
+	} else if scanner, ok := c.(interfaces.KeyScanner); ok {
+		bytesPerSecond := int64(0)
+		if dcConfig := env.GetConfigurator().GetDistributedCacheConfig(); dcConfig != nil {
+			bytesPerSecond = dcConfig.RebalanceBandwidthBytesPerSecond
+		}
+		dc.rebalancer = newRebalancer(dc, scanner, bytesPerSecond)
+	} else {
+		log.Printf("Distributed cache %q: local cache does not support scanning keys; rebalancing is disabled", myAddr)
+	}
+	dc.peerDiscovery, err = peerdiscovery.New(env, myAddr, groupName, dc.setPeers)
+	if err != nil {
+		return nil, err
+	}
 	go func() {
 		dc.StartListening()
 	}()
 	return dc, nil
 }
 
+// setPeers is called by peer discovery whenever the set of peers in
+// this cache group (or their weights) changes.
+func (c *Cache) setPeers(peerWeights map[string]int) {
+	c.consistentHash.SetWeighted(peerWeights)
+	if c.rebalancer != nil {
+		c.rebalancer.PeersChanged()
+	}
+}
+
 func (c *Cache) StartListening() {
-	go func() {
-		log.Printf("Distributed disk listening on %q", c.myAddr)
-		c.heartbeatChannel.StartAdvertising()
-		c.cacheProxy.Server().ListenAndServe()
-	}()
+	if c.rebalancer != nil {
+		c.rebalancer.Start()
+	}
+	log.Printf("Distributed disk listening on %q", c.myAddr)
+	if err := c.cacheProxy.StartListening(); err != nil {
+		log.Printf("Distributed disk %q failed to listen: %s", c.myAddr, err)
+		return
+	}
+	c.peerDiscovery.Start()
 }
 
 func (c *Cache) Shutdown() {
 	log.Printf("Distributed disk shutting down %q", c.myAddr)
-	c.heartbeatChannel.StopAdvertising()
-	c.cacheProxy.Server().Close()
+	c.peerDiscovery.Stop()
+	if c.rebalancer != nil {
+		c.rebalancer.Stop()
+	}
+	c.cacheProxy.Shutdown()
 }
 
 func (c *Cache) WithPrefix(prefix string) interfaces.Cache {
@@ -114,29 +152,70 @@ func (c *Cache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
 	return c.remoteContains(ctx, d)
 }
 
+// groupByPeer returns a map from peer to the digests which should be looked
+// up on that peer, where each digest is assigned to the peer at position
+// "attempt" in its list of replicas. Digests which have no such peer (because
+// all of their replicas have already been tried) are returned separately.
+func (c *Cache) groupByPeer(digests []*repb.Digest, attempt int) (map[string][]*repb.Digest, []*repb.Digest) {
+	byPeer := make(map[string][]*repb.Digest)
+	exhausted := make([]*repb.Digest, 0)
+	for _, d := range digests {
+		peers := c.peers(d)
+		if attempt >= len(peers) {
+			exhausted = append(exhausted, d)
+			continue
+		}
+		peer := peers[attempt]
+		byPeer[peer] = append(byPeer[peer], d)
+	}
+	return byPeer, exhausted
+}
+
+// ContainsMulti issues a single FindMissing call to each peer that owns any of
+// the digests. Like Contains, if a peer is unavailable, its digests are looked
+// up on their next replica instead.
 func (c *Cache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
-	lock := sync.RWMutex{} // protects(foundMap)
+	lock := sync.Mutex{} // protects(foundMap, retry)
 	foundMap := make(map[*repb.Digest]bool, len(digests))
-	eg, ctx := errgroup.WithContext(ctx)
 
-	for _, d := range digests {
-		fetchFn := func(d *repb.Digest) {
+	pending := digests
+	for attempt := 0; len(pending) > 0; attempt++ {
+		byPeer, exhausted := c.groupByPeer(pending, attempt)
+		if len(exhausted) > 0 {
+			log.Printf("All peers failed for %d digests.", len(exhausted))
+		}
+		for _, d := range exhausted {
+			foundMap[d] = false
+		}
+
+		retry := make([]*repb.Digest, 0)
+		eg, gctx := errgroup.WithContext(ctx)
+		for peer, peerDigests := range byPeer {
+			peer, peerDigests := peer, peerDigests
 			eg.Go(func() error {
-				exists, err := c.Contains(ctx, d)
+				missing, err := c.cacheProxy.RemoteFindMissing(gctx, peer, c.prefix, peerDigests)
+				lock.Lock()
+				defer lock.Unlock()
+				if status.IsUnavailableError(err) {
+					retry = append(retry, peerDigests...)
+					return nil
+				}
 				if err != nil {
 					return err
 				}
-				lock.Lock()
-				defer lock.Unlock()
-				foundMap[d] = exists
+				for _, d := range peerDigests {
+					foundMap[d] = true
+				}
+				for _, d := range missing {
+					foundMap[d] = false
+				}
 				return nil
 			})
 		}
-		fetchFn(d)
-	}
-
-	if err := eg.Wait(); err != nil {
-		return nil, err
+		if err := eg.Wait(); err != nil {
+			return nil, err
+		}
+		pending = retry
 	}
 
 	return foundMap, nil
@@ -167,29 +246,46 @@ func (c *Cache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
 	return ioutil.ReadAll(r)
 }
 
+// GetMulti issues a single GetMulti call to each peer that owns any of the
+// digests. Like Get, if a peer is unavailable, its digests are fetched from
+// their next replica instead. Digests which are not found, including those
+// whose replicas are all unavailable, are omitted from the result.
 func (c *Cache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
-	lock := sync.RWMutex{} // protects(foundMap)
+	lock := sync.Mutex{} // protects(foundMap, retry)
 	foundMap := make(map[*repb.Digest][]byte, len(digests))
-	eg, ctx := errgroup.WithContext(ctx)
 
-	for _, d := range digests {
-		fetchFn := func(d *repb.Digest) {
+	pending := digests
+	for attempt := 0; len(pending) > 0; attempt++ {
+		byPeer, exhausted := c.groupByPeer(pending, attempt)
+		if len(exhausted) > 0 {
+			log.Printf("All peers failed for %d digests.", len(exhausted))
+		}
+
+		retry := make([]*repb.Digest, 0)
+		eg, gctx := errgroup.WithContext(ctx)
+		for peer, peerDigests := range byPeer {
+			peer, peerDigests := peer, peerDigests
 			eg.Go(func() error {
-				data, err := c.Get(ctx, d)
+				found, err := c.cacheProxy.RemoteGetMulti(gctx, peer, c.prefix, peerDigests)
+				lock.Lock()
+				defer lock.Unlock()
+				if status.IsUnavailableError(err) {
+					retry = append(retry, peerDigests...)
+					return nil
+				}
 				if err != nil {
 					return err
 				}
-				lock.Lock()
-				defer lock.Unlock()
-				foundMap[d] = data
+				for d, data := range found {
+					foundMap[d] = data
+				}
 				return nil
 			})
 		}
-		fetchFn(d)
-	}
-
-	if err := eg.Wait(); err != nil {
-		return nil, err
+		if err := eg.Wait(); err != nil {
+			return nil, err
+		}
+		pending = retry
 	}
 
 	return foundMap, nil
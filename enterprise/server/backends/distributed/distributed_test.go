@@ -207,3 +207,59 @@ func TestDroppedNode(t *testing.T) {
 		}
 	}
 }
+
+func TestContainsMultiAndGetMulti(t *testing.T) {
+	te := getTestEnv(t, emptyUserMap)
+	te.SetPubSub(pubsub.NewTestPubSub())
+	ctx := getAnonContext(t)
+
+	caches := make([]*distributed.Cache, 0, 3)
+	for i := 0; i < 3; i++ {
+		peer := fmt.Sprintf("localhost:%d", app.FreePort(t))
+		c := newDistributedCache(t, te, peer, 2, 10000000)
+		defer c.Shutdown()
+		waitUntilServerIsAlive(peer)
+		caches = append(caches, c)
+	}
+
+	// Wait until every cache has received a heartbeat from every peer.
+	time.Sleep(2 * time.Second)
+
+	stored := make(map[*repb.Digest][]byte, 0)
+	all := make([]*repb.Digest, 0)
+	for i := 0; i < 50; i++ {
+		d, buf := testdigest.NewRandomDigestBuf(t, 100)
+		all = append(all, d)
+		if i%2 == 0 {
+			if err := caches[rand.Intn(len(caches))].Set(ctx, d, buf); err != nil {
+				t.Fatal(err)
+			}
+			stored[d] = buf
+		}
+	}
+
+	c := caches[rand.Intn(len(caches))]
+	found, err := c.ContainsMulti(ctx, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range all {
+		_, shouldExist := stored[d]
+		if found[d] != shouldExist {
+			t.Fatalf("ContainsMulti(%q) = %t, want %t", d.GetHash(), found[d], shouldExist)
+		}
+	}
+
+	values, err := c.GetMulti(ctx, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != len(stored) {
+		t.Fatalf("GetMulti returned %d values, want %d", len(values), len(stored))
+	}
+	for d, buf := range stored {
+		if !bytes.Equal(values[d], buf) {
+			t.Fatalf("GetMulti returned wrong contents for %q", d.GetHash())
+		}
+	}
+}
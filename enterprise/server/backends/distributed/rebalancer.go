@@ -0,0 +1,227 @@
+package distributed
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cacheproxy"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/time/rate"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// How long the peer set must be stable before rebalancing starts.
+	// During a deploy or scale-up, peers join one heartbeat at a time, so
+	// this avoids starting a new scan for every single peer.
+	defaultRebalanceDelay = 10 * time.Second
+
+	// How fast to move data to new owners if no limit is configured.
+	defaultRebalanceBytesPerSecond = 10 * 1000 * 1000 // 10 MB/s
+)
+
+var errPeersChanged = status.AbortedError("Peer set changed during rebalance")
+
+// A rebalancer moves the entries of the local cache to the peers which own
+// them after the peer set changes. Entries that this node no longer owns are
+// streamed to each of their new owners and then deleted locally; entries this
+// node still owns are copied to any new replicas which are missing them.
+type rebalancer struct {
+	c       *Cache
+	scanner interfaces.KeyScanner
+	limiter *rate.Limiter
+
+	// How long the peer set must be stable before rebalancing starts.
+	Delay time.Duration
+
+	trigger chan struct{}
+	quit    chan struct{}
+}
+
+func newRebalancer(c *Cache, scanner interfaces.KeyScanner, bytesPerSecond int64) *rebalancer {
+	if bytesPerSecond <= 0 {
+		bytesPerSecond = defaultRebalanceBytesPerSecond
+	}
+	return &rebalancer{
+		c:       c,
+		scanner: scanner,
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond)),
+		Delay:   defaultRebalanceDelay,
+		trigger: make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+}
+
+func (r *rebalancer) Start() {
+	go r.run()
+}
+
+func (r *rebalancer) Stop() {
+	close(r.quit)
+}
+
+// PeersChanged schedules a rebalance. It never blocks; if a rebalance is
+// already scheduled, this is a no-op.
+func (r *rebalancer) PeersChanged() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (r *rebalancer) peersChangedSinceScanStarted() bool {
+	return len(r.trigger) > 0
+}
+
+func (r *rebalancer) run() {
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-r.trigger:
+		}
+
+		// Wait until the peer set has settled.
+		settled := false
+		for !settled {
+			select {
+			case <-r.quit:
+				return
+			case <-r.trigger:
+			case <-time.After(r.Delay):
+				settled = true
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-r.quit:
+				cancel()
+			case <-done:
+			}
+		}()
+		if err := r.rebalance(ctx); err != nil && err != errPeersChanged {
+			log.Printf("Distributed cache %q: error rebalancing: %s", r.c.myAddr, err)
+		}
+		close(done)
+		cancel()
+	}
+}
+
+func (r *rebalancer) rebalance(ctx context.Context) error {
+	start := time.Now()
+	log.Printf("Distributed cache %q: rebalancing local cache", r.c.myAddr)
+	metrics.DistributedCacheRebalanceInProgress.Set(1)
+	defer metrics.DistributedCacheRebalanceInProgress.Set(0)
+
+	err := r.scanner.ScanKeys(ctx, func(key string, sizeBytes int64) error {
+		if r.peersChangedSinceScanStarted() {
+			// The run loop will start a new pass using the new peer
+			// set, so don't bother finishing this one.
+			return errPeersChanged
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		metrics.DistributedCacheRebalanceScannedKeys.Inc()
+		if err := r.rebalanceKey(ctx, key, sizeBytes); err != nil {
+			metrics.DistributedCacheRebalanceErrorCount.Inc()
+			log.Printf("Distributed cache %q: error rebalancing %q: %s", r.c.myAddr, key, err)
+		}
+		return nil
+	})
+	if err == nil {
+		log.Printf("Distributed cache %q: finished rebalancing in %s", r.c.myAddr, time.Since(start))
+	}
+	return err
+}
+
+func (r *rebalancer) rebalanceKey(ctx context.Context, key string, sizeBytes int64) error {
+	userPrefix, cachePrefix, hash, err := prefix.ParseCacheKey(key)
+	if err != nil {
+		return err
+	}
+	d := &repb.Digest{
+		Hash:      hash,
+		SizeBytes: sizeBytes,
+	}
+	ctx = cacheproxy.WithPeerUserPrefix(ctx, userPrefix)
+	local := r.c.local.WithPrefix(cachePrefix)
+
+	stillOwner := false
+	for _, peer := range r.c.peers(d) {
+		if r.c.peerDiscovery.IsSelf(peer) {
+			stillOwner = true
+			continue
+		}
+		exists, err := r.c.cacheProxy.RemoteContains(ctx, peer, cachePrefix, d)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if err := r.copyToPeer(ctx, local, peer, cachePrefix, d); err != nil {
+			return err
+		}
+	}
+	if stillOwner {
+		return nil
+	}
+	return local.Delete(ctx, d)
+}
+
+func (r *rebalancer) copyToPeer(ctx context.Context, local cacheReader, peer, cachePrefix string, d *repb.Digest) error {
+	reader, err := local.Reader(ctx, d, 0)
+	if err != nil {
+		return err
+	}
+	wc, err := r.c.cacheProxy.RemoteWriter(ctx, peer, cachePrefix, d)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(wc, &throttledReader{ctx: ctx, r: reader, limiter: r.limiter})
+	if err != nil {
+		wc.Close()
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	metrics.DistributedCacheRebalanceMovedKeys.Inc()
+	metrics.DistributedCacheRebalanceMovedBytes.Add(float64(n))
+	return nil
+}
+
+type cacheReader interface {
+	Reader(ctx context.Context, d *repb.Digest, offset int64) (io.Reader, error)
+}
+
+// throttledReader limits the rate at which data can be read from the wrapped
+// reader.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if burst := t.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.limiter.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
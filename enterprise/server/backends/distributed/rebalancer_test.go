@@ -0,0 +1,103 @@
+package distributed
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/app"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/pubsub"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	testauth "github.com/buildbuddy-io/buildbuddy/server/testutil/auth"
+	testdigest "github.com/buildbuddy-io/buildbuddy/server/testutil/digest"
+	testenv "github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+)
+
+func waitForPeers(t *testing.T, c *Cache, numPeers int) {
+	// Ask for more replicas than needed so we can count how many peers
+	// are in the ring.
+	for i := 0; i < 100; i++ {
+		if len(c.consistentHash.GetNReplicas("", numPeers+1)) == numPeers {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %q to see %d peers", c.myAddr, numPeers)
+}
+
+func TestRebalanceMovesKeysToNewOwner(t *testing.T) {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	flags.Set(t, "cache.distributed_cache.peer_secret", "test-peer-secret")
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers()))
+	te.SetPubSub(pubsub.NewTestPubSub())
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	if err != nil {
+		t.Fatalf("error attaching user prefix: %s", err)
+	}
+
+	newCache := func() (*Cache, *memory_cache.MemoryCache) {
+		mc, err := memory_cache.NewMemoryCache(10000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewDistributedCache(te, mc, fmt.Sprintf("localhost:%d", app.FreePort(t)), "testGroup", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, mc
+	}
+
+	// Write everything while the first node is the only owner.
+	cacheA, localA := newCache()
+	defer cacheA.Shutdown()
+	waitForPeers(t, cacheA, 1)
+	digests := make([]*repb.Digest, 0, 50)
+	for i := 0; i < 50; i++ {
+		d, buf := testdigest.NewRandomDigestBuf(t, 100)
+		if err := cacheA.Set(ctx, d, buf); err != nil {
+			t.Fatalf("Error setting %q in cache: %s", d.GetHash(), err)
+		}
+		digests = append(digests, d)
+	}
+
+	// Add a second node, and once both nodes know about each other,
+	// rebalance the first node's data.
+	cacheB, localB := newCache()
+	defer cacheB.Shutdown()
+	waitForPeers(t, cacheA, 2)
+	waitForPeers(t, cacheB, 2)
+	if err := cacheA.rebalancer.rebalance(context.Background()); err != nil {
+		t.Fatalf("Error rebalancing: %s", err)
+	}
+
+	moved := 0
+	for _, d := range digests {
+		owners := make(map[string]bool)
+		for _, peer := range cacheA.peers(d) {
+			owners[peer] = true
+		}
+		inA, err := localA.Contains(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inB, err := localB.Contains(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inA != owners[cacheA.myAddr] || inB != owners[cacheB.myAddr] {
+			t.Errorf("Digest %q is owned by %v (in A: %t, in B: %t)", d.GetHash(), owners, inA, inB)
+		}
+		if inB {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatalf("Expected some digests to be moved to the new node")
+	}
+}
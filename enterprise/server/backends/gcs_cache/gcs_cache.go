@@ -1,6 +1,7 @@
 package gcs_cache
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"io/ioutil"
@@ -13,6 +14,7 @@ import (
 	"cloud.google.com/go/storage"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/autoclose"
 	"github.com/buildbuddy-io/buildbuddy/server/util/cache_metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -25,6 +27,9 @@ import (
 
 const (
 	maxNumRetries = 3
+
+	// Blobs at least this large are written with a resumable upload.
+	resumableUploadThresholdBytes = 8 * 1000 * 1000
 )
 
 var (
@@ -138,6 +143,7 @@ func (g *GCSCache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
 		}
 		return nil, err
 	}
+	defer reader.Close()
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
 	b, err := ioutil.ReadAll(reader)
 	timer.ObserveGet(len(b), err)
@@ -327,7 +333,22 @@ func (g *GCSCache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io
 	if err != nil {
 		return nil, err
 	}
-	reader, err := g.bucketHandle.Object(k).NewReader(ctx)
+	// A range starting at the end of the object is rejected as
+	// unsatisfiable, so there's nothing to fetch once the object is known
+	// to exist.
+	if offset == d.GetSizeBytes() {
+		exists, err := g.Contains(ctx, d)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, status.NotFoundErrorf("Digest '%s/%d' not found in cache", d.GetHash(), d.GetSizeBytes())
+		}
+		return bytes.NewReader(nil), nil
+	}
+	// Only fetch the requested range rather than downloading the whole
+	// object and discarding everything before offset.
+	reader, err := g.bucketHandle.Object(k).NewRangeReader(ctx, offset, -1)
 	if err != nil {
 		if err == storage.ErrObjectNotExist {
 			return nil, status.NotFoundErrorf("Digest '%s/%d' not found in cache", d.GetHash(), d.GetSizeBytes())
@@ -335,7 +356,7 @@ func (g *GCSCache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io
 		return nil, err
 	}
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
-	return timer.NewInstrumentedReader(reader, d.GetSizeBytes()), nil
+	return timer.NewInstrumentedReader(autoclose.NewReader(reader), d.GetSizeBytes()-offset), nil
 }
 
 func isRetryableGCSError(err error) bool {
@@ -378,15 +399,20 @@ func (wc *gcsDedupingWriteCloser) Close() error {
 	return swallowGCSAlreadyExistsError(wc.WriteCloser.Close())
 }
 
+// setChunkSize picks the upload strategy for a blob. Small blobs are
+// buffered whole and sent as a single chunk. Larger blobs use a resumable
+// upload so that only one chunk at a time is held in memory. Either way, a
+// failed chunk is retried without restarting the whole upload; a ChunkSize of
+// 0 would avoid buffering small blobs, but would disable retries.
 func setChunkSize(d *repb.Digest, w *storage.Writer) {
-	switch size := d.GetSizeBytes(); {
-	case size < 8*1000*1000:
-		{
+	if size := d.GetSizeBytes(); size < resumableUploadThresholdBytes {
+		w.ChunkSize = googleapi.MinUploadChunkSize
+		if size > googleapi.MinUploadChunkSize {
 			w.ChunkSize = int(size)
 		}
-	default:
-		w.ChunkSize = googleapi.DefaultUploadChunkSize
+		return
 	}
+	w.ChunkSize = googleapi.DefaultUploadChunkSize
 }
 
 func (g *GCSCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
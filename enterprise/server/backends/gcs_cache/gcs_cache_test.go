@@ -0,0 +1,409 @@
+package gcs_cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cache_archive"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	testdigest "github.com/buildbuddy-io/buildbuddy/server/testutil/digest"
+	testenv "github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+)
+
+const testBucket = "test-bucket"
+
+// fakeGCS implements just enough of the GCS JSON and XML APIs to read and
+// write objects: metadata lookups, ranged media downloads, and multipart and
+// resumable uploads.
+type fakeGCS struct {
+	mu             sync.Mutex
+	objects        map[string][]byte
+	sessions       map[string]*uploadSession
+	uploadTypes    []string
+	bytesServed    int64
+	numChunkWrites int
+}
+
+type uploadSession struct {
+	name      string
+	mustBeNew bool
+	data      []byte
+}
+
+func newFakeGCS() *fakeGCS {
+	return &fakeGCS{
+		objects:  make(map[string][]byte),
+		sessions: make(map[string]*uploadSession),
+	}
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/"+testBucket+"/o"):
+		f.startUpload(w, r)
+	case strings.HasPrefix(r.URL.Path, "/upload-session/"):
+		f.writeChunk(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/storage/v1/b/"+testBucket+"/o/"):
+		f.getAttrs(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/"+testBucket+"/"):
+		f.download(w, r)
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeGCS) getAttrs(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"+testBucket+"/o/")
+	data, ok := f.objects[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"bucket":      testBucket,
+		"name":        name,
+		"size":        strconv.Itoa(len(data)),
+		"timeCreated": time.Now().Format(time.RFC3339),
+	})
+}
+
+func (f *fakeGCS) download(w http.ResponseWriter, r *http.Request) {
+	data, ok := f.objects[strings.TrimPrefix(r.URL.Path, "/"+testBucket+"/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		f.bytesServed += int64(len(data))
+		w.Write(data)
+		return
+	}
+	start, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHeader, "bytes="), "-"))
+	if err != nil || start > len(data) {
+		http.Error(w, "unsupported range "+rangeHeader, http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+	w.WriteHeader(http.StatusPartialContent)
+	f.bytesServed += int64(len(data) - start)
+	w.Write(data[start:])
+}
+
+func (f *fakeGCS) startUpload(w http.ResponseWriter, r *http.Request) {
+	uploadType := r.URL.Query().Get("uploadType")
+	f.uploadTypes = append(f.uploadTypes, uploadType)
+	mustBeNew := r.URL.Query().Get("ifGenerationMatch") == "0"
+
+	switch uploadType {
+	case "multipart":
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		var parts [][]byte
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			b, err := ioutil.ReadAll(p)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			parts = append(parts, b)
+		}
+		if len(parts) != 2 {
+			http.Error(w, "expected metadata and media parts", http.StatusBadRequest)
+			return
+		}
+		f.finishUpload(w, objectName(parts[0]), mustBeNew, parts[1])
+	case "resumable":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := strconv.Itoa(len(f.sessions))
+		f.sessions[id] = &uploadSession{name: objectName(b), mustBeNew: mustBeNew}
+		w.Header().Set("Location", "http://"+r.Host+"/upload-session/"+id)
+	default:
+		http.Error(w, "unsupported upload type "+uploadType, http.StatusBadRequest)
+	}
+}
+
+func (f *fakeGCS) writeChunk(w http.ResponseWriter, r *http.Request) {
+	s, ok := f.sessions[strings.TrimPrefix(r.URL.Path, "/upload-session/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.numChunkWrites++
+	s.data = append(s.data, b...)
+	if strings.HasSuffix(r.Header.Get("Content-Range"), "/*") {
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+		return
+	}
+	f.finishUpload(w, s.name, s.mustBeNew, s.data)
+}
+
+func (f *fakeGCS) finishUpload(w http.ResponseWriter, name string, mustBeNew bool, data []byte) {
+	if _, ok := f.objects[name]; ok && mustBeNew {
+		http.Error(w, "object already exists", http.StatusPreconditionFailed)
+		return
+	}
+	f.objects[name] = data
+	json.NewEncoder(w).Encode(map[string]string{
+		"bucket": testBucket,
+		"name":   name,
+		"size":   strconv.Itoa(len(data)),
+	})
+}
+
+func objectName(metadata []byte) string {
+	obj := struct {
+		Name string `json:"name"`
+	}{}
+	json.Unmarshal(metadata, &obj)
+	return obj.Name
+}
+
+func newTestCache(t *testing.T) (*GCSCache, *fakeGCS) {
+	fake := newFakeGCS()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	// Pointing the client at an emulator makes it use plain HTTP and skip
+	// authentication.
+	host := strings.TrimPrefix(server.URL, "http://")
+	oldHost, hadHost := os.LookupEnv("STORAGE_EMULATOR_HOST")
+	os.Setenv("STORAGE_EMULATOR_HOST", host)
+	t.Cleanup(func() {
+		if hadHost {
+			os.Setenv("STORAGE_EMULATOR_HOST", oldHost)
+		} else {
+			os.Unsetenv("STORAGE_EMULATOR_HOST")
+		}
+	})
+
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(server.URL+"/storage/v1/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &GCSCache{
+		gcsClient:    client,
+		bucketHandle: client.Bucket(testBucket),
+		ttlInDays:    30,
+	}, fake
+}
+
+func getAnonContext(t *testing.T) context.Context {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	if err != nil {
+		t.Fatalf("error attaching user prefix: %s", err)
+	}
+	return ctx
+}
+
+func TestSetAndGet(t *testing.T) {
+	ctx := getAnonContext(t)
+	g, fake := newTestCache(t)
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	if err := g.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	// Writing the same digest again is a no-op.
+	if err := g.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := g.Get(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf) {
+		t.Fatalf("Get returned different data than was set")
+	}
+	if fake.uploadTypes[0] != "multipart" {
+		t.Fatalf("Small blob was uploaded with %q upload, want multipart", fake.uploadTypes[0])
+	}
+
+	missing, _ := testdigest.NewRandomDigestBuf(t, 1000)
+	if _, err := g.Get(ctx, missing); !status.IsNotFoundError(err) {
+		t.Fatalf("Get(missing digest) returned %v, want NotFound", err)
+	}
+}
+
+func TestReaderFetchesOnlyRequestedRange(t *testing.T) {
+	ctx := getAnonContext(t)
+	g, fake := newTestCache(t)
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	if err := g.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{0, 1, 500, 999, 1000} {
+		fake.mu.Lock()
+		fake.bytesServed = 0
+		fake.mu.Unlock()
+
+		r, err := g.Reader(ctx, d, offset)
+		if err != nil {
+			t.Fatalf("Reader(offset=%d) returned error: %s", offset, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, buf[offset:]) {
+			t.Fatalf("Reader(offset=%d) returned %d bytes, want %d", offset, len(got), len(buf)-int(offset))
+		}
+		fake.mu.Lock()
+		served := fake.bytesServed
+		fake.mu.Unlock()
+		if served != int64(len(buf))-offset {
+			t.Fatalf("Reader(offset=%d) downloaded %d bytes, want %d", offset, served, int64(len(buf))-offset)
+		}
+	}
+
+	missing, _ := testdigest.NewRandomDigestBuf(t, 1000)
+	if _, err := g.Reader(ctx, missing, 0); !status.IsNotFoundError(err) {
+		t.Fatalf("Reader(missing digest) returned %v, want NotFound", err)
+	}
+}
+
+func TestWriterUsesResumableUploadForLargeBlobs(t *testing.T) {
+	ctx := getAnonContext(t)
+	for _, tc := range []struct {
+		size       int64
+		uploadType string
+		numChunks  int
+	}{
+		{1000, "multipart", 0},
+		{resumableUploadThresholdBytes + 1, "multipart", 0},
+		// Blobs spanning more than one upload chunk are sent a chunk at a
+		// time.
+		{googleapi.DefaultUploadChunkSize + 1, "resumable", 2},
+	} {
+		g, fake := newTestCache(t)
+		d, buf := testdigest.NewRandomDigestBuf(t, tc.size)
+		w, err := g.Writer(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(buf); i += 64 * 1024 {
+			end := i + 64*1024
+			if end > len(buf) {
+				end = len(buf)
+			}
+			if _, err := w.Write(buf[i:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.uploadTypes) != 1 || fake.uploadTypes[0] != tc.uploadType {
+			t.Fatalf("%d byte blob was uploaded with %v, want a single %q upload", tc.size, fake.uploadTypes, tc.uploadType)
+		}
+		if fake.numChunkWrites != tc.numChunks {
+			t.Fatalf("%d byte blob was uploaded in %d chunks, want %d", tc.size, fake.numChunkWrites, tc.numChunks)
+		}
+		got, err := g.Get(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, buf) {
+			t.Fatalf("Get returned different data than was written")
+		}
+	}
+}
+
+func TestImportArchive(t *testing.T) {
+	ctx := context.Background()
+	src, err := memory_cache.NewMemoryCache(1000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type entry struct {
+		ctx       context.Context
+		namespace func(c interfaces.Cache) interfaces.Cache
+		d         *repb.Digest
+		data      []byte
+	}
+	entries := make([]*entry, 0)
+	for _, userPrefix := range []string{"GR1/", "ANON/"} {
+		for _, ns := range []func(c interfaces.Cache) interfaces.Cache{
+			func(c interfaces.Cache) interfaces.Cache { return namespace.CASCache(c, "") },
+			func(c interfaces.Cache) interfaces.Cache { return namespace.ActionCache(c, "linux") },
+		} {
+			e := &entry{ctx: prefix.AttachExplicitUserPrefixToContext(ctx, userPrefix), namespace: ns}
+			e.d, e.data = testdigest.NewRandomDigestBuf(t, 1000)
+			if err := ns(src).Set(e.ctx, e.d, e.data); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, e)
+		}
+	}
+	archivePath := filepath.Join(t.TempDir(), "cache.tar")
+	if _, err := cache_archive.Export(ctx, src, src, archivePath, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	g, _ := newTestCache(t)
+	stats, err := cache_archive.Import(ctx, g, archivePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != len(entries) || stats.Failed != 0 {
+		t.Fatalf("Import stats: %+v, want %d entries copied", stats, len(entries))
+	}
+	for _, e := range entries {
+		got, err := e.namespace(g).Get(e.ctx, e.d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, e.data) {
+			t.Fatalf("Get returned different data than was imported")
+		}
+	}
+}
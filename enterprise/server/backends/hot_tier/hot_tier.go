@@ -0,0 +1,416 @@
+package hot_tier
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/memcache"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/redis"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/prometheus/client_golang/prometheus"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// Keys in the store are namespaced so they can't collide with blobs
+	// stored by the same backend.
+	negativeKeyPrefix    = "missing/"
+	actionCacheKeyPrefix = "hot-ac/"
+
+	// ActionResults larger than this are not kept in the hot tier.
+	maxActionCacheEntrySizeBytes = 1024 * 1024
+
+	hitEvent  = "hit"
+	missEvent = "miss"
+)
+
+// Store is a fast key-value store shared by all app replicas, such as the
+// memcache and redis caches.
+type Store interface {
+	GetKeys(ctx context.Context, keys []string) (map[string][]byte, error)
+	SetKeys(ctx context.Context, kvs map[string][]byte, ttl time.Duration) error
+	DeleteKeys(ctx context.Context, keys []string) error
+}
+
+type Options struct {
+	// If > 0, digests which the underlying cache reports as missing are
+	// remembered as missing for this long. Writing a digest clears its entry.
+	NegativeCacheTTL time.Duration
+
+	// If > 0, action cache entries which are read from the underlying cache
+	// are kept in the store for this long.
+	ActionCacheTTL time.Duration
+}
+
+// OptionsFromConfig returns the Options set in a backend's hot tier config.
+func OptionsFromConfig(htc *config.HotTierConfig) Options {
+	if htc == nil {
+		return Options{}
+	}
+	return Options{
+		NegativeCacheTTL: time.Duration(htc.NegativeCacheTTLSeconds) * time.Second,
+		ActionCacheTTL:   time.Duration(htc.ActionCacheTTLSeconds) * time.Second,
+	}
+}
+
+// WrapConfiguredCache wraps cache, the durable cache, in the hot tiers that
+// are configured for the redis and memcache backends. The cache is returned
+// as is if neither is.
+func WrapConfiguredCache(env environment.Env, cache interfaces.Cache) (interfaces.Cache, error) {
+	c := env.GetConfigurator()
+	if opts := OptionsFromConfig(c.GetCacheRedisHotTierConfig()); opts.Enabled() {
+		if c.GetCacheRedisTarget() == "" {
+			return nil, status.FailedPreconditionError("The redis hot tier requires a redis_target")
+		}
+		store, err := redis.NewCache(c.GetCacheRedisTarget(), env.GetHealthChecker())
+		if err != nil {
+			return nil, err
+		}
+		cache = NewCache(cache, store, "redis", opts)
+	}
+	if opts := OptionsFromConfig(c.GetCacheMemcacheHotTierConfig()); opts.Enabled() {
+		if len(c.GetCacheMemcacheTargets()) == 0 {
+			return nil, status.FailedPreconditionError("The memcache hot tier requires memcache_targets")
+		}
+		cache = NewCache(cache, memcache.NewCache(c.GetCacheMemcacheTargets()...), "memcache", opts)
+	}
+	return cache, nil
+}
+
+// Enabled returns true if any hot tier features are turned on.
+func (o Options) Enabled() bool {
+	return o.NegativeCacheTTL > 0 || o.ActionCacheTTL > 0
+}
+
+// Cache wraps a cache, answering repeated lookups of missing digests and
+// reads of popular action cache entries from a Store instead.
+//
+// Negative entries are cleared after each write, but a lookup which races
+// with a write may still cache a stale negative result, so NegativeCacheTTL
+// bounds how long a newly written digest may be reported as missing.
+type Cache struct {
+	cache         interfaces.Cache
+	store         Store
+	opts          Options
+	backend       string
+	prefix        string
+	isActionCache bool
+}
+
+// NewCache returns a Cache wrapping cache. backend names the store in
+// metrics (e.g. "redis").
+func NewCache(cache interfaces.Cache, store Store, backend string, opts Options) *Cache {
+	return &Cache{
+		cache:   cache,
+		store:   store,
+		opts:    opts,
+		backend: backend,
+	}
+}
+
+func (c *Cache) WithPrefix(prefix string) interfaces.Cache {
+	newPrefix := filepath.Join(append(filepath.SplitList(c.prefix), prefix)...)
+	if len(newPrefix) > 0 && newPrefix[len(newPrefix)-1] != '/' {
+		newPrefix += "/"
+	}
+	return &Cache{
+		cache:         c.cache.WithPrefix(prefix),
+		store:         c.store,
+		opts:          c.opts,
+		backend:       c.backend,
+		prefix:        newPrefix,
+		isActionCache: prefix == namespace.ACCachePrefix,
+	}
+}
+
+func (c *Cache) key(ctx context.Context, keyPrefix string, d *repb.Digest) (string, error) {
+	hash, err := digest.Validate(d)
+	if err != nil {
+		return "", err
+	}
+	userPrefix, err := prefix.UserPrefixFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return keyPrefix + userPrefix + c.prefix + hash, nil
+}
+
+func (c *Cache) keys(ctx context.Context, keyPrefix string, digests []*repb.Digest) (map[*repb.Digest]string, error) {
+	keys := make(map[*repb.Digest]string, len(digests))
+	for _, d := range digests {
+		k, err := c.key(ctx, keyPrefix, d)
+		if err != nil {
+			return nil, err
+		}
+		keys[d] = k
+	}
+	return keys, nil
+}
+
+func (c *Cache) useNegativeCache() bool {
+	return c.opts.NegativeCacheTTL > 0
+}
+
+func (c *Cache) useActionCache() bool {
+	return c.isActionCache && c.opts.ActionCacheTTL > 0
+}
+
+func (c *Cache) observe(counter *prometheus.CounterVec, event string, n int) {
+	if n == 0 {
+		return
+	}
+	counter.With(prometheus.Labels{
+		metrics.CacheBackendLabel:   c.backend,
+		metrics.CacheEventTypeLabel: event,
+	}).Add(float64(n))
+}
+
+// storeGet looks up the keys in the store. Store errors are logged and treated
+// as misses, since the underlying cache can always answer instead.
+func (c *Cache) storeGet(ctx context.Context, keys map[*repb.Digest]string) map[*repb.Digest][]byte {
+	keyList := make([]string, 0, len(keys))
+	for _, k := range keys {
+		keyList = append(keyList, k)
+	}
+	found, err := c.store.GetKeys(ctx, keyList)
+	if err != nil {
+		log.Printf("Error reading hot tier (%s): %s", c.backend, err)
+		return nil
+	}
+	result := make(map[*repb.Digest][]byte, len(found))
+	for d, k := range keys {
+		if v, ok := found[k]; ok {
+			result[d] = v
+		}
+	}
+	return result
+}
+
+func (c *Cache) storeSet(ctx context.Context, kvs map[string][]byte, ttl time.Duration) {
+	if len(kvs) == 0 {
+		return
+	}
+	if err := c.store.SetKeys(ctx, kvs, ttl); err != nil {
+		log.Printf("Error writing hot tier (%s): %s", c.backend, err)
+	}
+}
+
+// invalidate clears any negative and action cache entries for the digests.
+// Errors are logged rather than returned, because the digests have already
+// been written to the underlying cache.
+func (c *Cache) invalidate(ctx context.Context, digests ...*repb.Digest) {
+	keys := make([]string, 0, 2*len(digests))
+	for _, d := range digests {
+		for _, keyPrefix := range c.storeKeyPrefixes() {
+			k, err := c.key(ctx, keyPrefix, d)
+			if err != nil {
+				log.Printf("Error invalidating hot tier (%s): %s", c.backend, err)
+				return
+			}
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if err := c.store.DeleteKeys(ctx, keys); err != nil {
+		log.Printf("Error invalidating hot tier (%s): %s", c.backend, err)
+	}
+}
+
+// storeKeyPrefixes returns the prefixes of the store keys this cache may
+// have written.
+func (c *Cache) storeKeyPrefixes() []string {
+	keyPrefixes := make([]string, 0, 2)
+	if c.useNegativeCache() {
+		keyPrefixes = append(keyPrefixes, negativeKeyPrefix)
+	}
+	if c.useActionCache() {
+		keyPrefixes = append(keyPrefixes, actionCacheKeyPrefix)
+	}
+	return keyPrefixes
+}
+
+func (c *Cache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
+	if !c.useNegativeCache() {
+		return c.cache.Contains(ctx, d)
+	}
+	found, err := c.ContainsMulti(ctx, []*repb.Digest{d})
+	if err != nil {
+		return false, err
+	}
+	return found[d], nil
+}
+
+func (c *Cache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
+	if !c.useNegativeCache() {
+		return c.cache.ContainsMulti(ctx, digests)
+	}
+	keys, err := c.keys(ctx, negativeKeyPrefix, digests)
+	if err != nil {
+		return nil, err
+	}
+	knownMissing := c.storeGet(ctx, keys)
+	c.observe(metrics.CacheNegativeLookupCount, hitEvent, len(knownMissing))
+	c.observe(metrics.CacheNegativeLookupCount, missEvent, len(digests)-len(knownMissing))
+
+	result := make(map[*repb.Digest]bool, len(digests))
+	remaining := make([]*repb.Digest, 0, len(digests))
+	for _, d := range digests {
+		if _, ok := knownMissing[d]; ok {
+			result[d] = false
+		} else {
+			remaining = append(remaining, d)
+		}
+	}
+	if len(remaining) == 0 {
+		return result, nil
+	}
+	found, err := c.cache.ContainsMulti(ctx, remaining)
+	if err != nil {
+		return nil, err
+	}
+	missing := make(map[string][]byte)
+	for _, d := range remaining {
+		result[d] = found[d]
+		if !found[d] {
+			missing[keys[d]] = []byte{}
+		}
+	}
+	c.storeSet(ctx, missing, c.opts.NegativeCacheTTL)
+	return result, nil
+}
+
+func (c *Cache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	if !c.useActionCache() {
+		return c.cache.Get(ctx, d)
+	}
+	found, err := c.GetMulti(ctx, []*repb.Digest{d})
+	if err != nil {
+		return nil, err
+	}
+	data, ok := found[d]
+	if !ok {
+		return nil, status.NotFoundErrorf("Digest %q not found in cache", d.GetHash())
+	}
+	return data, nil
+}
+
+func (c *Cache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	if !c.useActionCache() {
+		return c.cache.GetMulti(ctx, digests)
+	}
+	keys, err := c.keys(ctx, actionCacheKeyPrefix, digests)
+	if err != nil {
+		return nil, err
+	}
+	result := c.storeGet(ctx, keys)
+	if result == nil {
+		result = make(map[*repb.Digest][]byte, len(digests))
+	}
+	c.observe(metrics.CacheActionCacheHotTierLookupCount, hitEvent, len(result))
+	c.observe(metrics.CacheActionCacheHotTierLookupCount, missEvent, len(digests)-len(result))
+
+	remaining := make([]*repb.Digest, 0, len(digests))
+	for _, d := range digests {
+		if _, ok := result[d]; !ok {
+			remaining = append(remaining, d)
+		}
+	}
+	if len(remaining) == 0 {
+		return result, nil
+	}
+	found, err := c.cache.GetMulti(ctx, remaining)
+	if err != nil {
+		return nil, err
+	}
+	hot := make(map[string][]byte, len(found))
+	for d, data := range found {
+		result[d] = data
+		if len(data) <= maxActionCacheEntrySizeBytes {
+			hot[keys[d]] = data
+		}
+	}
+	c.storeSet(ctx, hot, c.opts.ActionCacheTTL)
+	return result, nil
+}
+
+func (c *Cache) Set(ctx context.Context, d *repb.Digest, data []byte) error {
+	if err := c.cache.Set(ctx, d, data); err != nil {
+		return err
+	}
+	c.invalidate(ctx, d)
+	return nil
+}
+
+func (c *Cache) SetMulti(ctx context.Context, kvs map[*repb.Digest][]byte) error {
+	if err := c.cache.SetMulti(ctx, kvs); err != nil {
+		return err
+	}
+	digests := make([]*repb.Digest, 0, len(kvs))
+	for d := range kvs {
+		digests = append(digests, d)
+	}
+	c.invalidate(ctx, digests...)
+	return nil
+}
+
+func (c *Cache) Delete(ctx context.Context, d *repb.Digest) error {
+	if err := c.cache.Delete(ctx, d); err != nil {
+		return err
+	}
+	if c.useActionCache() {
+		c.invalidate(ctx, d)
+	}
+	return nil
+}
+
+func (c *Cache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.Reader, error) {
+	if !c.useActionCache() {
+		return c.cache.Reader(ctx, d, offset)
+	}
+	data, err := c.Get(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type invalidateOnClose struct {
+	io.WriteCloser
+	ctx context.Context
+	c   *Cache
+	d   *repb.Digest
+}
+
+func (w *invalidateOnClose) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	w.c.invalidate(w.ctx, w.d)
+	return nil
+}
+
+func (c *Cache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
+	wc, err := c.cache.Writer(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	return &invalidateOnClose{WriteCloser: wc, ctx: ctx, c: c, d: d}, nil
+}
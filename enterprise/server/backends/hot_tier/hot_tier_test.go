@@ -0,0 +1,261 @@
+package hot_tier_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/hot_tier"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/redis"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/healthcheck"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	testdigest "github.com/buildbuddy-io/buildbuddy/server/testutil/digest"
+	testenv "github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+)
+
+// countingCache counts the digests looked up in the wrapped cache.
+type countingCache struct {
+	interfaces.Cache
+	mu      *sync.Mutex
+	lookups *int
+}
+
+func (c *countingCache) count(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.lookups += n
+}
+
+func (c *countingCache) numLookups() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return *c.lookups
+}
+
+func (c *countingCache) WithPrefix(prefix string) interfaces.Cache {
+	return &countingCache{Cache: c.Cache.WithPrefix(prefix), mu: c.mu, lookups: c.lookups}
+}
+
+func (c *countingCache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
+	c.count(len(digests))
+	return c.Cache.ContainsMulti(ctx, digests)
+}
+
+func (c *countingCache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	c.count(len(digests))
+	return c.Cache.GetMulti(ctx, digests)
+}
+
+func newCountingCache(t *testing.T) *countingCache {
+	mc, err := memory_cache.NewMemoryCache(10000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &countingCache{Cache: mc, mu: &sync.Mutex{}, lookups: new(int)}
+}
+
+func getAnonContext(t *testing.T) context.Context {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	if err != nil {
+		t.Fatalf("error attaching user prefix: %s", err)
+	}
+	return ctx
+}
+
+func newStore(t *testing.T, mr *miniredis.Miniredis) hot_tier.Store {
+	store, err := redis.NewCache(mr.Addr(), healthcheck.NewTestingHealthChecker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestNegativeCache(t *testing.T) {
+	ctx := getAnonContext(t)
+	mr := miniredis.RunT(t)
+	durable := newCountingCache(t)
+	c := hot_tier.NewCache(durable, newStore(t, mr), "redis", hot_tier.Options{NegativeCacheTTL: 10 * time.Second})
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 100)
+	for i := 0; i < 3; i++ {
+		found, err := c.ContainsMulti(ctx, []*repb.Digest{d})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found[d] {
+			t.Fatalf("Found digest which was never written")
+		}
+	}
+	if n := durable.numLookups(); n != 1 {
+		t.Fatalf("Durable cache was checked %d times, want 1", n)
+	}
+
+	// Writing the digest clears its negative entry.
+	if err := c.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	found, err := c.Contains(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatalf("Digest not found after it was written")
+	}
+
+	// Negative entries expire.
+	d2, _ := testdigest.NewRandomDigestBuf(t, 100)
+	if _, err := c.Contains(ctx, d2); err != nil {
+		t.Fatal(err)
+	}
+	before := durable.numLookups()
+	mr.FastForward(11 * time.Second)
+	if _, err := c.Contains(ctx, d2); err != nil {
+		t.Fatal(err)
+	}
+	if n := durable.numLookups(); n != before+1 {
+		t.Fatalf("Durable cache was checked %d times after the negative entry expired, want %d", n, before+1)
+	}
+}
+
+func TestNegativeCacheClearedByWriter(t *testing.T) {
+	ctx := getAnonContext(t)
+	mr := miniredis.RunT(t)
+	c := hot_tier.NewCache(newCountingCache(t), newStore(t, mr), "redis", hot_tier.Options{NegativeCacheTTL: time.Minute})
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 100)
+	if found, err := c.Contains(ctx, d); err != nil || found {
+		t.Fatalf("Contains() = %t, %v; want false", found, err)
+	}
+	w, err := c.Writer(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := c.Contains(ctx, d); err != nil || !found {
+		t.Fatalf("Contains() = %t, %v after writing; want true", found, err)
+	}
+}
+
+func TestActionCacheHotTier(t *testing.T) {
+	ctx := getAnonContext(t)
+	mr := miniredis.RunT(t)
+	store := newStore(t, mr)
+	opts := hot_tier.Options{ActionCacheTTL: time.Minute}
+	durable := newCountingCache(t)
+	ac := namespace.ActionCache(hot_tier.NewCache(durable, store, "redis", opts), "")
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 100)
+	if err := ac.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		got, err := ac.Get(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, buf) {
+			t.Fatalf("Get returned different data")
+		}
+	}
+	if n := durable.numLookups(); n != 1 {
+		t.Fatalf("Durable cache was read %d times, want 1", n)
+	}
+
+	// Another app replica (with its own durable cache client) shares the
+	// hot tier.
+	otherReplica := namespace.ActionCache(hot_tier.NewCache(newCountingCache(t), store, "redis", opts), "")
+	got, err := otherReplica.Get(ctx, d)
+	if err != nil {
+		t.Fatalf("Other replica couldn't read hot entry: %s", err)
+	}
+	if !bytes.Equal(got, buf) {
+		t.Fatalf("Other replica read different data")
+	}
+
+	// Overwriting an entry invalidates the hot copy.
+	_, newBuf := testdigest.NewRandomDigestBuf(t, 100)
+	if err := ac.Set(ctx, d, newBuf); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ac.Get(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, newBuf) {
+		t.Fatalf("Get returned stale data after Set")
+	}
+}
+
+func TestCASReadsAreNotHot(t *testing.T) {
+	ctx := getAnonContext(t)
+	mr := miniredis.RunT(t)
+	durable := newCountingCache(t)
+	cas := namespace.CASCache(hot_tier.NewCache(durable, newStore(t, mr), "redis", hot_tier.Options{ActionCacheTTL: time.Minute}), "")
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 100)
+	if err := cas.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cas.GetMulti(ctx, []*repb.Digest{d}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := durable.numLookups(); n != 2 {
+		t.Fatalf("Durable cache was read %d times, want 2", n)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Fatalf("CAS reads wrote keys %v to the hot tier", keys)
+	}
+}
+
+func TestWrapConfiguredCache(t *testing.T) {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	if err != nil {
+		t.Fatalf("error attaching user prefix: %s", err)
+	}
+	durable := newCountingCache(t)
+
+	c, err := hot_tier.WrapConfiguredCache(te, durable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != durable {
+		t.Fatalf("Cache was wrapped without any hot tier configured")
+	}
+
+	mr := miniredis.RunT(t)
+	flags.Set(t, "cache.redis_target", mr.Addr())
+	flags.Set(t, "cache.redis_hot_tier.negative_cache_ttl_seconds", "10")
+	c, err = hot_tier.WrapConfiguredCache(te, durable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := testdigest.NewRandomDigestBuf(t, 100)
+	for i := 0; i < 2; i++ {
+		if found, err := c.Contains(ctx, d); err != nil || found {
+			t.Fatalf("Contains() = %t, %v; want false", found, err)
+		}
+	}
+	if n := durable.numLookups(); n != 1 {
+		t.Fatalf("Durable cache was checked %d times, want 1", n)
+	}
+}
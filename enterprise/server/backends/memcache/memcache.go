@@ -6,6 +6,7 @@ import (
 	"io"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
@@ -240,12 +241,10 @@ func (c *Cache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.Re
 		return nil, err
 	}
 
+	// The stored value may be larger than the digest says, for example if
+	// it is encrypted, so it is returned in full.
 	r := bytes.NewReader(buf)
 	r.Seek(offset, 0)
-	length := d.GetSizeBytes()
-	if length > 0 {
-		return io.LimitReader(r, length), nil
-	}
 	return r, nil
 }
 
@@ -277,6 +276,47 @@ func (c *Cache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, err
 	}, nil
 }
 
+// GetKeys, SetKeys and DeleteKeys operate on raw keys (which must already
+// include any user prefix), so that this cache can be used as a hot tier
+// store.
+
+func (c *Cache) GetKeys(ctx context.Context, keys []string) (map[string][]byte, error) {
+	items, err := c.mc.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]byte, len(items))
+	for k, item := range items {
+		result[k] = item.Value
+	}
+	return result, nil
+}
+
+func (c *Cache) SetKeys(ctx context.Context, kvs map[string][]byte, ttl time.Duration) error {
+	// memcache treats an expiration of 0 as "never expire".
+	expiration := int32(ttl.Seconds())
+	if expiration < 1 {
+		expiration = 1
+	}
+	for k, v := range kvs {
+		item := makeItem(k, v)
+		item.Expiration = expiration
+		if err := c.mc.Set(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cache) DeleteKeys(ctx context.Context, keys []string) error {
+	for _, k := range keys {
+		if err := c.mc.Delete(k); err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *Cache) Start() error {
 	return nil
 }
@@ -3,14 +3,19 @@ package redis
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/cache_metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -20,6 +25,15 @@ import (
 const (
 	mcCutoffSizeBytes = 512000000 - 1        // 512 MB
 	ttl               = 259200 * time.Second // 3 days
+
+	// Blobs larger than this are split into chunks of (at most) this size,
+	// each stored under its own key, so that no single redis value is too
+	// large.
+	defaultChunkSizeBytes = 1024 * 1024 // 1 MB
+
+	// The value stored under a chunked blob's key is a manifest starting
+	// with this string.
+	manifestMagic = "bbchunks1"
 )
 
 var (
@@ -30,25 +44,89 @@ func eligibleForCache(d *repb.Digest) bool {
 	return d.GetSizeBytes() < mcCutoffSizeBytes
 }
 
+// manifest describes a chunked blob. The chunks of a blob are written under
+// keys unique to each write, and the manifest is written last, so readers
+// never see a partially written blob, and concurrent writers of the same blob
+// don't interfere with each other. Chunks which are no longer referenced by a
+// manifest are cleaned up by their TTL.
+type manifest struct {
+	id             string
+	sizeBytes      int64
+	chunkSizeBytes int64
+}
+
+func (m *manifest) String() string {
+	return fmt.Sprintf("%s %s %d %d", manifestMagic, m.id, m.sizeBytes, m.chunkSizeBytes)
+}
+
+func (m *manifest) numChunks() int64 {
+	return (m.sizeBytes + m.chunkSizeBytes - 1) / m.chunkSizeBytes
+}
+
+// chunkLength returns the number of bytes in chunk i.
+func (m *manifest) chunkLength(i int64) int64 {
+	if i == m.numChunks()-1 {
+		return m.sizeBytes - i*m.chunkSizeBytes
+	}
+	return m.chunkSizeBytes
+}
+
+func (m *manifest) chunkKey(key string, i int64) string {
+	return fmt.Sprintf("%s/chunks/%s/%d", key, m.id, i)
+}
+
+// parseManifest returns the manifest stored in val, or nil if val is not a
+// manifest (for example, a large blob written before chunking was
+// supported).
+func parseManifest(val []byte) *manifest {
+	if !bytes.HasPrefix(val, []byte(manifestMagic+" ")) {
+		return nil
+	}
+	fields := strings.Fields(string(val))
+	if len(fields) != 4 {
+		return nil
+	}
+	sizeBytes, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || sizeBytes <= 0 {
+		return nil
+	}
+	chunkSizeBytes, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil || chunkSizeBytes <= 0 {
+		return nil
+	}
+	return &manifest{id: fields[1], sizeBytes: sizeBytes, chunkSizeBytes: chunkSizeBytes}
+}
+
 // Cache is a cache that uses digests as keys instead of strings.
 // Adding a WithPrefix method allows us to separate AC content from CAS
 // content.
 type Cache struct {
-	prefix string
-	rdb    *redis.Client
+	prefix         string
+	rdb            redis.UniversalClient
+	chunkSizeBytes int64
+}
+
+// NewCache returns a cache backed by the redis target, which may be a single
+// server, a Redis Cluster or a set of Sentinels (see
+// redisutil.TargetToOptions). Its health is checked by hc, unless hc is nil.
+func NewCache(redisTarget string, hc interfaces.HealthChecker) (*Cache, error) {
+	rdb, err := redisutil.NewClientFromTarget(redisTarget)
+	if err != nil {
+		return nil, err
+	}
+	c := newCache(rdb)
+	if hc != nil {
+		hc.AddHealthCheck("redis_cache", c)
+	}
+	return c, nil
 }
 
-func NewCache(redisServer string, hc interfaces.HealthChecker) *Cache {
-	c := &Cache{
-		prefix: "",
-		rdb: redis.NewClient(&redis.Options{
-			Addr:     redisServer,
-			Password: "", // no password set
-			DB:       0,  // use default DB
-		}),
+func newCache(rdb redis.UniversalClient) *Cache {
+	return &Cache{
+		prefix:         "",
+		rdb:            rdb,
+		chunkSizeBytes: defaultChunkSizeBytes,
 	}
-	hc.AddHealthCheck("redis_cache", c)
-	return c
 }
 
 func (c *Cache) Check(ctx context.Context) error {
@@ -68,10 +146,15 @@ func (c *Cache) key(ctx context.Context, d *repb.Digest) (string, error) {
 	return userPrefix + c.prefix + hash, nil
 }
 
+// isChunked returns true if the blob with digest d is stored in chunks.
+func (c *Cache) isChunked(d *repb.Digest) bool {
+	return d.GetSizeBytes() > c.chunkSizeBytes
+}
+
 func (c *Cache) rdbGet(ctx context.Context, key string) ([]byte, error) {
-	val, err := c.rdb.Get(ctx, key).Result()
+	val, err := c.rdb.Get(ctx, key).Bytes()
 	if err == nil {
-		return []byte(val), nil
+		return val, nil
 	}
 	if err == redis.Nil {
 		return nil, status.NotFoundErrorf("Key %q not found in cache", key)
@@ -97,6 +180,31 @@ func (c *Cache) rdbMultiExists(ctx context.Context, keys ...string) (map[string]
 	return result, nil
 }
 
+// rdbMultiGet returns the values of all keys which exist. Unlike MGET, this
+// works even if the keys are spread across the nodes of a cluster.
+func (c *Cache) rdbMultiGet(ctx context.Context, keys ...string) (map[string][]byte, error) {
+	pipe := c.rdb.Pipeline()
+	m := make(map[string]*redis.StringCmd, len(keys))
+	for _, k := range keys {
+		m[k] = pipe.Get(ctx, k)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	result := make(map[string][]byte, len(keys))
+	for k, v := range m {
+		val, err := v.Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[k] = val
+	}
+	return result, nil
+}
+
 func (c *Cache) rdbMultiSet(ctx context.Context, setMap map[string][]byte) error {
 	pipe := c.rdb.Pipeline()
 	for k, v := range setMap {
@@ -111,14 +219,89 @@ func (c *Cache) rdbSet(ctx context.Context, key string, data []byte) error {
 	return err
 }
 
+// getChunked returns the manifest of the chunked blob stored under key. If the
+// blob was stored whole, its contents are returned instead.
+func (c *Cache) getChunked(ctx context.Context, key string) (*manifest, []byte, error) {
+	val, err := c.rdbGet(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m := parseManifest(val); m != nil {
+		return m, nil, nil
+	}
+	return nil, val, nil
+}
+
+// getChunks reads and reassembles all of the chunks of a blob.
+func (c *Cache) getChunks(ctx context.Context, key string, m *manifest) ([]byte, error) {
+	chunkKeys := make([]string, 0, m.numChunks())
+	for i := int64(0); i < m.numChunks(); i++ {
+		chunkKeys = append(chunkKeys, m.chunkKey(key, i))
+	}
+	chunks, err := c.rdbMultiGet(ctx, chunkKeys...)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, m.sizeBytes)
+	for i, chunkKey := range chunkKeys {
+		chunk, ok := chunks[chunkKey]
+		if !ok || int64(len(chunk)) != m.chunkLength(int64(i)) {
+			return nil, status.NotFoundErrorf("Chunk %d of key %q not found in cache", i, key)
+		}
+		buf = append(buf, chunk...)
+	}
+	return buf, nil
+}
+
+// resolve returns the contents of the blob whose key has the value val.
+func (c *Cache) resolve(ctx context.Context, d *repb.Digest, key string, val []byte) ([]byte, error) {
+	if !c.isChunked(d) {
+		return val, nil
+	}
+	m := parseManifest(val)
+	if m == nil {
+		return val, nil
+	}
+	return c.getChunks(ctx, key, m)
+}
+
+// containsChunked refreshes the TTL of a chunked blob and all of its chunks,
+// returning false if any of them are missing.
+func (c *Cache) containsChunked(ctx context.Context, key string) (bool, error) {
+	m, _, err := c.getChunked(ctx, key)
+	if status.IsNotFoundError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	keys := []string{key}
+	if m != nil {
+		for i := int64(0); i < m.numChunks(); i++ {
+			keys = append(keys, m.chunkKey(key, i))
+		}
+	}
+	exists, err := c.rdbMultiExists(ctx, keys...)
+	if err != nil {
+		return false, err
+	}
+	for _, found := range exists {
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
 func (c *Cache) WithPrefix(prefix string) interfaces.Cache {
 	newPrefix := filepath.Join(append(filepath.SplitList(c.prefix), prefix)...)
 	if len(newPrefix) > 0 && newPrefix[len(newPrefix)-1] != '/' {
 		newPrefix += "/"
 	}
 	return &Cache{
-		prefix: newPrefix,
-		rdb:    c.rdb,
+		prefix:         newPrefix,
+		rdb:            c.rdb,
+		chunkSizeBytes: c.chunkSizeBytes,
 	}
 }
 
@@ -128,7 +311,12 @@ func (c *Cache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
 		return false, err
 	}
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
-	found, err := c.rdb.Expire(ctx, key, ttl).Result()
+	var found bool
+	if c.isChunked(d) {
+		found, err = c.containsChunked(ctx, key)
+	} else {
+		found, err = c.rdb.Expire(ctx, key, ttl).Result()
+	}
 	timer.ObserveContains(err)
 	return found, err
 }
@@ -156,6 +344,16 @@ func (c *Cache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[
 		return nil, err
 	}
 
+	// Chunked blobs are only present if all of their chunks are.
+	for k, found := range mcMap {
+		if !found || !c.isChunked(digestsByKey[k]) {
+			continue
+		}
+		if mcMap[k], err = c.containsChunked(ctx, k); err != nil {
+			return nil, err
+		}
+	}
+
 	// Assemble results.
 	response := make(map[*repb.Digest]bool, len(keys))
 	for _, k := range keys {
@@ -177,6 +375,9 @@ func (c *Cache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
 
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
 	b, err := c.rdbGet(ctx, k)
+	if err == nil {
+		b, err = c.resolve(ctx, d, k, b)
+	}
 	timer.ObserveGet(len(b), err)
 	return b, err
 }
@@ -193,19 +394,23 @@ func (c *Cache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb
 		digestsByKey[k] = d
 	}
 
-	rMap, err := c.rdb.MGet(ctx, keys...).Result()
+	rMap, err := c.rdbMultiGet(ctx, keys...)
 	if err != nil {
 		return nil, err
 	}
 
 	// Assemble results.
 	response := make(map[*repb.Digest][]byte, len(keys))
-	for i, k := range keys {
+	for k, val := range rMap {
 		d := digestsByKey[k]
-		item, ok := (rMap[i]).([]byte)
-		if ok {
-			response[d] = item
+		data, err := c.resolve(ctx, d, k, val)
+		if status.IsNotFoundError(err) {
+			continue
 		}
+		if err != nil {
+			return nil, err
+		}
+		response[d] = data
 	}
 	return response, nil
 }
@@ -220,20 +425,44 @@ func (c *Cache) Set(ctx context.Context, d *repb.Digest, data []byte) error {
 	}
 
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
-	err = c.rdbSet(ctx, k, data)
+	if c.isChunked(d) {
+		err = c.setChunked(ctx, k, data)
+	} else {
+		err = c.rdbSet(ctx, k, data)
+	}
 	timer.ObserveSet(len(data), err)
 	return err
 }
 
+func (c *Cache) setChunked(ctx context.Context, key string, data []byte) error {
+	w, err := c.newChunkedWriter(ctx, key)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.commit()
+}
+
 func (c *Cache) SetMulti(ctx context.Context, kvs map[*repb.Digest][]byte) error {
 	setMap := make(map[string][]byte, len(kvs))
 	for d, v := range kvs {
+		if c.isChunked(d) {
+			if err := c.Set(ctx, d, v); err != nil {
+				return err
+			}
+			continue
+		}
 		k, err := c.key(ctx, d)
 		if err != nil {
 			return err
 		}
 		setMap[k] = v
 	}
+	if len(setMap) == 0 {
+		return nil
+	}
 	return c.rdbMultiSet(ctx, setMap)
 }
 
@@ -243,11 +472,36 @@ func (c *Cache) Delete(ctx context.Context, d *repb.Digest) error {
 		return err
 	}
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
-	err = c.rdb.Del(ctx, k).Err()
+	err = c.delete(ctx, d, k)
 	timer.ObserveDelete(err)
 	return err
 }
 
+func (c *Cache) delete(ctx context.Context, d *repb.Digest, key string) error {
+	if !c.isChunked(d) {
+		return c.rdb.Del(ctx, key).Err()
+	}
+	m, _, err := c.getChunked(ctx, key)
+	if status.IsNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Keys are deleted one at a time because a single DEL can't span
+	// the nodes of a cluster. The manifest is deleted first so that
+	// readers never see a blob with missing chunks.
+	pipe := c.rdb.Pipeline()
+	pipe.Del(ctx, key)
+	if m != nil {
+		for i := int64(0); i < m.numChunks(); i++ {
+			pipe.Del(ctx, m.chunkKey(key, i))
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
 func offsetLimReader(data []byte, offset, length int64) io.Reader {
 	r := bytes.NewReader(data)
 	r.Seek(offset, 0)
@@ -257,6 +511,39 @@ func offsetLimReader(data []byte, offset, length int64) io.Reader {
 	return r
 }
 
+// chunkReader reads a chunked blob starting at an offset, fetching one chunk
+// at a time.
+type chunkReader struct {
+	ctx       context.Context
+	c         *Cache
+	key       string
+	m         *manifest
+	nextChunk int64
+	skip      int64
+	buf       []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.nextChunk >= r.m.numChunks() {
+			return 0, io.EOF
+		}
+		chunk, err := r.c.rdbGet(r.ctx, r.m.chunkKey(r.key, r.nextChunk))
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(chunk)) != r.m.chunkLength(r.nextChunk) {
+			return 0, status.DataLossErrorf("Chunk %d of key %q has the wrong length", r.nextChunk, r.key)
+		}
+		r.buf = chunk[r.skip:]
+		r.skip = 0
+		r.nextChunk++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
 // Low level interface used for seeking and stream-writing.
 func (c *Cache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.Reader, error) {
 	if !eligibleForCache(d) {
@@ -266,19 +553,43 @@ func (c *Cache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.Re
 	if err != nil {
 		return nil, err
 	}
+	if c.isChunked(d) {
+		return c.chunkedReader(ctx, k, offset)
+	}
 	buf, err := c.rdbGet(ctx, k)
 	if err != nil {
 		return nil, err
 	}
 
+	// The stored value may be larger than the digest says, for example if
+	// it is encrypted, so it is returned in full.
 	r := bytes.NewReader(buf)
 	r.Seek(offset, 0)
-	length := d.GetSizeBytes()
-	if length > 0 {
-		return io.LimitReader(r, length), nil
+	timer := cache_metrics.NewCacheTimer(cacheLabels)
+	return timer.NewInstrumentedReader(r, int64(r.Len())), nil
+}
+
+func (c *Cache) chunkedReader(ctx context.Context, key string, offset int64) (io.Reader, error) {
+	m, val, err := c.getChunked(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return offsetLimReader(val, offset, 0), nil
+	}
+	if offset >= m.sizeBytes {
+		return bytes.NewReader(nil), nil
 	}
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
-	return timer.NewInstrumentedReader(r, length), nil
+	r := &chunkReader{
+		ctx:       ctx,
+		c:         c,
+		key:       key,
+		m:         m,
+		nextChunk: offset / m.chunkSizeBytes,
+		skip:      offset % m.chunkSizeBytes,
+	}
+	return timer.NewInstrumentedReader(r, m.sizeBytes-offset), nil
 }
 
 type closeFn func(b *bytes.Buffer) error
@@ -294,6 +605,78 @@ func (d *setOnClose) Close() error {
 	return err
 }
 
+// chunkedWriter writes each chunk of a blob as soon as it's full, and writes
+// the blob's manifest when closed. Once writing a chunk fails, the blob is
+// never committed.
+type chunkedWriter struct {
+	ctx   context.Context
+	c     *Cache
+	key   string
+	m     *manifest
+	buf   bytes.Buffer
+	err   error
+	timer *cache_metrics.CacheTimer
+}
+
+func (c *Cache) newChunkedWriter(ctx context.Context, key string) (*chunkedWriter, error) {
+	id, err := random.RandomString(16)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkedWriter{
+		ctx:   ctx,
+		c:     c,
+		key:   key,
+		m:     &manifest{id: id, chunkSizeBytes: c.chunkSizeBytes},
+		timer: cache_metrics.NewCacheTimer(cacheLabels),
+	}, nil
+}
+
+func (w *chunkedWriter) flushChunk(chunk []byte) error {
+	i := w.m.sizeBytes / w.m.chunkSizeBytes
+	if err := w.c.rdbSet(w.ctx, w.m.chunkKey(w.key, i), chunk); err != nil {
+		return err
+	}
+	w.m.sizeBytes += int64(len(chunk))
+	return nil
+}
+
+// Write buffers all of p, and writes any chunks that are full.
+func (w *chunkedWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf.Write(p)
+	for int64(w.buf.Len()) >= w.m.chunkSizeBytes {
+		if err := w.flushChunk(w.buf.Next(int(w.m.chunkSizeBytes))); err != nil {
+			w.err = err
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// commit writes any remaining data and the manifest, which makes the blob
+// visible to readers.
+func (w *chunkedWriter) commit() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.buf.Len() > 0 {
+		if err := w.flushChunk(w.buf.Bytes()); err != nil {
+			return err
+		}
+		w.buf.Reset()
+	}
+	return w.c.rdbSet(w.ctx, w.key, []byte(w.m.String()))
+}
+
+func (w *chunkedWriter) Close() error {
+	err := w.commit()
+	w.timer.ObserveWrite(w.m.sizeBytes, err)
+	return err
+}
+
 func (c *Cache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
 	if !eligibleForCache(d) {
 		return nil, status.ResourceExhaustedErrorf("Writer: Digest %v too big for redis", d)
@@ -302,6 +685,9 @@ func (c *Cache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, err
 	if err != nil {
 		return nil, err
 	}
+	if c.isChunked(d) {
+		return c.newChunkedWriter(ctx, k)
+	}
 	var buffer bytes.Buffer
 	return &setOnClose{
 		Buffer: &buffer,
@@ -313,6 +699,32 @@ func (c *Cache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, err
 	}, nil
 }
 
+// GetKeys, SetKeys and DeleteKeys operate on raw keys (which must already
+// include any user prefix), so that this cache can be used as a hot tier
+// store.
+
+func (c *Cache) GetKeys(ctx context.Context, keys []string) (map[string][]byte, error) {
+	return c.rdbMultiGet(ctx, keys...)
+}
+
+func (c *Cache) SetKeys(ctx context.Context, kvs map[string][]byte, ttl time.Duration) error {
+	pipe := c.rdb.Pipeline()
+	for k, v := range kvs {
+		pipe.Set(ctx, k, v, ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (c *Cache) DeleteKeys(ctx context.Context, keys []string) error {
+	pipe := c.rdb.Pipeline()
+	for _, k := range keys {
+		pipe.Del(ctx, k)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
 func (c *Cache) Start() error {
 	return nil
 }
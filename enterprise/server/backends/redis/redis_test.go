@@ -0,0 +1,275 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/healthcheck"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	testdigest "github.com/buildbuddy-io/buildbuddy/server/testutil/digest"
+	testenv "github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+)
+
+const testChunkSizeBytes = 100
+
+func getAnonContext(t *testing.T) context.Context {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	if err != nil {
+		t.Fatalf("error attaching user prefix: %s", err)
+	}
+	return ctx
+}
+
+// newTestCaches returns a cache talking to mr as a single server, and
+// another talking to it as a (single node) Redis Cluster.
+func newTestCaches(t *testing.T, mr *miniredis.Miniredis) map[string]*Cache {
+	caches := make(map[string]*Cache)
+	for name, target := range map[string]string{
+		"single":  mr.Addr(),
+		"cluster": "redis-cluster://" + mr.Addr(),
+	} {
+		c, err := NewCache(target, healthcheck.NewTestingHealthChecker())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.chunkSizeBytes = testChunkSizeBytes
+		caches[name] = c
+	}
+	return caches
+}
+
+func TestSetGetAndContains(t *testing.T) {
+	ctx := getAnonContext(t)
+	mr := miniredis.RunT(t)
+	for name, c := range newTestCaches(t, mr) {
+		for _, size := range []int64{1, testChunkSizeBytes, testChunkSizeBytes + 1, 10*testChunkSizeBytes + 7} {
+			d, buf := testdigest.NewRandomDigestBuf(t, size)
+			if err := c.Set(ctx, d, buf); err != nil {
+				t.Fatalf("%s: error setting %d byte digest: %s", name, size, err)
+			}
+			found, err := c.Contains(ctx, d)
+			if err != nil || !found {
+				t.Fatalf("%s: Contains(%d byte digest) = %t, %v; want true", name, size, found, err)
+			}
+			got, err := c.Get(ctx, d)
+			if err != nil {
+				t.Fatalf("%s: error getting %d byte digest: %s", name, size, err)
+			}
+			if !bytes.Equal(got, buf) {
+				t.Fatalf("%s: Get(%d byte digest) returned different data", name, size)
+			}
+		}
+	}
+}
+
+func TestMultiOperations(t *testing.T) {
+	ctx := getAnonContext(t)
+	mr := miniredis.RunT(t)
+	for name, c := range newTestCaches(t, mr) {
+		kvs := make(map[*repb.Digest][]byte)
+		digests := make([]*repb.Digest, 0)
+		for _, size := range []int64{10, 50, 250, 1000} {
+			d, buf := testdigest.NewRandomDigestBuf(t, size)
+			kvs[d] = buf
+			digests = append(digests, d)
+		}
+		if err := c.SetMulti(ctx, kvs); err != nil {
+			t.Fatalf("%s: error in SetMulti: %s", name, err)
+		}
+		missing, _ := testdigest.NewRandomDigestBuf(t, 500)
+		digests = append(digests, missing)
+
+		found, err := c.ContainsMulti(ctx, digests)
+		if err != nil {
+			t.Fatalf("%s: error in ContainsMulti: %s", name, err)
+		}
+		got, err := c.GetMulti(ctx, digests)
+		if err != nil {
+			t.Fatalf("%s: error in GetMulti: %s", name, err)
+		}
+		for d, buf := range kvs {
+			if !found[d] {
+				t.Errorf("%s: ContainsMulti didn't find %q", name, d.GetHash())
+			}
+			if !bytes.Equal(got[d], buf) {
+				t.Errorf("%s: GetMulti returned different data for %q", name, d.GetHash())
+			}
+		}
+		if found[missing] {
+			t.Errorf("%s: ContainsMulti found missing digest", name)
+		}
+		if _, ok := got[missing]; ok {
+			t.Errorf("%s: GetMulti returned missing digest", name)
+		}
+	}
+}
+
+func TestReaderAtOffset(t *testing.T) {
+	ctx := getAnonContext(t)
+	mr := miniredis.RunT(t)
+	c := newTestCaches(t, mr)["single"]
+	d, buf := testdigest.NewRandomDigestBuf(t, 10*testChunkSizeBytes+7)
+	if err := c.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{0, 1, testChunkSizeBytes - 1, testChunkSizeBytes, 5*testChunkSizeBytes + 50, int64(len(buf)) - 1, int64(len(buf))} {
+		r, err := c.Reader(ctx, d, offset)
+		if err != nil {
+			t.Fatalf("Reader(offset=%d) returned error: %s", offset, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Error reading at offset %d: %s", offset, err)
+		}
+		if !bytes.Equal(got, buf[offset:]) {
+			t.Fatalf("Reader(offset=%d) returned %d bytes, want %d", offset, len(got), len(buf)-int(offset))
+		}
+	}
+
+	// Reading from the last chunk shouldn't need any earlier chunks.
+	for _, key := range mr.Keys() {
+		if strings.HasSuffix(key, "/0") {
+			mr.Del(key)
+		}
+	}
+	r, err := c.Reader(ctx, d, 9*testChunkSizeBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf[9*testChunkSizeBytes:]) {
+		t.Fatalf("Reader returned different data after deleting the first chunk")
+	}
+}
+
+func TestWriterStreamsChunks(t *testing.T) {
+	ctx := getAnonContext(t)
+	mr := miniredis.RunT(t)
+	c := newTestCaches(t, mr)["cluster"]
+	d, buf := testdigest.NewRandomDigestBuf(t, 3*testChunkSizeBytes+1)
+	w, err := c.Writer(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(buf); i += 33 {
+		end := i + 33
+		if end > len(buf) {
+			end = len(buf)
+		}
+		if _, err := w.Write(buf[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The blob isn't visible until the writer is closed.
+	if found, err := c.Contains(ctx, d); err != nil || found {
+		t.Fatalf("Contains() = %t, %v before Close; want false", found, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// One manifest plus four chunks.
+	if keys := mr.Keys(); len(keys) != 5 {
+		t.Fatalf("Got keys %v, want a manifest and 4 chunks", keys)
+	}
+	got, err := c.Get(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf) {
+		t.Fatalf("Get returned different data than was written")
+	}
+}
+
+func TestMissingChunk(t *testing.T) {
+	ctx := getAnonContext(t)
+	mr := miniredis.RunT(t)
+	c := newTestCaches(t, mr)["single"]
+	d, buf := testdigest.NewRandomDigestBuf(t, 3*testChunkSizeBytes)
+	if err := c.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range mr.Keys() {
+		if strings.HasSuffix(key, "/1") {
+			mr.Del(key)
+		}
+	}
+	if found, err := c.Contains(ctx, d); err != nil || found {
+		t.Fatalf("Contains() = %t, %v with a missing chunk; want false", found, err)
+	}
+	if _, err := c.Get(ctx, d); !status.IsNotFoundError(err) {
+		t.Fatalf("Get() returned %v with a missing chunk; want NotFound", err)
+	}
+	got, err := c.GetMulti(ctx, []*repb.Digest{d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("GetMulti() returned a blob with a missing chunk")
+	}
+}
+
+func TestDeleteRemovesChunks(t *testing.T) {
+	ctx := getAnonContext(t)
+	mr := miniredis.RunT(t)
+	c := newTestCaches(t, mr)["single"]
+	d, buf := testdigest.NewRandomDigestBuf(t, 3*testChunkSizeBytes)
+	if err := c.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Fatalf("Keys %v remain after Delete", keys)
+	}
+}
+
+func TestUnchunkedLargeBlob(t *testing.T) {
+	ctx := getAnonContext(t)
+	mr := miniredis.RunT(t)
+	c := newTestCaches(t, mr)["single"]
+	d, buf := testdigest.NewRandomDigestBuf(t, 3*testChunkSizeBytes)
+
+	// Large blobs written before chunking was supported are stored whole.
+	k, err := c.key(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mr.Set(k, string(buf)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Get(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf) {
+		t.Fatalf("Get returned different data")
+	}
+	r, err := c.Reader(ctx, d, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf[10:]) {
+		t.Fatalf("Reader returned different data")
+	}
+	if found, err := c.Contains(ctx, d); err != nil || !found {
+		t.Fatalf("Contains() = %t, %v; want true", found, err)
+	}
+}
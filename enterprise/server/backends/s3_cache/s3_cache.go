@@ -13,15 +13,15 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/autoclose"
 	"github.com/buildbuddy-io/buildbuddy/server/util/cache_metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/s3util"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"golang.org/x/sync/errgroup"
 
@@ -45,16 +45,16 @@ type S3Cache struct {
 func NewS3Cache(awsConfig *config.S3CacheConfig) (*S3Cache, error) {
 	ctx := context.Background()
 
-	var creds *credentials.Credentials
-
-	// See https://docs.aws.amazon.com/sdk-for-go/v1/developer-guide/configuring-sdk.html#specifying-credentials
-	if awsConfig.CredentialsProfile != "" {
-		creds = credentials.NewSharedCredentials("", awsConfig.CredentialsProfile)
-	}
-
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(awsConfig.Region),
-		Credentials: creds,
+	sess, err := s3util.NewSession(&s3util.SessionConfig{
+		Region:                  awsConfig.Region,
+		Endpoint:                awsConfig.Endpoint,
+		ForcePathStyle:          awsConfig.ForcePathStyle,
+		CredentialsProfile:      awsConfig.CredentialsProfile,
+		CredentialsFile:         awsConfig.CredentialsFile,
+		StaticCredentialsID:     awsConfig.StaticCredentialsID,
+		StaticCredentialsSecret: awsConfig.StaticCredentialsSecret,
+		StaticCredentialsToken:  awsConfig.StaticCredentialsToken,
+		CACertFile:              awsConfig.CACertFile,
 	})
 	if err != nil {
 		return nil, err
@@ -205,7 +205,7 @@ func (s3c *S3Cache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
 }
 
 func (s3c *S3Cache) get(ctx context.Context, d *repb.Digest, key string) ([]byte, error) {
-	buff := &aws.WriteAtBuffer{}
+	buff := aws.NewWriteAtBuffer(make([]byte, 0, d.GetSizeBytes()))
 	_, err := s3c.downloader.DownloadWithContext(ctx, buff, &s3.GetObjectInput{
 		Bucket: s3c.bucket,
 		Key:    aws.String(key),
@@ -385,23 +385,45 @@ func (s3c *S3Cache) Reader(ctx context.Context, d *repb.Digest, offset int64) (i
 	if err != nil {
 		return nil, err
 	}
-	// TODO(bduffany): track this as a contains() request, or find a way to
-	// track it as part of the read
-	result, err := s3c.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+	// A range starting at the end of the object is rejected as
+	// unsatisfiable, so there's nothing to fetch once the object is known
+	// to exist.
+	if offset == d.GetSizeBytes() {
+		exists, err := s3c.Contains(ctx, d)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, status.NotFoundErrorf("Digest '%s/%d' not found in cache", d.GetHash(), d.GetSizeBytes())
+		}
+		return bytes.NewReader(nil), nil
+	}
+	input := &s3.GetObjectInput{
 		Bucket: s3c.bucket,
 		Key:    aws.String(k),
-		Range:  aws.String(fmt.Sprintf("%d-", offset)),
-	})
-	if isNotFoundErr(err) {
-		return nil, status.NotFoundErrorf("Digest '%s/%d' not found in cache", d.GetHash(), d.GetSizeBytes())
+	}
+	// Ask S3 for just the bytes past offset. An open-ended range starting
+	// at 0 is the whole object, so skip the header in that case.
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	// TODO(bduffany): track this as a contains() request, or find a way to
+	// track it as part of the read
+	result, err := s3c.s3.GetObjectWithContext(ctx, input)
+	if err != nil {
+		if isNotFoundErr(err) {
+			return nil, status.NotFoundErrorf("Digest '%s/%d' not found in cache", d.GetHash(), d.GetSizeBytes())
+		}
+		return nil, err
 	}
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
-	return timer.NewInstrumentedReader(result.Body, d.GetSizeBytes()), err
+	return timer.NewInstrumentedReader(autoclose.NewReader(result.Body), d.GetSizeBytes()-offset), nil
 }
 
 type waitForUploadWriteCloser struct {
 	io.WriteCloser
 	finishedWrite chan struct{}
+	uploadErr     error // written before finishedWrite is closed
 	timer         *cache_metrics.CacheTimer
 	size          int64
 }
@@ -412,7 +434,7 @@ func (w *waitForUploadWriteCloser) Close() error {
 		return err
 	}
 	<-w.finishedWrite
-	return nil
+	return w.uploadErr
 }
 
 func (s3c *S3Cache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
@@ -433,8 +455,12 @@ func (s3c *S3Cache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser,
 		timer:         timer,
 		size:          d.GetSizeBytes(),
 	}
+	// The uploader reads the pipe one part at a time: blobs smaller than a
+	// part go up in a single PutObject and larger ones as a multipart
+	// upload, so at most a few parts are ever held in memory.
 	go func() {
-		if _, err = s3c.uploader.UploadWithContext(ctx, uploadParams); err != nil {
+		if _, err := s3c.uploader.UploadWithContext(ctx, uploadParams); err != nil {
+			closer.uploadErr = err
 			r.CloseWithError(err)
 		}
 		close(closer.finishedWrite)
@@ -0,0 +1,163 @@
+package s3_cache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+
+	testdigest "github.com/buildbuddy-io/buildbuddy/server/testutil/digest"
+	testenv "github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+	tests3 "github.com/buildbuddy-io/buildbuddy/server/testutil/s3"
+)
+
+const testBucket = "test-bucket"
+
+func newTestCache(t *testing.T) (*S3Cache, *tests3.Server) {
+	server := tests3.Run(t, &tests3.Options{AccessKeyID: "test-id"})
+	s3c, err := NewS3Cache(&config.S3CacheConfig{
+		Region:                  "us-east-1",
+		Bucket:                  testBucket,
+		Endpoint:                server.URL,
+		ForcePathStyle:          true,
+		StaticCredentialsID:     "test-id",
+		StaticCredentialsSecret: "test-secret",
+		TTLDays:                 30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s3c, server
+}
+
+func getAnonContext(t *testing.T) context.Context {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	if err != nil {
+		t.Fatalf("error attaching user prefix: %s", err)
+	}
+	return ctx
+}
+
+func TestSetAndGet(t *testing.T) {
+	ctx := getAnonContext(t)
+	s3c, _ := newTestCache(t)
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	if err := s3c.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s3c.Get(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf) {
+		t.Fatalf("Get returned different data than was set")
+	}
+
+	missing, _ := testdigest.NewRandomDigestBuf(t, 1000)
+	if _, err := s3c.Get(ctx, missing); !status.IsNotFoundError(err) {
+		t.Fatalf("Get(missing digest) returned %v, want NotFound", err)
+	}
+}
+
+func TestReaderFetchesOnlyRequestedRange(t *testing.T) {
+	ctx := getAnonContext(t)
+	s3c, server := newTestCache(t)
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	if err := s3c.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{0, 1, 500, 999, 1000} {
+		server.ResetStats()
+
+		r, err := s3c.Reader(ctx, d, offset)
+		if err != nil {
+			t.Fatalf("Reader(offset=%d) returned error: %s", offset, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, buf[offset:]) {
+			t.Fatalf("Reader(offset=%d) returned %d bytes, want %d", offset, len(got), len(buf)-int(offset))
+		}
+		if served := server.Stats().BytesServed; served != int64(len(buf))-offset {
+			t.Fatalf("Reader(offset=%d) downloaded %d bytes, want %d", offset, served, int64(len(buf))-offset)
+		}
+	}
+
+	missing, _ := testdigest.NewRandomDigestBuf(t, 1000)
+	if _, err := s3c.Reader(ctx, missing, 0); !status.IsNotFoundError(err) {
+		t.Fatalf("Reader(missing digest) returned %v, want NotFound", err)
+	}
+
+	server.SetFailRequests(true)
+	if _, err := s3c.Reader(ctx, d, 0); err == nil {
+		t.Fatalf("Reader returned no error when the server failed")
+	}
+}
+
+func TestWriterUsesMultipartUploadForLargeBlobs(t *testing.T) {
+	ctx := getAnonContext(t)
+	for _, tc := range []struct {
+		size           int64
+		numPutObjects  int
+		numUploadParts int
+	}{
+		{1000, 1, 0},
+		{2*s3manager.MinUploadPartSize + 1, 0, 3},
+	} {
+		s3c, server := newTestCache(t)
+		d, buf := testdigest.NewRandomDigestBuf(t, tc.size)
+		w, err := s3c.Writer(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(buf); i += 64 * 1024 {
+			end := i + 64*1024
+			if end > len(buf) {
+				end = len(buf)
+			}
+			if _, err := w.Write(buf[i:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if stats := server.Stats(); stats.NumPutObjects != tc.numPutObjects || stats.NumUploadParts != tc.numUploadParts {
+			t.Fatalf("%d byte blob was uploaded with %d PutObject and %d UploadPart requests, want %d and %d", tc.size, stats.NumPutObjects, stats.NumUploadParts, tc.numPutObjects, tc.numUploadParts)
+		}
+		got, err := s3c.Get(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, buf) {
+			t.Fatalf("Get returned different data than was written")
+		}
+	}
+}
+
+func TestWriterReturnsUploadError(t *testing.T) {
+	ctx := getAnonContext(t)
+	s3c, server := newTestCache(t)
+	server.SetFailRequests(true)
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	w, err := s3c.Writer(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Fatalf("Close returned no error when the upload failed")
+	}
+}
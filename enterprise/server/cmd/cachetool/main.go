@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/azure_cache"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/gcs_cache"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/hot_tier"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/redis"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/s3_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/cachetool"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/libmain"
+	"github.com/buildbuddy-io/buildbuddy/server/util/crypter"
+	"google.golang.org/api/option"
+)
+
+// The enterprise cachetool can also import entries into the GCS, S3, Azure
+// and redis caches, for example to move from a disk cache to a GCS cache. Those
+// caches can't list their entries, so they can't be exported from.
+func main() {
+	cachetool.Main(getConfiguredCache)
+}
+
+// getConfiguredCache returns the cloud or redis cache configured in
+// configurator, or else the local cache the open-source server would use.
+// Cloud and redis caches are returned without a local cache, and aren't
+// encrypted with c, as only local caches are encrypted. Hot tiers aren't
+// written to, as they only hold copies of the entries in the cache.
+func getConfiguredCache(configurator *config.Configurator, c *crypter.Crypter) (interfaces.Cache, interfaces.Cache, error) {
+	cache, err := getConfiguredRemoteCache(configurator)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cache == nil {
+		return libmain.GetConfiguredCache(configurator, c)
+	}
+	return cache, nil, nil
+}
+
+func getConfiguredRemoteCache(configurator *config.Configurator) (interfaces.Cache, error) {
+	if gcsConfig := configurator.GetCacheGCSConfig(); gcsConfig != nil {
+		opts := make([]option.ClientOption, 0)
+		if gcsConfig.CredentialsFile != "" {
+			opts = append(opts, option.WithCredentialsFile(gcsConfig.CredentialsFile))
+		}
+		return gcs_cache.NewGCSCache(gcsConfig.Bucket, gcsConfig.ProjectID, gcsConfig.TTLDays, opts...)
+	}
+	if s3Config := configurator.GetCacheS3Config(); s3Config != nil {
+		return s3_cache.NewS3Cache(s3Config)
+	}
+	if azureConfig := configurator.GetCacheAzureConfig(); azureConfig != nil {
+		return azure_cache.NewAzureCache(azureConfig)
+	}
+	// A redis target only holds the cache itself if no redis hot tier
+	// stores copies of another cache's entries in it.
+	if target := configurator.GetCacheRedisTarget(); target != "" && !hot_tier.OptionsFromConfig(configurator.GetCacheRedisHotTierConfig()).Enabled() {
+		rc, err := redis.NewCache(target, nil)
+		if err != nil {
+			return nil, err
+		}
+		// Nothing checks the health of the cache while the tool runs, so
+		// make sure redis is reachable before copying anything.
+		if err := rc.Check(context.Background()); err != nil {
+			return nil, err
+		}
+		return rc, nil
+	}
+	return nil, nil
+}
@@ -127,6 +127,16 @@ func (i *InvocationStatService) GetInvocationStat(ctx context.Context, req *inpb
                      SUM(total_download_usec) as total_download_usec,
                      SUM(total_upload_usec) as total_upload_usec,
 
+                     SUM(CASE WHEN wall_time_usec > 0 THEN 1 ELSE 0 END) as build_metrics_count,
+                     SUM(actions_created) as total_actions_created,
+                     SUM(targets_loaded) as total_targets_loaded,
+                     SUM(targets_configured) as total_targets_configured,
+                     SUM(packages_loaded) as total_packages_loaded,
+                     SUM(cpu_time_usec) as total_cpu_time_usec,
+                     SUM(wall_time_usec) as total_wall_time_usec,
+                     SUM(analysis_phase_time_usec) as total_analysis_phase_time_usec,
+                     MAX(used_heap_size_post_build) as max_used_heap_size_post_build,
+
                      MAX(duration_usec) as max_duration_usec,
                      COUNT(DISTINCT user) as user_count,
                      COUNT(DISTINCT host) as host_count,
@@ -2,305 +2,582 @@ package cacheproxy
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
-	"strconv"
-	"strings"
-	"time"
+	"net"
+	"os"
+	"sync"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/rpc/filters"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
-	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 
+	dcpb "github.com/buildbuddy-io/buildbuddy/proto/distributed_cache"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
-	gcodes "google.golang.org/grpc/codes"
-	gstatus "google.golang.org/grpc/status"
 )
 
 const (
-	downloadPath = "/download"
-	uploadPath   = "/upload"
+	// Set instead of a JWT when a peer moves data that was already
+	// authorized when it was first written, for example when rebalancing.
+	// Only trusted if the peer is authenticated.
+	userPrefixHeader = "x-buildbuddy-user-prefix"
 
-	hashParam      = "hash"
-	sizeBytesParam = "size_bytes"
-	prefixParam    = "prefix"
-	offsetParam    = "offset"
+	// Set to the configured peer_secret by peers, to authenticate each other
+	// when mTLS isn't used.
+	peerSecretHeader = "x-buildbuddy-peer-secret"
 
-	jwtHeader = "x-buildbuddy-jwt"
+	// Set in the context of requests from authenticated peers.
+	authenticatedPeerContextKey = "cacheproxy.authenticatedPeer"
+
+	// The maximum number of bytes sent in a single Read or Write message.
+	chunkSizeBytes = 1000000 // 1MB
 )
 
+// CacheProxy serves the wrapped cache to distributed cache peers over gRPC,
+// and provides a client for reading from and writing to those peers.
 type CacheProxy struct {
 	env        environment.Env
 	cache      interfaces.Cache
-	fileServer *http.Server
+	listenAddr string
+	server     *grpc.Server
+
+	// Transport credentials used when dialing peers, or nil if traffic is
+	// not encrypted.
+	clientCreds credentials.TransportCredentials
+
+	// Peers are authenticated by their client certs if mTLS is configured,
+	// or else by the peer secret, if one is configured.
+	mTLS       bool
+	peerSecret string
+
+	mu    sync.Mutex // protects(conns)
+	conns map[string]*grpc.ClientConn
 }
 
-func NewCacheProxy(env environment.Env, c interfaces.Cache, listenAddr string) *CacheProxy {
-	mux := http.NewServeMux()
+// NewCacheProxy creates a proxy which serves "c" to distributed cache peers
+// on listenAddr. If a cert and key are configured in the distributed cache
+// config, all traffic is encrypted with TLS, and if a CA cert is also
+// configured, peers must authenticate each other with certificates signed by
+// that authority (mTLS).
+//
+// Peers may move data that was already authorized on behalf of its owner
+// (see WithPeerUserPrefix) only if they authenticate each other, with mTLS or
+// with the peer secret configured in the distributed cache config.
+func NewCacheProxy(env environment.Env, c interfaces.Cache, listenAddr string) (*CacheProxy, error) {
 	proxy := &CacheProxy{
-		env:   env,
-		cache: c,
+		env:        env,
+		cache:      c,
+		listenAddr: listenAddr,
+		conns:      make(map[string]*grpc.ClientConn, 0),
 	}
-	mux.Handle(downloadPath, proxy)
-	mux.Handle(uploadPath, proxy)
-	proxy.fileServer = &http.Server{
-		Addr:    listenAddr,
-		Handler: http.Handler(mux),
+	grpcOptions := []grpc.ServerOption{
+		filters.GetUnaryInterceptor(env),
+		filters.GetStreamInterceptor(env),
+		grpc.ChainUnaryInterceptor(proxy.authenticatePeerUnaryServerInterceptor),
+		grpc.ChainStreamInterceptor(proxy.authenticatePeerStreamServerInterceptor),
 	}
-	return proxy
+	if dcConfig := env.GetConfigurator().GetDistributedCacheConfig(); dcConfig != nil {
+		if dcConfig.CertFile != "" {
+			serverCreds, clientCreds, err := loadTLSCredentials(dcConfig.CertFile, dcConfig.KeyFile, dcConfig.CACertFile)
+			if err != nil {
+				return nil, err
+			}
+			grpcOptions = append(grpcOptions, grpc.Creds(serverCreds))
+			proxy.clientCreds = clientCreds
+			proxy.mTLS = dcConfig.CACertFile != ""
+		}
+		proxy.peerSecret = dcConfig.PeerSecret
+	}
+	if !proxy.PeersAuthenticated() {
+		log.Printf("Distributed cache %q: peers are not authenticated (neither ca_cert_file nor peer_secret is set), so they can't move data between each other", listenAddr)
+	}
+	proxy.server = grpc.NewServer(grpcOptions...)
+	dcpb.RegisterDistributedCacheServer(proxy.server, proxy)
+	return proxy, nil
 }
 
-func writeErr(err error, w http.ResponseWriter) {
-	http.Error(w, err.Error(), http.StatusInternalServerError)
-	return
+func loadTLSCredentials(certFile, keyFile, caCertFile string) (credentials.TransportCredentials, credentials.TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, status.InvalidArgumentErrorf("Error loading distributed cache cert: %s", err)
+	}
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	clientConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if caCertFile != "" {
+		caCert, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return nil, nil, status.InvalidArgumentErrorf("Error reading distributed cache CA cert: %s", err)
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return nil, nil, status.InvalidArgumentErrorf("No certificates found in distributed cache CA cert %q", caCertFile)
+		}
+		serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		serverConfig.ClientCAs = caPool
+		clientConfig.RootCAs = caPool
+		clientConfig.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(serverConfig), credentials.NewTLS(clientConfig), nil
 }
 
-func readDigest(r *http.Request) (*repb.Digest, error) {
-	hash := r.URL.Query().Get(hashParam)
-	sizeBytes := r.URL.Query().Get(sizeBytesParam)
-	if hash == "" || sizeBytes == "" {
-		return nil, status.InvalidArgumentErrorf("CacheProxy: hash (%q) and size_bytes (%q) params are required.", hash, sizeBytes)
-	}
-	n, err := strconv.ParseInt(sizeBytes, 10, 64)
+// StartListening starts serving the wrapped cache to peers. It returns once
+// the listener has been created.
+func (c *CacheProxy) StartListening() error {
+	lis, err := net.Listen("tcp", c.listenAddr)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &repb.Digest{
-		Hash:      hash,
-		SizeBytes: n,
-	}, nil
+	go func() {
+		c.server.Serve(lis)
+	}()
+	return nil
 }
 
-func readJWT(ctx context.Context, r *http.Request) context.Context {
-	if jwt := r.Header.Get(jwtHeader); jwt != "" {
-		return context.WithValue(ctx, jwtHeader, jwt)
+// Shutdown stops serving the wrapped cache and closes all connections to
+// peers.
+func (c *CacheProxy) Shutdown() {
+	c.server.Stop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for peer, conn := range c.conns {
+		conn.Close()
+		delete(c.conns, peer)
 	}
-	return ctx
 }
 
-func setJWT(ctx context.Context, r *http.Request) {
-	if jwt, ok := ctx.Value(jwtHeader).(string); ok {
-		r.Header.Set(jwtHeader, jwt)
+// WithPeerUserPrefix returns a context that reads and writes data stored under
+// the specified user prefix, both locally and on remote peers, without
+// requiring a JWT. It must only be used for data which was already authorized
+// when it was first written.
+func WithPeerUserPrefix(ctx context.Context, userPrefix string) context.Context {
+	ctx = prefix.AttachExplicitUserPrefixToContext(ctx, userPrefix)
+	return context.WithValue(ctx, userPrefixHeader, userPrefix)
+}
+
+// PeersAuthenticated returns whether peers authenticate each other, and so
+// whether they may move data on behalf of its owner with WithPeerUserPrefix.
+func (c *CacheProxy) PeersAuthenticated() bool {
+	return c.mTLS || c.peerSecret != ""
+}
+
+func (c *CacheProxy) setPeerUserPrefix(ctx context.Context) context.Context {
+	if userPrefix, ok := ctx.Value(userPrefixHeader).(string); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, userPrefixHeader, userPrefix)
+		if c.peerSecret != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, peerSecretHeader, c.peerSecret)
+		}
 	}
+	return ctx
 }
 
-func contains(c context.Context, cache interfaces.Cache, d *repb.Digest, w http.ResponseWriter) {
-	ok, err := cache.Contains(c, d)
-	if err != nil {
-		writeErr(err, w)
-		return
+// isAuthenticatedPeer returns whether the request was sent by another server
+// in this distributed cache group: one presenting a client cert verified by
+// the configured CA, or the configured peer secret.
+func (c *CacheProxy) isAuthenticatedPeer(ctx context.Context) bool {
+	if c.mTLS {
+		if p, ok := peer.FromContext(ctx); ok {
+			if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+				return true
+			}
+		}
 	}
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		return
+	if c.peerSecret != "" {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			for _, secret := range md.Get(peerSecretHeader) {
+				if subtle.ConstantTimeCompare([]byte(secret), []byte(c.peerSecret)) == 1 {
+					return true
+				}
+			}
+		}
 	}
-	w.WriteHeader(200)
+	return false
 }
 
-func reader(c context.Context, cache interfaces.Cache, d *repb.Digest, offset int64, w http.ResponseWriter) {
-	r, err := cache.Reader(c, d, offset)
-	if gstatus.Code(err) == gcodes.NotFound {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		return
-	}
-	if err != nil {
-		writeErr(err, w)
-		return
+func (c *CacheProxy) authenticatePeer(ctx context.Context) context.Context {
+	if c.isAuthenticatedPeer(ctx) {
+		return context.WithValue(ctx, authenticatedPeerContextKey, true)
 	}
-	_, err = io.Copy(w, r)
-	if err != nil {
-		writeErr(err, w)
-		return
+	return ctx
+}
+
+type wrappedServerStreamWithContext struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (w *wrappedServerStreamWithContext) Context() context.Context {
+	return w.ctx
+}
+
+func (c *CacheProxy) authenticatePeerUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(c.authenticatePeer(ctx), req)
+}
+
+func (c *CacheProxy) authenticatePeerStreamServerInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &wrappedServerStreamWithContext{stream, c.authenticatePeer(stream.Context())})
+}
+
+// attachUserPrefix attaches the user prefix sent by the peer to the context,
+// if the peer is authenticated. Otherwise, the prefix is derived from the
+// caller's own credentials, like any other request.
+func (c *CacheProxy) attachUserPrefix(ctx context.Context) (context.Context, error) {
+	if authenticated, ok := ctx.Value(authenticatedPeerContextKey).(bool); ok && authenticated {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if vals := md.Get(userPrefixHeader); len(vals) > 0 && vals[0] != "" {
+				return prefix.AttachExplicitUserPrefixToContext(ctx, vals[0]), nil
+			}
+		}
 	}
+	return prefix.AttachUserPrefixToContext(ctx, c.env)
 }
 
-func writer(c context.Context, cache interfaces.Cache, d *repb.Digest, r *http.Request, w http.ResponseWriter) {
-	wc, err := cache.Writer(c, d)
+func digestKey(d *repb.Digest) string {
+	return fmt.Sprintf("%s/%d", d.GetHash(), d.GetSizeBytes())
+}
+
+func (c *CacheProxy) FindMissing(ctx context.Context, req *dcpb.FindMissingRequest) (*dcpb.FindMissingResponse, error) {
+	ctx, err := c.attachUserPrefix(ctx)
 	if err != nil {
-		writeErr(err, w)
-		return
+		return nil, err
 	}
-	_, err = io.Copy(wc, r.Body)
+	found, err := c.cache.WithPrefix(req.GetPrefix()).ContainsMulti(ctx, req.GetKey())
 	if err != nil {
-		writeErr(err, w)
-		return
+		return nil, err
 	}
-	if err := wc.Close(); err != nil {
-		writeErr(err, w)
-		return
+	rsp := &dcpb.FindMissingResponse{}
+	for _, d := range req.GetKey() {
+		if !found[d] {
+			rsp.Missing = append(rsp.Missing, d)
+		}
 	}
-	w.WriteHeader(200)
+	return rsp, nil
 }
 
-func (c *CacheProxy) Server() *http.Server {
-	return c.fileServer
+func (c *CacheProxy) GetMulti(ctx context.Context, req *dcpb.GetMultiRequest) (*dcpb.GetMultiResponse, error) {
+	ctx, err := c.attachUserPrefix(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cache := c.cache.WithPrefix(req.GetPrefix())
+	rsp := &dcpb.GetMultiResponse{}
+	for _, d := range req.GetKey() {
+		data, err := cache.Get(ctx, d)
+		if status.IsNotFoundError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rsp.KeyValue = append(rsp.KeyValue, &dcpb.KV{Key: d, Value: data})
+	}
+	return rsp, nil
 }
 
-func (c *CacheProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	ctx := readJWT(r.Context(), r)
-	ctx, err := prefix.AttachUserPrefixToContext(ctx, c.env)
+func (c *CacheProxy) Read(req *dcpb.ReadRequest, stream dcpb.DistributedCache_ReadServer) error {
+	ctx, err := c.attachUserPrefix(stream.Context())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
-	d, err := readDigest(r)
+	r, err := c.cache.WithPrefix(req.GetPrefix()).Reader(ctx, req.GetKey(), req.GetOffset())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	cache := c.cache.WithPrefix(r.URL.Query().Get(prefixParam))
-
-	switch r.URL.Path {
-	case downloadPath:
-		{
-			if r.Method == http.MethodHead {
-				contains(ctx, cache, d, w)
-				log.Printf("CacheProxy(%s): /Contains %q took %s", c.fileServer.Addr, d.GetHash(), time.Since(start))
-				return
+		return err
+	}
+	buf := make([]byte, chunkSizeBytes)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := stream.Send(&dcpb.ReadResponse{Data: buf[:n]}); err != nil {
+				return err
 			}
-			if r.Method == http.MethodPost {
-				offset := int64(0)
-				if o := r.URL.Query().Get(offsetParam); o != "" {
-					if n, err := strconv.ParseInt(o, 10, 64); err == nil {
-						offset = n
-					}
-				}
-				reader(ctx, cache, d, offset, w)
-				log.Printf("CacheProxy(%s): /Read %q took %s", c.fileServer.Addr, d.GetHash(), time.Since(start))
-				return
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Write stages the data it receives in a temp file, and only writes it to the
+// wrapped cache once finish_write is received, so that streams which end early
+// never leave a cache writer open, or commit part of a blob.
+func (c *CacheProxy) Write(stream dcpb.DistributedCache_WriteServer) error {
+	ctx, err := c.attachUserPrefix(stream.Context())
+	if err != nil {
+		return err
+	}
+	var cache interfaces.Cache
+	var d *repb.Digest
+	var f *os.File
+	bytesWritten := int64(0)
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return status.DataLossError("Write stream ended before finish_write was set")
+		}
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			cache = c.cache.WithPrefix(req.GetPrefix())
+			d = req.GetKey()
+			f, err = ioutil.TempFile("", "buildbuddy_cacheproxy_*")
+			if err != nil {
+				return err
 			}
-			writeErr(status.InvalidArgumentError("Invalid method (use HEAD or POST)"), w)
+			defer os.Remove(f.Name())
+			defer f.Close()
+		}
+		n, err := f.Write(req.GetData())
+		if err != nil {
+			return err
 		}
-	case uploadPath:
-		{
-			if r.Method == http.MethodPost {
-				writer(ctx, cache, d, r, w)
-				log.Printf("CacheProxy(%s): /Write %q took %s", c.fileServer.Addr, d.GetHash(), time.Since(start))
-				return
+		bytesWritten += int64(n)
+		if req.GetFinishWrite() {
+			if err := writeStagedFile(ctx, cache, d, f); err != nil {
+				return err
 			}
-			writeErr(status.InvalidArgumentError("Invalid method (use POST)"), w)
+			return stream.SendAndClose(&dcpb.WriteResponse{CommittedSize: bytesWritten})
 		}
-	default:
-		writeErr(status.InvalidArgumentErrorf("Invalid path %q", r.URL.Path), w)
 	}
-	_ = start
 }
 
-func (c *CacheProxy) remoteFileURL(peer, action, prefix, hash string, sizeBytes, offset int64) (string, error) {
-	if !strings.HasPrefix(peer, "http") {
-		peer = "http://" + peer
+func writeStagedFile(ctx context.Context, cache interfaces.Cache, d *repb.Digest, f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
 	}
-	base, err := url.Parse(peer)
+	wc, err := cache.Writer(ctx, d)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if _, err := io.Copy(wc, f); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+func (c *CacheProxy) getClient(peer string) (dcpb.DistributedCacheClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.conns[peer]; ok {
+		return dcpb.NewDistributedCacheClient(conn), nil
 	}
-	rel, err := base.Parse(action)
+	dialOptions := []grpc.DialOption{
+		filters.GetUnaryClientInterceptor(),
+		filters.GetStreamClientInterceptor(),
+	}
+	if c.clientCreds != nil {
+		dialOptions = append(dialOptions, grpc.WithTransportCredentials(c.clientCreds))
+	} else {
+		dialOptions = append(dialOptions, grpc.WithInsecure())
+	}
+	conn, err := grpc.Dial(peer, dialOptions...)
 	if err != nil {
-		return "", err
+		return nil, status.UnavailableError(err.Error())
 	}
-	q := rel.Query()
-	q.Set(prefixParam, prefix)
-	q.Set(hashParam, hash)
-	q.Set(sizeBytesParam, strconv.Itoa(int(sizeBytes)))
-	q.Set(offsetParam, strconv.Itoa(int(offset)))
-	rel.RawQuery = q.Encode()
-	return rel.String(), nil
+	c.conns[peer] = conn
+	return dcpb.NewDistributedCacheClient(conn), nil
 }
 
 func (c *CacheProxy) RemoteContains(ctx context.Context, peer, prefix string, d *repb.Digest) (bool, error) {
-	u, err := c.remoteFileURL(peer, downloadPath, prefix, d.GetHash(), d.GetSizeBytes(), 0)
+	missing, err := c.RemoteFindMissing(ctx, peer, prefix, []*repb.Digest{d})
 	if err != nil {
 		return false, err
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	return len(missing) == 0, nil
+}
+
+// RemoteFindMissing returns the subset of digests which are not stored on the
+// specified peer.
+func (c *CacheProxy) RemoteFindMissing(ctx context.Context, peer, prefix string, digests []*repb.Digest) ([]*repb.Digest, error) {
+	client, err := c.getClient(peer)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	setJWT(ctx, req)
-	rsp, err := http.DefaultClient.Do(req)
+	rsp, err := client.FindMissing(c.setPeerUserPrefix(ctx), &dcpb.FindMissingRequest{
+		Prefix: prefix,
+		Key:    digests,
+	})
 	if err != nil {
-		return false, status.UnavailableError(err.Error())
+		return nil, err
+	}
+	// Return the caller's digests rather than the deserialized copies so
+	// that they can be used as map keys.
+	missing := make(map[string]struct{}, len(rsp.GetMissing()))
+	for _, d := range rsp.GetMissing() {
+		missing[digestKey(d)] = struct{}{}
 	}
-	defer rsp.Body.Close()
-	return rsp.StatusCode == 200, nil
+	result := make([]*repb.Digest, 0, len(missing))
+	for _, d := range digests {
+		if _, ok := missing[digestKey(d)]; ok {
+			result = append(result, d)
+		}
+	}
+	return result, nil
 }
 
-// AutoCloser closes the provided ReadCloser upon the
-// first call to Read which returns a non-nil error.
-type AutoCloser struct {
-	io.ReadCloser
+// RemoteGetMulti returns the values stored on the specified peer for each of
+// the provided digests. Digests which are not found are omitted from the
+// result.
+func (c *CacheProxy) RemoteGetMulti(ctx context.Context, peer, prefix string, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	client, err := c.getClient(peer)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := client.GetMulti(c.setPeerUserPrefix(ctx), &dcpb.GetMultiRequest{
+		Prefix: prefix,
+		Key:    digests,
+	})
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(rsp.GetKeyValue()))
+	for _, kv := range rsp.GetKeyValue() {
+		values[digestKey(kv.GetKey())] = kv.GetValue()
+	}
+	result := make(map[*repb.Digest][]byte, len(values))
+	for _, d := range digests {
+		if v, ok := values[digestKey(d)]; ok {
+			result[d] = v
+		}
+	}
+	return result, nil
 }
 
-func (c *AutoCloser) Read(data []byte) (int, error) {
-	n, err := c.ReadCloser.Read(data)
-	if err != nil {
-		defer c.ReadCloser.Close()
+// streamReader reads the data sent in a Read stream. The first response is
+// received eagerly so that errors (like NotFound) are returned before the
+// caller starts reading.
+type streamReader struct {
+	stream dcpb.DistributedCache_ReadClient
+	buf    []byte
+	err    error
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 && r.err == nil {
+		rsp, err := r.stream.Recv()
+		if err != nil {
+			r.err = err
+			break
+		}
+		r.buf = rsp.GetData()
+	}
+	if len(r.buf) > 0 {
+		n := copy(p, r.buf)
+		r.buf = r.buf[n:]
+		return n, nil
 	}
-	return n, err
+	return 0, r.err
 }
 
 func (c *CacheProxy) RemoteReader(ctx context.Context, peer, prefix string, d *repb.Digest, offset int64) (io.Reader, error) {
-	u, err := c.remoteFileURL(peer, downloadPath, prefix, d.GetHash(), d.GetSizeBytes(), offset)
+	client, err := c.getClient(peer)
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	stream, err := client.Read(c.setPeerUserPrefix(ctx), &dcpb.ReadRequest{
+		Prefix: prefix,
+		Key:    d,
+		Offset: offset,
+	})
 	if err != nil {
 		return nil, err
 	}
-	setJWT(ctx, req)
-	rsp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, status.UnavailableError(err.Error())
-	}
-	if rsp.StatusCode == 200 {
-		return &AutoCloser{rsp.Body}, nil
-	} else if rsp.StatusCode == 404 {
-		return nil, status.NotFoundError("File not found (remotely).")
+	r := &streamReader{stream: stream}
+	rsp, err := stream.Recv()
+	if err == io.EOF {
+		r.err = err
+	} else if err != nil {
+		return nil, err
 	} else {
-		return nil, status.UnavailableError("Remote reader unavailable.")
+		r.buf = rsp.GetData()
 	}
+	return r, nil
 }
 
-type PipeGroup struct {
-	io.WriteCloser
-	eg *errgroup.Group
+// streamWriter sends the data written to it in a Write stream. The write is
+// only committed on the peer when Close is called.
+type streamWriter struct {
+	stream      dcpb.DistributedCache_WriteClient
+	prefix      string
+	d           *repb.Digest
+	sentHeaders bool
 }
 
-func (p *PipeGroup) Close() error {
-	if err := p.WriteCloser.Close(); err != nil {
+func (w *streamWriter) send(data []byte, finishWrite bool) error {
+	req := &dcpb.WriteRequest{
+		Data:        data,
+		FinishWrite: finishWrite,
+	}
+	if !w.sentHeaders {
+		req.Prefix = w.prefix
+		req.Key = w.d
+		w.sentHeaders = true
+	}
+	if err := w.stream.Send(req); err != nil {
+		// Send returns io.EOF if the peer has already failed the
+		// stream; the actual error is returned by CloseAndRecv.
+		if err == io.EOF {
+			_, err = w.stream.CloseAndRecv()
+		}
 		return err
 	}
-	return p.eg.Wait()
+	return nil
+}
+
+func (w *streamWriter) Write(data []byte) (int, error) {
+	written := 0
+	for written < len(data) {
+		end := written + chunkSizeBytes
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := w.send(data[written:end], false); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+func (w *streamWriter) Close() error {
+	if err := w.send(nil, true); err != nil {
+		return err
+	}
+	_, err := w.stream.CloseAndRecv()
+	return err
 }
 
 func (c *CacheProxy) RemoteWriter(ctx context.Context, peer, prefix string, d *repb.Digest) (io.WriteCloser, error) {
-	u, err := c.remoteFileURL(peer, uploadPath, prefix, d.GetHash(), d.GetSizeBytes(), 0)
+	client, err := c.getClient(peer)
 	if err != nil {
 		return nil, err
 	}
-	reader, writer := io.Pipe()
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, reader)
+	stream, err := client.Write(c.setPeerUserPrefix(ctx))
 	if err != nil {
-		return nil, status.UnavailableError(err.Error())
+		return nil, err
 	}
-	setJWT(ctx, req)
-	eg, _ := errgroup.WithContext(ctx)
-	eg.Go(func() error {
-		client := &http.Client{}
-		rsp, err := client.Do(req)
-		if err != nil {
-			log.Printf("Error in goroutine running client.Do: %s", err)
-			err = status.UnavailableError(err.Error())
-			reader.CloseWithError(err)
-			return err
-		}
-		return rsp.Body.Close()
-	})
-	return &PipeGroup{writer, eg}, nil
+	return &streamWriter{
+		stream: stream,
+		prefix: prefix,
+		d:      d,
+	}, nil
 }
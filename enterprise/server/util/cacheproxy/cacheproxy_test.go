@@ -3,10 +3,20 @@ package cacheproxy_test
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -16,8 +26,14 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/app"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
+	crand "crypto/rand"
+	dcpb "github.com/buildbuddy-io/buildbuddy/proto/distributed_cache"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	testauth "github.com/buildbuddy-io/buildbuddy/server/testutil/auth"
+	testdigest "github.com/buildbuddy-io/buildbuddy/server/testutil/digest"
 	testenv "github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
 )
 
@@ -74,10 +90,14 @@ func TestReader(t *testing.T) {
 	}
 
 	peer := fmt.Sprintf("localhost:%d", app.FreePort(t))
-	c := cacheproxy.NewCacheProxy(te, te.GetCache(), peer)
-	go func() {
-		c.Server().ListenAndServe()
-	}()
+	c, err := cacheproxy.NewCacheProxy(te, te.GetCache(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartListening(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
 	waitUntilServerIsAlive(peer)
 
 	randomSrc := &randomDataMaker{rand.NewSource(time.Now().Unix())}
@@ -134,10 +154,14 @@ func TestWriter(t *testing.T) {
 	}
 
 	peer := fmt.Sprintf("localhost:%d", app.FreePort(t))
-	c := cacheproxy.NewCacheProxy(te, te.GetCache(), peer)
-	go func() {
-		c.Server().ListenAndServe()
-	}()
+	c, err := cacheproxy.NewCacheProxy(te, te.GetCache(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartListening(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
 	waitUntilServerIsAlive(peer)
 
 	randomSrc := &randomDataMaker{rand.NewSource(time.Now().Unix())}
@@ -201,10 +225,14 @@ func TestContains(t *testing.T) {
 	}
 
 	peer := fmt.Sprintf("localhost:%d", app.FreePort(t))
-	c := cacheproxy.NewCacheProxy(te, te.GetCache(), peer)
-	go func() {
-		c.Server().ListenAndServe()
-	}()
+	c, err := cacheproxy.NewCacheProxy(te, te.GetCache(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartListening(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
 	waitUntilServerIsAlive(peer)
 
 	randomSrc := &randomDataMaker{rand.NewSource(time.Now().Unix())}
@@ -269,10 +297,14 @@ func TestOversizeBlobs(t *testing.T) {
 	}
 
 	peer := fmt.Sprintf("localhost:%d", app.FreePort(t))
-	c := cacheproxy.NewCacheProxy(te, te.GetCache(), peer)
-	go func() {
-		c.Server().ListenAndServe()
-	}()
+	c, err := cacheproxy.NewCacheProxy(te, te.GetCache(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartListening(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
 	waitUntilServerIsAlive(peer)
 
 	randomSrc := &randomDataMaker{rand.NewSource(time.Now().Unix())}
@@ -335,3 +367,292 @@ func TestOversizeBlobs(t *testing.T) {
 		}
 	}
 }
+
+func TestFindMissingAndGetMulti(t *testing.T) {
+	ctx := context.Background()
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := getTestEnv(t, emptyUserMap)
+
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	if err != nil {
+		t.Errorf("error attaching user prefix: %v", err)
+	}
+
+	peer := fmt.Sprintf("localhost:%d", app.FreePort(t))
+	c, err := cacheproxy.NewCacheProxy(te, te.GetCache(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartListening(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	prefix := "prefix/"
+	stored := make(map[*repb.Digest][]byte, 0)
+	all := make([]*repb.Digest, 0)
+	for i := 0; i < 20; i++ {
+		d, buf := testdigest.NewRandomDigestBuf(t, 100)
+		all = append(all, d)
+		if i%2 == 0 {
+			if err := te.GetCache().WithPrefix(prefix).Set(ctx, d, buf); err != nil {
+				t.Fatal(err)
+			}
+			stored[d] = buf
+		}
+	}
+
+	missing, err := c.RemoteFindMissing(ctx, peer, prefix, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != len(all)-len(stored) {
+		t.Fatalf("Expected %d missing digests, got %d", len(all)-len(stored), len(missing))
+	}
+	for _, d := range missing {
+		if _, ok := stored[d]; ok {
+			t.Fatalf("Digest %q was stored but reported missing", d.GetHash())
+		}
+	}
+
+	found, err := c.RemoteGetMulti(ctx, peer, prefix, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(stored) {
+		t.Fatalf("Expected %d digests, got %d", len(stored), len(found))
+	}
+	for d, buf := range stored {
+		if !bytes.Equal(found[d], buf) {
+			t.Fatalf("Digest %q returned wrong contents", d.GetHash())
+		}
+	}
+}
+
+func writePEM(t *testing.T, path, blockType string, b []byte) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: b}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestCerts writes a CA cert, and a cert for localhost signed by that
+// CA, to dir.
+func writeTestCerts(t *testing.T, dir string) (caCertFile, certFile, keyFile string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(crand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caCertFile = filepath.Join(dir, "ca.crt")
+	certFile = filepath.Join(dir, "peer.crt")
+	keyFile = filepath.Join(dir, "peer.key")
+	writePEM(t, caCertFile, "CERTIFICATE", caDER)
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return caCertFile, certFile, keyFile
+}
+
+func TestMTLS(t *testing.T) {
+	ctx := context.Background()
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := getTestEnv(t, emptyUserMap)
+
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	if err != nil {
+		t.Errorf("error attaching user prefix: %v", err)
+	}
+
+	peer := fmt.Sprintf("localhost:%d", app.FreePort(t))
+	dir, err := ioutil.TempDir("/tmp", "cacheproxy_test_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caCertFile, certFile, keyFile := writeTestCerts(t, dir)
+	flags.Set(t, "cache.distributed_cache.listen_addr", peer)
+	flags.Set(t, "cache.distributed_cache.cert_file", certFile)
+	flags.Set(t, "cache.distributed_cache.key_file", keyFile)
+	flags.Set(t, "cache.distributed_cache.ca_cert_file", caCertFile)
+
+	c, err := cacheproxy.NewCacheProxy(te, te.GetCache(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartListening(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	if err := te.GetCache().Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Peers presenting a cert signed by the CA can read.
+	r, err := c.RemoteReader(ctx, peer, "", d, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rbuf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rbuf, buf) {
+		t.Fatalf("Digest %q returned wrong contents", d.GetHash())
+	}
+
+	// Clients that trust the server but don't present a cert are rejected.
+	caPEM, err := ioutil.ReadFile(caCertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPool := x509.NewCertPool()
+	caPool.AppendCertsFromPEM(caPEM)
+	conn, err := grpc.Dial(peer, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: caPool})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = dcpb.NewDistributedCacheClient(conn).FindMissing(ctx, &dcpb.FindMissingRequest{Key: []*repb.Digest{d}})
+	if err == nil {
+		t.Fatal("FindMissing without a client cert should fail")
+	}
+}
+
+func TestPeerUserPrefixRequiresAuthenticatedPeer(t *testing.T) {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	flags.Set(t, "cache.distributed_cache.peer_secret", "test-peer-secret")
+	te := getTestEnv(t, emptyUserMap)
+
+	peer := fmt.Sprintf("localhost:%d", app.FreePort(t))
+	c, err := cacheproxy.NewCacheProxy(te, te.GetCache(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartListening(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	waitUntilServerIsAlive(peer)
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	ownerCtx := prefix.AttachExplicitUserPrefixToContext(context.Background(), "GR123/")
+	if err := te.GetCache().Set(ownerCtx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Peers sending the peer secret can read data under another user prefix.
+	found, err := c.RemoteContains(cacheproxy.WithPeerUserPrefix(context.Background(), "GR123/"), peer, "", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatalf("Digest %q should be found by an authenticated peer", d.GetHash())
+	}
+
+	// Anyone else sending a user prefix gets their own prefix instead.
+	conn, err := grpc.Dial(peer, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-buildbuddy-user-prefix", "GR123/")
+	rsp, err := dcpb.NewDistributedCacheClient(conn).FindMissing(ctx, &dcpb.FindMissingRequest{Key: []*repb.Digest{d}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.GetMissing()) != 1 {
+		t.Fatalf("Digest %q should be missing for an unauthenticated caller", d.GetHash())
+	}
+}
+
+func TestWriteEndingBeforeFinishWriteIsNotCommitted(t *testing.T) {
+	ctx := context.Background()
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := getTestEnv(t, emptyUserMap)
+
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	if err != nil {
+		t.Errorf("error attaching user prefix: %v", err)
+	}
+
+	peer := fmt.Sprintf("localhost:%d", app.FreePort(t))
+	c, err := cacheproxy.NewCacheProxy(te, te.GetCache(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartListening(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	waitUntilServerIsAlive(peer)
+
+	conn, err := grpc.Dial(peer, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	stream, err := dcpb.NewDistributedCacheClient(conn).Write(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&dcpb.WriteRequest{Key: d, Data: buf[:500]}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.CloseAndRecv(); err == nil {
+		t.Fatal("Write without finish_write should fail")
+	}
+
+	found, err := te.GetCache().Contains(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatalf("Digest %q should not be committed", d.GetHash())
+	}
+}
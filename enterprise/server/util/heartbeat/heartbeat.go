@@ -4,9 +4,12 @@ import (
 	"context"
 	"log"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 )
 
 const (
@@ -23,6 +26,37 @@ const (
 
 type PeersUpdateFn func(peerSet ...string)
 
+// PeerWeightsUpdateFn is called with the weight of every peer in the set.
+// A weight of 0 means the peer didn't advertise a weight.
+type PeerWeightsUpdateFn func(peerWeights map[string]int)
+
+// FormatPeer returns the string a peer with the given weight is advertised
+// as: "addr=weight", or just "addr" if weight is 0.
+func FormatPeer(addr string, weight int) string {
+	if weight == 0 {
+		return addr
+	}
+	return addr + "=" + strconv.Itoa(weight)
+}
+
+// ParsePeer parses a string returned by FormatPeer.
+func ParsePeer(peer string) (string, int, error) {
+	i := strings.LastIndex(peer, "=")
+	if i < 0 {
+		return peer, 0, nil
+	}
+	weight, err := strconv.Atoi(peer[i+1:])
+	if err != nil || weight < 0 {
+		return "", 0, status.InvalidArgumentErrorf("Invalid weight in peer %q", peer)
+	}
+	return peer[:i], weight, nil
+}
+
+type peerState struct {
+	lastBeat time.Time
+	weight   int
+}
+
 type HeartbeatChannel struct {
 	// This node will send heartbeats every this often.
 	Period time.Duration
@@ -36,17 +70,35 @@ type HeartbeatChannel struct {
 
 	groupName string
 	myAddr    string
-	peers     map[string]time.Time
+	myWeight  int
+	peers     map[string]peerState
 	ps        interfaces.PubSub
-	updateFn  PeersUpdateFn
+	updateFn  PeerWeightsUpdateFn
 	quit      chan struct{}
 }
 
 func NewHeartbeatChannel(ps interfaces.PubSub, myAddr, groupName string, updateFn PeersUpdateFn) *HeartbeatChannel {
+	return NewWeightedHeartbeatChannel(ps, myAddr, 0, groupName, func(peerWeights map[string]int) {
+		nodes := make([]string, 0, len(peerWeights))
+		for peer := range peerWeights {
+			nodes = append(nodes, peer)
+		}
+		sort.Strings(nodes)
+		updateFn(nodes...)
+	})
+}
+
+// NewWeightedHeartbeatChannel is like NewHeartbeatChannel, but also
+// advertises myWeight (if non-zero) along with myAddr, and reports the
+// weights advertised by all peers. Nodes which don't understand weights will
+// treat a weighted peer as a different address, so weights should only be
+// set once all nodes in the group have been upgraded.
+func NewWeightedHeartbeatChannel(ps interfaces.PubSub, myAddr string, myWeight int, groupName string, updateFn PeerWeightsUpdateFn) *HeartbeatChannel {
 	hac := &HeartbeatChannel{
 		groupName:   groupName,
 		myAddr:      myAddr,
-		peers:       make(map[string]time.Time, 0),
+		myWeight:    myWeight,
+		peers:       make(map[string]peerState, 0),
 		ps:          ps,
 		updateFn:    updateFn,
 		quit:        make(chan struct{}),
@@ -79,7 +131,7 @@ func (c *HeartbeatChannel) StopAdvertising() {
 }
 
 func (c *HeartbeatChannel) sendHeartbeat(ctx context.Context) {
-	err := c.ps.Publish(ctx, c.groupName, c.myAddr)
+	err := c.ps.Publish(ctx, c.groupName, FormatPeer(c.myAddr, c.myWeight))
 	if err != nil {
 		log.Printf("HeartbeatChannel(%s): error publishing: %s", c.groupName, err)
 	}
@@ -87,12 +139,14 @@ func (c *HeartbeatChannel) sendHeartbeat(ctx context.Context) {
 
 func (c *HeartbeatChannel) notifySetChanged() {
 	nodes := make([]string, 0, len(c.peers))
-	for peer, _ := range c.peers {
-		nodes = append(nodes, peer)
+	peerWeights := make(map[string]int, len(c.peers))
+	for peer, state := range c.peers {
+		nodes = append(nodes, FormatPeer(peer, state.weight))
+		peerWeights[peer] = state.weight
 	}
 	sort.Strings(nodes)
 	log.Printf("HeartbeatChannel(%s): peerset changed: %s", c.groupName, nodes)
-	c.updateFn(nodes...)
+	c.updateFn(peerWeights)
 }
 
 func (c *HeartbeatChannel) watchPeers(ctx context.Context) {
@@ -101,16 +155,21 @@ func (c *HeartbeatChannel) watchPeers(ctx context.Context) {
 	pubsubChan := subscriber.Chan()
 	for {
 		select {
-		case peer := <-pubsubChan:
-			_, ok := c.peers[peer]
-			c.peers[peer] = time.Now()
-			if !ok {
+		case msg := <-pubsubChan:
+			peer, weight, err := ParsePeer(msg)
+			if err != nil {
+				log.Printf("HeartbeatChannel(%s): ignoring heartbeat: %s", c.groupName, err)
+				continue
+			}
+			prev, ok := c.peers[peer]
+			c.peers[peer] = peerState{lastBeat: time.Now(), weight: weight}
+			if !ok || prev.weight != weight {
 				c.notifySetChanged()
 			}
 		case <-time.After(c.CheckPeriod):
 			updated := false
-			for peer, lastBeat := range c.peers {
-				if time.Since(lastBeat) > c.Timeout {
+			for peer, state := range c.peers {
+				if time.Since(state.lastBeat) > c.Timeout {
 					delete(c.peers, peer)
 					updated = true
 				}
@@ -0,0 +1,310 @@
+package peerdiscovery
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/heartbeat"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	// Discovery methods which can be set in the distributed cache config.
+	HeartbeatDiscovery = "heartbeat"
+	StaticDiscovery    = "static"
+	DNSDiscovery       = "dns"
+
+	// How often DNS records are re-resolved if no interval is configured.
+	defaultDNSPollInterval = 10 * time.Second
+)
+
+// A PeerDiscovery finds the members of a distributed cache group. Whenever
+// the set of members (or their weights) changes, it calls the
+// PeerWeightsUpdateFn it was created with with the weight of every member. A
+// weight of 0 means the member should get the default weight.
+type PeerDiscovery interface {
+	// Start begins discovering peers (and, if applicable, announcing this
+	// node to them).
+	Start()
+
+	// Stop stops discovering peers.
+	Stop()
+
+	// IsSelf returns whether peer, as it appears in the set of peers, is
+	// this node. It may not be the address this node listens on.
+	IsSelf(peer string) bool
+}
+
+// New returns the PeerDiscovery selected by the distributed cache config.
+// If no method is configured, peers are discovered by sending heartbeats
+// over the environment's PubSub (redis).
+func New(env environment.Env, myAddr, groupName string, updateFn heartbeat.PeerWeightsUpdateFn) (PeerDiscovery, error) {
+	method := HeartbeatDiscovery
+	weight := 0
+	var peers []string
+	dnsName := ""
+	dnsPollIntervalSeconds := 0
+	if dcConfig := env.GetConfigurator().GetDistributedCacheConfig(); dcConfig != nil {
+		if dcConfig.PeerDiscovery != "" {
+			method = dcConfig.PeerDiscovery
+		}
+		weight = dcConfig.Weight
+		peers = dcConfig.Peers
+		dnsName = dcConfig.DNSName
+		dnsPollIntervalSeconds = dcConfig.DNSPollIntervalSeconds
+	}
+	switch method {
+	case HeartbeatDiscovery:
+		if env.GetPubSub() == nil {
+			return nil, status.FailedPreconditionError("Heartbeat peer discovery requires a redis target")
+		}
+		return NewHeartbeatDiscovery(env, myAddr, weight, groupName, updateFn), nil
+	case StaticDiscovery:
+		return NewStaticDiscovery(peers, myAddr, updateFn)
+	case DNSDiscovery:
+		if dnsName == "" {
+			return nil, status.InvalidArgumentError("DNS peer discovery requires a dns_name")
+		}
+		pollInterval := defaultDNSPollInterval
+		if dnsPollIntervalSeconds > 0 {
+			pollInterval = time.Duration(dnsPollIntervalSeconds) * time.Second
+		}
+		return NewDNSDiscovery(dnsName, myAddr, pollInterval, updateFn), nil
+	default:
+		return nil, status.InvalidArgumentErrorf("Unknown peer discovery method %q", method)
+	}
+}
+
+type heartbeatDiscovery struct {
+	hc     *heartbeat.HeartbeatChannel
+	myAddr string
+}
+
+// NewHeartbeatDiscovery returns a PeerDiscovery which announces this node
+// (and its weight), and listens for other nodes, over the environment's
+// PubSub.
+func NewHeartbeatDiscovery(env environment.Env, myAddr string, weight int, groupName string, updateFn heartbeat.PeerWeightsUpdateFn) PeerDiscovery {
+	return &heartbeatDiscovery{
+		hc:     heartbeat.NewWeightedHeartbeatChannel(env.GetPubSub(), myAddr, weight, groupName, updateFn),
+		myAddr: myAddr,
+	}
+}
+
+func (h *heartbeatDiscovery) Start() {
+	h.hc.StartAdvertising()
+}
+
+func (h *heartbeatDiscovery) Stop() {
+	h.hc.StopAdvertising()
+}
+
+func (h *heartbeatDiscovery) IsSelf(peer string) bool {
+	return peer == h.myAddr
+}
+
+type staticDiscovery struct {
+	peers    map[string]int
+	myAddr   string
+	updateFn heartbeat.PeerWeightsUpdateFn
+}
+
+// NewStaticDiscovery returns a PeerDiscovery with a fixed set of peers, each
+// of which may have a weight ("host:port=weight"). This node is always
+// included in the set, even if it's not listed in peers.
+func NewStaticDiscovery(peers []string, myAddr string, updateFn heartbeat.PeerWeightsUpdateFn) (PeerDiscovery, error) {
+	peerWeights := make(map[string]int, len(peers)+1)
+	for _, peer := range peers {
+		addr, weight, err := heartbeat.ParsePeer(peer)
+		if err != nil {
+			return nil, err
+		}
+		peerWeights[addr] = weight
+	}
+	if _, ok := peerWeights[myAddr]; !ok {
+		peerWeights[myAddr] = 0
+	}
+	return &staticDiscovery{
+		peers:    peerWeights,
+		myAddr:   myAddr,
+		updateFn: updateFn,
+	}, nil
+}
+
+func (s *staticDiscovery) Start() {
+	s.updateFn(s.peers)
+}
+
+func (s *staticDiscovery) Stop() {}
+
+func (s *staticDiscovery) IsSelf(peer string) bool {
+	return peer == s.myAddr
+}
+
+type lookupHostFn func(ctx context.Context, host string) ([]string, error)
+type lookupSRVFn func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+
+type dnsDiscovery struct {
+	// How often the DNS name is re-resolved.
+	period time.Duration
+
+	name     string
+	myAddr   string
+	updateFn heartbeat.PeerWeightsUpdateFn
+	quit     chan struct{}
+	peers    []string
+
+	lookupHost lookupHostFn
+	lookupSRV  lookupSRVFn
+	localIPs   map[string]struct{}
+}
+
+// NewDNSDiscovery returns a PeerDiscovery which resolves name every period.
+// If name is in "host:port" format, host is resolved to A/AAAA records and
+// each address (with the given port) is a peer; this works well with
+// Kubernetes headless services. Otherwise, name is resolved to SRV records
+// (for example "_dc._tcp.cache.example.com") and each target is a peer.
+//
+// Resolved addresses are used as-is, so that every node puts the same peers
+// on its ring. This node must be among them: it recognizes itself as the
+// address which is myAddr, or which belongs to this machine and has the same
+// port as myAddr. DNS records don't carry weights, so all peers get the
+// default weight.
+func NewDNSDiscovery(name, myAddr string, period time.Duration, updateFn heartbeat.PeerWeightsUpdateFn) PeerDiscovery {
+	return &dnsDiscovery{
+		period:     period,
+		name:       name,
+		myAddr:     myAddr,
+		updateFn:   updateFn,
+		quit:       make(chan struct{}),
+		lookupHost: net.DefaultResolver.LookupHost,
+		lookupSRV:  net.DefaultResolver.LookupSRV,
+		localIPs:   localIPs(),
+	}
+}
+
+func localIPs() map[string]struct{} {
+	ips := make(map[string]struct{}, 0)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("Error listing interface addresses: %s", err)
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips[ipNet.IP.String()] = struct{}{}
+		}
+	}
+	return ips
+}
+
+func sortedPeers(peerSet map[string]struct{}) []string {
+	peers := make([]string, 0, len(peerSet))
+	for peer := range peerSet {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+func (d *dnsDiscovery) Start() {
+	d.refresh()
+	go func() {
+		for {
+			select {
+			case <-d.quit:
+				return
+			case <-time.After(d.period):
+				d.refresh()
+			}
+		}
+	}()
+}
+
+func (d *dnsDiscovery) Stop() {
+	close(d.quit)
+}
+
+// IsSelf returns true if addr refers to this node.
+func (d *dnsDiscovery) IsSelf(addr string) bool {
+	if addr == d.myAddr {
+		return true
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	_, myPort, err := net.SplitHostPort(d.myAddr)
+	if err != nil || port != myPort {
+		return false
+	}
+	_, ok := d.localIPs[host]
+	return ok
+}
+
+func (d *dnsDiscovery) resolve(ctx context.Context) ([]string, error) {
+	addrs := make([]string, 0)
+	if host, port, err := net.SplitHostPort(d.name); err == nil {
+		ips, err := d.lookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+		return addrs, nil
+	}
+	_, srvs, err := d.lookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+	for _, srv := range srvs {
+		target := strings.TrimSuffix(srv.Target, ".")
+		addrs = append(addrs, net.JoinHostPort(target, strconv.Itoa(int(srv.Port))))
+	}
+	return addrs, nil
+}
+
+func (d *dnsDiscovery) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), d.period)
+	defer cancel()
+	addrs, err := d.resolve(ctx)
+	if err != nil {
+		// Keep the last known set of peers rather than dropping all of
+		// them because of a transient DNS failure.
+		log.Printf("DNSDiscovery(%s): error resolving peers: %s", d.name, err)
+		return
+	}
+	if len(addrs) == 0 {
+		log.Printf("DNSDiscovery(%s): no peers resolved", d.name)
+		return
+	}
+	peerSet := make(map[string]struct{}, len(addrs))
+	listed := false
+	for _, addr := range addrs {
+		peerSet[addr] = struct{}{}
+		listed = listed || d.IsSelf(addr)
+	}
+	// This node may not be listed yet (for example, if it isn't ready), in
+	// which case its peers don't send it anything either.
+	if !listed {
+		log.Printf("DNSDiscovery(%s): %q is not among the resolved peers", d.name, d.myAddr)
+	}
+
+	peers := sortedPeers(peerSet)
+	if strings.Join(peers, ",") == strings.Join(d.peers, ",") {
+		return
+	}
+	d.peers = peers
+	log.Printf("DNSDiscovery(%s): peerset changed: %s", d.name, peers)
+	peerWeights := make(map[string]int, len(peers))
+	for _, peer := range peers {
+		peerWeights[peer] = 0
+	}
+	d.updateFn(peerWeights)
+}
@@ -0,0 +1,143 @@
+package peerdiscovery
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/consistent_hash"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+type peerRecorder struct {
+	mu    sync.Mutex
+	peers []map[string]int
+}
+
+func (r *peerRecorder) update(peerWeights map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers = append(r.peers, peerWeights)
+}
+
+func (r *peerRecorder) updates() []map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]map[string]int{}, r.peers...)
+}
+
+func TestStaticDiscovery(t *testing.T) {
+	r := &peerRecorder{}
+	d, err := NewStaticDiscovery([]string{"10.0.0.2:1991=200", "10.0.0.1:1991"}, "10.0.0.3:1991", r.update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Start()
+	defer d.Stop()
+
+	want := []map[string]int{{"10.0.0.1:1991": 0, "10.0.0.2:1991": 200, "10.0.0.3:1991": 0}}
+	if got := r.updates(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got peer updates %v, want %v", got, want)
+	}
+}
+
+func TestStaticDiscoveryInvalidWeight(t *testing.T) {
+	r := &peerRecorder{}
+	if _, err := NewStaticDiscovery([]string{"10.0.0.1:1991=big"}, "10.0.0.3:1991", r.update); err == nil {
+		t.Fatalf("NewStaticDiscovery succeeded with an invalid weight")
+	}
+}
+
+func newTestDNSDiscovery(name, myAddr string, updateFn func(peerWeights map[string]int)) *dnsDiscovery {
+	d := NewDNSDiscovery(name, myAddr, time.Hour, updateFn).(*dnsDiscovery)
+	d.localIPs = map[string]struct{}{"10.0.0.1": {}}
+	return d
+}
+
+func TestDNSDiscoveryARecords(t *testing.T) {
+	r := &peerRecorder{}
+	d := newTestDNSDiscovery("cache.example.com:1991", "my-host:1991", r.update)
+	ips := []string{"10.0.0.1", "10.0.0.2"}
+	var lookupErr error
+	d.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if host != "cache.example.com" {
+			t.Fatalf("Unexpected lookup of %q", host)
+		}
+		return ips, lookupErr
+	}
+
+	// The local address is kept as it was resolved, but recognized as this
+	// node.
+	d.refresh()
+	if !d.IsSelf("10.0.0.1:1991") || d.IsSelf("10.0.0.2:1991") {
+		t.Fatalf("10.0.0.1:1991 should be the only address recognized as %q", d.myAddr)
+	}
+	// Nothing changed, so no update is sent.
+	d.refresh()
+	// A new peer is added.
+	ips = []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	d.refresh()
+	// Lookup failures keep the last known set of peers.
+	lookupErr = status.UnavailableError("DNS is down")
+	d.refresh()
+
+	want := []map[string]int{
+		{"10.0.0.1:1991": 0, "10.0.0.2:1991": 0},
+		{"10.0.0.1:1991": 0, "10.0.0.2:1991": 0, "10.0.0.3:1991": 0},
+	}
+	if got := r.updates(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got peer updates %v, want %v", got, want)
+	}
+}
+
+func TestDNSDiscoverySRVRecords(t *testing.T) {
+	r := &peerRecorder{}
+	d := newTestDNSDiscovery("_dc._tcp.cache.example.com", "cache-0.cache.example.com:1991", r.update)
+	d.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_dc._tcp.cache.example.com" {
+			t.Fatalf("Unexpected lookup of %q", name)
+		}
+		return "", []*net.SRV{
+			{Target: "cache-1.cache.example.com.", Port: 1991},
+			{Target: "cache-0.cache.example.com.", Port: 1991},
+		}, nil
+	}
+	d.refresh()
+
+	want := []map[string]int{{"cache-0.cache.example.com:1991": 0, "cache-1.cache.example.com:1991": 0}}
+	if got := r.updates(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got peer updates %v, want %v", got, want)
+	}
+}
+
+func TestDNSDiscoveryNodesAgreeOnOwners(t *testing.T) {
+	// Both nodes listen on every interface, so neither address they listen
+	// on is the one their peers reach them at.
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	rings := make([]*consistent_hash.ConsistentHash, 0)
+	for _, localIP := range []string{"10.0.0.1", "10.0.0.2"} {
+		ring := consistent_hash.NewConsistentHash()
+		rings = append(rings, ring)
+		d := NewDNSDiscovery("cache.example.com:1991", "0.0.0.0:1991", time.Hour, ring.SetWeighted).(*dnsDiscovery)
+		d.localIPs = map[string]struct{}{localIP: {}}
+		d.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+			return ips, nil
+		}
+		d.refresh()
+		if !d.IsSelf(net.JoinHostPort(localIP, "1991")) {
+			t.Fatalf("Node at %s doesn't recognize itself", localIP)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		a, b := rings[0].GetNReplicas(key, 2), rings[1].GetNReplicas(key, 2)
+		if !reflect.DeepEqual(a, b) {
+			t.Fatalf("Nodes disagree on the owners of %q: %v and %v", key, a, b)
+		}
+	}
+}
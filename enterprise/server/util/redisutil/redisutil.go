@@ -0,0 +1,65 @@
+package redisutil
+
+import (
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	redis "github.com/go-redis/redis/v8"
+)
+
+const (
+	clusterScheme  = "redis-cluster://"
+	sentinelScheme = "redis-sentinel://"
+)
+
+// TargetToOptions parses a redis target. A target is either "host:port" for a
+// single redis server, "redis-cluster://host1:port,host2:port" for a Redis
+// Cluster (any subset of the cluster's nodes may be listed; the rest are
+// discovered), or "redis-sentinel://mastername@host1:port,host2:port" for a
+// set of Sentinel servers monitoring the master named mastername.
+func TargetToOptions(target string) (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{}
+	addrs := target
+	switch {
+	case strings.HasPrefix(target, clusterScheme):
+		addrs = strings.TrimPrefix(target, clusterScheme)
+	case strings.HasPrefix(target, sentinelScheme):
+		addrs = strings.TrimPrefix(target, sentinelScheme)
+		parts := strings.SplitN(addrs, "@", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, status.InvalidArgumentErrorf("Redis sentinel target %q must be in the form %smastername@host:port", target, sentinelScheme)
+		}
+		opts.MasterName = parts[0]
+		addrs = parts[1]
+	default:
+		if strings.Contains(target, ",") {
+			return nil, status.InvalidArgumentErrorf("Redis target %q lists multiple servers; use %s or %s", target, clusterScheme, sentinelScheme)
+		}
+	}
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			opts.Addrs = append(opts.Addrs, addr)
+		}
+	}
+	if len(opts.Addrs) == 0 {
+		return nil, status.InvalidArgumentErrorf("Redis target %q has no addresses", target)
+	}
+	return opts, nil
+}
+
+// NewClientFromTarget returns a client for the redis target, which may be in
+// any of the forms accepted by TargetToOptions.
+func NewClientFromTarget(target string) (redis.UniversalClient, error) {
+	opts, err := TargetToOptions(target)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(target, clusterScheme) {
+		// NewUniversalClient only returns a cluster client if there are
+		// multiple addresses, but a cluster may be reached through a single
+		// (e.g. load balanced) address.
+		return redis.NewClusterClient(opts.Cluster()), nil
+	}
+	return redis.NewUniversalClient(opts), nil
+}
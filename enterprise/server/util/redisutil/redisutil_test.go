@@ -0,0 +1,39 @@
+package redisutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTargetToOptions(t *testing.T) {
+	tests := []struct {
+		target     string
+		addrs      []string
+		masterName string
+		wantErr    bool
+	}{
+		{"localhost:6379", []string{"localhost:6379"}, "", false},
+		{"redis-cluster://a:6379,b:6379", []string{"a:6379", "b:6379"}, "", false},
+		{"redis-cluster://a:6379", []string{"a:6379"}, "", false},
+		{"redis-sentinel://mymaster@a:26379, b:26379", []string{"a:26379", "b:26379"}, "mymaster", false},
+		{"redis-sentinel://a:26379", nil, "", true},
+		{"a:6379,b:6379", nil, "", true},
+		{"redis-cluster://", nil, "", true},
+	}
+	for _, tc := range tests {
+		opts, err := TargetToOptions(tc.target)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("TargetToOptions(%q) succeeded, expected error", tc.target)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("TargetToOptions(%q) returned error: %s", tc.target, err)
+			continue
+		}
+		if !reflect.DeepEqual(opts.Addrs, tc.addrs) || opts.MasterName != tc.masterName {
+			t.Errorf("TargetToOptions(%q) = (%v, %q), want (%v, %q)", tc.target, opts.Addrs, opts.MasterName, tc.addrs, tc.masterName)
+		}
+	}
+}
@@ -2,28 +2,31 @@ package blobstore
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/azureutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
+	"github.com/buildbuddy-io/buildbuddy/server/util/s3util"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 
 	gstatus "google.golang.org/grpc/status"
@@ -35,10 +38,51 @@ const (
 	diskLabel  = "disk"
 	gcsLabel   = "gcs"
 	awsS3Label = "aws_s3"
+	azureLabel = "azure"
 )
 
-// Returns whatever blobstore is specified in the config.
-func GetConfiguredBlobstore(c *config.Configurator) (interfaces.Blobstore, error) {
+// listBlobNames returns the names of all blobs whose names start with prefix.
+// It's only used for prefixes covering a bounded number of blobs, like those
+// of a single invocation.
+func listBlobNames(ctx context.Context, bs interfaces.Blobstore, prefix string) ([]string, error) {
+	names := make([]string, 0)
+	err := bs.ListBlobs(ctx, prefix, func(name string, modTime time.Time) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// codecBlobstore is a blobstore which compresses blobs it writes with a
+// configurable codec, and optionally encrypts them.
+type codecBlobstore interface {
+	interfaces.Blobstore
+	SetCodec(codec Codec)
+	SetSealer(sealer Sealer)
+}
+
+// Returns whatever blobstore is specified in the config. If sealer is not
+// nil, blobs are encrypted with it once they have been compressed.
+func GetConfiguredBlobstore(c *config.Configurator, sealer Sealer) (interfaces.Blobstore, error) {
+	codec, err := ParseCodec(c.GetStorageCompression())
+	if err != nil {
+		return nil, err
+	}
+	bs, err := getConfiguredBlobstore(c)
+	if err != nil {
+		return nil, err
+	}
+	bs.SetCodec(codec)
+	if sealer != nil {
+		bs.SetSealer(sealer)
+	}
+	return bs, nil
+}
+
+func getConfiguredBlobstore(c *config.Configurator) (codecBlobstore, error) {
 	if c.GetStorageDiskRootDir() != "" {
 		return NewDiskBlobStore(c.GetStorageDiskRootDir())
 	}
@@ -53,6 +97,10 @@ func GetConfiguredBlobstore(c *config.Configurator) (interfaces.Blobstore, error
 	if awsConfig := c.GetStorageAWSS3Config(); awsConfig != nil && awsConfig.Bucket != "" {
 		return NewAwsS3BlobStore(awsConfig)
 	}
+
+	if azureConfig := c.GetStorageAzureConfig(); azureConfig != nil && azureConfig.ContainerName != "" {
+		return NewAzureBlobStore(azureConfig)
+	}
 	return nil, fmt.Errorf("No storage backend configured -- please specify at least one in the config")
 }
 
@@ -75,9 +123,8 @@ func recordWriteMetrics(typeLabel string, startTime time.Time, size int, err err
 	}).Observe(float64(size))
 }
 
-func recordReadMetrics(typeLabel string, startTime time.Time, b []byte, err error) {
+func recordReadMetrics(typeLabel string, startTime time.Time, size int, err error) {
 	duration := time.Since(startTime)
-	size := len(b)
 	metrics.BlobstoreReadCount.With(prometheus.Labels{
 		metrics.StatusLabel:        fmt.Sprintf("%d", gstatus.Code(err)),
 		metrics.BlobstoreTypeLabel: typeLabel,
@@ -111,66 +158,126 @@ func recordDeleteMetrics(typeLabel string, startTime time.Time, err error) {
 	}).Observe(float64(duration.Microseconds()))
 }
 
-// A Disk-based blob storage implementation that reads and writes blobs to/from
-// files.
-type DiskBlobStore struct {
-	rootDir string
+// meteredReader records read metrics for a streamed blob when it is closed.
+type meteredReader struct {
+	io.ReadCloser
+	typeLabel string
+	start     time.Time
+	size      int
+	err       error
 }
 
-func NewDiskBlobStore(rootDir string) (*DiskBlobStore, error) {
-	if err := disk.EnsureDirectoryExists(rootDir); err != nil {
-		return nil, err
-	}
-	return &DiskBlobStore{
-		rootDir: rootDir,
-	}, nil
+func newMeteredReader(typeLabel string, r io.ReadCloser) *meteredReader {
+	return &meteredReader{ReadCloser: r, typeLabel: typeLabel, start: time.Now()}
 }
 
-func decompress(in []byte, err error) ([]byte, error) {
-	if err != nil {
-		return in, err
+func (m *meteredReader) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	m.size += n
+	if err != nil && err != io.EOF {
+		m.err = err
 	}
+	return n, err
+}
 
-	var buf bytes.Buffer
-	// Write instead of using NewBuffer because if this is not a gzip file
-	// we want to return "in" directly later, and NewBuffer would take
-	// ownership of it.
-	if _, err := buf.Write(in); err != nil {
-		return nil, err
-	}
-	zr, err := gzip.NewReader(&buf)
-	if err == gzip.ErrHeader {
-		// Compatibility hack: if we got a header error it means this
-		// is probably an uncompressed record written before we were
-		// compressing. Just read it as-is.
-		return in, nil
-	}
-	if err != nil {
-		log.Printf("zr err: %s", err)
-		return nil, err
-	}
-	rsp, err := ioutil.ReadAll(zr)
+func (m *meteredReader) Close() error {
+	recordReadMetrics(m.typeLabel, m.start, m.size, m.err)
+	return m.ReadCloser.Close()
+}
+
+// meteredWriter records write metrics for a streamed blob when it is
+// closed.
+type meteredWriter struct {
+	io.WriteCloser
+	typeLabel string
+	start     time.Time
+	size      int
+	err       error
+}
+
+func newMeteredWriter(typeLabel string, w io.WriteCloser) *meteredWriter {
+	return &meteredWriter{WriteCloser: w, typeLabel: typeLabel, start: time.Now()}
+}
+
+func (m *meteredWriter) Write(p []byte) (int, error) {
+	n, err := m.WriteCloser.Write(p)
+	m.size += n
 	if err != nil {
-		log.Printf("readall err: %s", err)
-		return nil, err
+		m.err = err
 	}
-	if err := zr.Close(); err != nil {
-		log.Printf("close err: %s", err)
-		return nil, err
+	return n, err
+}
+
+func (m *meteredWriter) Close() error {
+	err := m.WriteCloser.Close()
+	if err == nil {
+		err = m.err
 	}
-	return rsp, nil
+	recordWriteMetrics(m.typeLabel, m.start, m.size, err)
+	return err
 }
 
-func compress(in []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	zr := gzip.NewWriter(&buf)
-	if _, err := zr.Write(in); err != nil {
-		return nil, err
+func (m *meteredWriter) Abort() {
+	abortWriter(m.WriteCloser)
+}
+
+var errUploadAborted = status.AbortedError("Blob upload was aborted")
+
+// pipeUploadWriter streams everything written to it to an upload running
+// in the background. Close waits for the upload to finish and returns its
+// error.
+type pipeUploadWriter struct {
+	*io.PipeWriter
+	done      chan struct{}
+	uploadErr error // written before done is closed
+}
+
+func newPipeUploadWriter(upload func(r io.Reader) error) *pipeUploadWriter {
+	pr, pw := io.Pipe()
+	w := &pipeUploadWriter{
+		PipeWriter: pw,
+		done:       make(chan struct{}),
+	}
+	go func() {
+		w.uploadErr = upload(pr)
+		// If the upload failed before reading everything, unblock the
+		// writer.
+		pr.CloseWithError(w.uploadErr)
+		close(w.done)
+	}()
+	return w
+}
+
+func (w *pipeUploadWriter) Close() error {
+	if err := w.PipeWriter.Close(); err != nil {
+		return err
 	}
-	if err := zr.Close(); err != nil {
+	<-w.done
+	return w.uploadErr
+}
+
+// Abort fails the upload so that the blob isn't stored, and waits for it to
+// finish.
+func (w *pipeUploadWriter) Abort() {
+	w.PipeWriter.CloseWithError(errUploadAborted)
+	<-w.done
+}
+
+// A Disk-based blob storage implementation that reads and writes blobs to/from
+// files.
+type DiskBlobStore struct {
+	blobCodec
+	rootDir string
+}
+
+func NewDiskBlobStore(rootDir string) (*DiskBlobStore, error) {
+	if err := disk.EnsureDirectoryExists(rootDir); err != nil {
 		return nil, err
 	}
-	return ioutil.ReadAll(&buf)
+	return &DiskBlobStore{
+		blobCodec: blobCodec{codec: GzipCodec},
+		rootDir:   rootDir,
+	}, nil
 }
 
 func (d *DiskBlobStore) blobPath(blobName string) (string, error) {
@@ -188,7 +295,7 @@ func (d *DiskBlobStore) WriteBlob(ctx context.Context, blobName string, data []b
 		return 0, err
 	}
 
-	compressedData, err := compress(data)
+	compressedData, err := d.compress(ctx, data)
 	if err != nil {
 		return 0, err
 	}
@@ -205,8 +312,8 @@ func (d *DiskBlobStore) ReadBlob(ctx context.Context, blobName string) ([]byte,
 	}
 	start := time.Now()
 	b, err := disk.ReadFile(ctx, fullPath)
-	recordReadMetrics(diskLabel, start, b, err)
-	return decompress(b, err)
+	recordReadMetrics(diskLabel, start, len(b), err)
+	return d.decompress(ctx, b, err)
 }
 
 func (d *DiskBlobStore) DeleteBlob(ctx context.Context, blobName string) error {
@@ -220,6 +327,35 @@ func (d *DiskBlobStore) DeleteBlob(ctx context.Context, blobName string) error {
 	return err
 }
 
+func (d *DiskBlobStore) BlobReader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	fullPath, err := d.blobPath(blobName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.NotFoundError(err.Error())
+		}
+		return nil, err
+	}
+	return d.newBlobReader(ctx, newMeteredReader(diskLabel, f))
+}
+
+func (d *DiskBlobStore) BlobWriter(ctx context.Context, blobName string) (io.WriteCloser, error) {
+	fullPath, err := d.blobPath(blobName)
+	if err != nil {
+		return nil, err
+	}
+	// The blob is written to a temporary file which is moved into place
+	// when the writer is closed.
+	w, err := disk.FileWriter(ctx, fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return d.newBlobWriter(ctx, newMeteredWriter(diskLabel, w))
+}
+
 func (d *DiskBlobStore) BlobExists(ctx context.Context, blobName string) (bool, error) {
 	fullPath, err := d.blobPath(blobName)
 	if err != nil {
@@ -228,8 +364,60 @@ func (d *DiskBlobStore) BlobExists(ctx context.Context, blobName string) (bool,
 	return disk.FileExists(fullPath)
 }
 
+func (d *DiskBlobStore) ListBlobs(ctx context.Context, prefix string, fn func(name string, modTime time.Time) error) error {
+	// Only walk the directory that the prefix points into.
+	walkRoot, err := d.blobPath(prefix[:strings.LastIndex(prefix, "/")+1])
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(walkRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == walkRoot && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(d.rootDir, path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(relPath); strings.HasPrefix(name, prefix) {
+			return fn(name, info.ModTime())
+		}
+		return nil
+	})
+}
+
+func (d *DiskBlobStore) DeletePrefix(ctx context.Context, prefix string) error {
+	names, err := listBlobNames(ctx, d, prefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := d.DeleteBlob(ctx, name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		d.removeEmptyParentDirs(name)
+	}
+	return nil
+}
+
+// removeEmptyParentDirs removes the directories containing a deleted blob,
+// stopping at the first one that isn't empty.
+func (d *DiskBlobStore) removeEmptyParentDirs(blobName string) {
+	for dir := filepath.Dir(blobName); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if err := os.Remove(filepath.Join(d.rootDir, dir)); err != nil {
+			return
+		}
+	}
+}
+
 // GCSBlobStore implements the blobstore API on top of the google cloud storage API.
 type GCSBlobStore struct {
+	blobCodec
 	gcsClient    *storage.Client
 	bucketHandle *storage.BucketHandle
 	projectID    string
@@ -242,6 +430,7 @@ func NewGCSBlobStore(bucketName, projectID string, opts ...option.ClientOption)
 		return nil, err
 	}
 	g := &GCSBlobStore{
+		blobCodec: blobCodec{codec: GzipCodec},
 		gcsClient: gcsClient,
 		projectID: projectID,
 	}
@@ -272,19 +461,23 @@ func (g *GCSBlobStore) ReadBlob(ctx context.Context, blobName string) ([]byte, e
 	}
 	start := time.Now()
 	b, err := ioutil.ReadAll(reader)
-	recordReadMetrics(gcsLabel, start, b, err)
-	return decompress(b, err)
+	recordReadMetrics(gcsLabel, start, len(b), err)
+	return g.decompress(ctx, b, err)
 }
 
 func (g *GCSBlobStore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
-	writer := g.bucketHandle.Object(blobName).NewWriter(ctx)
-	defer writer.Close()
-	compressedData, err := compress(data)
+	// The object is created when the writer is closed, so it's only opened
+	// once there's something to write.
+	compressedData, err := g.compress(ctx, data)
 	if err != nil {
 		return 0, err
 	}
 	start := time.Now()
+	writer := g.bucketHandle.Object(blobName).NewWriter(ctx)
 	n, err := writer.Write(compressedData)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
 	recordWriteMetrics(gcsLabel, start, n, err)
 	return n, err
 }
@@ -296,6 +489,42 @@ func (g *GCSBlobStore) DeleteBlob(ctx context.Context, blobName string) error {
 	return err
 }
 
+func (g *GCSBlobStore) BlobReader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	reader, err := g.bucketHandle.Object(blobName).NewReader(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, status.NotFoundError(err.Error())
+		}
+		return nil, err
+	}
+	return g.newBlobReader(ctx, newMeteredReader(gcsLabel, reader))
+}
+
+// gcsWriter is a GCS object writer which can be aborted by canceling its
+// context.
+type gcsWriter struct {
+	*storage.Writer
+	cancel context.CancelFunc
+}
+
+func (w *gcsWriter) Close() error {
+	defer w.cancel()
+	return w.Writer.Close()
+}
+
+// Abort cancels the upload so that the object isn't created.
+func (w *gcsWriter) Abort() {
+	w.cancel()
+	w.Writer.Close()
+}
+
+func (g *GCSBlobStore) BlobWriter(ctx context.Context, blobName string) (io.WriteCloser, error) {
+	// GCS only creates the object once the writer is closed.
+	ctx, cancel := context.WithCancel(ctx)
+	writer := &gcsWriter{g.bucketHandle.Object(blobName).NewWriter(ctx), cancel}
+	return g.newBlobWriter(ctx, newMeteredWriter(gcsLabel, writer))
+}
+
 func (g *GCSBlobStore) BlobExists(ctx context.Context, blobName string) (bool, error) {
 	_, err := g.bucketHandle.Object(blobName).Attrs(ctx)
 	if err == storage.ErrObjectNotExist {
@@ -307,8 +536,38 @@ func (g *GCSBlobStore) BlobExists(ctx context.Context, blobName string) (bool, e
 	}
 }
 
+func (g *GCSBlobStore) ListBlobs(ctx context.Context, prefix string, fn func(name string, modTime time.Time) error) error {
+	it := g.bucketHandle.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(attrs.Name, attrs.Updated); err != nil {
+			return err
+		}
+	}
+}
+
+func (g *GCSBlobStore) DeletePrefix(ctx context.Context, prefix string) error {
+	names, err := listBlobNames(ctx, g, prefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := g.DeleteBlob(ctx, name); err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+	return nil
+}
+
 // AWS stuff
 type AwsS3BlobStore struct {
+	blobCodec
 	s3         *s3.S3
 	bucket     *string
 	downloader *s3manager.Downloader
@@ -318,18 +577,17 @@ type AwsS3BlobStore struct {
 func NewAwsS3BlobStore(awsConfig *config.AwsS3Config) (*AwsS3BlobStore, error) {
 	ctx := context.Background()
 
-	var creds *credentials.Credentials
-
-	// See https://docs.aws.amazon.com/sdk-for-go/v1/developer-guide/configuring-sdk.html#specifying-credentials
-	if awsConfig.CredentialsProfile != "" {
-		creds = credentials.NewSharedCredentials("", awsConfig.CredentialsProfile)
-	}
-
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(awsConfig.Region),
-		Credentials: creds,
+	sess, err := s3util.NewSession(&s3util.SessionConfig{
+		Region:                  awsConfig.Region,
+		Endpoint:                awsConfig.Endpoint,
+		ForcePathStyle:          awsConfig.ForcePathStyle,
+		CredentialsProfile:      awsConfig.CredentialsProfile,
+		CredentialsFile:         awsConfig.CredentialsFile,
+		StaticCredentialsID:     awsConfig.StaticCredentialsID,
+		StaticCredentialsSecret: awsConfig.StaticCredentialsSecret,
+		StaticCredentialsToken:  awsConfig.StaticCredentialsToken,
+		CACertFile:              awsConfig.CACertFile,
 	})
-
 	if err != nil {
 		return nil, err
 	}
@@ -338,6 +596,7 @@ func NewAwsS3BlobStore(awsConfig *config.AwsS3Config) (*AwsS3BlobStore, error) {
 	svc := s3.New(sess)
 
 	awsBlobStore := &AwsS3BlobStore{
+		blobCodec:  blobCodec{codec: GzipCodec},
 		s3:         svc,
 		bucket:     aws.String(awsConfig.Bucket),
 		downloader: s3manager.NewDownloader(sess),
@@ -381,8 +640,8 @@ func (a *AwsS3BlobStore) createBucketIfNotExists(ctx context.Context, bucketName
 func (a *AwsS3BlobStore) ReadBlob(ctx context.Context, blobName string) ([]byte, error) {
 	start := time.Now()
 	b, err := a.download(ctx, blobName)
-	recordReadMetrics(awsS3Label, start, b, err)
-	return decompress(b, err)
+	recordReadMetrics(awsS3Label, start, len(b), err)
+	return a.decompress(ctx, b, err)
 }
 
 func (a *AwsS3BlobStore) download(ctx context.Context, blobName string) ([]byte, error) {
@@ -399,13 +658,14 @@ func (a *AwsS3BlobStore) download(ctx context.Context, blobName string) ([]byte,
 				return nil, status.NotFoundError(err.Error())
 			}
 		}
+		return nil, err
 	}
 
 	return buff.Bytes(), nil
 }
 
 func (a *AwsS3BlobStore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
-	compressedData, err := compress(data)
+	compressedData, err := a.compress(ctx, data)
 	if err != nil {
 		return 0, err
 	}
@@ -427,6 +687,34 @@ func (a *AwsS3BlobStore) upload(ctx context.Context, blobName string, compressed
 	return len(compressedData), nil
 }
 
+func (a *AwsS3BlobStore) BlobReader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	rsp, err := a.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: a.bucket,
+		Key:    aws.String(blobName),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, status.NotFoundError(err.Error())
+		}
+		return nil, err
+	}
+	return a.newBlobReader(ctx, newMeteredReader(awsS3Label, rsp.Body))
+}
+
+func (a *AwsS3BlobStore) BlobWriter(ctx context.Context, blobName string) (io.WriteCloser, error) {
+	// The uploader sends large blobs as a multipart upload, which is only
+	// completed once everything has been written.
+	w := newPipeUploadWriter(func(r io.Reader) error {
+		_, err := a.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket: a.bucket,
+			Key:    aws.String(blobName),
+			Body:   r,
+		})
+		return err
+	})
+	return a.newBlobWriter(ctx, newMeteredWriter(awsS3Label, w))
+}
+
 func (a *AwsS3BlobStore) DeleteBlob(ctx context.Context, blobName string) error {
 	start := time.Now()
 	err := a.delete(ctx, blobName)
@@ -458,8 +746,195 @@ func (a *AwsS3BlobStore) BlobExists(ctx context.Context, blobName string) (bool,
 	}
 
 	if _, err := a.s3.HeadObjectWithContext(ctx, params); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return false, nil
+		}
 		return false, err
 	}
 
 	return true, nil
 }
+
+func (a *AwsS3BlobStore) ListBlobs(ctx context.Context, prefix string, fn func(name string, modTime time.Time) error) error {
+	params := &s3.ListObjectsV2Input{
+		Bucket: a.bucket,
+		Prefix: aws.String(prefix),
+	}
+	var fnErr error
+	err := a.s3.ListObjectsV2PagesWithContext(ctx, params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if fnErr = fn(aws.StringValue(object.Key), aws.TimeValue(object.LastModified)); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+func (a *AwsS3BlobStore) DeletePrefix(ctx context.Context, prefix string) error {
+	names, err := listBlobNames(ctx, a, prefix)
+	if err != nil {
+		return err
+	}
+	// DeleteObjects accepts at most 1000 keys per request.
+	const maxKeysPerDelete = 1000
+	for len(names) > 0 {
+		batchSize := len(names)
+		if batchSize > maxKeysPerDelete {
+			batchSize = maxKeysPerDelete
+		}
+		objects := make([]*s3.ObjectIdentifier, 0, batchSize)
+		for _, name := range names[:batchSize] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(name)})
+		}
+		names = names[batchSize:]
+
+		start := time.Now()
+		rsp, err := a.s3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: a.bucket,
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err == nil && len(rsp.Errors) > 0 {
+			e := rsp.Errors[0]
+			err = status.UnavailableErrorf("Error deleting %d objects, first error deleting %q: %s", len(rsp.Errors), aws.StringValue(e.Key), aws.StringValue(e.Message))
+		}
+		recordDeleteMetrics(awsS3Label, start, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AzureBlobStore implements the blobstore API on top of Azure Blob Storage.
+type AzureBlobStore struct {
+	blobCodec
+	containerURL azblob.ContainerURL
+}
+
+func NewAzureBlobStore(azureConfig *config.AzureConfig) (*AzureBlobStore, error) {
+	ctx := context.Background()
+	containerURL, err := azureutil.NewContainerURL(azureConfig.AccountName, azureConfig.AccountKey, azureConfig.Endpoint, azureConfig.ContainerName)
+	if err != nil {
+		return nil, err
+	}
+	if err := azureutil.CreateContainerIfNotExists(ctx, containerURL); err != nil {
+		return nil, err
+	}
+	log.Printf("Initialized Azure blobstore with container %q", azureConfig.ContainerName)
+	return &AzureBlobStore{
+		blobCodec:    blobCodec{codec: GzipCodec},
+		containerURL: containerURL,
+	}, nil
+}
+
+func (z *AzureBlobStore) ReadBlob(ctx context.Context, blobName string) ([]byte, error) {
+	start := time.Now()
+	b, err := z.download(ctx, blobName)
+	recordReadMetrics(azureLabel, start, len(b), err)
+	return z.decompress(ctx, b, err)
+}
+
+func (z *AzureBlobStore) download(ctx context.Context, blobName string) ([]byte, error) {
+	body, err := z.openDownload(ctx, blobName)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+func (z *AzureBlobStore) openDownload(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	resp, err := z.containerURL.NewBlobURL(blobName).Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if azureutil.IsNotFoundErr(err) {
+			return nil, status.NotFoundError(err.Error())
+		}
+		return nil, err
+	}
+	return resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3}), nil
+}
+
+func (z *AzureBlobStore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
+	compressedData, err := z.compress(ctx, data)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	_, err = azblob.UploadBufferToBlockBlob(ctx, compressedData, z.containerURL.NewBlockBlobURL(blobName), azblob.UploadToBlockBlobOptions{})
+	n := len(compressedData)
+	if err != nil {
+		n = 0
+	}
+	recordWriteMetrics(azureLabel, start, n, err)
+	return n, err
+}
+
+func (z *AzureBlobStore) BlobReader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	body, err := z.openDownload(ctx, blobName)
+	if err != nil {
+		return nil, err
+	}
+	return z.newBlobReader(ctx, newMeteredReader(azureLabel, body))
+}
+
+func (z *AzureBlobStore) BlobWriter(ctx context.Context, blobName string) (io.WriteCloser, error) {
+	// Blocks are staged as they fill up and committed once the writer is
+	// closed, so the blob only becomes visible when it is complete.
+	w := newPipeUploadWriter(func(r io.Reader) error {
+		_, err := azblob.UploadStreamToBlockBlob(ctx, r, z.containerURL.NewBlockBlobURL(blobName), azblob.UploadStreamToBlockBlobOptions{})
+		return err
+	})
+	return z.newBlobWriter(ctx, newMeteredWriter(azureLabel, w))
+}
+
+func (z *AzureBlobStore) DeleteBlob(ctx context.Context, blobName string) error {
+	start := time.Now()
+	_, err := z.containerURL.NewBlobURL(blobName).Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	recordDeleteMetrics(azureLabel, start, err)
+	return err
+}
+
+func (z *AzureBlobStore) BlobExists(ctx context.Context, blobName string) (bool, error) {
+	_, err := z.containerURL.NewBlobURL(blobName).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err == nil {
+		return true, nil
+	}
+	if azureutil.IsNotFoundErr(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (z *AzureBlobStore) ListBlobs(ctx context.Context, prefix string, fn func(name string, modTime time.Time) error) error {
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		rsp, err := z.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return err
+		}
+		for _, blob := range rsp.Segment.BlobItems {
+			if err := fn(blob.Name, blob.Properties.LastModified); err != nil {
+				return err
+			}
+		}
+		marker = rsp.NextMarker
+	}
+	return nil
+}
+
+func (z *AzureBlobStore) DeletePrefix(ctx context.Context, prefix string) error {
+	names, err := listBlobNames(ctx, z, prefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := z.DeleteBlob(ctx, name); err != nil && !azureutil.IsNotFoundErr(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,506 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	testazure "github.com/buildbuddy-io/buildbuddy/server/testutil/azure"
+	tests3 "github.com/buildbuddy-io/buildbuddy/server/testutil/s3"
+)
+
+const testBucket = "test-bucket"
+
+func listBlobs(t *testing.T, bs interfaces.Blobstore, prefix string) []string {
+	names := make([]string, 0)
+	err := bs.ListBlobs(context.Background(), prefix, func(name string, modTime time.Time) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func testListAndDeletePrefix(t *testing.T, bs interfaces.Blobstore) {
+	ctx := context.Background()
+	for _, name := range []string{"iid1/chunks/iid1-0.chunk", "iid1/chunks/iid1-1.chunk", "iid10/chunks/iid10-0.chunk", "iid2"} {
+		if _, err := bs.WriteBlob(ctx, name, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"iid1/chunks/iid1-0.chunk", "iid1/chunks/iid1-1.chunk", "iid10/chunks/iid10-0.chunk", "iid2"}},
+		{"iid1", []string{"iid1/chunks/iid1-0.chunk", "iid1/chunks/iid1-1.chunk", "iid10/chunks/iid10-0.chunk"}},
+		{"iid1/", []string{"iid1/chunks/iid1-0.chunk", "iid1/chunks/iid1-1.chunk"}},
+		{"iid1/chunks/iid1-1", []string{"iid1/chunks/iid1-1.chunk"}},
+		{"iid3/", []string{}},
+	} {
+		if got := listBlobs(t, bs, tc.prefix); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("ListBlobs(%q) = %v, want %v", tc.prefix, got, tc.want)
+		}
+	}
+
+	if err := bs.DeletePrefix(ctx, "iid1/"); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := []string{"iid10/chunks/iid10-0.chunk", "iid2"}, listBlobs(t, bs, ""); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ListBlobs after DeletePrefix = %v, want %v", got, want)
+	}
+	if err := bs.DeletePrefix(ctx, "iid3/"); err != nil {
+		t.Fatalf("DeletePrefix of a prefix with no blobs returned %v", err)
+	}
+}
+
+func testStreaming(t *testing.T, bs interfaces.Blobstore) {
+	ctx := context.Background()
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+	w, err := bs.BlobWriter(ctx, "invocation/streamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i += 64 * 1024 {
+		if _, err := w.Write(data[i : i+64*1024]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bs.ReadBlob(ctx, "invocation/streamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("ReadBlob returned different data than was streamed to BlobWriter")
+	}
+
+	if _, err := bs.WriteBlob(ctx, "invocation/written", data); err != nil {
+		t.Fatal(err)
+	}
+	r, err := bs.BlobReader(ctx, "invocation/written")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("BlobReader returned different data than was written by WriteBlob")
+	}
+
+	if _, err := bs.BlobReader(ctx, "invocation/missing"); !status.IsNotFoundError(err) {
+		t.Fatalf("BlobReader(missing blob) returned %v, want NotFound", err)
+	}
+}
+
+func newDiskBlobStore(t *testing.T) (*blobstore.DiskBlobStore, string) {
+	rootDir, err := ioutil.TempDir("", "blobstore-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(rootDir) })
+	bs, err := blobstore.NewDiskBlobStore(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs, rootDir
+}
+
+func TestDiskBlobStoreCodecs(t *testing.T) {
+	// Gzip blobs are stored as bare gzip streams that older servers can
+	// read, while zstd blobs carry a header naming their codec.
+	for name, prefix := range map[string][]byte{
+		"gzip": {0x1f, 0x8b},
+		"zstd": append([]byte("\x00BBZ"), byte(blobstore.ZstdCodec)),
+	} {
+		codec, err := blobstore.ParseCodec(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, rootDir := newDiskBlobStore(t)
+		bs.SetCodec(codec)
+		testStreaming(t, bs)
+
+		data := bytes.Repeat([]byte("hello world "), 1000)
+		if _, err := bs.WriteBlob(context.Background(), "blob", data); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := ioutil.ReadFile(filepath.Join(rootDir, "blob"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(stored, prefix) {
+			t.Fatalf("Blob written with %s doesn't start with %q: %q", name, prefix, stored[:len(prefix)])
+		}
+		if len(stored) >= len(data) {
+			t.Fatalf("Blob written with %s is %d bytes, not compressed from %d", name, len(stored), len(data))
+		}
+	}
+}
+
+func TestDiskBlobStoreReadsLegacyBlobs(t *testing.T) {
+	ctx := context.Background()
+	bs, rootDir := newDiskBlobStore(t)
+	data := []byte("hello world")
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(data)
+	zw.Close()
+	// Blobs written before we were compressing weren't compressed at all,
+	// and gzip blobs were briefly stored with the codec header.
+	for name, stored := range map[string][]byte{
+		"gzip":         gzipped.Bytes(),
+		"gzip-header":  append(append([]byte("\x00BBZ"), byte(blobstore.GzipCodec)), gzipped.Bytes()...),
+		"uncompressed": data,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(rootDir, name), stored, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := bs.ReadBlob(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("ReadBlob(%s blob) = %q, want %q", name, got, data)
+		}
+		r, err := bs.BlobReader(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("BlobReader(%s blob) returned %q, want %q", name, got, data)
+		}
+	}
+}
+
+// failingSealer fails to seal blobs, either as soon as it's asked to or
+// once the sealed data is flushed.
+type failingSealer struct {
+	failOnClose bool
+}
+
+var errSealFailed = status.UnavailableError("KMS is unavailable")
+
+func (s *failingSealer) NewSealWriter(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	if !s.failOnClose {
+		return nil, errSealFailed
+	}
+	return &failingSealWriter{w}, nil
+}
+
+func (s *failingSealer) NewOpenReader(ctx context.Context, r io.Reader) (io.Reader, error) {
+	return r, nil
+}
+
+type failingSealWriter struct {
+	io.Writer
+}
+
+func (failingSealWriter) Close() error {
+	return errSealFailed
+}
+
+func TestDiskBlobStoreKeepsBlobWhenSealingFails(t *testing.T) {
+	ctx := context.Background()
+	for _, failOnClose := range []bool{false, true} {
+		bs, rootDir := newDiskBlobStore(t)
+		data := []byte("hello world")
+		if _, err := bs.WriteBlob(ctx, "invocation/summary", data); err != nil {
+			t.Fatal(err)
+		}
+		bs.SetSealer(&failingSealer{failOnClose: failOnClose})
+
+		if _, err := bs.WriteBlob(ctx, "invocation/summary", []byte("replaced")); err == nil {
+			t.Fatalf("WriteBlob succeeded with a failing sealer")
+		}
+		if w, err := bs.BlobWriter(ctx, "invocation/summary"); err == nil {
+			w.Write([]byte("replaced"))
+			if err := w.Close(); err == nil {
+				t.Fatalf("BlobWriter succeeded with a failing sealer")
+			}
+		}
+
+		bs.SetSealer(nil)
+		got, err := bs.ReadBlob(ctx, "invocation/summary")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("ReadBlob returned %q after failed writes, want %q", got, data)
+		}
+		// Nor are any temp files left behind.
+		files, err := ioutil.ReadDir(filepath.Join(rootDir, "invocation"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("Found %d files after failed writes, want 1", len(files))
+		}
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	if _, err := blobstore.ParseCodec("lz4"); !status.IsInvalidArgumentError(err) {
+		t.Fatalf("ParseCodec(\"lz4\") returned %v, want InvalidArgument", err)
+	}
+	codec, err := blobstore.ParseCodec("")
+	if err != nil || codec != blobstore.GzipCodec {
+		t.Fatalf("ParseCodec(\"\") = %s, %v; want gzip", codec, err)
+	}
+}
+
+func TestDiskBlobStoreListAndDeletePrefix(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "blobstore-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	bs, err := blobstore.NewDiskBlobStore(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testListAndDeletePrefix(t, bs)
+	// Directories emptied by DeletePrefix are removed too.
+	if _, err := os.Stat(rootDir + "/iid1"); !os.IsNotExist(err) {
+		t.Fatalf("Directory of deleted chunks still exists: %v", err)
+	}
+}
+
+func TestAwsS3BlobStoreListAndDeletePrefix(t *testing.T) {
+	server := tests3.Run(t, &tests3.Options{})
+	bs, err := blobstore.NewAwsS3BlobStore(&config.AwsS3Config{
+		Region:                  "us-east-1",
+		Bucket:                  testBucket,
+		Endpoint:                server.URL,
+		ForcePathStyle:          true,
+		StaticCredentialsID:     "test-id",
+		StaticCredentialsSecret: "test-secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testListAndDeletePrefix(t, bs)
+}
+
+func TestAwsS3BlobStoreStreaming(t *testing.T) {
+	server := tests3.Run(t, &tests3.Options{})
+	bs, err := blobstore.NewAwsS3BlobStore(&config.AwsS3Config{
+		Region:                  "us-east-1",
+		Bucket:                  testBucket,
+		Endpoint:                server.URL,
+		ForcePathStyle:          true,
+		StaticCredentialsID:     "test-id",
+		StaticCredentialsSecret: "test-secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStreaming(t, bs)
+}
+
+func testAwsS3BlobStore(t *testing.T, awsConfig *config.AwsS3Config, server *tests3.Server) {
+	ctx := context.Background()
+	bs, err := blobstore.NewAwsS3BlobStore(awsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello world")
+	if _, err := bs.WriteBlob(ctx, "invocation/blob", data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.Object(testBucket, "invocation/blob"); !ok {
+		t.Fatalf("Blob wasn't written to the S3 bucket, got keys %v", server.Keys(testBucket))
+	}
+	exists, err := bs.BlobExists(ctx, "invocation/blob")
+	if err != nil || !exists {
+		t.Fatalf("BlobExists() = %t, %v; want true", exists, err)
+	}
+	got, err := bs.ReadBlob(ctx, "invocation/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("ReadBlob() = %q, want %q", got, data)
+	}
+	if err := bs.DeleteBlob(ctx, "invocation/blob"); err != nil {
+		t.Fatal(err)
+	}
+	exists, err = bs.BlobExists(ctx, "invocation/blob")
+	if err != nil || exists {
+		t.Fatalf("BlobExists() = %t, %v after delete; want false", exists, err)
+	}
+	if _, err := bs.ReadBlob(ctx, "invocation/blob"); !status.IsNotFoundError(err) {
+		t.Fatalf("ReadBlob() returned %v after delete, want NotFound", err)
+	}
+}
+
+func TestAwsS3BlobStoreStaticCredentials(t *testing.T) {
+	server := tests3.Run(t, &tests3.Options{AccessKeyID: "test-id"})
+	testAwsS3BlobStore(t, &config.AwsS3Config{
+		Region:                  "us-east-1",
+		Bucket:                  testBucket,
+		Endpoint:                server.URL,
+		ForcePathStyle:          true,
+		StaticCredentialsID:     "test-id",
+		StaticCredentialsSecret: "test-secret",
+	}, server)
+}
+
+func TestAwsS3BlobStoreCredentialsFile(t *testing.T) {
+	server := tests3.Run(t, &tests3.Options{AccessKeyID: "file-id"})
+	f, err := ioutil.TempFile("", "s3-credentials-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("[minio]\naws_access_key_id = file-id\naws_secret_access_key = file-secret\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	testAwsS3BlobStore(t, &config.AwsS3Config{
+		Region:             "us-east-1",
+		Bucket:             testBucket,
+		Endpoint:           server.URL,
+		ForcePathStyle:     true,
+		CredentialsFile:    f.Name(),
+		CredentialsProfile: "minio",
+	}, server)
+}
+
+func TestAwsS3BlobStoreWrongCredentials(t *testing.T) {
+	server := tests3.Run(t, &tests3.Options{AccessKeyID: "test-id"})
+	_, err := blobstore.NewAwsS3BlobStore(&config.AwsS3Config{
+		Region:                  "us-east-1",
+		Bucket:                  testBucket,
+		Endpoint:                server.URL,
+		ForcePathStyle:          true,
+		StaticCredentialsID:     "other-id",
+		StaticCredentialsSecret: "other-secret",
+	})
+	if err == nil {
+		t.Fatalf("NewAwsS3BlobStore succeeded with the wrong credentials")
+	}
+}
+
+func TestAwsS3BlobStoreTLS(t *testing.T) {
+	server := tests3.Run(t, &tests3.Options{TLS: true})
+	awsConfig := &config.AwsS3Config{
+		Region:                  "us-east-1",
+		Bucket:                  testBucket,
+		Endpoint:                server.URL,
+		ForcePathStyle:          true,
+		StaticCredentialsID:     "test-id",
+		StaticCredentialsSecret: "test-secret",
+	}
+	if _, err := blobstore.NewAwsS3BlobStore(awsConfig); err == nil {
+		t.Fatalf("NewAwsS3BlobStore trusted a self-signed certificate without a CA cert file")
+	}
+	awsConfig.CACertFile = server.CACertFile(t)
+	testAwsS3BlobStore(t, awsConfig, server)
+}
+
+func TestAzureBlobStore(t *testing.T) {
+	ctx := context.Background()
+	server := testazure.Run(t)
+	bs, err := blobstore.NewAzureBlobStore(&config.AzureConfig{
+		AccountName:   testazure.AccountName,
+		AccountKey:    testazure.AccountKey,
+		ContainerName: "test-container",
+		Endpoint:      server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello world")
+	if _, err := bs.WriteBlob(ctx, "invocation/blob", data); err != nil {
+		t.Fatal(err)
+	}
+	stored, ok := server.Blob("test-container", "invocation/blob")
+	if !ok {
+		t.Fatalf("Blob wasn't written to the Azure container, got blobs %v", server.BlobNames("test-container"))
+	}
+	if bytes.Equal(stored, data) {
+		t.Fatalf("Blob was stored uncompressed")
+	}
+	exists, err := bs.BlobExists(ctx, "invocation/blob")
+	if err != nil || !exists {
+		t.Fatalf("BlobExists() = %t, %v; want true", exists, err)
+	}
+	got, err := bs.ReadBlob(ctx, "invocation/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("ReadBlob() = %q, want %q", got, data)
+	}
+	if err := bs.DeleteBlob(ctx, "invocation/blob"); err != nil {
+		t.Fatal(err)
+	}
+	exists, err = bs.BlobExists(ctx, "invocation/blob")
+	if err != nil || exists {
+		t.Fatalf("BlobExists() = %t, %v after delete; want false", exists, err)
+	}
+	if _, err := bs.ReadBlob(ctx, "invocation/blob"); !status.IsNotFoundError(err) {
+		t.Fatalf("ReadBlob() returned %v after delete, want NotFound", err)
+	}
+}
+
+func TestAzureBlobStoreListAndDeletePrefix(t *testing.T) {
+	server := testazure.Run(t)
+	bs, err := blobstore.NewAzureBlobStore(&config.AzureConfig{
+		AccountName:   testazure.AccountName,
+		AccountKey:    testazure.AccountKey,
+		ContainerName: "test-container",
+		Endpoint:      server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testListAndDeletePrefix(t, bs)
+}
+
+func TestAzureBlobStoreStreaming(t *testing.T) {
+	server := testazure.Run(t)
+	bs, err := blobstore.NewAzureBlobStore(&config.AzureConfig{
+		AccountName:   testazure.AccountName,
+		AccountKey:    testazure.AccountKey,
+		ContainerName: "test-container",
+		Endpoint:      server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStreaming(t, bs)
+}
@@ -0,0 +1,247 @@
+package blobstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/DataDog/zstd"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// Codec is the compression codec a blob was stored with.
+type Codec byte
+
+const (
+	GzipCodec Codec = 1
+	ZstdCodec Codec = 2
+)
+
+// Gzip blobs are stored as bare gzip streams, so that older servers can
+// still read them. Blobs compressed with any other codec are stored with a
+// header naming it: blobHeaderMagic followed by a single Codec byte. Blobs
+// written before we were compressing are not compressed at all.
+const blobHeaderMagic = "\x00BBZ"
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// ParseCodec returns the codec with the given name, as used in the config.
+// The empty name is gzip, which every version of the server can read.
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "", "gzip":
+		return GzipCodec, nil
+	case "zstd":
+		return ZstdCodec, nil
+	default:
+		return 0, status.InvalidArgumentErrorf("Unknown blob compression codec %q, must be one of gzip or zstd", name)
+	}
+}
+
+func (c Codec) String() string {
+	switch c {
+	case GzipCodec:
+		return "gzip"
+	case ZstdCodec:
+		return "zstd"
+	default:
+		return "unknown"
+	}
+}
+
+// A Sealer encrypts blobs after they are compressed, and decrypts them before
+// they are decompressed, since encrypted data doesn't compress.
+type Sealer interface {
+	// NewSealWriter returns a writer which encrypts everything written to
+	// it onto w. Closing it writes out the rest of the encrypted data, but
+	// doesn't close w.
+	NewSealWriter(ctx context.Context, w io.Writer) (io.WriteCloser, error)
+	// NewOpenReader returns a reader for the decrypted contents of r. Data
+	// which isn't encrypted is returned as-is.
+	NewOpenReader(ctx context.Context, r io.Reader) (io.Reader, error)
+}
+
+// blobCodec is embedded in each blobstore to hold the codec that blobs are
+// compressed with when they are written, and the sealer that encrypts them,
+// if any.
+type blobCodec struct {
+	codec  Codec
+	sealer Sealer
+}
+
+// SetCodec sets the codec that blobs are compressed with from now on. Blobs
+// can always be read, whatever codec they were written with.
+func (b *blobCodec) SetCodec(codec Codec) {
+	b.codec = codec
+}
+
+// SetSealer sets the sealer that blobs are encrypted with from now on. Blobs
+// written before a sealer was set are still readable.
+func (b *blobCodec) SetSealer(sealer Sealer) {
+	b.sealer = sealer
+}
+
+// aborter is implemented by the writers that blobs are stored with, which
+// store the blob when they're closed, so that a blob that couldn't be
+// written whole can be dropped instead.
+type aborter interface {
+	Abort()
+}
+
+// abortWriter drops the blob being written to w if w can, and closes w
+// otherwise.
+func abortWriter(w io.WriteCloser) {
+	if a, ok := w.(aborter); ok {
+		a.Abort()
+		return
+	}
+	w.Close()
+}
+
+// codecWriter compresses everything written to it onto w, and closes w once
+// the compressed stream has been flushed.
+type codecWriter struct {
+	io.WriteCloser
+	w io.WriteCloser
+}
+
+func (c *codecWriter) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		abortWriter(c.w)
+		return err
+	}
+	return c.w.Close()
+}
+
+// Abort drops the blob without flushing the compressed stream.
+func (c *codecWriter) Abort() {
+	abortWriter(c.w)
+}
+
+// newBlobWriter returns a writer which compresses everything written to it
+// with b's codec onto w, preceded by the blob header if the codec needs one,
+// and then seals it if b has a sealer. Closing the returned writer also
+// closes w, unless the blob couldn't be written whole, in which case w is
+// aborted so that the blob isn't stored.
+func (b *blobCodec) newBlobWriter(ctx context.Context, w io.WriteCloser) (io.WriteCloser, error) {
+	if b.sealer != nil {
+		sw, err := b.sealer.NewSealWriter(ctx, w)
+		if err != nil {
+			abortWriter(w)
+			return nil, err
+		}
+		w = &codecWriter{sw, w}
+	}
+	switch codec := b.codec; codec {
+	case GzipCodec:
+		return &codecWriter{gzip.NewWriter(w), w}, nil
+	case ZstdCodec:
+		if _, err := w.Write(append([]byte(blobHeaderMagic), byte(codec))); err != nil {
+			abortWriter(w)
+			return nil, err
+		}
+		return &codecWriter{zstd.NewWriter(w), w}, nil
+	default:
+		abortWriter(w)
+		return nil, status.InvalidArgumentErrorf("Unknown blob compression codec %d", codec)
+	}
+}
+
+// codecReader decompresses a stored blob read from r, and closes r when it
+// is closed.
+type codecReader struct {
+	io.ReadCloser
+	r io.ReadCloser
+}
+
+func (c *codecReader) Close() error {
+	err := c.ReadCloser.Close()
+	if rErr := c.r.Close(); err == nil {
+		err = rErr
+	}
+	return err
+}
+
+// newBlobReader returns a reader for the opened and decompressed contents of
+// the blob read from r, working out how it was compressed from its header.
+// Closing the returned reader also closes r.
+func (b *blobCodec) newBlobReader(ctx context.Context, r io.ReadCloser) (io.ReadCloser, error) {
+	var in io.Reader = r
+	if b.sealer != nil {
+		or, err := b.sealer.NewOpenReader(ctx, r)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		in = or
+	}
+	br := bufio.NewReader(in)
+	// Peek returns fewer bytes only if the blob is shorter than the
+	// header, in which case it can't have one.
+	header, _ := br.Peek(len(blobHeaderMagic) + 1)
+	var zr io.ReadCloser
+	var err error
+	switch {
+	case len(header) == len(blobHeaderMagic)+1 && string(header[:len(blobHeaderMagic)]) == blobHeaderMagic:
+		br.Discard(len(header))
+		switch codec := Codec(header[len(blobHeaderMagic)]); codec {
+		case GzipCodec:
+			zr, err = gzip.NewReader(br)
+		case ZstdCodec:
+			zr = zstd.NewReader(br)
+		default:
+			err = status.DataLossErrorf("Blob was stored with unknown compression codec %d", codec)
+		}
+	case bytes.HasPrefix(header, gzipMagic):
+		zr, err = gzip.NewReader(br)
+	default:
+		// Compatibility hack: this is an uncompressed record written
+		// before we were compressing. Just read it as-is.
+		zr = ioutil.NopCloser(br)
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &codecReader{zr, r}, nil
+}
+
+func (b *blobCodec) decompress(ctx context.Context, in []byte, err error) ([]byte, error) {
+	if err != nil {
+		return in, err
+	}
+	r, err := b.newBlobReader(ctx, ioutil.NopCloser(bytes.NewReader(in)))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (nopWriteCloser) Abort() {}
+
+func (b *blobCodec) compress(ctx context.Context, in []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := b.newBlobWriter(ctx, nopWriteCloser{&buf})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(in); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
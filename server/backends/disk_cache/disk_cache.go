@@ -294,6 +294,15 @@ func (d *dbWriteOnClose) Close() error {
 	return d.closeFn(d.bytesWritten)
 }
 
+// Abort removes the temp file being written without adding it to the cache.
+func (d *dbWriteOnClose) Abort() {
+	if a, ok := d.WriteCloser.(interface{ Abort() }); ok {
+		a.Abort()
+		return
+	}
+	d.WriteCloser.Close()
+}
+
 func (c *DiskCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
 	k, err := c.key(ctx, d)
 	if err != nil {
@@ -319,6 +328,41 @@ func (c *DiskCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser,
 	}, nil
 }
 
+// ScanKeys calls fn with every key stored in the cache, regardless of
+// prefix, along with the size of its value, from least to most recently
+// used. Keys are formatted exactly as
+// they are stored, relative to the root directory: userPrefix + prefix + hash.
+func (c *DiskCache) ScanKeys(ctx context.Context, fn func(key string, sizeBytes int64) error) error {
+	c.lock.Lock()
+	keys := c.l.Keys()
+	c.lock.Unlock()
+	for _, k := range keys {
+		fullPath, ok := k.(string)
+		if !ok {
+			continue
+		}
+		c.lock.Lock()
+		v, ok := c.l.Peek(fullPath)
+		c.lock.Unlock()
+		if !ok {
+			// Evicted since the keys were listed.
+			continue
+		}
+		record, ok := v.(*fileRecord)
+		if !ok {
+			continue
+		}
+		key, err := filepath.Rel(c.rootDir, fullPath)
+		if err != nil {
+			return err
+		}
+		if err := fn(key, record.sizeBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *DiskCache) Start() error {
 	return nil
 }
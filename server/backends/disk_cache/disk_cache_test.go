@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/server/backends/disk_cache"
@@ -292,3 +293,44 @@ func TestFileAtomicity(t *testing.T) {
 		t.Fatalf("Error reading/writing digest %q from goroutine: %s", d.GetHash(), err.Error())
 	}
 }
+
+func TestScanKeysLRUOrder(t *testing.T) {
+	dc, err := disk_cache.NewDiskCache(getTmpDir(t), 1000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := getAnonContext(t)
+	var digests []*repb.Digest
+	for i := 0; i < 3; i++ {
+		d, buf := testdigest.NewRandomDigestBuf(t, 100)
+		if err := dc.Set(ctx, d, buf); err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, d)
+	}
+	// Use the first digest written so it is most recently used.
+	if _, err := dc.Get(ctx, digests[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	err = dc.ScanKeys(ctx, func(key string, sizeBytes int64) error {
+		if sizeBytes != 100 {
+			t.Errorf("Key %q has size %d, want 100", key, sizeBytes)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*repb.Digest{digests[1], digests[2], digests[0]}
+	if len(keys) != len(want) {
+		t.Fatalf("ScanKeys returned %d keys, want %d", len(keys), len(want))
+	}
+	for i, d := range want {
+		if !strings.HasSuffix(keys[i], d.GetHash()) {
+			t.Errorf("Key %d is %q, want the key of %q", i, keys[i], d.GetHash())
+		}
+	}
+}
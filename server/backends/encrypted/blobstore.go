@@ -0,0 +1,82 @@
+package encrypted
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/crypter"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+)
+
+// groupIDFromPrefix returns the group that data stored under a user prefix
+// belongs to, which is the key its data keys are wrapped under.
+func groupIDFromPrefix(userPrefix string) string {
+	return strings.TrimSuffix(userPrefix, "/")
+}
+
+// Sealer encrypts blobs for a blobstore, which compresses them first. Blobs
+// written before encryption was enabled are still readable.
+type Sealer struct {
+	env     environment.Env
+	crypter *crypter.Crypter
+}
+
+func NewSealer(env environment.Env, c *crypter.Crypter) *Sealer {
+	return &Sealer{
+		env:     env,
+		crypter: c,
+	}
+}
+
+// groupID returns the group of the user writing a blob. Blobs written by
+// the server itself, without an authenticated user, use the empty group.
+func (s *Sealer) groupID(ctx context.Context) string {
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env)
+	if err != nil {
+		return ""
+	}
+	userPrefix, err := prefix.UserPrefixFromContext(ctx)
+	if err != nil {
+		return ""
+	}
+	return groupIDFromPrefix(userPrefix)
+}
+
+func (s *Sealer) NewSealWriter(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	return s.crypter.NewEncryptWriter(ctx, w, s.groupID(ctx))
+}
+
+func (s *Sealer) NewOpenReader(ctx context.Context, r io.Reader) (io.Reader, error) {
+	return s.crypter.NewDecryptReader(ctx, r)
+}
+
+// abortWriter drops the entry being written to w without storing it, if w
+// supports that, as closing a cache writer stores whatever was written to it.
+func abortWriter(w io.WriteCloser) {
+	if a, ok := w.(interface{ Abort() }); ok {
+		a.Abort()
+		return
+	}
+	w.Close()
+}
+
+// encryptWriteCloser writes the final encrypted chunk before closing the
+// underlying writer, which is aborted instead if that fails.
+type encryptWriteCloser struct {
+	io.WriteCloser
+	w io.WriteCloser
+}
+
+func (e *encryptWriteCloser) Close() error {
+	if err := e.WriteCloser.Close(); err != nil {
+		abortWriter(e.w)
+		return err
+	}
+	return e.w.Close()
+}
+
+func (e *encryptWriteCloser) Abort() {
+	abortWriter(e.w)
+}
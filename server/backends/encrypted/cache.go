@@ -0,0 +1,166 @@
+package encrypted
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/crypter"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// Cache encrypts the entries stored in another cache, under the key of the
+// group whose user prefix is on the context. Entries written before
+// encryption was enabled are still readable.
+//
+// Encrypted entries are a little larger than their digests say, so the
+// underlying cache must not truncate reads to the digest size.
+type Cache struct {
+	cache   interfaces.Cache
+	crypter *crypter.Crypter
+}
+
+func NewCache(cache interfaces.Cache, c *crypter.Crypter) *Cache {
+	return &Cache{
+		cache:   cache,
+		crypter: c,
+	}
+}
+
+func (c *Cache) groupID(ctx context.Context) (string, error) {
+	userPrefix, err := prefix.UserPrefixFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return groupIDFromPrefix(userPrefix), nil
+}
+
+func (c *Cache) WithPrefix(prefix string) interfaces.Cache {
+	return &Cache{
+		cache:   c.cache.WithPrefix(prefix),
+		crypter: c.crypter,
+	}
+}
+
+func (c *Cache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
+	return c.cache.Contains(ctx, d)
+}
+
+func (c *Cache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
+	return c.cache.ContainsMulti(ctx, digests)
+}
+
+func (c *Cache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	data, err := c.cache.Get(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	return c.crypter.Decrypt(ctx, data)
+}
+
+func (c *Cache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	found, err := c.cache.GetMulti(ctx, digests)
+	if err != nil {
+		return nil, err
+	}
+	for d, data := range found {
+		if found[d], err = c.crypter.Decrypt(ctx, data); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+func (c *Cache) Set(ctx context.Context, d *repb.Digest, data []byte) error {
+	groupID, err := c.groupID(ctx)
+	if err != nil {
+		return err
+	}
+	encrypted, err := c.crypter.Encrypt(ctx, groupID, data)
+	if err != nil {
+		return err
+	}
+	return c.cache.Set(ctx, d, encrypted)
+}
+
+func (c *Cache) SetMulti(ctx context.Context, kvs map[*repb.Digest][]byte) error {
+	groupID, err := c.groupID(ctx)
+	if err != nil {
+		return err
+	}
+	encrypted := make(map[*repb.Digest][]byte, len(kvs))
+	for d, data := range kvs {
+		if encrypted[d], err = c.crypter.Encrypt(ctx, groupID, data); err != nil {
+			return err
+		}
+	}
+	return c.cache.SetMulti(ctx, encrypted)
+}
+
+func (c *Cache) Delete(ctx context.Context, d *repb.Digest) error {
+	return c.cache.Delete(ctx, d)
+}
+
+func (c *Cache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.Reader, error) {
+	if offset == 0 {
+		r, err := c.cache.Reader(ctx, d, 0)
+		if err != nil {
+			return nil, err
+		}
+		return c.crypter.NewDecryptReader(ctx, r)
+	}
+
+	// Offsets into the plaintext don't map onto the encrypted entry, so
+	// its header is read to find the chunk holding offset, which is then
+	// decrypted from its start.
+	hr, err := c.cache.Reader(ctx, d, 0)
+	if err != nil {
+		return nil, err
+	}
+	h, err := crypter.ReadHeader(bufio.NewReader(hr))
+	if closer, ok := hr.(io.Closer); ok {
+		closer.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		// Entries written before encryption was enabled are stored as
+		// they are.
+		return c.cache.Reader(ctx, d, offset)
+	}
+	plainOffset, sealedOffset := crypter.ChunkStart(h, offset)
+	r, err := c.cache.Reader(ctx, d, sealedOffset)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := c.crypter.NewDecryptReaderAt(ctx, h, r, plainOffset)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, dr, offset-plainOffset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return dr, nil
+}
+
+func (c *Cache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
+	groupID, err := c.groupID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w, err := c.cache.Writer(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	ew, err := c.crypter.NewEncryptWriter(ctx, w, groupID)
+	if err != nil {
+		abortWriter(w)
+		return nil, err
+	}
+	return &encryptWriteCloser{ew, w}, nil
+}
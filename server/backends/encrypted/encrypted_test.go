@@ -0,0 +1,297 @@
+package encrypted
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/disk_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/crypter"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"google.golang.org/grpc/metadata"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	testauth "github.com/buildbuddy-io/buildbuddy/server/testutil/auth"
+	testdigest "github.com/buildbuddy-io/buildbuddy/server/testutil/digest"
+	testenv "github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+)
+
+func newTestCrypter(t *testing.T) *crypter.Crypter {
+	kf := &crypter.Keyfile{}
+	if _, err := kf.Rotate(""); err != nil {
+		t.Fatal(err)
+	}
+	kms, err := crypter.NewKeyfileKMS(kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypter.New(kms)
+}
+
+func newTestEnv(t *testing.T) *testenv.TestEnv {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	return te
+}
+
+func authenticatedContext(te *testenv.TestEnv, userID string) context.Context {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(testauth.TestApiKeyHeader, userID))
+	return te.GetAuthenticator().AuthenticateGRPCRequest(ctx)
+}
+
+// storedGroupID returns the group that stored data was encrypted for.
+func storedGroupID(t *testing.T, stored []byte) string {
+	h, err := crypter.ReadHeader(bufio.NewReader(bytes.NewReader(stored)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h == nil {
+		t.Fatalf("Stored data isn't encrypted")
+	}
+	return h.GroupID
+}
+
+func TestCache(t *testing.T) {
+	te := newTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(authenticatedContext(te, "US1"), te)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc, err := memory_cache.NewMemoryCache(1000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCache(mc, newTestCrypter(t))
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 200000)
+	if err := c.Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := mc.Get(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, buf[:1000]) {
+		t.Fatalf("Cache entry was stored in plaintext")
+	}
+	if groupID := storedGroupID(t, stored); groupID != "GR1" {
+		t.Fatalf("Cache entry was encrypted for group %q, want GR1", groupID)
+	}
+	got, err := c.Get(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf) {
+		t.Fatalf("Get returned different data than was set")
+	}
+	for _, offset := range []int64{0, 1, 65535, 65536, 100000, 131072, 199999, 200000} {
+		r, err := c.Reader(ctx, d, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, buf[offset:]) {
+			t.Fatalf("Reader(offset=%d) returned %d bytes, want %d", offset, len(got), len(buf)-int(offset))
+		}
+	}
+
+	d2, buf2 := testdigest.NewRandomDigestBuf(t, 1000)
+	w, err := c.Writer(ctx, d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(buf2); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	found, err := c.GetMulti(ctx, []*repb.Digest{d, d2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(found[d], buf) || !bytes.Equal(found[d2], buf2) {
+		t.Fatalf("GetMulti returned different data than was written")
+	}
+
+	// Entries written before encryption was enabled are still readable.
+	d3, buf3 := testdigest.NewRandomDigestBuf(t, 1000)
+	if err := mc.Set(ctx, d3, buf3); err != nil {
+		t.Fatal(err)
+	}
+	got, err = c.Get(ctx, d3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf3) {
+		t.Fatalf("Get returned different data than was stored unencrypted")
+	}
+}
+
+// failingWriteCache fails the writes to its entries after the first
+// allowedWrites of them.
+type failingWriteCache struct {
+	interfaces.Cache
+	allowedWrites int
+}
+
+func (c *failingWriteCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
+	w, err := c.Cache.Writer(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	return &failingWriter{w, c.allowedWrites}, nil
+}
+
+type failingWriter struct {
+	io.WriteCloser
+	allowedWrites int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.allowedWrites == 0 {
+		return 0, status.UnavailableError("disk is full")
+	}
+	w.allowedWrites--
+	return w.WriteCloser.Write(p)
+}
+
+func (w *failingWriter) Abort() {
+	w.WriteCloser.(interface{ Abort() }).Abort()
+}
+
+func TestCacheDropsEntriesThatFailToWrite(t *testing.T) {
+	te := newTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(authenticatedContext(te, "US1"), te)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootDir, err := ioutil.TempDir("", "encrypted-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(rootDir) })
+	dc, err := disk_cache.NewDiskCache(rootDir, 1000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing the header fails when no writes are allowed, and flushing the
+	// final chunk fails once the header has been written.
+	for _, allowedWrites := range []int{0, 1} {
+		c := NewCache(&failingWriteCache{dc, allowedWrites}, newTestCrypter(t))
+		d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+		if w, err := c.Writer(ctx, d); err == nil {
+			w.Write(buf)
+			if err := w.Close(); err == nil {
+				t.Fatalf("Writer succeeded after %d writes", allowedWrites)
+			}
+		}
+		contains, err := c.Contains(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contains {
+			t.Fatalf("Cache contains an entry that failed to write after %d writes", allowedWrites)
+		}
+	}
+}
+
+func TestSealer(t *testing.T) {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := newTestEnv(t)
+	rootDir, err := ioutil.TempDir("", "encrypted-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(rootDir) })
+	bs, err := blobstore.NewDiskBlobStore(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.SetSealer(NewSealer(te, newTestCrypter(t)))
+	data := bytes.Repeat([]byte("build log "), 10000)
+
+	for _, tc := range []struct {
+		ctx     context.Context
+		groupID string
+	}{
+		{authenticatedContext(te, "US1"), "GR1"},
+		// Blobs written without an authenticated user are anonymous.
+		{context.Background(), "ANON"},
+	} {
+		if _, err := bs.WriteBlob(tc.ctx, "blob", data); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := ioutil.ReadFile(filepath.Join(rootDir, "blob"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if groupID := storedGroupID(t, stored); groupID != tc.groupID {
+			t.Fatalf("Blob was encrypted for group %q, want %q", groupID, tc.groupID)
+		}
+		// Blobs are compressed before they're encrypted.
+		if len(stored) >= len(data)/10 {
+			t.Fatalf("Stored blob is %d bytes, not compressed from %d", len(stored), len(data))
+		}
+		got, err := bs.ReadBlob(context.Background(), "blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("ReadBlob returned different data than was written")
+		}
+	}
+
+	w, err := bs.BlobWriter(authenticatedContext(te, "US1"), "streamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := bs.BlobReader(context.Background(), "streamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("BlobReader returned different data than was streamed to BlobWriter")
+	}
+
+	// Blobs written before encryption was enabled are still readable.
+	unsealed, err := blobstore.NewDiskBlobStore(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unsealed.WriteBlob(context.Background(), "legacy", data); err != nil {
+		t.Fatal(err)
+	}
+	got, err = bs.ReadBlob(context.Background(), "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("ReadBlob returned different data than was stored unencrypted")
+	}
+}
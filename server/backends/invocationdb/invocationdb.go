@@ -158,6 +158,30 @@ func (d *InvocationDB) LookupExpiredInvocations(ctx context.Context, cutoffTime
 	return invocations, nil
 }
 
+func (d *InvocationDB) InvocationExists(ctx context.Context, invocationID string) (bool, error) {
+	ti := &tables.Invocation{}
+	err := d.h.Raw(`SELECT invocation_id FROM Invocations WHERE invocation_id = ?`, invocationID).Take(ti).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *InvocationDB) LookupInvocationOwner(ctx context.Context, invocationID string) (*tables.Invocation, error) {
+	ti := &tables.Invocation{}
+	err := d.h.Raw(`SELECT invocation_id, user_id, group_id, perms, invocation_status FROM Invocations WHERE invocation_id = ?`, invocationID).Take(ti).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, status.NotFoundErrorf("Invocation %s not found", invocationID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ti, nil
+}
+
 func (d *InvocationDB) FillCounts(ctx context.Context, stat *telpb.TelemetryStat) error {
 	counts := d.h.Raw(`
 		SELECT 
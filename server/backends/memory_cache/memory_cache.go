@@ -192,6 +192,37 @@ func (m *MemoryCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteClose
 	}, nil
 }
 
+// ScanKeys calls fn with every key stored in the cache, regardless of
+// prefix, along with the size of its value, from least to most recently
+// used. Keys are formatted exactly as
+// they are stored: userPrefix + prefix + hash.
+func (m *MemoryCache) ScanKeys(ctx context.Context, fn func(key string, sizeBytes int64) error) error {
+	m.lock.Lock()
+	keys := m.l.Keys()
+	m.lock.Unlock()
+	for _, k := range keys {
+		key, ok := k.(string)
+		if !ok {
+			continue
+		}
+		m.lock.Lock()
+		v, ok := m.l.Peek(key)
+		m.lock.Unlock()
+		if !ok {
+			// Evicted since the keys were listed.
+			continue
+		}
+		value, ok := v.([]byte)
+		if !ok {
+			continue
+		}
+		if err := fn(key, int64(len(value))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *MemoryCache) Start() error {
 	return nil
 }
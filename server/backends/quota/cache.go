@@ -0,0 +1,123 @@
+package quota
+
+import (
+	"context"
+	"io"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// Cache enforces the quotas of the group whose user prefix is on the context
+// on another cache. Uploads by groups over one of their hard limits fail with
+// a ResourceExhausted error; reads always succeed.
+type Cache struct {
+	cache   interfaces.Cache
+	manager *Manager
+}
+
+func NewCache(m *Manager, cache interfaces.Cache) *Cache {
+	return &Cache{
+		cache:   cache,
+		manager: m,
+	}
+}
+
+func (c *Cache) groupID(ctx context.Context) (string, error) {
+	userPrefix, err := prefix.UserPrefixFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return groupIDFromPrefix(userPrefix), nil
+}
+
+func (c *Cache) recordRead(ctx context.Context, sizeBytes int64) {
+	if groupID, err := c.groupID(ctx); err == nil {
+		c.manager.recordRead(ctx, groupID, sizeBytes)
+	}
+}
+
+func (c *Cache) checkWrite(ctx context.Context, sizeBytes int64) error {
+	groupID, err := c.groupID(ctx)
+	if err != nil {
+		return err
+	}
+	return c.manager.checkWrite(ctx, groupID, sizeBytes)
+}
+
+func (c *Cache) WithPrefix(prefix string) interfaces.Cache {
+	return &Cache{
+		cache:   c.cache.WithPrefix(prefix),
+		manager: c.manager,
+	}
+}
+
+func (c *Cache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
+	return c.cache.Contains(ctx, d)
+}
+
+func (c *Cache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
+	return c.cache.ContainsMulti(ctx, digests)
+}
+
+func (c *Cache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	data, err := c.cache.Get(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	c.recordRead(ctx, int64(len(data)))
+	return data, nil
+}
+
+func (c *Cache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	found, err := c.cache.GetMulti(ctx, digests)
+	if err != nil {
+		return nil, err
+	}
+	sizeBytes := int64(0)
+	for _, data := range found {
+		sizeBytes += int64(len(data))
+	}
+	c.recordRead(ctx, sizeBytes)
+	return found, nil
+}
+
+func (c *Cache) Set(ctx context.Context, d *repb.Digest, data []byte) error {
+	if err := c.checkWrite(ctx, int64(len(data))); err != nil {
+		return err
+	}
+	return c.cache.Set(ctx, d, data)
+}
+
+func (c *Cache) SetMulti(ctx context.Context, kvs map[*repb.Digest][]byte) error {
+	sizeBytes := int64(0)
+	for _, data := range kvs {
+		sizeBytes += int64(len(data))
+	}
+	if err := c.checkWrite(ctx, sizeBytes); err != nil {
+		return err
+	}
+	return c.cache.SetMulti(ctx, kvs)
+}
+
+func (c *Cache) Delete(ctx context.Context, d *repb.Digest) error {
+	return c.cache.Delete(ctx, d)
+}
+
+func (c *Cache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.Reader, error) {
+	r, err := c.cache.Reader(ctx, d, offset)
+	if err != nil {
+		return nil, err
+	}
+	c.recordRead(ctx, d.GetSizeBytes()-offset)
+	return r, nil
+}
+
+func (c *Cache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
+	if err := c.checkWrite(ctx, d.GetSizeBytes()); err != nil {
+		return nil, err
+	}
+	return c.cache.Writer(ctx, d)
+}
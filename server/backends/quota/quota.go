@@ -0,0 +1,390 @@
+package quota
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/hit_tracker"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+var (
+	quotaScanInterval = flag.Duration("cache_quota_scan_interval", 5*time.Minute, "How often every app replica reports how many bytes each group stores in its cache. Storage quotas are enforced using the totals from the previous interval.")
+	quotaSyncInterval = flag.Duration("cache_quota_sync_interval", 10*time.Second, "How often every app replica adds the bytes it counted to the totals in the metrics collector, and reads back the totals of all replicas.")
+)
+
+// groupIDFromPrefix returns the group that cache entries stored under a user
+// prefix count against.
+func groupIDFromPrefix(userPrefix string) string {
+	return strings.TrimSuffix(userPrefix, "/")
+}
+
+func storedBytesCounter(groupID string, epoch time.Time) string {
+	return fmt.Sprintf("quota-%s-stored-bytes-%d", groupID, epoch.Unix())
+}
+
+func bandwidthBytesCounter(groupID string, t time.Time) string {
+	return fmt.Sprintf("quota-%s-bandwidth-bytes-%s", groupID, t.UTC().Format("20060102"))
+}
+
+// exceeded returns whether n is over limit. Limits that are 0 are not
+// enforced.
+func exceeded(n, limit int64) bool {
+	return limit > 0 && n > limit
+}
+
+// Manager tracks how many bytes each group stores in, and transfers to and
+// from, the cache. Totals are kept as counters in the MetricsCollector, so
+// that every app replica sharing it enforces the same quotas. Each replica
+// buffers what it adds to them and periodically syncs with the collector, so
+// that checking a write doesn't wait on it. Counters are named after the
+// interval or day they count, so they're never reset.
+//
+// Stored bytes are counted by periodically scanning the local cache: each
+// replica adds the bytes it stores for a group to a counter for the current
+// interval, and writes are checked against the (complete) counter of the
+// previous interval. Groups over their storage soft limit have their least
+// recently used entries evicted from every replica, in proportion to how much
+// of the group's data each replica stores.
+type Manager struct {
+	env           environment.Env
+	local         interfaces.Cache
+	scanner       interfaces.KeyScanner
+	defaultLimits config.QuotaLimits
+	groupLimits   map[string]config.QuotaLimits
+
+	mu sync.Mutex
+	// The totals of all replicas as of the last sync, and the counts this
+	// replica added since, including those being synced.
+	totals   map[string]int64
+	pending  map[string]int64
+	flushing map[string]int64
+	// When each counter was last read. Syncs read back the counters read
+	// during the last scan interval, and forget the others.
+	lastRead map[string]time.Time
+
+	lastReportedEpoch time.Time
+	cancel            context.CancelFunc
+	done              chan struct{}
+}
+
+// NewManager returns a Manager which enforces the quotas in conf. local is the
+// cache that entries are stored in on this replica. If it is not an
+// interfaces.KeyScanner, only bandwidth quotas are enforced.
+func NewManager(env environment.Env, local interfaces.Cache, conf *config.QuotaConfig) *Manager {
+	m := &Manager{
+		env:           env,
+		local:         local,
+		defaultLimits: conf.Default,
+		groupLimits:   make(map[string]config.QuotaLimits, len(conf.Groups)),
+		totals:        make(map[string]int64),
+		pending:       make(map[string]int64),
+		lastRead:      make(map[string]time.Time),
+	}
+	for _, g := range conf.Groups {
+		m.groupLimits[g.GroupID] = g.QuotaLimits
+	}
+	if scanner, ok := local.(interfaces.KeyScanner); ok {
+		m.scanner = scanner
+	} else {
+		log.Printf("Quota: cache does not support scanning keys; storage quotas are not enforced")
+	}
+	return m
+}
+
+func (m *Manager) limits(groupID string) config.QuotaLimits {
+	if l, ok := m.groupLimits[groupID]; ok {
+		return l
+	}
+	return m.defaultLimits
+}
+
+func (m *Manager) epoch(t time.Time) time.Time {
+	return t.Truncate(*quotaScanInterval)
+}
+
+// total returns the value of a counter, including what this replica added
+// to it since the last sync.
+func (m *Manager) total(counterName string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastRead[counterName] = time.Now()
+	return m.totals[counterName] + m.pending[counterName] + m.flushing[counterName]
+}
+
+// add adds n to a counter at the next sync.
+func (m *Manager) add(counterName string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending[counterName] += n
+}
+
+// sync adds what this replica counted since the last sync to the counters in
+// the metrics collector, and reads back the totals of all replicas for the
+// counters in use. Counts which could not be added are kept, and retried by
+// the next sync.
+func (m *Manager) sync(ctx context.Context) error {
+	mc := m.env.GetMetricsCollector()
+	if mc == nil {
+		return nil
+	}
+	m.mu.Lock()
+	m.flushing = m.pending
+	m.pending = make(map[string]int64)
+	flushing := m.flushing
+	cutoff := time.Now().Add(-*quotaScanInterval)
+	var read []string
+	for counterName, t := range m.lastRead {
+		if t.Before(cutoff) {
+			delete(m.lastRead, counterName)
+			continue
+		}
+		read = append(read, counterName)
+	}
+	m.mu.Unlock()
+
+	var lastErr error
+	totals := make(map[string]int64, len(flushing)+len(read))
+	failed := make(map[string]int64)
+	for counterName, n := range flushing {
+		total, err := mc.IncrementCount(ctx, counterName, n)
+		if err != nil {
+			lastErr = err
+			failed[counterName] = n
+			continue
+		}
+		totals[counterName] = total
+	}
+	for _, counterName := range read {
+		if _, ok := flushing[counterName]; ok {
+			continue
+		}
+		total, err := mc.ReadCount(ctx, counterName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		totals[counterName] = total
+	}
+
+	m.mu.Lock()
+	// Counters which couldn't be synced keep their last known totals, and
+	// the others which are no longer in use are dropped.
+	for counterName, n := range failed {
+		if total, ok := m.totals[counterName]; ok {
+			totals[counterName] = total
+		}
+		m.pending[counterName] += n
+	}
+	for _, counterName := range read {
+		if _, ok := totals[counterName]; !ok {
+			totals[counterName] = m.totals[counterName]
+		}
+	}
+	m.totals = totals
+	m.flushing = nil
+	m.mu.Unlock()
+	return lastErr
+}
+
+// storedBytes returns how many bytes groupID stored across all replicas
+// during the interval before epoch.
+func (m *Manager) storedBytes(groupID string, epoch time.Time) int64 {
+	if m.scanner == nil {
+		return 0
+	}
+	return m.total(storedBytesCounter(groupID, epoch.Add(-*quotaScanInterval)))
+}
+
+// countBandwidth counts bytes transferred to or from the cache against the
+// group's bandwidth quota for the current day (UTC).
+func (m *Manager) countBandwidth(groupID string, sizeBytes int64) {
+	if sizeBytes <= 0 {
+		return
+	}
+	now := time.Now()
+	m.add(bandwidthBytesCounter(groupID, now), sizeBytes)
+}
+
+// recordRead counts bytes read from the cache against the group's bandwidth
+// quota. Reads are never rejected.
+func (m *Manager) recordRead(ctx context.Context, groupID string, sizeBytes int64) {
+	m.countBandwidth(groupID, sizeBytes)
+}
+
+// checkWrite returns a ResourceExhausted error if the group is over one of its
+// hard limits. Otherwise, the write is counted against the group's bandwidth
+// quota. It only consults the totals as of the last sync, so it doesn't
+// wait on the metrics collector.
+func (m *Manager) checkWrite(ctx context.Context, groupID string, sizeBytes int64) error {
+	l := m.limits(groupID)
+	if l == (config.QuotaLimits{}) {
+		return nil
+	}
+	now := time.Now()
+	stored := m.storedBytes(groupID, m.epoch(now))
+	bandwidth := m.total(bandwidthBytesCounter(groupID, now))
+	if exceeded(stored, l.StorageHardLimitBytes) {
+		hit_tracker.TrackQuotaExceeded(ctx, m.env, true)
+		return status.ResourceExhaustedErrorf("Group %q stores %d bytes in the cache, over its limit of %d bytes. Uploads are rejected until older entries are evicted.", groupID, stored, l.StorageHardLimitBytes)
+	}
+	if exceeded(bandwidth, l.BandwidthHardLimitBytes) {
+		hit_tracker.TrackQuotaExceeded(ctx, m.env, true)
+		return status.ResourceExhaustedErrorf("Group %q transferred %d bytes to and from the cache today, over its limit of %d bytes. Uploads are rejected until tomorrow (UTC).", groupID, bandwidth, l.BandwidthHardLimitBytes)
+	}
+	if exceeded(stored, l.StorageSoftLimitBytes) || exceeded(bandwidth, l.BandwidthSoftLimitBytes) {
+		hit_tracker.TrackQuotaExceeded(ctx, m.env, false)
+	}
+	m.countBandwidth(groupID, sizeBytes)
+	return nil
+}
+
+func (m *Manager) localStoredBytes(ctx context.Context) (map[string]int64, error) {
+	local := make(map[string]int64)
+	err := m.scanner.ScanKeys(ctx, func(key string, sizeBytes int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		userPrefix, _, _, err := prefix.ParseCacheKey(key)
+		if err != nil {
+			// Not a cache entry, so it doesn't count against any
+			// group.
+			return nil
+		}
+		local[groupIDFromPrefix(userPrefix)] += sizeBytes
+		return nil
+	})
+	return local, err
+}
+
+// evict deletes the least recently used entries that groupID stores in the
+// local cache, until at least targetBytes are freed. It returns the number of
+// bytes freed.
+func (m *Manager) evict(ctx context.Context, groupID string, targetBytes int64) (int64, error) {
+	freed := int64(0)
+	errDone := status.AbortedError("done evicting")
+	err := m.scanner.ScanKeys(ctx, func(key string, sizeBytes int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if freed >= targetBytes {
+			return errDone
+		}
+		userPrefix, cachePrefix, hash, err := prefix.ParseCacheKey(key)
+		if err != nil || groupIDFromPrefix(userPrefix) != groupID {
+			return nil
+		}
+		d := &repb.Digest{
+			Hash:      hash,
+			SizeBytes: sizeBytes,
+		}
+		ctx := prefix.AttachExplicitUserPrefixToContext(ctx, userPrefix)
+		if err := m.local.WithPrefix(cachePrefix).Delete(ctx, d); err != nil {
+			log.Printf("Quota: error evicting %q: %s", key, err)
+			return nil
+		}
+		freed += sizeBytes
+		return nil
+	})
+	if err == errDone {
+		err = nil
+	}
+	return freed, err
+}
+
+// scan evicts entries of the groups which were over their storage soft limit
+// during the previous interval, and then reports how many bytes each group
+// stores in the local cache for the interval starting at epoch.
+func (m *Manager) scan(ctx context.Context, epoch time.Time) error {
+	if m.scanner == nil {
+		return nil
+	}
+	local, err := m.localStoredBytes(ctx)
+	if err != nil {
+		return err
+	}
+	for groupID, localBytes := range local {
+		softLimit := m.limits(groupID).StorageSoftLimitBytes
+		global := m.storedBytes(groupID, epoch)
+		if !exceeded(global, softLimit) {
+			continue
+		}
+		// Every replica frees its share of the excess, so that the
+		// group's least recently used entries go first everywhere.
+		share := int64(float64(global-softLimit) * float64(localBytes) / float64(global))
+		freed, err := m.evict(ctx, groupID, share)
+		if err != nil {
+			return err
+		}
+		log.Printf("Quota: group %q is over its storage soft limit; evicted %d bytes", groupID, freed)
+		local[groupID] -= freed
+	}
+	// The counter is read during the next interval.
+	for groupID, localBytes := range local {
+		m.add(storedBytesCounter(groupID, epoch), localBytes)
+	}
+	return m.sync(ctx)
+}
+
+// Start periodically syncs the counters with the metrics collector, and scans
+// the local cache, until Stop is called. Each interval is scanned once, as soon
+// after it starts as possible.
+func (m *Manager) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	syncTicker := time.NewTicker(*quotaSyncInterval)
+	scanTicker := time.NewTicker(*quotaScanInterval / 4)
+	go func() {
+		defer close(m.done)
+		defer syncTicker.Stop()
+		defer scanTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-syncTicker.C:
+				if err := m.sync(ctx); err != nil && ctx.Err() == nil {
+					log.Printf("Quota: error syncing counters: %s", err)
+				}
+				continue
+			case <-scanTicker.C:
+			}
+			epoch := m.epoch(time.Now())
+			if epoch.Equal(m.lastReportedEpoch) {
+				continue
+			}
+			if err := m.scan(ctx, epoch); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Quota: error scanning cache: %s", err)
+				}
+				continue
+			}
+			m.lastReportedEpoch = epoch
+		}
+	}()
+}
+
+// Stop stops the syncs and scans started by Start, and writes what this
+// replica counted since the last sync to the metrics collector.
+func (m *Manager) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+		<-m.done
+		m.cancel = nil
+		if err := m.sync(context.Background()); err != nil {
+			log.Printf("Quota: error syncing counters: %s", err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package quota
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_metrics_collector"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	testauth "github.com/buildbuddy-io/buildbuddy/server/testutil/auth"
+	testdigest "github.com/buildbuddy-io/buildbuddy/server/testutil/digest"
+	testenv "github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+)
+
+func newTestManager(t *testing.T, conf *config.QuotaConfig) (*Manager, *memory_cache.MemoryCache, context.Context, context.Context) {
+	te := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("US1", "GR1", "US2", "GR2")
+	te.SetAuthenticator(testauth.NewTestAuthenticator(users))
+	collector, err := memory_metrics_collector.NewMemoryMetricsCollector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.SetMetricsCollector(collector)
+	mc, err := memory_cache.NewMemoryCache(1000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ctxs []context.Context
+	for _, userID := range []string{"US1", "US2"} {
+		ctx, err := prefix.AttachUserPrefixToContext(testauth.WithAuthenticatedUser(context.Background(), users[userID]), te)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctxs = append(ctxs, ctx)
+	}
+	return NewManager(te, mc, conf), mc, ctxs[0], ctxs[1]
+}
+
+func setRandom(t *testing.T, ctx context.Context, c *Cache, sizeBytes int64) (*repb.Digest, error) {
+	d, buf := testdigest.NewRandomDigestBuf(t, sizeBytes)
+	return d, c.Set(ctx, d, buf)
+}
+
+func TestStorageHardLimit(t *testing.T) {
+	m, mc, ctx1, ctx2 := newTestManager(t, &config.QuotaConfig{
+		Groups: []config.GroupQuotaConfig{
+			{GroupID: "GR1", QuotaLimits: config.QuotaLimits{StorageHardLimitBytes: 1500}},
+		},
+	})
+	c := NewCache(m, mc)
+
+	d, err := setRandom(t, ctx1, c, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := setRandom(t, ctx1, c, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	// Report the stored bytes for the previous interval, which is what
+	// writes are checked against.
+	epoch := m.epoch(time.Now())
+	if err := m.scan(ctx1, epoch.Add(-*quotaScanInterval)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := setRandom(t, ctx1, c, 1000); !status.IsResourceExhaustedError(err) {
+		t.Fatalf("Set over the hard limit returned %v, want a ResourceExhausted error", err)
+	}
+	if _, err := c.Writer(ctx1, d); !status.IsResourceExhaustedError(err) {
+		t.Fatalf("Writer over the hard limit returned %v, want a ResourceExhausted error", err)
+	}
+	if _, err := c.Get(ctx1, d); err != nil {
+		t.Fatalf("Get over the hard limit returned %s, want success", err)
+	}
+	// Other groups are not affected.
+	if _, err := setRandom(t, ctx2, c, 1000); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBandwidthHardLimit(t *testing.T) {
+	m, mc, ctx1, _ := newTestManager(t, &config.QuotaConfig{
+		Default: config.QuotaLimits{BandwidthHardLimitBytes: 1500},
+	})
+	c := NewCache(m, mc)
+
+	d, err := setRandom(t, ctx1, c, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx1, d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := setRandom(t, ctx1, c, 1000); !status.IsResourceExhaustedError(err) {
+		t.Fatalf("Set over the bandwidth limit returned %v, want a ResourceExhausted error", err)
+	}
+	if _, err := c.Get(ctx1, d); err != nil {
+		t.Fatalf("Get over the bandwidth limit returned %s, want success", err)
+	}
+}
+
+func TestBandwidthSharedAcrossReplicas(t *testing.T) {
+	m1, mc, ctx1, _ := newTestManager(t, &config.QuotaConfig{
+		Default: config.QuotaLimits{BandwidthHardLimitBytes: 1500},
+	})
+	m2 := NewManager(m1.env, mc, &config.QuotaConfig{
+		Default: config.QuotaLimits{BandwidthHardLimitBytes: 1500},
+	})
+	c1 := NewCache(m1, mc)
+	c2 := NewCache(m2, mc)
+
+	if _, err := setRandom(t, ctx1, c1, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := setRandom(t, ctx1, c2, 1000); err != nil {
+		t.Fatal(err)
+	}
+	// Neither replica has seen the other's writes until they sync.
+	for _, m := range []*Manager{m1, m2, m1} {
+		if err := m.sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []*Cache{c1, c2} {
+		if _, err := setRandom(t, ctx1, c, 1); !status.IsResourceExhaustedError(err) {
+			t.Fatalf("Set over the shared bandwidth limit returned %v, want a ResourceExhausted error", err)
+		}
+	}
+}
+
+func TestStorageSoftLimitEvictsLeastRecentlyUsedEntries(t *testing.T) {
+	m, mc, ctx1, ctx2 := newTestManager(t, &config.QuotaConfig{
+		Default: config.QuotaLimits{StorageSoftLimitBytes: 2500},
+	})
+	c := NewCache(m, mc)
+
+	var digests []*repb.Digest
+	for i := 0; i < 4; i++ {
+		d, err := setRandom(t, ctx1, c, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, d)
+	}
+	other, err := setRandom(t, ctx2, c, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	epoch := m.epoch(time.Now())
+	if err := m.scan(ctx1, epoch.Add(-*quotaScanInterval)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.scan(ctx1, epoch); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, d := range digests {
+		exists, err := c.Contains(ctx1, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantExists := i >= 2; exists != wantExists {
+			t.Errorf("Entry %d exists: %t, want %t", i, exists, wantExists)
+		}
+	}
+	if exists, err := c.Contains(ctx2, other); err != nil || !exists {
+		t.Errorf("Entry of a group under its soft limit was evicted")
+	}
+
+	// Writes over the soft limit are still accepted.
+	if _, err := setRandom(t, ctx1, c, 1000); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,421 @@
+package usage_tracker
+
+import (
+	"context"
+	"flag"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	uapb "github.com/buildbuddy-io/buildbuddy/proto/usage"
+)
+
+var (
+	usageFlushInterval      = flag.Duration("usage_flush_interval", 1*time.Minute, "How often cache usage counts are written to the database.")
+	usageStoredScanInterval = flag.Duration("usage_stored_scan_interval", 1*time.Hour, "How often every app replica totals how many bytes each group stores in its local cache.")
+)
+
+const (
+	period = 24 * time.Hour
+
+	// The range of days returned by GetUsage if the request doesn't set
+	// a start time.
+	defaultQueryPeriods = 30
+	// The largest range of days that GetUsage will return.
+	maxQueryPeriods = 366
+)
+
+// usageKey identifies the Usage row that counts are aggregated into.
+type usageKey struct {
+	groupID         string
+	instanceName    string
+	periodStartUsec int64
+}
+
+// storedKey identifies the bytes that a group stores under one remote
+// instance name.
+type storedKey struct {
+	groupID      string
+	instanceName string
+}
+
+func periodStart(t time.Time) time.Time {
+	return t.UTC().Truncate(period)
+}
+
+func addCounts(dst, src *tables.UsageCounts) {
+	dst.ActionCacheHits += src.ActionCacheHits
+	dst.ActionCacheMisses += src.ActionCacheMisses
+	dst.ActionCacheUploads += src.ActionCacheUploads
+	dst.CasCacheHits += src.CasCacheHits
+	dst.CasCacheMisses += src.CasCacheMisses
+	dst.CasCacheUploads += src.CasCacheUploads
+	dst.TotalDownloadSizeBytes += src.TotalDownloadSizeBytes
+	dst.TotalUploadSizeBytes += src.TotalUploadSizeBytes
+}
+
+// UsageTracker aggregates cache usage per group, remote instance name and
+// day. Counts are buffered in memory and periodically added to the Usages
+// table, so that every app replica can write to the same rows.
+//
+// Stored bytes are totaled by periodically scanning the local cache: each
+// replica writes how many bytes each group stores in it to the CacheEntries
+// table, and the sum over all replicas is recorded as the day's stored size.
+type UsageTracker struct {
+	env       environment.Env
+	h         *db.DBHandle
+	scanner   interfaces.KeyScanner
+	replicaID string
+
+	mu      sync.Mutex
+	pending map[usageKey]*tables.UsageCounts
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewUsageTracker returns a UsageTracker which writes usage to h. scanner is
+// the cache that entries are stored in on this replica; if it is nil, stored
+// bytes are not tracked.
+func NewUsageTracker(env environment.Env, h *db.DBHandle, scanner interfaces.KeyScanner) *UsageTracker {
+	return &UsageTracker{
+		env:       env,
+		h:         h,
+		scanner:   scanner,
+		replicaID: uuid.New().String(),
+		pending:   make(map[usageKey]*tables.UsageCounts),
+	}
+}
+
+// groupID returns the group that ctx is authenticated as. It is empty for
+// anonymous users and users without a group, whose usage isn't recorded
+// since it can't be queried.
+func (ut *UsageTracker) groupID(ctx context.Context) string {
+	if auth := ut.env.GetAuthenticator(); auth != nil {
+		if u, err := auth.AuthenticatedUser(ctx); err == nil {
+			return u.GetGroupID()
+		}
+	}
+	return ""
+}
+
+func (ut *UsageTracker) Increment(ctx context.Context, instanceName string, counts *tables.UsageCounts) error {
+	groupID := ut.groupID(ctx)
+	if groupID == "" {
+		return nil
+	}
+	k := usageKey{
+		groupID:         groupID,
+		instanceName:    instanceName,
+		periodStartUsec: periodStart(time.Now()).UnixNano() / 1000,
+	}
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	ut.add(k, counts)
+	return nil
+}
+
+// add must be called with mu held.
+func (ut *UsageTracker) add(k usageKey, counts *tables.UsageCounts) {
+	existing, ok := ut.pending[k]
+	if !ok {
+		existing = &tables.UsageCounts{}
+		ut.pending[k] = existing
+	}
+	addCounts(existing, counts)
+}
+
+func (ut *UsageTracker) flushRow(k usageKey, c *tables.UsageCounts) error {
+	return ut.h.Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec(`UPDATE Usages SET
+		                    action_cache_hits = action_cache_hits + ?,
+		                    action_cache_misses = action_cache_misses + ?,
+		                    action_cache_uploads = action_cache_uploads + ?,
+		                    cas_cache_hits = cas_cache_hits + ?,
+		                    cas_cache_misses = cas_cache_misses + ?,
+		                    cas_cache_uploads = cas_cache_uploads + ?,
+		                    total_download_size_bytes = total_download_size_bytes + ?,
+		                    total_upload_size_bytes = total_upload_size_bytes + ?,
+		                    updated_at_usec = ?
+		                WHERE group_id = ? AND instance_name = ? AND period_start_usec = ?`,
+			c.ActionCacheHits, c.ActionCacheMisses, c.ActionCacheUploads,
+			c.CasCacheHits, c.CasCacheMisses, c.CasCacheUploads,
+			c.TotalDownloadSizeBytes, c.TotalUploadSizeBytes,
+			time.Now().UnixNano()/1000,
+			k.groupID, k.instanceName, k.periodStartUsec)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected > 0 {
+			return nil
+		}
+		return tx.Create(&tables.Usage{
+			GroupID:         k.groupID,
+			InstanceName:    k.instanceName,
+			PeriodStartUsec: k.periodStartUsec,
+			UsageCounts:     *c,
+		}).Error
+	})
+}
+
+// Flush writes all buffered counts to the database. Counts which could not be
+// written are kept, and retried by the next flush.
+func (ut *UsageTracker) Flush() error {
+	ut.mu.Lock()
+	pending := ut.pending
+	ut.pending = make(map[usageKey]*tables.UsageCounts)
+	ut.mu.Unlock()
+
+	var lastErr error
+	for k, c := range pending {
+		if err := ut.flushRow(k, c); err != nil {
+			// Another replica may have created the row between our
+			// update and insert, in which case the retry will update it.
+			lastErr = err
+			ut.mu.Lock()
+			ut.add(k, c)
+			ut.mu.Unlock()
+		}
+	}
+	return lastErr
+}
+
+// localStoredBytes returns how many bytes each group stores in the local
+// cache under each remote instance name.
+func (ut *UsageTracker) localStoredBytes(ctx context.Context) (map[storedKey]int64, error) {
+	local := make(map[storedKey]int64)
+	err := ut.scanner.ScanKeys(ctx, func(key string, sizeBytes int64) error {
+		userPrefix, cachePrefix, _, err := prefix.ParseCacheKey(key)
+		if err != nil {
+			// Not a cache entry, so it isn't anyone's usage.
+			return nil
+		}
+		groupID := strings.TrimSuffix(userPrefix, "/")
+		if groupID == "ANON" {
+			return nil
+		}
+		// The cache prefix is the instance name, if any, followed by
+		// the action cache prefix for action results.
+		instanceName := strings.TrimSuffix(cachePrefix, namespace.ACCachePrefix+"/")
+		instanceName = strings.TrimSuffix(instanceName, "/")
+		local[storedKey{groupID, instanceName}] += sizeBytes
+		return nil
+	})
+	return local, err
+}
+
+// reportStoredBytes replaces the stored bytes this replica reported by the
+// bytes each group now stores in its local cache. They expire if the
+// replica doesn't report again within two intervals.
+func (ut *UsageTracker) reportStoredBytes(ctx context.Context, local map[storedKey]int64) error {
+	now := time.Now()
+	expirationUsec := now.Add(2*(*usageStoredScanInterval)).UnixNano() / 1000
+	return ut.h.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("replica_id = ?", ut.replicaID).Delete(&tables.CacheEntry{}).Error; err != nil {
+			return err
+		}
+		for k, sizeBytes := range local {
+			err := tx.Create(&tables.CacheEntry{
+				EntryID:            strings.Join([]string{ut.replicaID, k.groupID, k.instanceName}, "/"),
+				ReplicaID:          ut.replicaID,
+				GroupID:            k.groupID,
+				InstanceName:       k.instanceName,
+				ExpirationTimeUsec: expirationUsec,
+				SizeBytes:          sizeBytes,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Where("expiration_time_usec <= ?", now.UnixNano()/1000).Delete(&tables.CacheEntry{}).Error
+	})
+}
+
+// recordStoredBytes sets the current day's stored size of every group and
+// instance name to the total that all replicas last reported.
+func (ut *UsageTracker) recordStoredBytes(ctx context.Context) error {
+	type storedRow struct {
+		GroupID      string
+		InstanceName string
+		SizeBytes    int64
+	}
+	var rows []*storedRow
+	err := ut.h.Raw(`SELECT group_id, instance_name, SUM(size_bytes) AS size_bytes FROM CacheEntries
+	                 GROUP BY group_id, instance_name`).Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	total := make(map[storedKey]int64, len(rows))
+	for _, r := range rows {
+		total[storedKey{r.GroupID, r.InstanceName}] = r.SizeBytes
+	}
+
+	periodStartUsec := periodStart(time.Now()).UnixNano() / 1000
+	// Groups that no longer store anything must be reset too.
+	var recorded []*tables.Usage
+	err = ut.h.Where("period_start_usec = ? AND stored_size_bytes > 0", periodStartUsec).Find(&recorded).Error
+	if err != nil {
+		return err
+	}
+	for _, u := range recorded {
+		k := storedKey{u.GroupID, u.InstanceName}
+		if _, ok := total[k]; !ok {
+			total[k] = 0
+		}
+	}
+
+	var lastErr error
+	for k, sizeBytes := range total {
+		err := ut.h.Transaction(func(tx *gorm.DB) error {
+			res := tx.Exec(`UPDATE Usages SET stored_size_bytes = ?, updated_at_usec = ?
+			                WHERE group_id = ? AND instance_name = ? AND period_start_usec = ?`,
+				sizeBytes, time.Now().UnixNano()/1000, k.groupID, k.instanceName, periodStartUsec)
+			if res.Error != nil || res.RowsAffected > 0 || sizeBytes == 0 {
+				return res.Error
+			}
+			return tx.Create(&tables.Usage{
+				GroupID:         k.groupID,
+				InstanceName:    k.instanceName,
+				PeriodStartUsec: periodStartUsec,
+				StoredSizeBytes: sizeBytes,
+			}).Error
+		})
+		if err != nil {
+			// Another replica may have created the row concurrently,
+			// in which case the next scan will update it.
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// UpdateStoredBytes reports how many bytes each group stores in the local
+// cache, and records the total over all replicas as the current day's
+// stored size.
+func (ut *UsageTracker) UpdateStoredBytes(ctx context.Context) error {
+	if ut.scanner == nil {
+		return nil
+	}
+	local, err := ut.localStoredBytes(ctx)
+	if err != nil {
+		return err
+	}
+	if err := ut.reportStoredBytes(ctx, local); err != nil {
+		return err
+	}
+	return ut.recordStoredBytes(ctx)
+}
+
+// Start periodically flushes buffered counts and totals stored bytes until
+// Stop is called.
+func (ut *UsageTracker) Start() {
+	ut.quit = make(chan struct{})
+	ut.done = make(chan struct{})
+	ticker := time.NewTicker(*usageFlushInterval)
+	scanTicker := time.NewTicker(*usageStoredScanInterval)
+	if ut.scanner == nil {
+		log.Printf("Usage: cache does not support scanning keys; stored bytes are not tracked")
+	}
+	go func() {
+		defer close(ut.done)
+		for {
+			select {
+			case <-ticker.C:
+				if err := ut.Flush(); err != nil {
+					log.Printf("Error flushing cache usage: %s", err)
+				}
+			case <-scanTicker.C:
+				if err := ut.UpdateStoredBytes(context.Background()); err != nil {
+					log.Printf("Error totaling stored cache bytes: %s", err)
+				}
+			case <-ut.quit:
+				ticker.Stop()
+				scanTicker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic flushes started by Start, flushes any counts that
+// are still buffered, and withdraws the stored bytes this replica reported.
+func (ut *UsageTracker) Stop() error {
+	if ut.quit != nil {
+		close(ut.quit)
+		<-ut.done
+		ut.quit = nil
+	}
+	if ut.scanner != nil {
+		if err := ut.h.Where("replica_id = ?", ut.replicaID).Delete(&tables.CacheEntry{}).Error; err != nil {
+			log.Printf("Error withdrawing stored cache bytes: %s", err)
+		}
+	}
+	return ut.Flush()
+}
+
+func toProto(u *tables.Usage) *uapb.Usage {
+	return &uapb.Usage{
+		InstanceName:           u.InstanceName,
+		PeriodStartUsec:        u.PeriodStartUsec,
+		ActionCacheHits:        u.ActionCacheHits,
+		ActionCacheMisses:      u.ActionCacheMisses,
+		ActionCacheUploads:     u.ActionCacheUploads,
+		CasCacheHits:           u.CasCacheHits,
+		CasCacheMisses:         u.CasCacheMisses,
+		CasCacheUploads:        u.CasCacheUploads,
+		TotalDownloadSizeBytes: u.TotalDownloadSizeBytes,
+		TotalUploadSizeBytes:   u.TotalUploadSizeBytes,
+		StoredSizeBytes:        u.StoredSizeBytes,
+	}
+}
+
+func (ut *UsageTracker) GetUsage(ctx context.Context, req *uapb.GetUsageRequest) (*uapb.GetUsageResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := perms.AuthorizeGroupAccess(ctx, ut.env, groupID); err != nil {
+		return nil, err
+	}
+
+	end := time.Now()
+	if req.GetEndTimeUsec() > 0 {
+		end = time.Unix(0, req.GetEndTimeUsec()*1000)
+	}
+	end = periodStart(end)
+	start := end.Add(-(defaultQueryPeriods - 1) * period)
+	if req.GetStartTimeUsec() > 0 {
+		start = periodStart(time.Unix(0, req.GetStartTimeUsec()*1000))
+	}
+	if start.After(end) {
+		return nil, status.InvalidArgumentError("start_time_usec must not be after end_time_usec")
+	}
+	if end.Sub(start) >= maxQueryPeriods*period {
+		return nil, status.InvalidArgumentErrorf("Usage can be returned for at most %d days", maxQueryPeriods)
+	}
+
+	q := ut.h.Where("group_id = ? AND period_start_usec >= ? AND period_start_usec <= ?",
+		groupID, start.UnixNano()/1000, end.UnixNano()/1000)
+	if instanceName := req.GetInstanceName(); instanceName != "" {
+		q = q.Where("instance_name = ?", instanceName)
+	}
+	var rows []*tables.Usage
+	if err := q.Order("period_start_usec ASC, instance_name ASC").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	rsp := &uapb.GetUsageResponse{}
+	for _, u := range rows {
+		rsp.Usage = append(rsp.Usage, toProto(u))
+	}
+	return rsp, nil
+}
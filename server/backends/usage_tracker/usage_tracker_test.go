@@ -0,0 +1,173 @@
+package usage_tracker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	uapb "github.com/buildbuddy-io/buildbuddy/proto/usage"
+	testauth "github.com/buildbuddy-io/buildbuddy/server/testutil/auth"
+	testdigest "github.com/buildbuddy-io/buildbuddy/server/testutil/digest"
+	testenv "github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+)
+
+func getUsage(t *testing.T, ut *UsageTracker, ctx context.Context, req *uapb.GetUsageRequest) []*uapb.Usage {
+	rsp, err := ut.GetUsage(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsp.GetUsage()
+}
+
+func TestIncrementAndGetUsage(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("US1", "GR1", "US2", "GR2")
+	te.SetAuthenticator(testauth.NewTestAuthenticator(users))
+	ut := NewUsageTracker(te, te.GetDBHandle(), nil)
+
+	ctx1 := testauth.WithAuthenticatedUser(context.Background(), users["US1"])
+	ctx2 := testauth.WithAuthenticatedUser(context.Background(), users["US2"])
+
+	// Flush in between increments, so that both the insert and the update
+	// paths are exercised.
+	if err := ut.Increment(ctx1, "", &tables.UsageCounts{CasCacheHits: 1, TotalDownloadSizeBytes: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ut.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ut.Increment(ctx1, "", &tables.UsageCounts{CasCacheHits: 1, TotalDownloadSizeBytes: 50}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ut.Increment(ctx1, "linux", &tables.UsageCounts{ActionCacheUploads: 1, TotalUploadSizeBytes: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ut.Increment(ctx2, "", &tables.UsageCounts{ActionCacheMisses: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// Anonymous usage isn't recorded.
+	if err := ut.Increment(context.Background(), "", &tables.UsageCounts{CasCacheHits: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ut.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	day := periodStart(time.Now()).UnixNano() / 1000
+	got := getUsage(t, ut, ctx1, &uapb.GetUsageRequest{RequestContext: testauth.RequestContext("US1", "GR1")})
+	if len(got) != 2 {
+		t.Fatalf("Got %d usage rows, want 2: %v", len(got), got)
+	}
+	if got[0].GetInstanceName() != "" || got[0].GetPeriodStartUsec() != day || got[0].GetCasCacheHits() != 2 || got[0].GetTotalDownloadSizeBytes() != 150 {
+		t.Errorf("Unexpected usage for the default instance name: %v", got[0])
+	}
+	if got[1].GetInstanceName() != "linux" || got[1].GetActionCacheUploads() != 1 || got[1].GetTotalUploadSizeBytes() != 10 {
+		t.Errorf("Unexpected usage for the linux instance name: %v", got[1])
+	}
+
+	got = getUsage(t, ut, ctx1, &uapb.GetUsageRequest{RequestContext: testauth.RequestContext("US1", "GR1"), InstanceName: "linux"})
+	if len(got) != 1 || got[0].GetInstanceName() != "linux" {
+		t.Errorf("Got usage %v, want only the linux instance name", got)
+	}
+
+	got = getUsage(t, ut, ctx2, &uapb.GetUsageRequest{RequestContext: testauth.RequestContext("US2", "GR2")})
+	if len(got) != 1 || got[0].GetActionCacheMisses() != 1 || got[0].GetCasCacheHits() != 0 {
+		t.Errorf("Unexpected usage for GR2: %v", got)
+	}
+
+	var anonymousRows int64
+	if err := te.GetDBHandle().Model(&tables.Usage{}).Where("group_id = ?", "").Count(&anonymousRows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if anonymousRows != 0 {
+		t.Errorf("Got %d usage rows for anonymous usage, want none", anonymousRows)
+	}
+
+	// Usage from before the requested range is not returned.
+	tomorrow := time.Now().Add(period).UnixNano() / 1000
+	got = getUsage(t, ut, ctx1, &uapb.GetUsageRequest{RequestContext: testauth.RequestContext("US1", "GR1"), StartTimeUsec: tomorrow, EndTimeUsec: tomorrow})
+	if len(got) != 0 {
+		t.Errorf("Got usage %v for tomorrow, want none", got)
+	}
+}
+
+func TestGetUsageRequiresGroupAccess(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("US1", "GR1", "US2", "GR2")
+	te.SetAuthenticator(testauth.NewTestAuthenticator(users))
+	ut := NewUsageTracker(te, te.GetDBHandle(), nil)
+
+	ctx := testauth.WithAuthenticatedUser(context.Background(), users["US2"])
+	_, err := ut.GetUsage(ctx, &uapb.GetUsageRequest{RequestContext: testauth.RequestContext("US2", "GR1")})
+	if !status.IsPermissionDeniedError(err) {
+		t.Fatalf("GetUsage for another group returned %v, want a PermissionDenied error", err)
+	}
+}
+
+func TestUpdateStoredBytes(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("US1", "GR1")
+	te.SetAuthenticator(testauth.NewTestAuthenticator(users))
+	mc, err := memory_cache.NewMemoryCache(1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut := NewUsageTracker(te, te.GetDBHandle(), mc)
+	ctx := testauth.WithAuthenticatedUser(context.Background(), users["US1"])
+
+	set := func(userPrefix string, cache interfaces.Cache, sizeBytes int64) *repb.Digest {
+		d, buf := testdigest.NewRandomDigestBuf(t, sizeBytes)
+		if err := cache.Set(prefix.AttachExplicitUserPrefixToContext(ctx, userPrefix), d, buf); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	d := set("GR1/", namespace.CASCache(mc, ""), 100)
+	set("GR1/", namespace.ActionCache(mc, ""), 10)
+	set("GR1/", namespace.CASCache(mc, "linux"), 1000)
+	set("GR1/", namespace.ActionCache(mc, "linux"), 20)
+	// Anonymous entries aren't anyone's usage.
+	set("ANON/", namespace.CASCache(mc, ""), 500)
+
+	if err := ut.UpdateStoredBytes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got := getUsage(t, ut, ctx, &uapb.GetUsageRequest{RequestContext: testauth.RequestContext("US1", "GR1")})
+	if len(got) != 2 || got[0].GetStoredSizeBytes() != 110 || got[1].GetInstanceName() != "linux" || got[1].GetStoredSizeBytes() != 1020 {
+		t.Fatalf("Unexpected stored bytes: %v", got)
+	}
+
+	// Stored bytes are replaced, not added to, by the next scan.
+	if err := mc.Delete(prefix.AttachExplicitUserPrefixToContext(ctx, "GR1/"), d); err != nil {
+		t.Fatal(err)
+	}
+	if err := ut.UpdateStoredBytes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got = getUsage(t, ut, ctx, &uapb.GetUsageRequest{RequestContext: testauth.RequestContext("US1", "GR1")})
+	if len(got) != 2 || got[0].GetStoredSizeBytes() != 10 || got[1].GetStoredSizeBytes() != 1020 {
+		t.Fatalf("Unexpected stored bytes after deleting an entry: %v", got)
+	}
+
+	// Stored bytes are withdrawn when the replica stops, and reset by the
+	// next scan of any replica.
+	if err := ut.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	other := NewUsageTracker(te, te.GetDBHandle(), nil)
+	if err := other.recordStoredBytes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got = getUsage(t, ut, ctx, &uapb.GetUsageRequest{RequestContext: testauth.RequestContext("US1", "GR1")})
+	if len(got) != 2 || got[0].GetStoredSizeBytes() != 0 || got[1].GetStoredSizeBytes() != 0 {
+		t.Fatalf("Unexpected stored bytes after the replica stopped: %v", got)
+	}
+}
@@ -3,22 +3,27 @@ package build_event_handler
 import (
 	"context"
 	"crypto/md5"
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/accumulator"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_status_reporter"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_parser"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_profile"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/redact"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/target_tracker"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/hit_tracker"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/background"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -39,34 +44,64 @@ import (
 
 const (
 	defaultChunkFileSizeBytes = 1000 * 100 // 100KB
+
+	// How often the events and summary of an in-progress invocation are
+	// checkpointed to the blobstore.
+	checkpointInterval = 10 * time.Second
+
+	// How long to spend fetching and summarizing the timing profile.
+	profileFetchTimeout = 5 * time.Minute
+
+	// How often invocation event streams check whether the invocation is
+	// complete, and read back the events they missed from the blobstore.
+	streamPollInterval = 5 * time.Second
+
+	// How many events received ahead of the ones they missed an invocation
+	// event stream holds on to until it has read those back.
+	maxPendingStreamedEvents = 1000
+
+	// The most events an invocation event stream sends in one batch.
+	maxStreamedEventBatchSize = 100
 )
 
 type BuildEventHandler struct {
-	env environment.Env
+	env      environment.Env
+	redactor *redact.Redactor
 }
 
-func NewBuildEventHandler(env environment.Env) *BuildEventHandler {
-	return &BuildEventHandler{
-		env: env,
+func NewBuildEventHandler(env environment.Env) (*BuildEventHandler, error) {
+	redactor, err := redact.NewRedactor(env)
+	if err != nil {
+		return nil, err
 	}
+	return &BuildEventHandler{
+		env:      env,
+		redactor: redactor,
+	}, nil
 }
 
-func (b *BuildEventHandler) OpenChannel(ctx context.Context, iid string) interfaces.BuildEventChannel {
+func (b *BuildEventHandler) OpenChannel(ctx context.Context, iid string) (interfaces.BuildEventChannel, error) {
 	chunkFileSizeBytes := b.env.GetConfigurator().GetStorageChunkFileSizeBytes()
 	if chunkFileSizeBytes == 0 {
 		chunkFileSizeBytes = defaultChunkFileSizeBytes
 	}
 	buildEventAccumulator := accumulator.NewBEValues(iid)
-	return &EventChannel{
+	e := &EventChannel{
 		env:                     b.env,
 		ctx:                     ctx,
 		pw:                      protofile.NewBufferedProtoWriter(b.env.GetBlobstore(), iid, chunkFileSizeBytes),
+		parser:                  event_parser.NewStreamingEventParser(),
+		redactor:                b.redactor,
 		beValues:                buildEventAccumulator,
 		statusReporter:          build_status_reporter.NewBuildStatusReporter(b.env, buildEventAccumulator),
 		targetTracker:           target_tracker.NewTargetTracker(b.env, buildEventAccumulator),
 		hasReceivedStartedEvent: false,
 		eventsBeforeStarted:     make([]*inpb.InvocationEvent, 0),
 	}
+	if err := e.resume(iid, chunkFileSizeBytes); err != nil {
+		return nil, err
+	}
+	return e, nil
 }
 
 func isFinalEvent(obe *pepb.OrderedBuildEvent) bool {
@@ -93,6 +128,14 @@ func isWorkspaceStatusEvent(bazelBuildEvent *build_event_stream.BuildEvent) bool
 	return false
 }
 
+func isStructuredCommandLineEvent(bazelBuildEvent *build_event_stream.BuildEvent) bool {
+	switch bazelBuildEvent.Payload.(type) {
+	case *build_event_stream.BuildEvent_StructuredCommandLine:
+		return true
+	}
+	return false
+}
+
 func readBazelEvent(obe *pepb.OrderedBuildEvent, out *build_event_stream.BuildEvent) error {
 	switch buildEvent := obe.Event.Event.(type) {
 	case *bepb.BuildEvent_BazelEvent:
@@ -105,30 +148,196 @@ type EventChannel struct {
 	ctx                     context.Context
 	env                     environment.Env
 	pw                      *protofile.BufferedProtoWriter
+	parser                  *event_parser.StreamingEventParser
+	commandLineEvents       []*inpb.InvocationEvent
 	beValues                *accumulator.BEValues
 	statusReporter          *build_status_reporter.BuildStatusReporter
 	targetTracker           *target_tracker.TargetTracker
 	hasReceivedStartedEvent bool
 	eventsBeforeStarted     []*inpb.InvocationEvent
+
+	// The sequence number of the last event received, and of the last one
+	// that's been persisted along with every event before it.
+	lastSequenceNumber      int64
+	persistedSequenceNumber int64
+
+	// The group whose redaction rules apply, and how many secrets have been
+	// redacted from the events received so far.
+	redactor       *redact.Redactor
+	groupID        string
+	redactionCount int64
+
+	// The summary last written to the blobstore.
+	summary *inpb.Invocation
 }
 
-func (e *EventChannel) fillInvocationFromEvents(ctx context.Context, iid string, invocation *inpb.Invocation) error {
-	pr := protofile.NewBufferedProtoReader(e.env.GetBlobstore(), iid)
-	parser := event_parser.NewStreamingEventParser()
-	parser.FillInvocation(invocation)
-	for {
-		event := &inpb.InvocationEvent{}
-		err := pr.ReadProto(ctx, event)
-		if err == nil {
-			parser.ParseEvent(event)
-		} else if err == io.EOF {
-			break
-		} else {
-			log.Printf("returning some other error: %s", err)
+// resume rebuilds the channel's state from the events persisted for the
+// invocation by an earlier stream, for when bazel reconnects after a network
+// error or an app restart, possibly to another app. The events bazel resends
+// are then skipped, and new ones are appended to the persisted ones. The
+// build status reporter and target tracker only see the events received
+// after reconnecting.
+func (e *EventChannel) resume(iid string, chunkFileSizeBytes int) error {
+	// Events are only persisted once the started event has been received,
+	// so there's nothing to resume until then.
+	exists, err := protofile.StreamExists(e.ctx, e.env.GetBlobstore(), iid)
+	if err != nil || !exists {
+		return err
+	}
+	// The invocation stays owned by the group that started it. API keys
+	// were redacted from the persisted started event, so the stream can't
+	// be re-authenticated from it: it may only be resumed by a user of the
+	// same group.
+	ti, err := e.env.GetInvocationDB().LookupInvocationOwner(e.ctx, iid)
+	if status.IsNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	groupID := ""
+	if auth := e.env.GetAuthenticator(); auth != nil {
+		if u, err := auth.AuthenticatedUser(e.ctx); err == nil {
+			groupID = u.GetGroupID()
+		}
+	}
+	if groupID != ti.GroupID {
+		return status.PermissionDeniedErrorf("Invocation %s belongs to another group", iid)
+	}
+	e.groupID = ti.GroupID
+
+	summary, err := readSummary(e.ctx, e.env, iid)
+	if err != nil {
+		return err
+	}
+	if summary != nil {
+		e.parser.RestoreConsoleBuffer(summary.ConsoleBuffer)
+		e.redactionCount = summary.RedactionCount
+		e.summary = summary
+	}
+	err = readEvents(e.ctx, e.env, iid, 0, func(event *inpb.InvocationEvent) bool {
+		e.beValues.AddEvent(event.BuildEvent)
+		e.parser.ParseEvent(event)
+		if isStructuredCommandLineEvent(event.BuildEvent) {
+			e.commandLineEvents = append(e.commandLineEvents, event)
+		}
+		e.lastSequenceNumber = event.SequenceNumber
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Resuming invocation %s after event %d", iid, e.lastSequenceNumber)
+	e.persistedSequenceNumber = e.lastSequenceNumber
+	e.hasReceivedStartedEvent = true
+	e.pw, err = protofile.NewResumedBufferedProtoWriter(e.ctx, e.env.GetBlobstore(), iid, chunkFileSizeBytes)
+	if err != nil {
+		return err
+	}
+	// The earlier stream may have marked the invocation disconnected, in
+	// which case it's in progress again. Complete invocations stay
+	// complete: bazel is only resending the events it didn't see acked.
+	if ti.InvocationStatus != int64(inpb.Invocation_DISCONNECTED_INVOCATION_STATUS) {
+		return nil
+	}
+	return e.env.GetInvocationDB().InsertOrUpdateInvocation(e.ctx, &tables.Invocation{
+		InvocationID:     iid,
+		InvocationStatus: int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS),
+	})
+}
+
+// authenticate switches the channel to the context of the API key in the
+// options of the started event, if there is one, and to the redaction rules
+// of its group.
+func (e *EventChannel) authenticate(startedEvent *build_event_stream.BuildEvent) error {
+	auth := e.env.GetAuthenticator()
+	if auth == nil {
+		return nil
+	}
+	options, err := extractOptionsFromStartedBuildEvent(startedEvent)
+	if err != nil {
+		return err
+	}
+	if apiKey := auth.ParseAPIKeyFromString(options); apiKey != "" {
+		e.ctx = auth.AuthContextFromAPIKey(e.ctx, apiKey)
+		authError := e.ctx.Value(interfaces.AuthContextUserErrorKey)
+		if authError != nil {
+			if err, ok := authError.(error); ok {
+				return err
+			}
+			return status.UnknownError(fmt.Sprintf("%v", authError))
+		}
+	}
+	if u, err := auth.AuthenticatedUser(e.ctx); err == nil {
+		e.groupID = u.GetGroupID()
+	}
+	return nil
+}
+
+// PersistedSequenceNumber returns the sequence number up to which events
+// have been persisted, and so can be acked.
+func (e *EventChannel) PersistedSequenceNumber() int64 {
+	return e.persistedSequenceNumber
+}
+
+// LastSequenceNumber returns the sequence number of the last event received,
+// by this stream or an earlier one.
+func (e *EventChannel) LastSequenceNumber() int64 {
+	return e.lastSequenceNumber
+}
+
+// RoutingInfo returns what the invocation's events are routed to build event
+// proxies by, which is all known once the workspace status event has been
+// handled.
+func (e *EventChannel) RoutingInfo() (*interfaces.BuildEventRoutingInfo, bool) {
+	return &interfaces.BuildEventRoutingInfo{
+		GroupID: e.groupID,
+		RepoURL: e.beValues.RepoURL(),
+		Role:    e.beValues.Role(),
+		Command: e.beValues.Command(),
+	}, e.beValues.WorkspaceIsLoaded()
+}
+
+// summaryBlobName returns the name of the blob holding the summary of the
+// events received so far for an invocation: an Invocation filled in by the
+// event parser. Its only events are the structured command line events,
+// redacted with every env var allowed so far.
+func summaryBlobName(iid string) string {
+	return filepath.Join(iid, "summary")
+}
+
+// fillInvocation fills in the summary of the events received so far and
+// checkpoints it to the blobstore if it changed, so that lookups don't have
+// to parse the events again.
+func (e *EventChannel) fillInvocation(ctx context.Context, iid string, invocation *inpb.Invocation) error {
+	summary := &inpb.Invocation{InvocationId: iid, RedactionCount: e.redactionCount}
+	e.parser.FillInvocation(summary)
+	for i, event := range e.commandLineEvents {
+		summary.Event = append(summary.Event, &inpb.InvocationEvent{
+			EventTime:      event.EventTime,
+			SequenceNumber: event.SequenceNumber,
+			BuildEvent: &build_event_stream.BuildEvent{
+				Id:       event.BuildEvent.Id,
+				Children: event.BuildEvent.Children,
+				Payload: &build_event_stream.BuildEvent_StructuredCommandLine{
+					StructuredCommandLine: summary.StructuredCommandLine[i],
+				},
+			},
+		})
+	}
+	if !proto.Equal(summary, e.summary) {
+		protoBytes, err := proto.Marshal(summary)
+		if err != nil {
 			return err
 		}
+		if _, err := e.env.GetBlobstore().WriteBlob(ctx, summaryBlobName(iid), protoBytes); err != nil {
+			return err
+		}
+		// The summary shares messages with the parser, which may
+		// change them as more events are parsed.
+		e.summary = proto.Clone(summary).(*inpb.Invocation)
 	}
-	parser.FillInvocation(invocation)
+	fillInvocationFromSummary(summary, invocation)
 	return nil
 }
 
@@ -152,13 +361,17 @@ func (e *EventChannel) MarkInvocationDisconnected(ctx context.Context, iid strin
 		InvocationStatus: inpb.Invocation_DISCONNECTED_INVOCATION_STATUS,
 	}
 
-	err := e.fillInvocationFromEvents(ctx, iid, invocation)
+	err := e.fillInvocation(ctx, iid, invocation)
 	if err != nil {
 		return err
 	}
 
 	ti := tableInvocationFromProto(invocation, iid)
-	return e.env.GetInvocationDB().InsertOrUpdateInvocation(ctx, ti)
+	if err := e.env.GetInvocationDB().InsertOrUpdateInvocation(ctx, ti); err != nil {
+		return err
+	}
+	e.publishStatusChange(ctx, iid)
+	return nil
 }
 
 func fillInvocationFromCacheStats(cacheStats *capb.CacheStats, ti *tables.Invocation) {
@@ -175,6 +388,27 @@ func fillInvocationFromCacheStats(cacheStats *capb.CacheStats, ti *tables.Invoca
 	ti.DownloadThroughputBytesPerSecond = cacheStats.GetDownloadThroughputBytesPerSecond()
 	ti.UploadThroughputBytesPerSecond = cacheStats.GetUploadThroughputBytesPerSecond()
 	ti.TotalCachedActionExecUsec = cacheStats.GetTotalCachedActionExecUsec()
+	ti.QuotaSoftLimitExceededCount = cacheStats.GetQuotaSoftLimitExceededCount()
+	ti.QuotaHardLimitExceededCount = cacheStats.GetQuotaHardLimitExceededCount()
+}
+
+func fillInvocationFromBuildMetrics(buildMetrics *build_event_stream.BuildMetrics, ti *tables.Invocation) {
+	ti.ActionsCreated = buildMetrics.GetActionSummary().GetActionsCreated()
+	ti.TargetsLoaded = buildMetrics.GetTargetMetrics().GetTargetsLoaded()
+	ti.TargetsConfigured = buildMetrics.GetTargetMetrics().GetTargetsConfigured()
+	ti.PackagesLoaded = buildMetrics.GetPackageMetrics().GetPackagesLoaded()
+	ti.UsedHeapSizePostBuild = buildMetrics.GetMemoryMetrics().GetUsedHeapSizePostBuild()
+	ti.CPUTimeUsec = millisToUsec(buildMetrics.GetTimingMetrics().GetCpuTimeInMs())
+	ti.WallTimeUsec = millisToUsec(buildMetrics.GetTimingMetrics().GetWallTimeInMs())
+	ti.AnalysisPhaseTimeUsec = millisToUsec(buildMetrics.GetTimingMetrics().GetAnalysisPhaseTimeInMs())
+}
+
+func millisToUsec(ms int64) int64 {
+	return (time.Duration(ms) * time.Millisecond).Microseconds()
+}
+
+func usecToMillis(usec int64) int64 {
+	return (time.Duration(usec) * time.Microsecond).Milliseconds()
 }
 
 func invocationStatusLabel(ti *tables.Invocation) string {
@@ -215,10 +449,11 @@ func (e *EventChannel) FinalizeInvocation(iid string) error {
 		InvocationId:     iid,
 		InvocationStatus: inpb.Invocation_COMPLETE_INVOCATION_STATUS,
 	}
-	err := e.fillInvocationFromEvents(e.ctx, iid, invocation)
+	err := e.fillInvocation(e.ctx, iid, invocation)
 	if err != nil {
 		return err
 	}
+	e.persistedSequenceNumber = e.lastSequenceNumber
 
 	ti := tableInvocationFromProto(invocation, iid)
 	if cacheStats := hit_tracker.CollectCacheStats(e.ctx, e.env, iid); cacheStats != nil {
@@ -228,6 +463,7 @@ func (e *EventChannel) FinalizeInvocation(iid string) error {
 	if err := e.env.GetInvocationDB().InsertOrUpdateInvocation(e.ctx, ti); err != nil {
 		return err
 	}
+	e.publishStatusChange(e.ctx, iid)
 
 	// Notify our webhooks, if we have any.
 	for _, hook := range e.env.GetWebhooks() {
@@ -266,6 +502,16 @@ func (e *EventChannel) handleEvent(event *pepb.PublishBuildToolEventStreamReques
 	streamID := event.OrderedBuildEvent.StreamId
 	iid := streamID.InvocationId
 
+	// Bazel resends every event that wasn't acked when it reconnects, some
+	// of which may have been persisted by an earlier stream already.
+	if seqNo <= e.lastSequenceNumber {
+		return nil
+	}
+	if seqNo != e.lastSequenceNumber+1 {
+		return status.InvalidArgumentErrorf("Expected build event %d of invocation %s, got %d", e.lastSequenceNumber+1, iid, seqNo)
+	}
+	e.lastSequenceNumber = seqNo
+
 	if isFinalEvent(event.OrderedBuildEvent) {
 		return nil
 	}
@@ -292,21 +538,8 @@ func (e *EventChannel) handleEvent(event *pepb.PublishBuildToolEventStreamReques
 			InvocationStatus: int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS),
 		}
 
-		if auth := e.env.GetAuthenticator(); auth != nil {
-			options, err := extractOptionsFromStartedBuildEvent(bazelBuildEvent)
-			if err != nil {
-				return err
-			}
-			if apiKey := auth.ParseAPIKeyFromString(options); apiKey != "" {
-				e.ctx = auth.AuthContextFromAPIKey(e.ctx, apiKey)
-				authError := e.ctx.Value(interfaces.AuthContextUserErrorKey)
-				if authError != nil {
-					if err, ok := authError.(error); ok {
-						return err
-					}
-					return status.UnknownError(fmt.Sprintf("%v", authError))
-				}
-			}
+		if err := e.authenticate(&bazelBuildEvent); err != nil {
+			return err
 		}
 
 		if err := e.env.GetInvocationDB().InsertOrUpdateInvocation(e.ctx, ti); err != nil {
@@ -335,6 +568,20 @@ func (e *EventChannel) handleEvent(event *pepb.PublishBuildToolEventStreamReques
 
 func (e *EventChannel) processSingleEvent(event *inpb.InvocationEvent, iid string) error {
 	e.beValues.AddEvent(event.BuildEvent) // in-memory structure to hold common values we want from the event.
+	// Look for the timing profile before URL secrets are stripped from its
+	// URI, which may need them to fetch it.
+	if uri := invocation_profile.ProfileURI(event.BuildEvent); uri != "" {
+		e.fetchProfile(iid, uri)
+	}
+	// Redact and parse the event before it's saved so that it's stored with
+	// its secrets and progress output already stripped.
+	e.redactionCount += e.redactor.RedactEvent(e.groupID, event.BuildEvent)
+	// Publish the event before parsing it strips its progress output.
+	e.publishEvent(iid, event)
+	e.parser.ParseEvent(event)
+	if isStructuredCommandLineEvent(event.BuildEvent) {
+		e.commandLineEvents = append(e.commandLineEvents, event)
+	}
 
 	if e.env.GetConfigurator().EnableTargetTracking() {
 		e.targetTracker.TrackTargetsForEvent(e.ctx, event.BuildEvent)
@@ -350,12 +597,19 @@ func (e *EventChannel) processSingleEvent(event *inpb.InvocationEvent, iid strin
 	// Small optimization: Flush the event stream after the workspace status event. Most of the
 	// command line options and workspace info has come through by then, so we have
 	// something to show the user. Flushing the proto file here allows that when the
-	// client fetches status for the incomplete build. Also flush if we haven't in over a minute.
-	if isWorkspaceStatusEvent(event.BuildEvent) || e.pw.TimeSinceLastWrite().Minutes() > 1 {
+	// client fetches status for the incomplete build. Also flush after the started
+	// event, and if we haven't in a while.
+	if isStartedEvent(event.BuildEvent) || isWorkspaceStatusEvent(event.BuildEvent) || e.pw.TimeSinceLastWrite() > checkpointInterval {
 		if err := e.pw.Flush(e.ctx); err != nil {
 			return err
 		}
 	}
+	// Whenever the event stream has been flushed, here or because the buffer
+	// filled up, checkpoint the summary so that it matches the persisted
+	// events, then let the events be acked.
+	if !e.pw.IsFlushed() {
+		return nil
+	}
 	// When we get the workspace status event, update the invocation in the DB
 	// so that it can be searched by its commit SHA, user name, etc. even
 	// while the invocation is still in progress.
@@ -363,18 +617,73 @@ func (e *EventChannel) processSingleEvent(event *inpb.InvocationEvent, iid strin
 		if err := e.writeBuildMetadata(e.ctx, iid); err != nil {
 			return err
 		}
+	} else if err := e.fillInvocation(e.ctx, iid, &inpb.Invocation{}); err != nil {
+		return err
 	}
-
+	e.persistedSequenceNumber = event.SequenceNumber
 	return nil
 }
 
+// invocationEventsChannel returns the name of the PubSub channel that the
+// events of an invocation are published to as they're processed, for the
+// replicas streaming them to clients. An empty message is published whenever
+// the invocation's status changes.
+func invocationEventsChannel(iid string) string {
+	return "invocation-events/" + iid
+}
+
+// publishEvent publishes an event that's been redacted, along with its
+// structured command line, which is redacted of every env var that isn't
+// allowed yet. Publishing is best-effort: streams read the events they miss
+// back from the blobstore.
+func (e *EventChannel) publishEvent(iid string, event *inpb.InvocationEvent) {
+	ps := e.env.GetPubSub()
+	if ps == nil {
+		return
+	}
+	if isStructuredCommandLineEvent(event.BuildEvent) {
+		event = proto.Clone(event).(*inpb.InvocationEvent)
+		e.parser.RedactCommandLine(event.BuildEvent.GetStructuredCommandLine())
+	}
+	protoBytes, err := proto.Marshal(event)
+	if err != nil {
+		log.Printf("Error marshaling event %d of invocation %s: %s", event.SequenceNumber, iid, err)
+		return
+	}
+	if err := ps.Publish(e.ctx, invocationEventsChannel(iid), base64.StdEncoding.EncodeToString(protoBytes)); err != nil {
+		log.Printf("Error publishing event %d of invocation %s: %s", event.SequenceNumber, iid, err)
+	}
+}
+
+func (e *EventChannel) publishStatusChange(ctx context.Context, iid string) {
+	ps := e.env.GetPubSub()
+	if ps == nil {
+		return
+	}
+	if err := ps.Publish(ctx, invocationEventsChannel(iid), ""); err != nil {
+		log.Printf("Error publishing status change of invocation %s: %s", iid, err)
+	}
+}
+
+// fetchProfile fetches and summarizes the timing profile in the background,
+// so as not to hold up the stream. Bazel uploads it before referencing it.
+func (e *EventChannel) fetchProfile(iid, uri string) {
+	ctx, cancel := background.ExtendContextForFinalization(e.ctx, profileFetchTimeout)
+	go func() {
+		defer cancel()
+		if err := invocation_profile.FetchAndStore(ctx, e.env, iid, uri); err != nil {
+			log.Printf("Error fetching timing profile for invocation %s: %s", iid, err)
+		}
+	}()
+}
+
 func (e *EventChannel) writeBuildMetadata(ctx context.Context, invocationID string) error {
 	db := e.env.GetInvocationDB()
 	ti := &tables.Invocation{
 		InvocationID: invocationID,
 	}
 	invocationProto := TableInvocationToProto(ti)
-	err := e.fillInvocationFromEvents(ctx, invocationID, invocationProto)
+	err := e.fillInvocation(ctx, invocationID, invocationProto)
 	if err != nil {
 		return err
 	}
@@ -385,7 +694,7 @@ func (e *EventChannel) writeBuildMetadata(ctx context.Context, invocationID stri
 	return nil
 }
 
-func extractOptionsFromStartedBuildEvent(event build_event_stream.BuildEvent) (string, error) {
+func extractOptionsFromStartedBuildEvent(event *build_event_stream.BuildEvent) (string, error) {
 	switch p := event.Payload.(type) {
 	case *build_event_stream.BuildEvent_Started:
 		return p.Started.OptionsDescription, nil
@@ -394,9 +703,18 @@ func extractOptionsFromStartedBuildEvent(event build_event_stream.BuildEvent) (s
 }
 
 func LookupInvocation(env environment.Env, ctx context.Context, iid string) (*inpb.Invocation, error) {
+	invocation, _, err := LookupInvocationWithEvents(env, ctx, iid, 0, 0, nil)
+	return invocation, err
+}
+
+// LookupInvocationWithEvents looks up an invocation along with a page of its
+// events: at most pageSize events matching filter, starting at
+// startSequenceNumber. If the page is full, the sequence number to start the
+// next page at is also returned.
+func LookupInvocationWithEvents(env environment.Env, ctx context.Context, iid string, startSequenceNumber int64, pageSize int, filter *inpb.InvocationEventFilter) (*inpb.Invocation, int64, error) {
 	ti, err := env.GetInvocationDB().LookupInvocation(ctx, iid)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// If this is an incomplete invocation, attempt to fill cache stats
@@ -409,23 +727,573 @@ func LookupInvocation(env environment.Env, ctx context.Context, iid string) (*in
 	}
 
 	invocation := TableInvocationToProto(ti)
+	page := &eventPage{
+		startSequenceNumber: startSequenceNumber,
+		pageSize:            pageSize,
+		filter:              filter,
+	}
+
+	summary, err := readSummary(ctx, env, iid)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Invocations written before summaries were checkpointed are summarized
+	// by parsing all of their events, which were not redacted when they were
+	// received either.
+	if summary == nil {
+		redactor, err := redactorFor(env)
+		if err != nil {
+			return nil, 0, err
+		}
+		parser := event_parser.NewStreamingEventParser()
+		err = readEvents(ctx, env, iid, 0, func(event *inpb.InvocationEvent) bool {
+			redactor.RedactEvent(ti.GroupID, event.BuildEvent)
+			parser.ParseEvent(event)
+			page.add(event)
+			return true
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		parser.FillInvocation(invocation)
+		invocation.Event = page.events
+		return invocation, page.nextSequenceNumber, nil
+	}
+
+	fillInvocationFromSummary(summary, invocation)
+	// Stored events were sanitized as they were received. Structured
+	// command lines are replaced by their copies from the summary, which
+	// are also redacted of the env vars that the build metadata didn't
+	// allow. Command lines received after the summary was checkpointed are
+	// returned as they were stored until the next checkpoint.
+	commandLineEvents := make(map[int64]*inpb.InvocationEvent, len(summary.Event))
+	for _, event := range summary.Event {
+		commandLineEvents[event.SequenceNumber] = event
+	}
+	startChunk, err := findChunk(ctx, env, iid, startSequenceNumber)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = readEvents(ctx, env, iid, startChunk, func(event *inpb.InvocationEvent) bool {
+		if isStructuredCommandLineEvent(event.BuildEvent) {
+			if redacted, ok := commandLineEvents[event.SequenceNumber]; ok {
+				event = redacted
+			}
+		}
+		return page.add(event)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	invocation.Event = page.events
+	return invocation, page.nextSequenceNumber, nil
+}
 
-	parser := event_parser.NewStreamingEventParser()
-	pr := protofile.NewBufferedProtoReader(env.GetBlobstore(), iid)
+// redactorFor returns the redactor of the app's build event handler, so that
+// its rules aren't compiled again on every lookup.
+func redactorFor(env environment.Env) (*redact.Redactor, error) {
+	if b, ok := env.GetBuildEventHandler().(*BuildEventHandler); ok {
+		return b.redactor, nil
+	}
+	return redact.NewRedactor(env)
+}
+
+// eventPage collects the events returned with an invocation.
+type eventPage struct {
+	startSequenceNumber int64
+	pageSize            int
+	filter              *inpb.InvocationEventFilter
+
+	events             []*inpb.InvocationEvent
+	nextSequenceNumber int64
+}
+
+// add adds event to the page if it's selected, and returns false once the
+// page is full.
+func (p *eventPage) add(event *inpb.InvocationEvent) bool {
+	if p.pageSize > 0 && len(p.events) >= p.pageSize {
+		return false
+	}
+	if event.SequenceNumber < p.startSequenceNumber || !matchesEventFilter(event, p.filter) {
+		return true
+	}
+	p.events = append(p.events, event)
+	if p.pageSize > 0 && len(p.events) >= p.pageSize {
+		p.nextSequenceNumber = event.SequenceNumber + 1
+		return false
+	}
+	return true
+}
+
+func matchesEventFilter(event *inpb.InvocationEvent, filter *inpb.InvocationEventFilter) bool {
+	if filter == nil {
+		return true
+	}
+	switch p := event.BuildEvent.GetPayload().(type) {
+	case *build_event_stream.BuildEvent_Progress:
+		if filter.ExcludeProgress {
+			return false
+		}
+	case *build_event_stream.BuildEvent_Action:
+		if filter.ExcludeSuccessfulActions && p.Action.GetSuccess() {
+			return false
+		}
+	}
+	if len(filter.PayloadType) == 0 {
+		return true
+	}
+	t := payloadType(event.BuildEvent)
+	for _, payloadType := range filter.PayloadType {
+		if payloadType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// payloadType returns the type of the payload of event, as it's named in
+// InvocationEventFilters.
+func payloadType(event *build_event_stream.BuildEvent) inpb.InvocationEventFilter_PayloadType {
+	switch event.GetPayload().(type) {
+	case *build_event_stream.BuildEvent_Progress:
+		return inpb.InvocationEventFilter_PROGRESS_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_Aborted:
+		return inpb.InvocationEventFilter_ABORTED_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_Started:
+		return inpb.InvocationEventFilter_STARTED_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_UnstructuredCommandLine:
+		return inpb.InvocationEventFilter_UNSTRUCTURED_COMMAND_LINE_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_StructuredCommandLine:
+		return inpb.InvocationEventFilter_STRUCTURED_COMMAND_LINE_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_OptionsParsed:
+		return inpb.InvocationEventFilter_OPTIONS_PARSED_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_WorkspaceStatus:
+		return inpb.InvocationEventFilter_WORKSPACE_STATUS_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_Fetch:
+		return inpb.InvocationEventFilter_FETCH_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_Configuration:
+		return inpb.InvocationEventFilter_CONFIGURATION_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_Expanded:
+		return inpb.InvocationEventFilter_EXPANDED_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_Configured:
+		return inpb.InvocationEventFilter_CONFIGURED_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_Action:
+		return inpb.InvocationEventFilter_ACTION_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_NamedSetOfFiles:
+		return inpb.InvocationEventFilter_NAMED_SET_OF_FILES_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_Completed:
+		return inpb.InvocationEventFilter_COMPLETED_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_TestResult:
+		return inpb.InvocationEventFilter_TEST_RESULT_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_TestSummary:
+		return inpb.InvocationEventFilter_TEST_SUMMARY_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_Finished:
+		return inpb.InvocationEventFilter_FINISHED_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_BuildToolLogs:
+		return inpb.InvocationEventFilter_BUILD_TOOL_LOGS_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_BuildMetrics:
+		return inpb.InvocationEventFilter_BUILD_METRICS_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_WorkspaceInfo:
+		return inpb.InvocationEventFilter_WORKSPACE_INFO_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_BuildMetadata:
+		return inpb.InvocationEventFilter_BUILD_METADATA_PAYLOAD_TYPE
+	case *build_event_stream.BuildEvent_ConvenienceSymlinksIdentified:
+		return inpb.InvocationEventFilter_CONVENIENCE_SYMLINKS_IDENTIFIED_PAYLOAD_TYPE
+	default:
+		return inpb.InvocationEventFilter_UNKNOWN_PAYLOAD_TYPE
+	}
+}
+
+// StreamInvocationEvents calls fn with batches of the events of an invocation
+// matching filter, starting at startSequenceNumber, as they're received,
+// until the invocation is no longer in progress, fn returns an error, or ctx
+// is done.
+// Events are received through PubSub as they're processed by whichever app
+// is handling the invocation. The events missed before subscribing, or
+// otherwise, are read back from the blobstore once they're persisted. If
+// there's no PubSub, the blobstore is polled instead.
+func StreamInvocationEvents(env environment.Env, ctx context.Context, iid string, startSequenceNumber int64, filter *inpb.InvocationEventFilter, fn func(events []*inpb.InvocationEvent) error) error {
+	// Subscribe before reading the persisted events so that none are missed
+	// in between.
+	var published <-chan string
+	if ps := env.GetPubSub(); ps != nil {
+		subscriber := ps.Subscribe(ctx, invocationEventsChannel(iid))
+		defer subscriber.Close()
+		published = subscriber.Chan()
+	}
+	// Sequence numbers start at 1.
+	if startSequenceNumber < 1 {
+		startSequenceNumber = 1
+	}
+	s := &eventStream{
+		nextSequenceNumber: startSequenceNumber,
+		nextChunk:          -1,
+		filter:             filter,
+		fn:                 fn,
+		pending:            make(map[int64]*inpb.InvocationEvent),
+	}
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+	for {
+		done, err := s.catchUp(env, ctx, iid)
+		if err != nil || done {
+			return err
+		}
+		if err := s.receive(ctx, iid, published, ticker.C); err != nil {
+			return err
+		}
+	}
+}
+
+// eventStream sends the events of an invocation in order, each of them once.
+type eventStream struct {
+	nextSequenceNumber int64
+	filter             *inpb.InvocationEventFilter
+	fn                 func(events []*inpb.InvocationEvent) error
+	batch              []*inpb.InvocationEvent
+
+	// The persisted chunk to read events from next, or -1 until the chunk
+	// holding the next event has been looked up. Chunks aren't changed once
+	// they're written, so each of them is only read once.
+	nextChunk int
+	// The redacted copies of the structured command line events, from the
+	// invocation's summary, by sequence number. Nil until the summary has
+	// been read.
+	commandLineEvents map[int64]*inpb.InvocationEvent
+
+	// The published events received ahead of the next one, by sequence
+	// number.
+	pending map[int64]*inpb.InvocationEvent
+}
+
+func (s *eventStream) send(event *inpb.InvocationEvent) error {
+	s.nextSequenceNumber = event.SequenceNumber + 1
+	if !matchesEventFilter(event, s.filter) {
+		return nil
+	}
+	s.batch = append(s.batch, event)
+	if len(s.batch) >= maxStreamedEventBatchSize {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *eventStream) flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+	batch := s.batch
+	s.batch = nil
+	return s.fn(batch)
+}
+
+// sendPending sends the pending events that are next in order, and drops the
+// ones that have been sent already.
+func (s *eventStream) sendPending() error {
+	for {
+		event, ok := s.pending[s.nextSequenceNumber]
+		if !ok {
+			break
+		}
+		delete(s.pending, event.SequenceNumber)
+		if err := s.send(event); err != nil {
+			return err
+		}
+	}
+	for sequenceNumber := range s.pending {
+		if sequenceNumber < s.nextSequenceNumber {
+			delete(s.pending, sequenceNumber)
+		}
+	}
+	return nil
+}
+
+// catchUp sends the persisted events that haven't been sent yet, and returns
+// whether the invocation is no longer in progress, in which case they were
+// the last of its events. Only the chunks written since the last call are
+// read.
+func (s *eventStream) catchUp(env environment.Env, ctx context.Context, iid string) (bool, error) {
+	if s.commandLineEvents == nil {
+		summary, err := readSummary(ctx, env, iid)
+		if err != nil {
+			return false, err
+		}
+		// Invocations written before summaries were checkpointed, or that
+		// haven't persisted any events yet, are looked up as a whole.
+		if summary == nil {
+			return s.catchUpFromLookup(env, ctx, iid)
+		}
+		s.setSummary(summary)
+	}
+	// Looking up the invocation also checks that it can still be read. Its
+	// status is looked up before its events so that none persisted in
+	// between are missed once it's complete.
+	ti, err := env.GetInvocationDB().LookupInvocation(ctx, iid)
+	if err != nil {
+		return false, err
+	}
+	if s.nextChunk < 0 {
+		s.nextChunk, err = findChunk(ctx, env, iid, s.nextSequenceNumber)
+		if err != nil {
+			return false, err
+		}
+	}
+	for {
+		err := protofile.ReadProtosInChunk(ctx, env.GetBlobstore(), iid, s.nextChunk, func() proto.Message {
+			return &inpb.InvocationEvent{}
+		}, func(msg proto.Message) error {
+			event := msg.(*inpb.InvocationEvent)
+			if event.SequenceNumber < s.nextSequenceNumber {
+				return nil
+			}
+			if isStructuredCommandLineEvent(event.BuildEvent) {
+				redacted, err := s.redactedCommandLineEvent(env, ctx, iid, event)
+				if err != nil {
+					return err
+				}
+				event = redacted
+			}
+			return s.send(event)
+		})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		s.nextChunk++
+	}
+	if err := s.sendPending(); err != nil {
+		return false, err
+	}
+	if err := s.flush(); err != nil {
+		return false, err
+	}
+	return ti.InvocationStatus != int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS), nil
+}
+
+// catchUpFromLookup is like catchUp, for invocations without a summary.
+func (s *eventStream) catchUpFromLookup(env environment.Env, ctx context.Context, iid string) (bool, error) {
+	invocation, _, err := LookupInvocationWithEvents(env, ctx, iid, s.nextSequenceNumber, 0, nil)
+	if err != nil {
+		return false, err
+	}
+	for _, event := range invocation.Event {
+		if event.SequenceNumber < s.nextSequenceNumber {
+			continue
+		}
+		if err := s.send(event); err != nil {
+			return false, err
+		}
+	}
+	if err := s.sendPending(); err != nil {
+		return false, err
+	}
+	if err := s.flush(); err != nil {
+		return false, err
+	}
+	return invocation.InvocationStatus != inpb.Invocation_PARTIAL_INVOCATION_STATUS, nil
+}
+
+func (s *eventStream) setSummary(summary *inpb.Invocation) {
+	s.commandLineEvents = make(map[int64]*inpb.InvocationEvent, len(summary.Event))
+	for _, event := range summary.Event {
+		s.commandLineEvents[event.SequenceNumber] = event
+	}
+}
+
+// redactedCommandLineEvent returns the copy of the structured command line
+// event from the invocation's summary, like LookupInvocationWithEvents. The
+// summary is read again if it was checkpointed before the event was
+// persisted, and the event is returned as it was stored if it's still
+// missing.
+func (s *eventStream) redactedCommandLineEvent(env environment.Env, ctx context.Context, iid string, event *inpb.InvocationEvent) (*inpb.InvocationEvent, error) {
+	if redacted, ok := s.commandLineEvents[event.SequenceNumber]; ok {
+		return redacted, nil
+	}
+	summary, err := readSummary(ctx, env, iid)
+	if err != nil {
+		return nil, err
+	}
+	if summary != nil {
+		s.setSummary(summary)
+	}
+	if redacted, ok := s.commandLineEvents[event.SequenceNumber]; ok {
+		return redacted, nil
+	}
+	return event, nil
+}
+
+// receive sends the published events as they're received, until the
+// invocation's status changes or it's time to poll.
+func (s *eventStream) receive(ctx context.Context, iid string, published <-chan string, poll <-chan time.Time) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-poll:
+			return nil
+		case msg, ok := <-published:
+			if !ok {
+				published = nil
+				continue
+			}
+			if msg == "" {
+				return nil
+			}
+			event, err := decodePublishedEvent(msg)
+			if err != nil {
+				log.Printf("Error decoding published event of invocation %s: %s", iid, err)
+				continue
+			}
+			if event.SequenceNumber > s.nextSequenceNumber {
+				// Some events were missed: hold on to this one until they've
+				// been read back.
+				if len(s.pending) < maxPendingStreamedEvents {
+					s.pending[event.SequenceNumber] = event
+				}
+				continue
+			}
+			if event.SequenceNumber == s.nextSequenceNumber {
+				if err := s.send(event); err != nil {
+					return err
+				}
+				if err := s.sendPending(); err != nil {
+					return err
+				}
+				if err := s.flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func decodePublishedEvent(msg string) (*inpb.InvocationEvent, error) {
+	protoBytes, err := base64.StdEncoding.DecodeString(msg)
+	if err != nil {
+		return nil, err
+	}
+	event := &inpb.InvocationEvent{}
+	if err := proto.Unmarshal(protoBytes, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// findChunk returns the sequence number of the chunk that the event with the
+// given sequence number was written to, without reading the chunks before it.
+func findChunk(ctx context.Context, env environment.Env, iid string, sequenceNumber int64) (int, error) {
+	if sequenceNumber <= 0 {
+		return 0, nil
+	}
+	// Returns whether the chunk starts at or before sequenceNumber.
+	startsBefore := func(chunk int) (bool, error) {
+		event := &inpb.InvocationEvent{}
+		err := protofile.ReadFirstProtoInChunk(ctx, env.GetBlobstore(), iid, chunk, event)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return event.SequenceNumber <= sequenceNumber, nil
+	}
+	// Find a chunk past the one we're looking for, then binary search for it.
+	lo, hi := 0, 1
+	for {
+		before, err := startsBefore(hi)
+		if err != nil {
+			return 0, err
+		}
+		if !before {
+			break
+		}
+		lo, hi = hi, hi*2
+	}
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		before, err := startsBefore(mid)
+		if err != nil {
+			return 0, err
+		}
+		if before {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+func readSummary(ctx context.Context, env environment.Env, iid string) (*inpb.Invocation, error) {
+	bs := env.GetBlobstore()
+	exists, err := bs.BlobExists(ctx, summaryBlobName(iid))
+	if err != nil || !exists {
+		return nil, err
+	}
+	protoBytes, err := bs.ReadBlob(ctx, summaryBlobName(iid))
+	if err != nil {
+		return nil, err
+	}
+	summary := &inpb.Invocation{}
+	if err := proto.Unmarshal(protoBytes, summary); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// readEvents calls fn with the events of an invocation, starting with the
+// chunk with the given sequence number, until fn returns false.
+func readEvents(ctx context.Context, env environment.Env, iid string, startChunk int, fn func(event *inpb.InvocationEvent) bool) error {
+	pr := protofile.NewBufferedProtoReaderAt(env.GetBlobstore(), iid, startChunk)
 	for {
 		event := &inpb.InvocationEvent{}
 		err := pr.ReadProto(ctx, event)
 		if err == nil {
-			parser.ParseEvent(event)
+			if !fn(event) {
+				return nil
+			}
 		} else if err == io.EOF {
-			break
+			return nil
 		} else {
-			log.Printf("returning some other error: %s", err)
-			return nil, err
+			return err
 		}
 	}
-	parser.FillInvocation(invocation)
-	return invocation, nil
+}
+
+// fillInvocationFromSummary fills invocation with the fields that the event
+// parser fills in, the same way event_parser.FillInvocation would.
+func fillInvocationFromSummary(summary *inpb.Invocation, invocation *inpb.Invocation) {
+	invocation.Command = summary.Command
+	invocation.Pattern = summary.Pattern
+	invocation.Success = summary.Success
+	invocation.ActionCount = summary.ActionCount
+	if summary.BuildMetrics != nil {
+		invocation.BuildMetrics = summary.BuildMetrics
+	}
+	invocation.StructuredCommandLine = append(invocation.StructuredCommandLine, summary.StructuredCommandLine...)
+	if summary.User != "" {
+		invocation.User = summary.User
+	}
+	if summary.Host != "" {
+		invocation.Host = summary.Host
+	}
+	if summary.Role != "" {
+		invocation.Role = summary.Role
+	}
+	if summary.RepoUrl != "" {
+		invocation.RepoUrl = summary.RepoUrl
+	}
+	if summary.CommitSha != "" {
+		invocation.CommitSha = summary.CommitSha
+	}
+	if summary.ReadPermission == inpb.InvocationPermission_PUBLIC {
+		invocation.ReadPermission = inpb.InvocationPermission_PUBLIC
+	}
+	invocation.DurationUsec = summary.DurationUsec
+	invocation.ConsoleBuffer = summary.ConsoleBuffer
+	invocation.RedactionCount = summary.RedactionCount
 }
 
 // TODO(siggisim): pull this out somewhere central
@@ -453,6 +1321,9 @@ func tableInvocationFromProto(p *inpb.Invocation, blobID string) *tables.Invocat
 		i.Pattern = truncatedJoin(p.Pattern, 3)
 	}
 	i.ActionCount = p.ActionCount
+	if p.BuildMetrics != nil {
+		fillInvocationFromBuildMetrics(p.BuildMetrics, i)
+	}
 	i.BlobID = blobID
 	i.InvocationStatus = int64(p.InvocationStatus)
 	if p.ReadPermission == inpb.InvocationPermission_PUBLIC {
@@ -500,6 +1371,29 @@ func TableInvocationToProto(i *tables.Invocation) *inpb.Invocation {
 		TotalCachedActionExecUsec:        i.TotalCachedActionExecUsec,
 		DownloadThroughputBytesPerSecond: i.DownloadThroughputBytesPerSecond,
 		UploadThroughputBytesPerSecond:   i.UploadThroughputBytesPerSecond,
+		QuotaSoftLimitExceededCount:      i.QuotaSoftLimitExceededCount,
+		QuotaHardLimitExceededCount:      i.QuotaHardLimitExceededCount,
+	}
+	out.BuildMetrics = &build_event_stream.BuildMetrics{
+		ActionSummary: &build_event_stream.BuildMetrics_ActionSummary{
+			ActionsCreated:  i.ActionsCreated,
+			ActionsExecuted: i.ActionCount,
+		},
+		MemoryMetrics: &build_event_stream.BuildMetrics_MemoryMetrics{
+			UsedHeapSizePostBuild: i.UsedHeapSizePostBuild,
+		},
+		TargetMetrics: &build_event_stream.BuildMetrics_TargetMetrics{
+			TargetsLoaded:     i.TargetsLoaded,
+			TargetsConfigured: i.TargetsConfigured,
+		},
+		PackageMetrics: &build_event_stream.BuildMetrics_PackageMetrics{
+			PackagesLoaded: i.PackagesLoaded,
+		},
+		TimingMetrics: &build_event_stream.BuildMetrics_TimingMetrics{
+			CpuTimeInMs:           usecToMillis(i.CPUTimeUsec),
+			WallTimeInMs:          usecToMillis(i.WallTimeUsec),
+			AnalysisPhaseTimeInMs: usecToMillis(i.AnalysisPhaseTimeUsec),
+		},
 	}
 	return out
 }
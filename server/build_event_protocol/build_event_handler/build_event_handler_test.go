@@ -2,17 +2,23 @@ package build_event_handler_test
 
 import (
 	"context"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/proto/command_line"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/stretchr/testify/assert"
 
 	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
 	testauth "github.com/buildbuddy-io/buildbuddy/server/testutil/auth"
+	testpubsub "github.com/buildbuddy-io/buildbuddy/server/testutil/pubsub"
 	anypb "github.com/golang/protobuf/ptypes/any"
 )
 
@@ -69,18 +75,71 @@ func startedEvent(options string) *anypb.Any {
 	return progressAny
 }
 
+func structuredCommandLineEvent(envVars ...string) *anypb.Any {
+	var options []*command_line.Option
+	for _, envVar := range envVars {
+		options = append(options, &command_line.Option{
+			CombinedForm: "--client_env=" + envVar,
+			OptionName:   "client_env",
+			OptionValue:  envVar,
+		})
+	}
+	commandLineAny := &anypb.Any{}
+	commandLineAny.MarshalFrom(&build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_StructuredCommandLine{
+			StructuredCommandLine: &command_line.CommandLine{
+				Sections: []*command_line.CommandLineSection{
+					{
+						SectionType: &command_line.CommandLineSection_OptionList{
+							OptionList: &command_line.OptionList{Option: options},
+						},
+					},
+				},
+			},
+		},
+	})
+	return commandLineAny
+}
+
+func buildMetricsEvent() *anypb.Any {
+	metricsAny := &anypb.Any{}
+	metricsAny.MarshalFrom(&build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_BuildMetrics{
+			BuildMetrics: &build_event_stream.BuildMetrics{
+				ActionSummary: &build_event_stream.BuildMetrics_ActionSummary{
+					ActionsCreated:  20,
+					ActionsExecuted: 10,
+					ActionData: []*build_event_stream.BuildMetrics_ActionSummary_ActionData{
+						{Mnemonic: "CppCompile", ActionsExecuted: 8},
+						{Mnemonic: "CppLink", ActionsExecuted: 2},
+					},
+				},
+				PackageMetrics: &build_event_stream.BuildMetrics_PackageMetrics{PackagesLoaded: 5},
+				TimingMetrics: &build_event_stream.BuildMetrics_TimingMetrics{
+					CpuTimeInMs:           3000,
+					WallTimeInMs:          2000,
+					AnalysisPhaseTimeInMs: 500,
+				},
+			},
+		},
+	})
+	return metricsAny
+}
+
 func TestUnauthenticatedHandleEventWithStartedFirst(t *testing.T) {
 	te := environment.GetTestEnv(t)
 	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
 	te.SetAuthenticator(auth)
 	ctx := context.Background()
 
-	handler := build_event_handler.NewBuildEventHandler(te)
-	channel := handler.OpenChannel(ctx, "test-invocation-id")
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	channel, err := handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
 
 	// Send unauthenticated started event without an api key
 	request := streamRequest(startedEvent("--remote_upload_local_results"), "test-invocation-id", 1)
-	err := channel.HandleEvent(request)
+	err = channel.HandleEvent(request)
 	assert.NoError(t, err)
 
 	// Look up the invocation and make sure it's public
@@ -95,12 +154,14 @@ func TestAuthenticatedHandleEventWithStartedFirst(t *testing.T) {
 	te.SetAuthenticator(auth)
 	ctx := context.Background()
 
-	handler := build_event_handler.NewBuildEventHandler(te)
-	channel := handler.OpenChannel(ctx, "test-invocation-id")
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	channel, err := handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
 
 	// Send authenticated started event with api key
 	request := streamRequest(startedEvent("--remote_upload_local_results --remote_header='"+testauth.TestApiKeyHeader+"=USER1' --remote_instance_name=foo"), "test-invocation-id", 1)
-	err := channel.HandleEvent(request)
+	err = channel.HandleEvent(request)
 	assert.NoError(t, err)
 
 	// Look up the invocation and make sure it's only visible to group
@@ -115,12 +176,14 @@ func TestAuthenticatedHandleEventWithProgressFirst(t *testing.T) {
 	te.SetAuthenticator(auth)
 	ctx := context.Background()
 
-	handler := build_event_handler.NewBuildEventHandler(te)
-	channel := handler.OpenChannel(ctx, "test-invocation-id")
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	channel, err := handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
 
 	// Send progress event
 	request := streamRequest(progressEvent(), "test-invocation-id", 1)
-	err := channel.HandleEvent(request)
+	err = channel.HandleEvent(request)
 	assert.NoError(t, err)
 
 	// Make sure invocation isn't written yet
@@ -144,12 +207,14 @@ func TestUnAuthenticatedHandleEventWithProgressFirst(t *testing.T) {
 	te.SetAuthenticator(auth)
 	ctx := context.Background()
 
-	handler := build_event_handler.NewBuildEventHandler(te)
-	channel := handler.OpenChannel(ctx, "test-invocation-id")
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	channel, err := handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
 
 	// Send progress event
 	request := streamRequest(progressEvent(), "test-invocation-id", 1)
-	err := channel.HandleEvent(request)
+	err = channel.HandleEvent(request)
 	assert.NoError(t, err)
 
 	// Make sure invocation isn't written yet
@@ -173,8 +238,10 @@ func TestHandleEventOver100ProgressEventsBeforeStarted(t *testing.T) {
 	te.SetAuthenticator(auth)
 	ctx := context.Background()
 
-	handler := build_event_handler.NewBuildEventHandler(te)
-	channel := handler.OpenChannel(ctx, "test-invocation-id")
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	channel, err := handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
 
 	// Send 104 progress events
 	for i := 1; i < 105; i++ {
@@ -204,12 +271,14 @@ func TestHandleEventWithWorkspaceStatusBeforeStarted(t *testing.T) {
 	te.SetAuthenticator(auth)
 	ctx := context.Background()
 
-	handler := build_event_handler.NewBuildEventHandler(te)
-	channel := handler.OpenChannel(ctx, "test-invocation-id")
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	channel, err := handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
 
 	// Send progress event
 	request := streamRequest(progressEvent(), "test-invocation-id", 1)
-	err := channel.HandleEvent(request)
+	err = channel.HandleEvent(request)
 	assert.NoError(t, err)
 
 	// Send workspace status event with commit sha (which causes a flush)
@@ -243,3 +312,326 @@ func TestHandleEventWithWorkspaceStatusBeforeStarted(t *testing.T) {
 	assert.Equal(t, "abc123", invocation.CommitSha)
 	assert.Equal(t, inpb.Invocation_COMPLETE_INVOCATION_STATUS, invocation.InvocationStatus)
 }
+
+func TestLookupInvocationReturnsSummaryAndSanitizedEvents(t *testing.T) {
+	te := environment.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+	te.SetAuthenticator(auth)
+	ctx := context.Background()
+
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	channel, err := handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
+
+	for i, event := range []*anypb.Any{
+		startedEvent("--remote_upload_local_results"),
+		structuredCommandLineEvent("USER=alice", "SECRET=hunter2"),
+		progressEvent(),
+		workspaceStatusEvent("COMMIT_SHA", "abc123"),
+	} {
+		err := channel.HandleEvent(streamRequest(event, "test-invocation-id", int64(i+1)))
+		assert.NoError(t, err)
+	}
+	err = channel.FinalizeInvocation("test-invocation-id")
+	assert.NoError(t, err)
+
+	invocation, err := build_event_handler.LookupInvocation(te, ctx, "test-invocation-id")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", invocation.User)
+	assert.Equal(t, "abc123", invocation.CommitSha)
+	assert.Equal(t, "stderrstdout", invocation.ConsoleBuffer)
+	assert.Equal(t, 1, len(invocation.StructuredCommandLine))
+	assert.Equal(t, 4, len(invocation.Event))
+
+	// Events are returned with their secrets and progress output stripped.
+	commandLine := invocation.Event[1].BuildEvent.GetStructuredCommandLine()
+	options := commandLine.Sections[0].GetOptionList().Option
+	assert.Equal(t, "USER=alice", options[0].OptionValue)
+	assert.Equal(t, "SECRET=<REDACTED>", options[1].OptionValue)
+	progress := invocation.Event[2].BuildEvent.GetProgress()
+	assert.Equal(t, "", progress.Stderr)
+	assert.Equal(t, "", progress.Stdout)
+}
+
+func TestLookupInvocationWithEventsPagesThroughChunks(t *testing.T) {
+	te := environment.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+	te.SetAuthenticator(auth)
+	ctx := context.Background()
+
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	channel, err := handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
+
+	err = channel.HandleEvent(streamRequest(startedEvent("--remote_upload_local_results"), "test-invocation-id", 1))
+	assert.NoError(t, err)
+	// Each workspace status event is flushed to a chunk of its own.
+	for i := int64(2); i < 20; i += 2 {
+		err := channel.HandleEvent(streamRequest(progressEvent(), "test-invocation-id", i))
+		assert.NoError(t, err)
+		err = channel.HandleEvent(streamRequest(workspaceStatusEvent("COMMIT_SHA", "abc123"), "test-invocation-id", i+1))
+		assert.NoError(t, err)
+	}
+	err = channel.FinalizeInvocation("test-invocation-id")
+	assert.NoError(t, err)
+
+	filter := &inpb.InvocationEventFilter{PayloadType: []inpb.InvocationEventFilter_PayloadType{inpb.InvocationEventFilter_WORKSPACE_STATUS_PAYLOAD_TYPE}}
+	invocation, next, err := build_event_handler.LookupInvocationWithEvents(te, ctx, "test-invocation-id", 8, 3, filter)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123", invocation.CommitSha)
+	var sequenceNumbers []int64
+	for _, event := range invocation.Event {
+		sequenceNumbers = append(sequenceNumbers, event.SequenceNumber)
+	}
+	assert.Equal(t, []int64{9, 11, 13}, sequenceNumbers)
+	assert.Equal(t, int64(14), next)
+
+	invocation, next, err = build_event_handler.LookupInvocationWithEvents(te, ctx, "test-invocation-id", next, 0, &inpb.InvocationEventFilter{ExcludeProgress: true})
+	assert.NoError(t, err)
+	sequenceNumbers = nil
+	for _, event := range invocation.Event {
+		sequenceNumbers = append(sequenceNumbers, event.SequenceNumber)
+	}
+	assert.Equal(t, []int64{15, 17, 19}, sequenceNumbers)
+	assert.Equal(t, int64(0), next)
+}
+
+func TestReopenedChannelResumesFromPersistedEvents(t *testing.T) {
+	te := environment.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+	te.SetAuthenticator(auth)
+	ctx := context.Background()
+
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	channel, err := handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
+	for i, event := range []*anypb.Any{
+		startedEvent("--remote_upload_local_results"),
+		progressEvent(),
+		workspaceStatusEvent("COMMIT_SHA", "abc123"),
+		progressEvent(),
+	} {
+		err := channel.HandleEvent(streamRequest(event, "test-invocation-id", int64(i+1)))
+		assert.NoError(t, err)
+	}
+	// The last progress event hasn't been flushed yet.
+	assert.Equal(t, int64(3), channel.PersistedSequenceNumber())
+
+	// Bazel reconnects and resends every event that wasn't acked, plus any
+	// it hadn't sent yet.
+	channel, err = handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), channel.PersistedSequenceNumber())
+	for i, event := range []*anypb.Any{
+		progressEvent(),
+		workspaceStatusEvent("COMMIT_SHA", "abc123"),
+		progressEvent(),
+		progressEvent(),
+	} {
+		err := channel.HandleEvent(streamRequest(event, "test-invocation-id", int64(i+2)))
+		assert.NoError(t, err)
+	}
+	err = channel.HandleEvent(streamRequest(progressEvent(), "test-invocation-id", 7))
+	assert.Error(t, err)
+	err = channel.FinalizeInvocation("test-invocation-id")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), channel.PersistedSequenceNumber())
+
+	invocation, err := build_event_handler.LookupInvocation(te, ctx, "test-invocation-id")
+	assert.NoError(t, err)
+	var sequenceNumbers []int64
+	for _, event := range invocation.Event {
+		sequenceNumbers = append(sequenceNumbers, event.SequenceNumber)
+	}
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, sequenceNumbers)
+	assert.Equal(t, "abc123", invocation.CommitSha)
+	assert.Equal(t, "stderrstdoutstderrstdoutstderrstdout", invocation.ConsoleBuffer)
+	assert.Equal(t, inpb.Invocation_COMPLETE_INVOCATION_STATUS, invocation.InvocationStatus)
+}
+
+func TestReopenedChannelKeepsOwnerAndStatus(t *testing.T) {
+	te := environment.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1", "USER2", "GROUP2"))
+	te.SetAuthenticator(auth)
+	ctx := context.Background()
+
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	channel, err := handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
+	// Nothing has been persisted, so there's nothing to resume.
+	assert.Equal(t, int64(0), channel.PersistedSequenceNumber())
+	err = channel.HandleEvent(streamRequest(startedEvent("--remote_header='"+testauth.TestApiKeyHeader+"=USER1'"), "test-invocation-id", 1))
+	assert.NoError(t, err)
+	err = channel.FinalizeInvocation("test-invocation-id")
+	assert.NoError(t, err)
+
+	// The API key was redacted from the persisted started event, but the
+	// invocation still belongs to the group that started it.
+	user1Ctx := auth.AuthContextFromAPIKey(ctx, "USER1")
+	channel, err = handler.OpenChannel(user1Ctx, "test-invocation-id")
+	assert.NoError(t, err)
+	routingInfo, _ := channel.RoutingInfo()
+	assert.Equal(t, "GROUP1", routingInfo.GroupID)
+	invocation, err := build_event_handler.LookupInvocation(te, user1Ctx, "test-invocation-id")
+	assert.NoError(t, err)
+	assert.Equal(t, inpb.Invocation_COMPLETE_INVOCATION_STATUS, invocation.InvocationStatus)
+
+	_, err = handler.OpenChannel(auth.AuthContextFromAPIKey(ctx, "USER2"), "test-invocation-id")
+	assert.True(t, status.IsPermissionDeniedError(err), "Resuming as another group returned %v, want a PermissionDenied error", err)
+}
+
+func TestReopenedChannelRequiresOwnerGroup(t *testing.T) {
+	te := environment.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+	te.SetAuthenticator(auth)
+	ctx := context.Background()
+
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	channel, err := handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
+	err = channel.HandleEvent(streamRequest(startedEvent("--remote_header='"+testauth.TestApiKeyHeader+"=USER1'"), "test-invocation-id", 1))
+	assert.NoError(t, err)
+	err = channel.FinalizeInvocation("test-invocation-id")
+	assert.NoError(t, err)
+
+	// Reconnecting without credentials must not adopt the group that
+	// started the invocation.
+	_, err = handler.OpenChannel(ctx, "test-invocation-id")
+	assert.True(t, status.IsPermissionDeniedError(err), "Resuming anonymously returned %v, want a PermissionDenied error", err)
+}
+
+func TestFinalizeInvocationRecordsBuildMetrics(t *testing.T) {
+	te := environment.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+	te.SetAuthenticator(auth)
+	ctx := context.Background()
+
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	channel, err := handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
+	err = channel.HandleEvent(streamRequest(startedEvent("--remote_upload_local_results"), "test-invocation-id", 1))
+	assert.NoError(t, err)
+	err = channel.HandleEvent(streamRequest(buildMetricsEvent(), "test-invocation-id", 2))
+	assert.NoError(t, err)
+	err = channel.FinalizeInvocation("test-invocation-id")
+	assert.NoError(t, err)
+
+	ti, err := te.GetInvocationDB().LookupInvocation(ctx, "test-invocation-id")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), ti.ActionCount)
+	assert.Equal(t, int64(20), ti.ActionsCreated)
+	assert.Equal(t, int64(5), ti.PackagesLoaded)
+	assert.Equal(t, int64(3000000), ti.CPUTimeUsec)
+	assert.Equal(t, int64(500000), ti.AnalysisPhaseTimeUsec)
+
+	// Per-mnemonic action data is only kept in the invocation's summary.
+	invocation, err := build_event_handler.LookupInvocation(te, ctx, "test-invocation-id")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(500), invocation.BuildMetrics.GetTimingMetrics().GetAnalysisPhaseTimeInMs())
+	actionData := invocation.BuildMetrics.GetActionSummary().GetActionData()
+	assert.Equal(t, 2, len(actionData))
+	assert.Equal(t, "CppCompile", actionData[0].Mnemonic)
+}
+
+// countingBlobstore counts the reads of each blob.
+type countingBlobstore struct {
+	interfaces.Blobstore
+
+	mu    sync.Mutex
+	reads map[string]int
+}
+
+func (b *countingBlobstore) ReadBlob(ctx context.Context, blobName string) ([]byte, error) {
+	b.mu.Lock()
+	b.reads[blobName]++
+	b.mu.Unlock()
+	return b.Blobstore.ReadBlob(ctx, blobName)
+}
+
+func (b *countingBlobstore) readCount(blobName string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reads[blobName]
+}
+
+func TestStreamInvocationEventsResumesThenFollowsPublishedEvents(t *testing.T) {
+	te := environment.GetTestEnv(t)
+	bs := &countingBlobstore{Blobstore: te.GetBlobstore(), reads: make(map[string]int)}
+	te.SetBlobstore(bs)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+	te.SetAuthenticator(auth)
+	te.SetPubSub(testpubsub.NewTestPubSub())
+	ctx := context.Background()
+
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	channel, err := handler.OpenChannel(ctx, "test-invocation-id")
+	assert.NoError(t, err)
+	for i, event := range []*anypb.Any{
+		startedEvent("--remote_upload_local_results"),
+		progressEvent(),
+		workspaceStatusEvent("COMMIT_SHA", "abc123"),
+	} {
+		err := channel.HandleEvent(streamRequest(event, "test-invocation-id", int64(i+1)))
+		assert.NoError(t, err)
+	}
+
+	received := make(chan *inpb.InvocationEvent, 100)
+	streamErr := make(chan error)
+	go func() {
+		streamErr <- build_event_handler.StreamInvocationEvents(te, ctx, "test-invocation-id", 2, nil, func(events []*inpb.InvocationEvent) error {
+			for _, event := range events {
+				received <- event
+			}
+			return nil
+		})
+	}()
+	nextEvent := func() *inpb.InvocationEvent {
+		select {
+		case event := <-received:
+			return event
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for an event")
+			return nil
+		}
+	}
+
+	// The persisted events are read back first.
+	assert.Equal(t, int64(2), nextEvent().SequenceNumber)
+	assert.Equal(t, int64(3), nextEvent().SequenceNumber)
+
+	// New events are streamed before they're persisted, along with their
+	// progress output, and with their secrets redacted.
+	err = channel.HandleEvent(streamRequest(structuredCommandLineEvent("USER=alice", "SECRET=hunter2"), "test-invocation-id", 4))
+	assert.NoError(t, err)
+	event := nextEvent()
+	assert.Equal(t, int64(4), event.SequenceNumber)
+	options := event.BuildEvent.GetStructuredCommandLine().Sections[0].GetOptionList().Option
+	assert.Equal(t, "USER=alice", options[0].OptionValue)
+	assert.Equal(t, "SECRET=<REDACTED>", options[1].OptionValue)
+
+	err = channel.HandleEvent(streamRequest(progressEvent(), "test-invocation-id", 5))
+	assert.NoError(t, err)
+	event = nextEvent()
+	assert.Equal(t, int64(5), event.SequenceNumber)
+	assert.Equal(t, "stderr", event.BuildEvent.GetProgress().GetStderr())
+
+	// The stream ends once the invocation is finalized.
+	err = channel.FinalizeInvocation("test-invocation-id")
+	assert.NoError(t, err)
+	select {
+	case err := <-streamErr:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the stream to end")
+	}
+	assert.Empty(t, received)
+	// Persisted chunks are only read back once.
+	assert.Equal(t, 1, bs.readCount("test-invocation-id/chunks/test-invocation-id-0.chunk"))
+}
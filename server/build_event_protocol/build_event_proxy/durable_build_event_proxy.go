@@ -0,0 +1,541 @@
+package build_event_proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+)
+
+const (
+	spoolFileSuffix   = ".spool"
+	corruptFileSuffix = ".corrupt"
+
+	minRetryDelay = 1 * time.Second
+	maxRetryDelay = 5 * time.Minute
+)
+
+// DurableBuildEventProxyClient forwards build events like
+// BuildEventProxyClient, but doesn't drop them when the target is slow or
+// unavailable. Each stream is spooled to a file on local disk as it's
+// received, and replayed from there to the target, with backoff, until the
+// target has acked every event. Streams that were still spooled when the app
+// stopped are replayed when it starts again.
+//
+// Lifecycle events are still forwarded on a best effort basis.
+type DurableBuildEventProxyClient struct {
+	target  string
+	dir     string
+	client  pepb.PublishBuildEventClient
+	rootCtx context.Context
+	labels  prometheus.Labels
+
+	mu sync.Mutex // PROTECTS(lastStreams)
+	// The last stream spooled for each invocation that is still being
+	// forwarded. Streams of the same invocation are forwarded one after the
+	// other, in the order they were spooled.
+	lastStreams map[string]*spooledStream
+}
+
+func NewDurableBuildEventProxyClient(target, spoolDir string) (*DurableBuildEventProxyClient, error) {
+	conn, err := grpc_client.DialTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	return newDurableBuildEventProxyClient(target, pepb.NewPublishBuildEventClient(conn), spoolDir)
+}
+
+func newDurableBuildEventProxyClient(target string, client pepb.PublishBuildEventClient, spoolDir string) (*DurableBuildEventProxyClient, error) {
+	c := &DurableBuildEventProxyClient{
+		target:  target,
+		dir:     filepath.Join(spoolDir, targetDirName(target)),
+		client:  client,
+		rootCtx: context.Background(),
+		labels: prometheus.Labels{
+			metrics.BuildEventProxyTargetLabel: targetLabel(target),
+		},
+		lastStreams: make(map[string]*spooledStream),
+	}
+	if err := disk.EnsureDirectoryExists(c.dir); err != nil {
+		return nil, err
+	}
+	// Pick up the streams spooled before the app last stopped. Glob sorts its
+	// matches, so the streams of each invocation are recovered in the order
+	// they were spooled.
+	paths, err := filepath.Glob(filepath.Join(c.dir, "*"+spoolFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		s, err := c.recoverStream(path)
+		if err != nil {
+			return nil, err
+		}
+		c.startForwarding(s)
+	}
+	if len(paths) > 0 {
+		log.Printf("Proxy: replaying %d spooled build event streams to %s", len(paths), targetLabel(target))
+	}
+	return c, nil
+}
+
+// targetDirName returns the name of the directory the streams forwarded to
+// target are spooled in. Targets may contain credentials, so they're hashed.
+func targetDirName(target string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(target)))[:16]
+}
+
+// targetLabel returns target without the credentials it may contain.
+func targetLabel(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return target
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func (c *DurableBuildEventProxyClient) PublishLifecycleEvent(_ context.Context, req *pepb.PublishLifecycleEventRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	go func() {
+		_, err := c.client.PublishLifecycleEvent(c.rootCtx, req)
+		if err != nil {
+			log.Printf("Error publishing lifecycle event: %s", err.Error())
+		}
+	}()
+	return &empty.Empty{}, nil
+}
+
+func (c *DurableBuildEventProxyClient) PublishBuildToolEventStream(_ context.Context, opts ...grpc.CallOption) (pepb.PublishBuildEvent_PublishBuildToolEventStreamClient, error) {
+	return &spoolingStream{c: c}, nil
+}
+
+// spooledStream is a stream of build events spooled to a file, as a sequence
+// of varint length-prefixed requests.
+type spooledStream struct {
+	// The highest sequence number acked by the target, and how many events
+	// are spooled and acked. Only accessed atomically, so they come first to
+	// be 64-bit aligned.
+	ackedSequenceNumber int64
+	spooledCount        int64
+	ackedCount          int64
+
+	path         string
+	invocationID string
+	// The stream of the same invocation that must be forwarded before this
+	// one, if any.
+	prev *spooledStream
+	// Closed once the stream has been forwarded.
+	done chan struct{}
+
+	mu     sync.Mutex // PROTECTS(file, closed, syncedCount, updated)
+	file   *os.File
+	closed bool
+	// How many of the spooled events have been synced to disk.
+	syncedCount int64
+	// Closed and replaced whenever events are spooled or the stream is
+	// closed, to wake up the forwarder.
+	updated chan struct{}
+}
+
+func (c *DurableBuildEventProxyClient) newSpooledStream(invocationID string) (*spooledStream, error) {
+	name := fmt.Sprintf("%s.%020d%s", url.PathEscape(invocationID), time.Now().UnixNano(), spoolFileSuffix)
+	path := filepath.Join(c.dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, status.UnavailableErrorf("Error creating build event spool file: %s", err)
+	}
+	return &spooledStream{
+		path:         path,
+		invocationID: invocationID,
+		done:         make(chan struct{}),
+		file:         f,
+		updated:      make(chan struct{}),
+	}, nil
+}
+
+// recoverStream returns the stream spooled to path before a restart, which
+// won't receive any more events.
+func (c *DurableBuildEventProxyClient) recoverStream(path string) (*spooledStream, error) {
+	name := strings.TrimSuffix(filepath.Base(path), spoolFileSuffix)
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	invocationID, err := url.PathUnescape(name)
+	if err != nil {
+		invocationID = name
+	}
+	s := &spooledStream{
+		path:         path,
+		invocationID: invocationID,
+		done:         make(chan struct{}),
+		closed:       true,
+		updated:      make(chan struct{}),
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := newSpoolReader(f)
+	for {
+		if _, err := r.next(); err != nil {
+			if err == io.EOF || status.IsDataLossError(err) {
+				break
+			}
+			return nil, err
+		}
+		s.spooledCount++
+	}
+	metrics.BuildEventProxyUnackedEvents.With(c.labels).Add(float64(s.spooledCount))
+	return s, nil
+}
+
+func (s *spooledStream) append(req *pepb.PublishBuildToolEventStreamRequest) error {
+	buf, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(buf))
+	record = append(record[:binary.PutVarint(record, int64(len(buf)))], buf...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return status.FailedPreconditionError("Build event spool is closed")
+	}
+	if _, err := s.file.Write(record); err != nil {
+		// The record may have been partially written, so nothing can be
+		// appended after it. The forwarder skips partial records at the end
+		// of closed streams.
+		s.closeLocked()
+		return status.UnavailableErrorf("Error spooling build event: %s", err)
+	}
+	atomic.AddInt64(&s.spooledCount, 1)
+	s.notifyLocked()
+	return nil
+}
+
+// sync syncs the events spooled so far to disk.
+func (s *spooledStream) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Closed streams were synced when they were closed.
+	spooledCount := atomic.LoadInt64(&s.spooledCount)
+	if s.closed || s.syncedCount == spooledCount {
+		return nil
+	}
+	if err := s.file.Sync(); err != nil {
+		return status.UnavailableErrorf("Error syncing build event spool: %s", err)
+	}
+	s.syncedCount = spooledCount
+	return nil
+}
+
+func (s *spooledStream) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeLocked()
+}
+
+func (s *spooledStream) closeLocked() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.notifyLocked()
+	return err
+}
+
+func (s *spooledStream) notifyLocked() {
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// state returns whether the stream is closed, and a channel that is closed
+// when that or the number of spooled events changes.
+func (s *spooledStream) state() (bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed, s.updated
+}
+
+// ack records that the target acked the event with sequenceNumber, and
+// returns whether it hadn't been acked already.
+func (s *spooledStream) ack(sequenceNumber int64) bool {
+	if sequenceNumber <= atomic.LoadInt64(&s.ackedSequenceNumber) {
+		return false
+	}
+	atomic.StoreInt64(&s.ackedSequenceNumber, sequenceNumber)
+	atomic.AddInt64(&s.ackedCount, 1)
+	return true
+}
+
+// spoolingStream is the stream handed to the build event server, which
+// spools the events it's sent. The spool file is created when the first event
+// is sent, since that's when the invocation is known.
+type spoolingStream struct {
+	pepb.PublishBuildEvent_PublishBuildToolEventStreamClient
+	c *DurableBuildEventProxyClient
+	s *spooledStream
+}
+
+// Send returns once the event has been written to the spool file. The build
+// event server calls Sync before acking events to bazel, so that it doesn't
+// ack events that could still be lost, and the events sent in between are
+// synced together.
+func (ss *spoolingStream) Send(req *pepb.PublishBuildToolEventStreamRequest) error {
+	if ss.s == nil {
+		s, err := ss.c.newSpooledStream(req.GetOrderedBuildEvent().GetStreamId().GetInvocationId())
+		if err != nil {
+			return err
+		}
+		ss.s = s
+		ss.c.startForwarding(s)
+	}
+	if err := ss.s.append(req); err != nil {
+		return err
+	}
+	metrics.BuildEventProxyUnackedEvents.With(ss.c.labels).Inc()
+	return nil
+}
+
+// Sync syncs the events sent so far to disk.
+func (ss *spoolingStream) Sync() error {
+	if ss.s == nil {
+		return nil
+	}
+	return ss.s.sync()
+}
+
+func (ss *spoolingStream) Recv() (*pepb.PublishBuildToolEventStreamResponse, error) {
+	return nil, nil
+}
+
+func (ss *spoolingStream) CloseSend() error {
+	if ss.s == nil {
+		return nil
+	}
+	return ss.s.close()
+}
+
+func (c *DurableBuildEventProxyClient) startForwarding(s *spooledStream) {
+	c.mu.Lock()
+	s.prev = c.lastStreams[s.invocationID]
+	c.lastStreams[s.invocationID] = s
+	c.mu.Unlock()
+	go c.forward(s)
+}
+
+// forward replays s to the target until the target has acked all of its
+// events, and then deletes it.
+func (c *DurableBuildEventProxyClient) forward(s *spooledStream) {
+	defer func() {
+		c.mu.Lock()
+		if c.lastStreams[s.invocationID] == s {
+			delete(c.lastStreams, s.invocationID)
+		}
+		c.mu.Unlock()
+		close(s.done)
+	}()
+	if s.prev != nil {
+		<-s.prev.done
+		s.prev = nil
+	}
+
+	delay := minRetryDelay
+	for {
+		ackedCount := atomic.LoadInt64(&s.ackedCount)
+		err := c.replay(s)
+		if err == nil {
+			break
+		}
+		if status.IsDataLossError(err) {
+			// Retrying won't help, so keep the file around for inspection.
+			log.Printf("Giving up on forwarding build events for invocation %q to %s: %s", s.invocationID, targetLabel(c.target), err)
+			if err := os.Rename(s.path, strings.TrimSuffix(s.path, spoolFileSuffix)+corruptFileSuffix); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error moving corrupt build event spool file %q: %s", s.path, err)
+			}
+			c.recordForwarded(s)
+			return
+		}
+		if atomic.LoadInt64(&s.ackedCount) > ackedCount {
+			delay = minRetryDelay
+		}
+		metrics.BuildEventProxyRetries.With(c.labels).Inc()
+		log.Printf("Error forwarding build events for invocation %q to %s, retrying in %s: %s", s.invocationID, targetLabel(c.target), delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+	if err := os.Remove(s.path); err != nil {
+		log.Printf("Error deleting build event spool file %q: %s", s.path, err)
+	}
+	c.recordForwarded(s)
+}
+
+// recordForwarded stops counting the events of s that the target didn't ack
+// as lagging, once s won't be forwarded anymore.
+func (c *DurableBuildEventProxyClient) recordForwarded(s *spooledStream) {
+	unacked := atomic.LoadInt64(&s.spooledCount) - atomic.LoadInt64(&s.ackedCount)
+	if unacked > 0 {
+		metrics.BuildEventProxyUnackedEvents.With(c.labels).Sub(float64(unacked))
+	}
+}
+
+// replay opens a stream to the target and sends it the events of s that it
+// hasn't acked yet, following the spool file until s is closed. It returns nil
+// once the target has acked every event.
+func (c *DurableBuildEventProxyClient) replay(s *spooledStream) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return status.DataLossErrorf("Spool file is missing: %s", err)
+		}
+		return err
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(c.rootCtx)
+	stream, err := c.client.PublishBuildToolEventStream(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	recvErr := make(chan error, 1)
+	recvDone := make(chan struct{})
+	go func() {
+		defer close(recvDone)
+		for {
+			rsp, err := stream.Recv()
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				recvErr <- err
+				return
+			}
+			if s.ack(rsp.GetSequenceNumber()) {
+				metrics.BuildEventProxyUnackedEvents.With(c.labels).Dec()
+			}
+		}
+	}()
+	defer func() {
+		cancel()
+		<-recvDone
+	}()
+
+	r := newSpoolReader(f)
+	lastSequenceNumber := int64(0)
+	for {
+		closed, updated := s.state()
+		req, err := r.next()
+		if err == io.EOF {
+			if closed {
+				break
+			}
+			select {
+			case <-updated:
+				continue
+			case err := <-recvErr:
+				if err == nil {
+					err = status.UnavailableError("Target closed the stream before all events were sent")
+				}
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+		lastSequenceNumber = req.GetOrderedBuildEvent().GetSequenceNumber()
+		if lastSequenceNumber <= atomic.LoadInt64(&s.ackedSequenceNumber) {
+			continue
+		}
+		if err := stream.Send(req); err != nil {
+			// Send returns io.EOF when the stream broke, and the cause is
+			// returned by Recv.
+			if err == io.EOF {
+				if recvErr := <-recvErr; recvErr != nil {
+					return recvErr
+				}
+			}
+			return err
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	if err := <-recvErr; err != nil {
+		return err
+	}
+	if acked := atomic.LoadInt64(&s.ackedSequenceNumber); acked < lastSequenceNumber {
+		return status.UnavailableErrorf("Target closed the stream after acking events up to %d of %d", acked, lastSequenceNumber)
+	}
+	return nil
+}
+
+// spoolReader reads the events of a spool file, which may still be written.
+type spoolReader struct {
+	f      *os.File
+	r      *bufio.Reader
+	offset int64 // Of the next record.
+}
+
+func newSpoolReader(f *os.File) *spoolReader {
+	return &spoolReader{f: f, r: bufio.NewReader(f)}
+}
+
+// next returns the next event, or io.EOF if the next event hasn't been
+// completely spooled (yet).
+func (r *spoolReader) next() (*pepb.PublishBuildToolEventStreamRequest, error) {
+	size, err := binary.ReadVarint(r.r)
+	if err == nil {
+		if size < 0 {
+			return nil, status.DataLossErrorf("Invalid record size %d at offset %d", size, r.offset)
+		}
+		buf := make([]byte, size)
+		if _, err = io.ReadFull(r.r, buf); err == nil {
+			req := &pepb.PublishBuildToolEventStreamRequest{}
+			if err := proto.Unmarshal(buf, req); err != nil {
+				return nil, status.DataLossErrorf("Invalid record at offset %d: %s", r.offset, err)
+			}
+			header := make([]byte, binary.MaxVarintLen64)
+			r.offset += int64(binary.PutVarint(header, size)) + size
+			return req, nil
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Read the partial record again from its start next time.
+		if _, err := r.f.Seek(r.offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		r.r.Reset(r.f)
+		return nil, io.EOF
+	}
+	return nil, err
+}
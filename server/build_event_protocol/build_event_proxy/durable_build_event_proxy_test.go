@@ -0,0 +1,200 @@
+package build_event_proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+
+	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+)
+
+// fakeTarget is a BES backend that acks every event it receives, and refuses
+// streams while it's unavailable.
+type fakeTarget struct {
+	pepb.PublishBuildEventClient
+
+	mu          sync.Mutex
+	unavailable bool
+	received    []int64
+}
+
+func (t *fakeTarget) setUnavailable(unavailable bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.unavailable = unavailable
+}
+
+func (t *fakeTarget) receivedSequenceNumbers() []int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]int64{}, t.received...)
+}
+
+func (t *fakeTarget) PublishBuildToolEventStream(ctx context.Context, opts ...grpc.CallOption) (pepb.PublishBuildEvent_PublishBuildToolEventStreamClient, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.unavailable {
+		return nil, status.UnavailableError("target is unavailable")
+	}
+	return &fakeTargetStream{ctx: ctx, target: t, acks: make(chan int64, 100)}, nil
+}
+
+type fakeTargetStream struct {
+	pepb.PublishBuildEvent_PublishBuildToolEventStreamClient
+	ctx    context.Context
+	target *fakeTarget
+	acks   chan int64
+}
+
+func (s *fakeTargetStream) Send(req *pepb.PublishBuildToolEventStreamRequest) error {
+	s.target.mu.Lock()
+	defer s.target.mu.Unlock()
+	sequenceNumber := req.GetOrderedBuildEvent().GetSequenceNumber()
+	s.target.received = append(s.target.received, sequenceNumber)
+	s.acks <- sequenceNumber
+	return nil
+}
+
+func (s *fakeTargetStream) CloseSend() error {
+	close(s.acks)
+	return nil
+}
+
+func (s *fakeTargetStream) Recv() (*pepb.PublishBuildToolEventStreamResponse, error) {
+	select {
+	case sequenceNumber, ok := <-s.acks:
+		if !ok {
+			return nil, io.EOF
+		}
+		return &pepb.PublishBuildToolEventStreamResponse{SequenceNumber: sequenceNumber}, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func getTmpDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("/tmp", "buildbuddy_build_event_proxy_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func sendEvents(t *testing.T, c *DurableBuildEventProxyClient, invocationID string, sequenceNumbers ...int64) {
+	stream, err := c.PublishBuildToolEventStream(context.Background())
+	assert.NoError(t, err)
+	for _, sequenceNumber := range sequenceNumbers {
+		err := stream.Send(&pepb.PublishBuildToolEventStreamRequest{
+			OrderedBuildEvent: &pepb.OrderedBuildEvent{
+				StreamId:       &bepb.StreamId{InvocationId: invocationID},
+				SequenceNumber: sequenceNumber,
+			},
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, stream.CloseSend())
+}
+
+func spooledFiles(t *testing.T, c *DurableBuildEventProxyClient) []string {
+	paths, err := filepath.Glob(filepath.Join(c.dir, "*"+spoolFileSuffix))
+	assert.NoError(t, err)
+	return paths
+}
+
+func waitForForwarding(t *testing.T, c *DurableBuildEventProxyClient, target *fakeTarget, want []int64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(target.receivedSequenceNumbers()) >= len(want) && len(spooledFiles(t, c)) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, want, target.receivedSequenceNumbers())
+	assert.Empty(t, spooledFiles(t, c))
+}
+
+func TestDurableProxyForwardsEventsOnceTargetRecovers(t *testing.T) {
+	target := &fakeTarget{unavailable: true}
+	c, err := newDurableBuildEventProxyClient("grpc://localhost:1985", target, getTmpDir(t))
+	assert.NoError(t, err)
+
+	sendEvents(t, c, "invocation-1", 1, 2, 3)
+	assert.Len(t, spooledFiles(t, c), 1)
+
+	target.setUnavailable(false)
+	waitForForwarding(t, c, target, []int64{1, 2, 3})
+}
+
+func TestDurableProxyForwardsStreamsOfAnInvocationInOrder(t *testing.T) {
+	target := &fakeTarget{unavailable: true}
+	c, err := newDurableBuildEventProxyClient("grpc://localhost:1985", target, getTmpDir(t))
+	assert.NoError(t, err)
+
+	// Bazel resends the events that weren't acked on a new stream.
+	sendEvents(t, c, "invocation-1", 1, 2, 3)
+	sendEvents(t, c, "invocation-1", 3, 4)
+
+	target.setUnavailable(false)
+	waitForForwarding(t, c, target, []int64{1, 2, 3, 3, 4})
+}
+
+func TestDurableProxyReplaysSpooledStreamsAfterRestart(t *testing.T) {
+	spoolDir := getTmpDir(t)
+	unavailableTarget := &fakeTarget{unavailable: true}
+	c, err := newDurableBuildEventProxyClient("grpc://localhost:1985", unavailableTarget, spoolDir)
+	assert.NoError(t, err)
+	sendEvents(t, c, "invocation-1", 1, 2)
+
+	target := &fakeTarget{}
+	restarted, err := newDurableBuildEventProxyClient("grpc://localhost:1985", target, spoolDir)
+	assert.NoError(t, err)
+	waitForForwarding(t, restarted, target, []int64{1, 2})
+	assert.Empty(t, unavailableTarget.receivedSequenceNumbers())
+}
+
+func TestDurableProxySyncsSpooledEventsOnDemand(t *testing.T) {
+	target := &fakeTarget{unavailable: true}
+	c, err := newDurableBuildEventProxyClient("grpc://localhost:1985", target, getTmpDir(t))
+	assert.NoError(t, err)
+
+	stream, err := c.PublishBuildToolEventStream(context.Background())
+	assert.NoError(t, err)
+	ss := stream.(*spoolingStream)
+	// Nothing to sync before the first event.
+	assert.NoError(t, ss.Sync())
+	for _, sequenceNumber := range []int64{1, 2} {
+		err := stream.Send(&pepb.PublishBuildToolEventStreamRequest{
+			OrderedBuildEvent: &pepb.OrderedBuildEvent{
+				StreamId:       &bepb.StreamId{InvocationId: "invocation-1"},
+				SequenceNumber: sequenceNumber,
+			},
+		})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int64(0), ss.s.syncedCount)
+	assert.NoError(t, ss.Sync())
+	assert.Equal(t, int64(2), ss.s.syncedCount)
+	assert.NoError(t, stream.CloseSend())
+
+	target.setUnavailable(false)
+	waitForForwarding(t, c, target, []int64{1, 2})
+}
+
+func TestTargetLabelStripsCredentials(t *testing.T) {
+	assert.Equal(t, "grpcs://events.example.com:443", targetLabel("grpcs://abc123@events.example.com:443"))
+	assert.Equal(t, "grpc://localhost:1985", targetLabel("grpc://localhost:1985"))
+	assert.NotEqual(t, targetDirName("grpcs://a@events.example.com"), targetDirName("grpcs://b@events.example.com"))
+}
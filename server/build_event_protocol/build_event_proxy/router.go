@@ -0,0 +1,371 @@
+package build_event_proxy
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_parser"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+
+	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+)
+
+const (
+	// The role that routes match invocations without a role by.
+	localRole = "LOCAL"
+
+	// How long the routes of a group are cached for, and so how long it takes
+	// for changes to them in the DB to take effect.
+	groupRoutesTTL = 1 * time.Minute
+)
+
+// NewClient returns a client forwarding build events to target, which spools
+// them to disk if build_event_proxy.spool_dir is set.
+func NewClient(env environment.Env, target string) (pepb.PublishBuildEventClient, error) {
+	if spoolDir := env.GetConfigurator().GetBuildEventProxySpoolDir(); spoolDir != "" {
+		return NewDurableBuildEventProxyClient(target, spoolDir)
+	}
+	return NewBuildEventProxyClient(env, target), nil
+}
+
+// route forwards the build events of the invocations matching all of its
+// filters to hosts. An empty filter matches every invocation.
+type route struct {
+	hosts    []string
+	groupIDs []string
+	repos    []string
+	roles    []string
+	commands []string
+	// The types of the events forwarded without their payload.
+	excludedEvents map[string]bool
+}
+
+func normalizeRepoURL(repoURL string) string {
+	return event_parser.ExtractUserRepoFromRepoUrl(repoURL)
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *route) matches(info *interfaces.BuildEventRoutingInfo) bool {
+	role := info.Role
+	if role == "" {
+		role = localRole
+	}
+	return matchesAny(r.groupIDs, info.GroupID) &&
+		matchesAny(r.repos, normalizeRepoURL(info.RepoURL)) &&
+		matchesAny(r.roles, role) &&
+		matchesAny(r.commands, info.Command)
+}
+
+// eventTypes returns the types of build events, named after the fields of
+// the BuildEvent payload.
+func eventTypes() map[string]bool {
+	fields := proto.MessageReflect(&build_event_stream.BuildEvent{}).Descriptor().Oneofs().ByName("payload").Fields()
+	types := make(map[string]bool, fields.Len())
+	for i := 0; i < fields.Len(); i++ {
+		types[string(fields.Get(i).Name())] = true
+	}
+	return types
+}
+
+// eventType returns the type of event, or "" if it has no payload.
+func eventType(event *build_event_stream.BuildEvent) string {
+	m := proto.MessageReflect(event)
+	fd := m.WhichOneof(m.Descriptor().Oneofs().ByName("payload"))
+	if fd == nil {
+		return ""
+	}
+	return string(fd.Name())
+}
+
+func newExcludedEvents(types []string) (map[string]bool, error) {
+	if len(types) == 0 {
+		return nil, nil
+	}
+	validTypes := eventTypes()
+	excluded := make(map[string]bool, len(types))
+	for _, t := range types {
+		if !validTypes[t] {
+			return nil, status.InvalidArgumentErrorf("Unknown build event type %q", t)
+		}
+		excluded[t] = true
+	}
+	return excluded, nil
+}
+
+func routeFromConfig(r config.BuildEventProxyRoute) (*route, error) {
+	excludedEvents, err := newExcludedEvents(r.ExcludedEvents)
+	if err != nil {
+		return nil, err
+	}
+	repos := make([]string, 0, len(r.RepoURLs))
+	for _, repoURL := range r.RepoURLs {
+		repos = append(repos, normalizeRepoURL(repoURL))
+	}
+	return &route{
+		hosts:          r.Hosts,
+		groupIDs:       r.GroupIDs,
+		repos:          repos,
+		roles:          r.Roles,
+		commands:       r.Commands,
+		excludedEvents: excludedEvents,
+	}, nil
+}
+
+func routeFromTable(r *tables.BuildEventProxyRoute) (*route, error) {
+	rt := &route{
+		hosts:    []string{r.Host},
+		groupIDs: []string{r.GroupID},
+	}
+	if r.RepoURL != "" {
+		rt.repos = []string{normalizeRepoURL(r.RepoURL)}
+	}
+	if r.Role != "" {
+		rt.roles = []string{r.Role}
+	}
+	if r.Command != "" {
+		rt.commands = []string{r.Command}
+	}
+	var types []string
+	for _, t := range strings.Split(r.ExcludedEvents, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	excludedEvents, err := newExcludedEvents(types)
+	if err != nil {
+		return nil, err
+	}
+	rt.excludedEvents = excludedEvents
+	return rt, nil
+}
+
+type cachedGroupRoutes struct {
+	routes    []*route
+	expiresAt time.Time
+}
+
+// Router routes the build events of each invocation to the proxies selected
+// by the routes configured in build_event_proxy.routes, or, if its group has
+// routes in the DB, by those instead.
+type Router struct {
+	env    environment.Env
+	routes []*route
+	// The hosts that every build event is forwarded to already.
+	allEventsHosts map[string]bool
+
+	mu          sync.Mutex // PROTECTS(clients, groupRoutes, hasDBRoutes, hasDBRoutesExpiresAt)
+	clients     map[string]pepb.PublishBuildEventClient
+	groupRoutes map[string]*cachedGroupRoutes
+	// Whether any group has routes in the DB, cached like the routes of
+	// each group.
+	hasDBRoutes          bool
+	hasDBRoutesExpiresAt time.Time
+}
+
+// NewRouter returns a Router for the configured routes and the routes in the
+// DB, or nil if there can't be any. Routes may be added to the DB while the
+// app runs, so a Router is returned whenever there's a DB, and HasRoutes
+// tells whether there are any. clients are the proxy clients of the hosts
+// that every build event is forwarded to, which routes don't forward to again.
+func NewRouter(env environment.Env, clients map[string]pepb.PublishBuildEventClient) (*Router, error) {
+	configuredRoutes := env.GetConfigurator().GetBuildEventProxyRoutes()
+	if len(configuredRoutes) == 0 && env.GetDBHandle() == nil {
+		return nil, nil
+	}
+	r := &Router{
+		env:            env,
+		allEventsHosts: make(map[string]bool, len(clients)),
+		clients:        make(map[string]pepb.PublishBuildEventClient, len(clients)),
+		groupRoutes:    make(map[string]*cachedGroupRoutes),
+	}
+	for host, client := range clients {
+		r.allEventsHosts[host] = true
+		r.clients[host] = client
+	}
+	hosts := make([]string, 0)
+	for _, cr := range configuredRoutes {
+		rt, err := routeFromConfig(cr)
+		if err != nil {
+			return nil, err
+		}
+		r.routes = append(r.routes, rt)
+		hosts = append(hosts, rt.hosts...)
+	}
+	if db := env.GetDBHandle(); db != nil {
+		var dbHosts []string
+		if err := db.Model(&tables.BuildEventProxyRoute{}).Distinct("host").Pluck("host", &dbHosts).Error; err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, dbHosts...)
+	}
+	// Create the clients up front so that durable ones start replaying the
+	// events they spooled before a restart.
+	for _, host := range hosts {
+		if _, err := r.client(host); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *Router) client(host string) (pepb.PublishBuildEventClient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[host]; ok {
+		return client, nil
+	}
+	client, err := NewClient(r.env, host)
+	if err != nil {
+		return nil, err
+	}
+	r.clients[host] = client
+	return client, nil
+}
+
+// HasRoutes returns whether any routes are configured, or any group has
+// routes in the DB.
+func (r *Router) HasRoutes(ctx context.Context) (bool, error) {
+	db := r.env.GetDBHandle()
+	if len(r.routes) > 0 || db == nil {
+		return len(r.routes) > 0, nil
+	}
+	r.mu.Lock()
+	hasDBRoutes, expiresAt := r.hasDBRoutes, r.hasDBRoutesExpiresAt
+	r.mu.Unlock()
+	if time.Now().After(expiresAt) {
+		var rows []*tables.BuildEventProxyRoute
+		if err := db.Select("route_id").Limit(1).Find(&rows).Error; err != nil {
+			return false, err
+		}
+		hasDBRoutes = len(rows) > 0
+		r.mu.Lock()
+		r.hasDBRoutes = hasDBRoutes
+		r.hasDBRoutesExpiresAt = time.Now().Add(groupRoutesTTL)
+		r.mu.Unlock()
+	}
+	return hasDBRoutes, nil
+}
+
+// routesFor returns the routes that apply to the invocations of groupID.
+func (r *Router) routesFor(groupID string) ([]*route, error) {
+	db := r.env.GetDBHandle()
+	if groupID == "" || db == nil {
+		return r.routes, nil
+	}
+	r.mu.Lock()
+	cached, ok := r.groupRoutes[groupID]
+	r.mu.Unlock()
+	if !ok || time.Now().After(cached.expiresAt) {
+		var rows []*tables.BuildEventProxyRoute
+		if err := db.Where("group_id = ?", groupID).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+		cached = &cachedGroupRoutes{expiresAt: time.Now().Add(groupRoutesTTL)}
+		for _, row := range rows {
+			rt, err := routeFromTable(row)
+			if err != nil {
+				log.Printf("Skipping build event proxy route %q of group %q: %s", row.RouteID, groupID, err)
+				continue
+			}
+			cached.routes = append(cached.routes, rt)
+		}
+		r.mu.Lock()
+		r.groupRoutes[groupID] = cached
+		r.mu.Unlock()
+	}
+	if len(cached.routes) > 0 {
+		return cached.routes, nil
+	}
+	return r.routes, nil
+}
+
+// OpenRoutedStreams opens a stream to each host that the events of the
+// invocation described by info are routed to. If several routes forward to a
+// host, the first of them decides which events are stripped.
+func (r *Router) OpenRoutedStreams(ctx context.Context, info *interfaces.BuildEventRoutingInfo) ([]pepb.PublishBuildEvent_PublishBuildToolEventStreamClient, error) {
+	routes, err := r.routesFor(info.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	streams := make([]pepb.PublishBuildEvent_PublishBuildToolEventStreamClient, 0)
+	opened := make(map[string]bool)
+	for _, rt := range routes {
+		if !rt.matches(info) {
+			continue
+		}
+		for _, host := range rt.hosts {
+			if opened[host] || r.allEventsHosts[host] {
+				continue
+			}
+			opened[host] = true
+			client, err := r.client(host)
+			if err != nil {
+				log.Printf("Unable to proxy stream to %s: %s", targetLabel(host), err)
+				continue
+			}
+			stream, err := client.PublishBuildToolEventStream(ctx, grpc.WaitForReady(false))
+			if err != nil {
+				log.Printf("Unable to proxy stream to %s: %s", targetLabel(host), err)
+				continue
+			}
+			if len(rt.excludedEvents) > 0 {
+				stream = &strippingStream{stream, rt.excludedEvents}
+			}
+			streams = append(streams, stream)
+		}
+	}
+	return streams, nil
+}
+
+// strippingStream forwards the events of excluded types without their
+// payload. They're forwarded rather than dropped so that the sequence numbers
+// of the forwarded events stay contiguous, and the event graph stays intact.
+type strippingStream struct {
+	pepb.PublishBuildEvent_PublishBuildToolEventStreamClient
+	excludedEvents map[string]bool
+}
+
+func (s *strippingStream) Send(req *pepb.PublishBuildToolEventStreamRequest) error {
+	bazelEvent := req.GetOrderedBuildEvent().GetEvent().GetBazelEvent()
+	if bazelEvent == nil {
+		return s.PublishBuildEvent_PublishBuildToolEventStreamClient.Send(req)
+	}
+	event := &build_event_stream.BuildEvent{}
+	if err := ptypes.UnmarshalAny(bazelEvent, event); err != nil || !s.excludedEvents[eventType(event)] {
+		return s.PublishBuildEvent_PublishBuildToolEventStreamClient.Send(req)
+	}
+	stripped, err := ptypes.MarshalAny(&build_event_stream.BuildEvent{
+		Id:          event.Id,
+		Children:    event.Children,
+		LastMessage: event.LastMessage,
+	})
+	if err != nil {
+		return err
+	}
+	req = proto.Clone(req).(*pepb.PublishBuildToolEventStreamRequest)
+	req.OrderedBuildEvent.Event.Event = &bepb.BuildEvent_BazelEvent{BazelEvent: stripped}
+	return s.PublishBuildEvent_PublishBuildToolEventStreamClient.Send(req)
+}
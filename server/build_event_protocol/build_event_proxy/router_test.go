@@ -0,0 +1,148 @@
+package build_event_proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+
+	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+	testenv "github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+)
+
+func TestRouteMatchesInvocations(t *testing.T) {
+	rt, err := routeFromConfig(config.BuildEventProxyRoute{
+		Hosts:    []string{"grpc://localhost:1985"},
+		GroupIDs: []string{"GR1"},
+		RepoURLs: []string{"https://github.com/acme/app"},
+		Roles:    []string{"CI"},
+		Commands: []string{"build", "test"},
+	})
+	assert.NoError(t, err)
+
+	info := &interfaces.BuildEventRoutingInfo{
+		GroupID: "GR1",
+		RepoURL: "git@github.com:acme/app.git",
+		Role:    "CI",
+		Command: "test",
+	}
+	assert.True(t, rt.matches(info))
+
+	for _, other := range []*interfaces.BuildEventRoutingInfo{
+		{GroupID: "GR2", RepoURL: info.RepoURL, Role: info.Role, Command: info.Command},
+		{GroupID: info.GroupID, RepoURL: "https://github.com/acme/other", Role: info.Role, Command: info.Command},
+		{GroupID: info.GroupID, RepoURL: info.RepoURL, Role: "", Command: info.Command},
+		{GroupID: info.GroupID, RepoURL: info.RepoURL, Role: info.Role, Command: "run"},
+	} {
+		assert.False(t, rt.matches(other), "%+v", other)
+	}
+
+	// Routes without filters match every invocation, and LOCAL matches
+	// invocations without a role.
+	rt, err = routeFromConfig(config.BuildEventProxyRoute{Hosts: []string{"grpc://localhost:1985"}})
+	assert.NoError(t, err)
+	assert.True(t, rt.matches(&interfaces.BuildEventRoutingInfo{}))
+	rt, err = routeFromTable(&tables.BuildEventProxyRoute{GroupID: "GR1", Host: "grpc://localhost:1985", Role: "LOCAL"})
+	assert.NoError(t, err)
+	assert.True(t, rt.matches(&interfaces.BuildEventRoutingInfo{GroupID: "GR1"}))
+	assert.False(t, rt.matches(&interfaces.BuildEventRoutingInfo{GroupID: "GR1", Role: "CI"}))
+}
+
+func TestRoutesRejectUnknownEventTypes(t *testing.T) {
+	_, err := routeFromConfig(config.BuildEventProxyRoute{ExcludedEvents: []string{"progress", "not_an_event"}})
+	assert.Error(t, err)
+
+	rt, err := routeFromTable(&tables.BuildEventProxyRoute{ExcludedEvents: "progress, action"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"progress": true, "action": true}, rt.excludedEvents)
+}
+
+type recordingStream struct {
+	pepb.PublishBuildEvent_PublishBuildToolEventStreamClient
+	sent []*pepb.PublishBuildToolEventStreamRequest
+}
+
+func (s *recordingStream) Send(req *pepb.PublishBuildToolEventStreamRequest) error {
+	s.sent = append(s.sent, req)
+	return nil
+}
+
+func bazelEventRequest(t *testing.T, sequenceNumber int64, event *build_event_stream.BuildEvent) *pepb.PublishBuildToolEventStreamRequest {
+	bazelEvent, err := ptypes.MarshalAny(event)
+	assert.NoError(t, err)
+	return &pepb.PublishBuildToolEventStreamRequest{
+		OrderedBuildEvent: &pepb.OrderedBuildEvent{
+			StreamId:       &bepb.StreamId{InvocationId: "invocation-1"},
+			SequenceNumber: sequenceNumber,
+			Event: &bepb.BuildEvent{
+				Event: &bepb.BuildEvent_BazelEvent{BazelEvent: bazelEvent},
+			},
+		},
+	}
+}
+
+func TestStrippingStreamStripsExcludedEvents(t *testing.T) {
+	recorder := &recordingStream{}
+	stream := &strippingStream{recorder, map[string]bool{"progress": true}}
+
+	progressID := &build_event_stream.BuildEventId{
+		Id: &build_event_stream.BuildEventId_Progress{Progress: &build_event_stream.BuildEventId_ProgressId{OpaqueCount: 1}},
+	}
+	progress := bazelEventRequest(t, 2, &build_event_stream.BuildEvent{
+		Id:       progressID,
+		Children: []*build_event_stream.BuildEventId{progressID},
+		Payload: &build_event_stream.BuildEvent_Progress{
+			Progress: &build_event_stream.Progress{Stderr: "Analyzing: 3 targets"},
+		},
+	})
+	started := bazelEventRequest(t, 1, &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_Started{
+			Started: &build_event_stream.BuildStarted{Command: "build"},
+		},
+	})
+	assert.NoError(t, stream.Send(started))
+	assert.NoError(t, stream.Send(progress))
+
+	assert.Len(t, recorder.sent, 2)
+	assert.Same(t, started, recorder.sent[0])
+
+	stripped := recorder.sent[1]
+	assert.Equal(t, int64(2), stripped.OrderedBuildEvent.SequenceNumber)
+	event := &build_event_stream.BuildEvent{}
+	assert.NoError(t, ptypes.UnmarshalAny(stripped.OrderedBuildEvent.Event.GetBazelEvent(), event))
+	assert.Nil(t, event.Payload)
+	assert.Equal(t, int32(1), event.GetId().GetProgress().GetOpaqueCount())
+	assert.Len(t, event.Children, 1)
+	// The request that was sent isn't modified.
+	original := &build_event_stream.BuildEvent{}
+	assert.NoError(t, ptypes.UnmarshalAny(progress.OrderedBuildEvent.Event.GetBazelEvent(), original))
+	assert.Equal(t, "Analyzing: 3 targets", original.GetProgress().GetStderr())
+}
+
+func TestRouterHasRoutesOnceAGroupAddsOne(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	r, err := NewRouter(te, nil)
+	assert.NoError(t, err)
+
+	hasRoutes, err := r.HasRoutes(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, hasRoutes)
+
+	row := &tables.BuildEventProxyRoute{RouteID: "BR1", GroupID: "GR1", Host: "grpc://localhost:1985"}
+	assert.NoError(t, te.GetDBHandle().Create(row).Error)
+	hasRoutes, err = r.HasRoutes(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, hasRoutes, "whether there are routes should be cached")
+
+	r.hasDBRoutesExpiresAt = time.Time{}
+	hasRoutes, err = r.HasRoutes(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, hasRoutes)
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"io"
 	"log"
-	"sort"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
@@ -17,6 +16,18 @@ import (
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
 )
 
+const (
+	// The most events buffered before they're forwarded to the proxies they're
+	// routed to with what is known about the invocation so far.
+	maxUnroutedEvents = 1000
+)
+
+// syncer is implemented by the forwarding streams of durable proxies, whose
+// spooled events must be synced to disk before they're acked.
+type syncer interface {
+	Sync() error
+}
+
 type BuildEventProtocolServer struct {
 	env environment.Env
 }
@@ -51,10 +62,21 @@ func (s *BuildEventProtocolServer) PublishLifecycleEvent(ctx context.Context, re
 // have been sent and all ACKs have been received. If not it invokes a retry logic that may
 // decide to re-send every build event for which an ACK has not been received. If so, it
 // adds an OPEN_STREAM event.
+//
+// Events are acked as soon as they've been persisted, so that bazel only has
+// to resend the events after the last persisted one if the stream breaks. The
+// stream it reopens may land on another app, which picks up the invocation
+// from the persisted events.
+//
+// Events are only forwarded to the proxies they're routed to once what
+// they're routed by is known, from the workspace status event. Until then
+// they're buffered, and not acked so that bazel resends them if the stream
+// breaks before they're forwarded. The resent events are buffered again, even
+// though they've been persisted, so that the routed proxies get every event.
 func (s *BuildEventProtocolServer) PublishBuildToolEventStream(stream pepb.PublishBuildEvent_PublishBuildToolEventStreamServer) error {
 	ctx := stream.Context()
 	// Semantically, the protocol requires we ack events in order.
-	acks := make([]int, 0)
+	unacked := make([]int64, 0)
 	var streamID *bepb.StreamId
 	var channel interfaces.BuildEventChannel
 
@@ -65,9 +87,50 @@ func (s *BuildEventProtocolServer) PublishBuildToolEventStream(stream pepb.Publi
 			log.Printf("Unable to proxy stream: %s", err)
 			continue
 		}
-		defer stream.CloseSend()
 		forwardingStreams = append(forwardingStreams, stream)
 	}
+	defer func() {
+		for _, stream := range forwardingStreams {
+			stream.CloseSend()
+		}
+	}()
+
+	router := s.env.GetBuildEventProxyRouter()
+	routed := router == nil
+	if router != nil {
+		// Don't hold on to events until the workspace status is known if
+		// there are no routes to forward them by.
+		hasRoutes, err := router.HasRoutes(ctx)
+		if err != nil {
+			log.Printf("Error looking up build event proxy routes: %s", err)
+		}
+		routed = err == nil && !hasRoutes
+	}
+	unrouted := make([]*pepb.PublishBuildToolEventStreamRequest, 0)
+	// The routed streams opened by this stream, which haven't been sent the
+	// events that bazel resends on reconnecting, unlike the other proxies.
+	routedStreams := make([]pepb.PublishBuildEvent_PublishBuildToolEventStreamClient, 0)
+	routeEvents := func() error {
+		info, _ := channel.RoutingInfo()
+		streams, err := router.OpenRoutedStreams(ctx, info)
+		if err != nil {
+			log.Printf("Error routing events of invocation %q to proxies: %s", streamID.InvocationId, err)
+			return err
+		}
+		for _, stream := range streams {
+			forwardingStreams = append(forwardingStreams, stream)
+			routedStreams = append(routedStreams, stream)
+			for _, in := range unrouted {
+				if err := stream.Send(in); err != nil {
+					log.Printf("Error proxying event for invocation %q: %s", streamID.InvocationId, err)
+					return err
+				}
+			}
+		}
+		routed = true
+		unrouted = nil
+		return nil
+	}
 
 	disconnectWithErr := func(e error) error {
 		if channel != nil && streamID != nil {
@@ -81,6 +144,38 @@ func (s *BuildEventProtocolServer) PublishBuildToolEventStream(stream pepb.Publi
 		return e
 	}
 
+	ackPersistedEvents := func() error {
+		persisted := channel.PersistedSequenceNumber()
+		if len(unrouted) > 0 && unrouted[0].OrderedBuildEvent.SequenceNumber <= persisted {
+			persisted = unrouted[0].OrderedBuildEvent.SequenceNumber - 1
+		}
+		if len(unacked) == 0 || unacked[0] > persisted {
+			return nil
+		}
+		// Spooled events are synced once per batch of acks rather than
+		// as each of them is spooled.
+		for _, stream := range forwardingStreams {
+			if syncer, ok := stream.(syncer); ok {
+				if err := syncer.Sync(); err != nil {
+					log.Printf("Error syncing proxied events for invocation %q: %s", streamID.InvocationId, err)
+					return err
+				}
+			}
+		}
+		for len(unacked) > 0 && unacked[0] <= persisted {
+			rsp := &pepb.PublishBuildToolEventStreamResponse{
+				StreamId:       streamID,
+				SequenceNumber: unacked[0],
+			}
+			if err := stream.Send(rsp); err != nil {
+				log.Printf("Error sending ack stream for invocation %q: %s", streamID.InvocationId, err)
+				return err
+			}
+			unacked = unacked[1:]
+		}
+		return nil
+	}
+
 	for {
 		in, err := stream.Recv()
 		if err == io.EOF {
@@ -92,48 +187,68 @@ func (s *BuildEventProtocolServer) PublishBuildToolEventStream(stream pepb.Publi
 		}
 		if streamID == nil {
 			streamID = in.OrderedBuildEvent.StreamId
-			channel = s.env.GetBuildEventHandler().OpenChannel(ctx, streamID.InvocationId)
+			channel, err = s.env.GetBuildEventHandler().OpenChannel(ctx, streamID.InvocationId)
+			if err != nil {
+				log.Printf("Error opening build event channel for invocation %q: %s", streamID.InvocationId, err)
+				return err
+			}
 		}
 
+		// Bazel resends the events that weren't acked when it reconnects,
+		// which the proxies that aren't routed have been sent already. They
+		// haven't necessarily been routed yet, as events are held until they
+		// are, so they still go to the routed streams.
+		resent := in.OrderedBuildEvent.SequenceNumber <= channel.LastSequenceNumber()
 		if err := channel.HandleEvent(in); err != nil {
 			log.Printf("Error handling event; this means a broken build command: %s", err)
 			return disconnectWithErr(err)
 		}
-		for _, stream := range forwardingStreams {
-			// Intentionally ignore errors here -- proxying is best effort.
-			stream.Send(in)
+		sendTo := forwardingStreams
+		if resent {
+			sendTo = routedStreams
+		}
+		for _, stream := range sendTo {
+			// Best effort proxies never fail to send. Durable ones fail if the
+			// event couldn't be spooled, in which case it must not be acked
+			// so that bazel sends it again.
+			if err := stream.Send(in); err != nil {
+				log.Printf("Error proxying event for invocation %q: %s", streamID.InvocationId, err)
+				return disconnectWithErr(err)
+			}
+		}
+		if !routed {
+			unrouted = append(unrouted, in)
+			if _, known := channel.RoutingInfo(); known || len(unrouted) > maxUnroutedEvents {
+				if err := routeEvents(); err != nil {
+					return disconnectWithErr(err)
+				}
+			}
 		}
 
-		acks = append(acks, int(in.OrderedBuildEvent.SequenceNumber))
+		unacked = append(unacked, in.OrderedBuildEvent.SequenceNumber)
+		if err := ackPersistedEvents(); err != nil {
+			return disconnectWithErr(err)
+		}
 	}
 
-	// Check that we have received all acks! If we haven't bail out since we
-	// don't want to ack *anything*. This forces the client to retransmit
-	// everything all at once, which means we don't need to worry about
-	// cross-server consistency of messages in an invocation.
-	sort.Sort(sort.IntSlice(acks))
-	for i, ack := range acks {
-		if ack != i+1 {
-			log.Printf("Missing ack: saw %d and wanted %d. Bailing!", ack, i+1)
-			return io.EOF
+	if channel == nil {
+		return nil
+	}
+	// Forward the events of invocations that ended before their workspace
+	// status was known with what is known about them.
+	if !routed {
+		if err := routeEvents(); err != nil {
+			return disconnectWithErr(err)
 		}
 	}
-
 	if err := channel.FinalizeInvocation(streamID.InvocationId); err != nil {
 		log.Printf("Error finalizing invocation %q: %s", streamID.InvocationId, err)
 		return disconnectWithErr(err)
 	}
 
-	// Finally, ack everything.
-	for _, ack := range acks {
-		rsp := &pepb.PublishBuildToolEventStreamResponse{
-			StreamId:       streamID,
-			SequenceNumber: int64(ack),
-		}
-		if err := stream.Send(rsp); err != nil {
-			log.Printf("Error sending ack stream for invocation %q: %s", streamID.InvocationId, err)
-			return disconnectWithErr(err)
-		}
+	// Finally, ack everything else.
+	if err := ackPersistedEvents(); err != nil {
+		return disconnectWithErr(err)
 	}
 	return nil
 }
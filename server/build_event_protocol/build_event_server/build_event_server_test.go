@@ -0,0 +1,141 @@
+package build_event_server_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_server"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+
+	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+)
+
+const invocationID = "invocation-1"
+
+// fakeServerStream plays back the events bazel sends, then breaks if broken
+// is set.
+type fakeServerStream struct {
+	pepb.PublishBuildEvent_PublishBuildToolEventStreamServer
+	ctx    context.Context
+	events []*pepb.PublishBuildToolEventStreamRequest
+	broken bool
+	acked  []int64
+}
+
+func (s *fakeServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeServerStream) Recv() (*pepb.PublishBuildToolEventStreamRequest, error) {
+	if len(s.events) == 0 {
+		if s.broken {
+			return nil, status.UnavailableError("connection reset")
+		}
+		return nil, io.EOF
+	}
+	in := s.events[0]
+	s.events = s.events[1:]
+	return in, nil
+}
+
+func (s *fakeServerStream) Send(rsp *pepb.PublishBuildToolEventStreamResponse) error {
+	s.acked = append(s.acked, rsp.SequenceNumber)
+	return nil
+}
+
+type recordingStream struct {
+	pepb.PublishBuildEvent_PublishBuildToolEventStreamClient
+	sent []int64
+}
+
+func (s *recordingStream) Send(req *pepb.PublishBuildToolEventStreamRequest) error {
+	s.sent = append(s.sent, req.OrderedBuildEvent.SequenceNumber)
+	return nil
+}
+
+func (s *recordingStream) CloseSend() error {
+	return nil
+}
+
+// fakeRouter routes the events of every invocation to one proxy, which gets a
+// new recordingStream each time they're routed.
+type fakeRouter struct {
+	streams []*recordingStream
+}
+
+func (r *fakeRouter) HasRoutes(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func (r *fakeRouter) OpenRoutedStreams(ctx context.Context, info *interfaces.BuildEventRoutingInfo) ([]pepb.PublishBuildEvent_PublishBuildToolEventStreamClient, error) {
+	stream := &recordingStream{}
+	r.streams = append(r.streams, stream)
+	return []pepb.PublishBuildEvent_PublishBuildToolEventStreamClient{stream}, nil
+}
+
+func bazelEventRequest(t *testing.T, sequenceNumber int64, event *build_event_stream.BuildEvent) *pepb.PublishBuildToolEventStreamRequest {
+	bazelEvent, err := ptypes.MarshalAny(event)
+	assert.NoError(t, err)
+	return &pepb.PublishBuildToolEventStreamRequest{
+		OrderedBuildEvent: &pepb.OrderedBuildEvent{
+			StreamId:       &bepb.StreamId{InvocationId: invocationID},
+			SequenceNumber: sequenceNumber,
+			Event: &bepb.BuildEvent{
+				Event: &bepb.BuildEvent_BazelEvent{BazelEvent: bazelEvent},
+			},
+		},
+	}
+}
+
+func TestRoutedProxiesGetEventsResentBeforeRouting(t *testing.T) {
+	te := environment.GetTestEnv(t)
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	te.SetBuildEventHandler(handler)
+	router := &fakeRouter{}
+	te.SetBuildEventProxyRouter(router)
+	server, err := build_event_server.NewBuildEventProtocolServer(te)
+	assert.NoError(t, err)
+
+	started := bazelEventRequest(t, 1, &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_Started{Started: &build_event_stream.BuildStarted{}},
+	})
+	progress := bazelEventRequest(t, 2, &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_Progress{Progress: &build_event_stream.Progress{Stderr: "stderr"}},
+	})
+	workspaceStatus := bazelEventRequest(t, 3, &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_WorkspaceStatus{WorkspaceStatus: &build_event_stream.WorkspaceStatus{}},
+	})
+
+	// The started event is persisted, but the stream breaks before the
+	// events can be routed, so none of them are acked.
+	stream := &fakeServerStream{
+		ctx:    context.Background(),
+		events: []*pepb.PublishBuildToolEventStreamRequest{started, progress},
+		broken: true,
+	}
+	err = server.PublishBuildToolEventStream(stream)
+	assert.Error(t, err)
+	assert.Empty(t, stream.acked)
+	assert.Empty(t, router.streams)
+
+	// Bazel reconnects and resends them.
+	stream = &fakeServerStream{
+		ctx:    context.Background(),
+		events: []*pepb.PublishBuildToolEventStreamRequest{started, progress, workspaceStatus},
+	}
+	err = server.PublishBuildToolEventStream(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2, 3}, stream.acked)
+	if assert.Len(t, router.streams, 1) {
+		assert.Equal(t, []int64{1, 2, 3}, router.streams[0].sent)
+	}
+}
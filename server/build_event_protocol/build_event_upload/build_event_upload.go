@@ -0,0 +1,395 @@
+package build_event_upload
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_server"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+)
+
+const (
+	// The multipart form field holding the build event file. The fields
+	// before it hold the artifacts it references, each named after the
+	// file:// URI it's referenced by.
+	buildEventFileField = "build_event_file"
+
+	fileURIPrefix = "file://"
+
+	// The largest build event accepted, which is read into memory whole.
+	maxEventSizeBytes = 64 * 1024 * 1024
+)
+
+// BuildEventUploadHandler ingests the build event files that bazel writes
+// with --build_event_binary_file, for builds that can't reach the server
+// while they run. Each file is replayed through the build event protocol
+// server exactly as if bazel had streamed it, under the API key that the
+// request is authenticated with, if its events don't carry one.
+//
+// The file is either the body of the request, or the last field of a
+// multipart form whose other fields are the artifacts referenced by its
+// file:// URIs. Those are uploaded to the cache, and the URIs are rewritten
+// to point at them there, like those of the artifacts bazel uploads itself.
+//
+// Files can only be uploaded for new invocations: replaying events into an
+// existing invocation would overwrite it.
+type BuildEventUploadHandler struct {
+	env    environment.Env
+	server *build_event_server.BuildEventProtocolServer
+}
+
+func NewBuildEventUploadHandler(env environment.Env) (*BuildEventUploadHandler, error) {
+	server, err := build_event_server.NewBuildEventProtocolServer(env)
+	if err != nil {
+		return nil, err
+	}
+	return &BuildEventUploadHandler{
+		env:    env,
+		server: server,
+	}, nil
+}
+
+func (h *BuildEventUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Build event files must be uploaded with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = limitReader(w, r.Body, h.env.GetConfigurator().GetBuildEventUploadMaxSizeBytes(), "The upload")
+	iid, err := h.upload(w, r)
+	if err != nil {
+		log.Printf("Error ingesting build event file: %s", err)
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, iid)
+}
+
+// upload ingests the uploaded build event file and returns the ID of its
+// invocation.
+func (h *BuildEventUploadHandler) upload(w http.ResponseWriter, r *http.Request) (string, error) {
+	ctx := r.Context()
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		return h.ingest(ctx, r.Body, nil)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return "", status.InvalidArgumentError(err.Error())
+	}
+	// The bytestream URLs of the uploaded artifacts, by file:// URI.
+	artifacts := make(map[string]string)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return "", status.InvalidArgumentErrorf("Missing the %q field", buildEventFileField)
+		}
+		if err != nil {
+			return "", status.InvalidArgumentError(err.Error())
+		}
+		name := part.FormName()
+		if name == buildEventFileField {
+			return h.ingest(ctx, part, artifacts)
+		}
+		if !strings.HasPrefix(name, fileURIPrefix) {
+			return "", status.InvalidArgumentErrorf("Unexpected field %q: artifacts must be named after the file:// URI they're referenced by", name)
+		}
+		artifact := limitReader(w, part, h.env.GetConfigurator().GetBuildEventUploadMaxArtifactSizeBytes(), fmt.Sprintf("Artifact %q", name))
+		bytestreamURL, err := h.uploadArtifact(ctx, artifact)
+		if err != nil {
+			return "", err
+		}
+		artifacts[name] = bytestreamURL
+	}
+}
+
+func (h *BuildEventUploadHandler) ingest(ctx context.Context, r io.Reader, artifacts map[string]string) (string, error) {
+	stream := &fileStream{
+		ctx:       ctx,
+		env:       h.env,
+		reader:    bufio.NewReader(r),
+		artifacts: artifacts,
+	}
+	if err := h.server.PublishBuildToolEventStream(stream); err != nil {
+		return "", err
+	}
+	return stream.streamID.GetInvocationId(), nil
+}
+
+// uploadArtifact writes an artifact to the CAS and returns the bytestream URL
+// it can be downloaded from.
+func (h *BuildEventUploadHandler) uploadArtifact(ctx context.Context, r io.Reader) (string, error) {
+	cache := h.env.GetCache()
+	if cache == nil {
+		return "", status.FailedPreconditionError("A cache is required to upload artifacts")
+	}
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, h.env)
+	if err != nil {
+		return "", err
+	}
+	// The artifact's digest is needed to write it, so it's buffered in a
+	// temp file while it's computed.
+	f, err := ioutil.TempFile("", "buildbuddy_artifact_*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	d, err := digest.Compute(io.TeeReader(r, f))
+	if err != nil {
+		return "", err
+	}
+	if d.GetHash() != digest.EmptySha256 {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		w, err := namespace.CASCache(cache, "").Writer(ctx, d)
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(w, f); err != nil {
+			w.Close()
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("bytestream://%s/blobs/%s/%d", cacheHost(h.env), d.GetHash(), d.GetSizeBytes()), nil
+}
+
+// cacheHost returns the host that bazel would be configured to use as its
+// remote cache.
+func cacheHost(env environment.Env) string {
+	if cacheURL, err := url.Parse(env.GetConfigurator().GetAppCacheAPIURL()); err == nil && cacheURL.Host != "" {
+		return cacheURL.Host
+	}
+	port := "1985"
+	if f := flag.Lookup("grpc_port"); f != nil {
+		port = f.Value.String()
+	}
+	return "localhost:" + port
+}
+
+func httpStatus(err error) int {
+	switch {
+	case status.IsInvalidArgumentError(err):
+		return http.StatusBadRequest
+	case status.IsFailedPreconditionError(err):
+		return http.StatusPreconditionFailed
+	case status.IsUnauthenticatedError(err):
+		return http.StatusUnauthorized
+	case status.IsPermissionDeniedError(err):
+		return http.StatusForbidden
+	case status.IsAlreadyExistsError(err):
+		return http.StatusConflict
+	case status.IsResourceExhaustedError(err):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// fileStream replays a build event file as the build event stream bazel
+// would have sent: the events of the file, in order, followed by the event
+// that finishes the stream. The stream is opened for the invocation of the
+// started event, which bazel writes first.
+type fileStream struct {
+	// Not implemented, as the stream is only used by the build event
+	// protocol server.
+	pepb.PublishBuildEvent_PublishBuildToolEventStreamServer
+
+	ctx            context.Context
+	env            environment.Env
+	reader         *bufio.Reader
+	artifacts      map[string]string
+	streamID       *bepb.StreamId
+	sequenceNumber int64
+	finished       bool
+}
+
+func (s *fileStream) Context() context.Context {
+	return s.ctx
+}
+
+// Send drops acks: events are only ever replayed once.
+func (s *fileStream) Send(rsp *pepb.PublishBuildToolEventStreamResponse) error {
+	return nil
+}
+
+func (s *fileStream) Recv() (*pepb.PublishBuildToolEventStreamRequest, error) {
+	if s.finished {
+		return nil, io.EOF
+	}
+	event, err := readEvent(s.reader)
+	if err == io.EOF {
+		if s.streamID == nil {
+			return nil, status.InvalidArgumentError("The build event file is empty")
+		}
+		s.finished = true
+		return s.request(&bepb.BuildEvent{
+			Event: &bepb.BuildEvent_ComponentStreamFinished{
+				ComponentStreamFinished: &bepb.BuildEvent_BuildComponentStreamFinished{
+					Type: bepb.BuildEvent_BuildComponentStreamFinished_FINISHED,
+				},
+			},
+		}), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.streamID == nil {
+		iid := event.GetStarted().GetUuid()
+		if iid == "" {
+			return nil, status.InvalidArgumentError("The build event file must start with the started event")
+		}
+		if err := checkNewInvocation(s.ctx, s.env, iid); err != nil {
+			return nil, err
+		}
+		s.streamID = &bepb.StreamId{InvocationId: iid}
+	}
+	rewriteFileURIs(proto.MessageReflect(event), s.artifacts)
+	bazelEvent, err := ptypes.MarshalAny(event)
+	if err != nil {
+		return nil, err
+	}
+	return s.request(&bepb.BuildEvent{
+		Event: &bepb.BuildEvent_BazelEvent{BazelEvent: bazelEvent},
+	}), nil
+}
+
+// checkNewInvocation returns an AlreadyExists error if the invocation has
+// been created already, by any group.
+func checkNewInvocation(ctx context.Context, env environment.Env, iid string) error {
+	_, err := env.GetInvocationDB().LookupInvocationOwner(ctx, iid)
+	if status.IsNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return status.AlreadyExistsErrorf("Invocation %q already exists", iid)
+}
+
+func (s *fileStream) request(event *bepb.BuildEvent) *pepb.PublishBuildToolEventStreamRequest {
+	s.sequenceNumber++
+	event.EventTime = ptypes.TimestampNow()
+	return &pepb.PublishBuildToolEventStreamRequest{
+		OrderedBuildEvent: &pepb.OrderedBuildEvent{
+			StreamId:       s.streamID,
+			SequenceNumber: s.sequenceNumber,
+			Event:          event,
+		},
+	}
+}
+
+// readEvent reads the next of the varint length-prefixed events of a build
+// event file, or returns io.EOF if there are none left.
+func readEvent(r *bufio.Reader) (*build_event_stream.BuildEvent, error) {
+	size, err := binary.ReadUvarint(r)
+	if err == io.EOF || status.IsResourceExhaustedError(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("Error reading build event file: %s", err)
+	}
+	if size > maxEventSizeBytes {
+		return nil, status.InvalidArgumentErrorf("Build event of %d bytes exceeds the limit of %d bytes", size, maxEventSizeBytes)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if status.IsResourceExhaustedError(err) {
+			return nil, err
+		}
+		return nil, status.InvalidArgumentErrorf("Error reading build event file: %s", err)
+	}
+	event := &build_event_stream.BuildEvent{}
+	if err := proto.Unmarshal(buf, event); err != nil {
+		return nil, status.InvalidArgumentErrorf("Error parsing build event file: %s", err)
+	}
+	return event, nil
+}
+
+// limitedReader caps a reader with http.MaxBytesReader, and returns a
+// ResourceExhausted error describing what was too large once it's read past
+// the limit.
+type limitedReader struct {
+	io.ReadCloser
+	limit int64
+	n     int64
+	what  string
+}
+
+func limitReader(w http.ResponseWriter, r io.ReadCloser, limit int64, what string) *limitedReader {
+	return &limitedReader{
+		ReadCloser: http.MaxBytesReader(w, r, limit),
+		limit:      limit,
+		what:       what,
+	}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	l.n += int64(n)
+	if err != nil && err != io.EOF && l.n >= l.limit {
+		return n, status.ResourceExhaustedErrorf("%s exceeds the limit of %d bytes", l.what, l.limit)
+	}
+	return n, err
+}
+
+// rewriteFileURIs points the file:// URIs of the files referenced by m at
+// the uploaded artifacts, if they were uploaded.
+func rewriteFileURIs(m protoreflect.Message, artifacts map[string]string) {
+	if len(artifacts) == 0 {
+		return
+	}
+	if file, ok := m.Interface().(*build_event_stream.File); ok {
+		if bytestreamURL, ok := artifacts[file.GetUri()]; ok {
+			file.File = &build_event_stream.File_Uri{Uri: bytestreamURL}
+		}
+		return
+	}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.IsMap() {
+			if kind := fd.MapValue().Kind(); kind == protoreflect.MessageKind || kind == protoreflect.GroupKind {
+				v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+					rewriteFileURIs(mv.Message(), artifacts)
+					return true
+				})
+			}
+			return true
+		}
+		if kind := fd.Kind(); kind != protoreflect.MessageKind && kind != protoreflect.GroupKind {
+			return true
+		}
+		if fd.IsList() {
+			l := v.List()
+			for i := 0; i < l.Len(); i++ {
+				rewriteFileURIs(l.Get(i).Message(), artifacts)
+			}
+			return true
+		}
+		rewriteFileURIs(v.Message(), artifacts)
+		return true
+	})
+}
@@ -0,0 +1,166 @@
+package build_event_upload_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_upload"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	testauth "github.com/buildbuddy-io/buildbuddy/server/testutil/auth"
+)
+
+func eventFile(t *testing.T, events ...*build_event_stream.BuildEvent) []byte {
+	var buf bytes.Buffer
+	for _, event := range events {
+		protoBytes, err := proto.Marshal(event)
+		assert.NoError(t, err)
+		size := make([]byte, binary.MaxVarintLen64)
+		buf.Write(size[:binary.PutUvarint(size, uint64(len(protoBytes)))])
+		buf.Write(protoBytes)
+	}
+	return buf.Bytes()
+}
+
+func startedEvent(iid string) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_Started{
+			Started: &build_event_stream.BuildStarted{Uuid: iid, Command: "test"},
+		},
+	}
+}
+
+func progressEvent() *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_Progress{
+			Progress: &build_event_stream.Progress{Stderr: "stderr"},
+		},
+	}
+}
+
+func testResultEvent(testLogURI string) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_TestResult{
+			TestResult: &build_event_stream.TestResult{
+				TestActionOutput: []*build_event_stream.File{
+					{Name: "test.log", File: &build_event_stream.File_Uri{Uri: testLogURI}},
+				},
+			},
+		},
+	}
+}
+
+func newUploadHandler(t *testing.T) (*environment.TestEnv, *build_event_upload.BuildEventUploadHandler) {
+	te := environment.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1")))
+	handler, err := build_event_handler.NewBuildEventHandler(te)
+	assert.NoError(t, err)
+	te.SetBuildEventHandler(handler)
+	uploadHandler, err := build_event_upload.NewBuildEventUploadHandler(te)
+	assert.NoError(t, err)
+	return te, uploadHandler
+}
+
+func TestUploadReplaysEventsAndArtifacts(t *testing.T) {
+	te, uploadHandler := newUploadHandler(t)
+	ctx := context.Background()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	artifact, err := mw.CreateFormFile("file:///tmp/test.log", "test.log")
+	assert.NoError(t, err)
+	artifact.Write([]byte("PASSED"))
+	events, err := mw.CreateFormFile("build_event_file", "build_events.pb")
+	assert.NoError(t, err)
+	events.Write(eventFile(t,
+		startedEvent("test-invocation-id"),
+		progressEvent(),
+		testResultEvent("file:///tmp/test.log"),
+	))
+	assert.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/upload/build_event_file", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rsp := httptest.NewRecorder()
+	uploadHandler.ServeHTTP(rsp, req)
+	assert.Equal(t, http.StatusOK, rsp.Code, rsp.Body.String())
+	assert.Equal(t, "test-invocation-id\n", rsp.Body.String())
+
+	invocation, err := build_event_handler.LookupInvocation(te, ctx, "test-invocation-id")
+	assert.NoError(t, err)
+	assert.Equal(t, inpb.Invocation_COMPLETE_INVOCATION_STATUS, invocation.InvocationStatus)
+	assert.Equal(t, "test", invocation.Command)
+	assert.Equal(t, "stderr", invocation.ConsoleBuffer)
+	assert.Equal(t, 3, len(invocation.Event))
+
+	// The test log is uploaded to the cache, and referenced there.
+	d, err := digest.Compute(strings.NewReader("PASSED"))
+	assert.NoError(t, err)
+	uri := invocation.Event[2].BuildEvent.GetTestResult().TestActionOutput[0].GetUri()
+	assert.True(t, strings.HasPrefix(uri, "bytestream://"), uri)
+	assert.True(t, strings.HasSuffix(uri, "/blobs/"+d.GetHash()+"/6"), uri)
+	ctx, err = prefix.AttachUserPrefixToContext(ctx, te)
+	assert.NoError(t, err)
+	data, err := te.GetCache().Get(ctx, d)
+	assert.NoError(t, err)
+	assert.Equal(t, "PASSED", string(data))
+}
+
+func TestUploadRejectsFilesNotStartingWithStartedEvent(t *testing.T) {
+	_, uploadHandler := newUploadHandler(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/upload/build_event_file", bytes.NewReader(eventFile(t, progressEvent())))
+	rsp := httptest.NewRecorder()
+	uploadHandler.ServeHTTP(rsp, req)
+	assert.Equal(t, http.StatusBadRequest, rsp.Code)
+}
+
+func TestUploadRejectsExistingInvocations(t *testing.T) {
+	_, uploadHandler := newUploadHandler(t)
+
+	upload := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/upload/build_event_file", bytes.NewReader(eventFile(t, startedEvent("test-invocation-id"), progressEvent())))
+		rsp := httptest.NewRecorder()
+		uploadHandler.ServeHTTP(rsp, req)
+		return rsp
+	}
+	rsp := upload()
+	assert.Equal(t, http.StatusOK, rsp.Code, rsp.Body.String())
+	rsp = upload()
+	assert.Equal(t, http.StatusConflict, rsp.Code, rsp.Body.String())
+}
+
+func TestUploadRejectsArtifactsOverTheLimit(t *testing.T) {
+	_, uploadHandler := newUploadHandler(t)
+	flags.Set(t, "app.build_event_upload_max_artifact_size_bytes", "4")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	artifact, err := mw.CreateFormFile("file:///tmp/test.log", "test.log")
+	assert.NoError(t, err)
+	artifact.Write([]byte("PASSED"))
+	events, err := mw.CreateFormFile("build_event_file", "build_events.pb")
+	assert.NoError(t, err)
+	events.Write(eventFile(t, startedEvent("test-invocation-id"), testResultEvent("file:///tmp/test.log")))
+	assert.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/upload/build_event_file", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rsp := httptest.NewRecorder()
+	uploadHandler.ServeHTTP(rsp, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rsp.Code, rsp.Body.String())
+}
@@ -1,13 +1,13 @@
 package event_parser
 
 import (
-	"regexp"
 	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	"github.com/buildbuddy-io/buildbuddy/proto/command_line"
 	"github.com/buildbuddy-io/buildbuddy/server/terminal"
+	"github.com/golang/protobuf/proto"
 
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 )
@@ -20,36 +20,6 @@ const (
 	undefinedTimestamp        = int64(-1)
 )
 
-var (
-	urlSecretRegex = regexp.MustCompile(`[a-zA-Z-0-9-_=]+\@`)
-)
-
-func stripURLSecrets(input string) string {
-	return urlSecretRegex.ReplaceAllString(input, "")
-}
-
-func stripURLSecretsFromList(inputs []string) []string {
-	for index, input := range inputs {
-		inputs[index] = stripURLSecrets(input)
-	}
-	return inputs
-}
-
-func stripURLSecretsFromFile(file *build_event_stream.File) *build_event_stream.File {
-	switch p := file.GetFile().(type) {
-	case *build_event_stream.File_Uri:
-		p.Uri = stripURLSecrets(p.Uri)
-	}
-	return file
-}
-
-func stripURLSecretsFromFiles(files []*build_event_stream.File) []*build_event_stream.File {
-	for index, file := range files {
-		files[index] = stripURLSecretsFromFile(file)
-	}
-	return files
-}
-
 func parseAndFilterCommandLine(in *command_line.CommandLine, allowedEnvVars []string) (*command_line.CommandLine, map[string]string) {
 	envVarMap := make(map[string]string)
 	if in == nil {
@@ -62,18 +32,12 @@ func parseAndFilterCommandLine(in *command_line.CommandLine, allowedEnvVars []st
 		case *command_line.CommandLineSection_OptionList:
 			{
 				for _, option := range p.OptionList.Option {
-					option.OptionValue = stripURLSecrets(option.OptionValue)
-					option.CombinedForm = stripURLSecrets(option.CombinedForm)
-					if option.OptionName == "remote_header" || option.OptionName == "remote_cache_header" {
-						option.OptionValue = envVarRedactedPlaceholder
-						option.CombinedForm = envVarPrefix + option.OptionName + envVarSeparator + envVarRedactedPlaceholder
-					}
 					if option.OptionName == envVarOptionName {
 						parts := strings.Split(option.OptionValue, envVarSeparator)
 						if len(parts) == 2 {
 							envVarMap[parts[0]] = parts[1]
 						}
-						if isAllowedEnvVar(parts[0], allowedEnvVars) {
+						if IsAllowedEnvVar(parts[0], allowedEnvVars) {
 							continue
 						}
 
@@ -89,7 +53,9 @@ func parseAndFilterCommandLine(in *command_line.CommandLine, allowedEnvVars []st
 	return &out, envVarMap
 }
 
-func isAllowedEnvVar(variableName string, allowedEnvVars []string) bool {
+// IsAllowedEnvVar returns whether the value of an env var may be shown,
+// given a list of allowed names, which may end with a "*" wildcard.
+func IsAllowedEnvVar(variableName string, allowedEnvVars []string) bool {
 	lowercaseVariableName := strings.ToLower(variableName)
 	for _, allowed := range allowedEnvVars {
 		lowercaseAllowed := strings.ToLower(allowed)
@@ -105,21 +71,29 @@ func isAllowedEnvVar(variableName string, allowedEnvVars []string) bool {
 	return false
 }
 
+// StreamingEventParser maintains the summary of an invocation as its events
+// are parsed. FillInvocation may be called at any point to fill in the
+// summary of the events parsed so far.
 type StreamingEventParser struct {
 	startTimeMillis int64
 	endTimeMillis   int64
 	screenWriter    *terminal.ScreenWriter
 	allowedEnvVars  []string
 
-	structuredCommandLines []*command_line.CommandLine
-	workspaceStatuses      []*build_event_stream.WorkspaceStatus
-	buildMetadata          []map[string]string
+	// Copies of the structured command lines as they were received, so
+	// that they are redacted with every env var allowed by the time
+	// FillInvocation is called, and the command lines in the parsed events,
+	// which FillInvocation redacts in place.
+	structuredCommandLines      []*command_line.CommandLine
+	structuredCommandLineEvents []*command_line.CommandLine
+	workspaceStatuses           []*build_event_stream.WorkspaceStatus
+	buildMetadata               []map[string]string
 
-	events      []*inpb.InvocationEvent
-	pattern     []string
-	command     string
-	success     bool
-	actionCount int64
+	pattern      []string
+	command      string
+	success      bool
+	actionCount  int64
+	buildMetrics *build_event_stream.BuildMetrics
 }
 
 func NewStreamingEventParser() *StreamingEventParser {
@@ -131,12 +105,14 @@ func NewStreamingEventParser() *StreamingEventParser {
 		structuredCommandLines: make([]*command_line.CommandLine, 0),
 		workspaceStatuses:      make([]*build_event_stream.WorkspaceStatus, 0),
 		buildMetadata:          make([]map[string]string, 0),
-		events:                 make([]*inpb.InvocationEvent, 0),
 	}
 }
 
+// ParseEvent adds event to the summary. Console output is stripped from the
+// event in place. Events are expected to be redacted already, except for the
+// env vars in structured command lines, which are only known to be allowed
+// once the build metadata has been parsed.
 func (sep *StreamingEventParser) ParseEvent(event *inpb.InvocationEvent) {
-	sep.events = append(sep.events, event)
 	switch p := event.BuildEvent.Payload.(type) {
 	case *build_event_stream.BuildEvent_Progress:
 		{
@@ -153,7 +129,6 @@ func (sep *StreamingEventParser) ParseEvent(event *inpb.InvocationEvent) {
 		}
 	case *build_event_stream.BuildEvent_Started:
 		{
-			p.Started.OptionsDescription = stripURLSecrets(p.Started.OptionsDescription)
 			sep.startTimeMillis = p.Started.StartTimeMillis
 			sep.command = p.Started.Command
 			for _, child := range event.BuildEvent.Children {
@@ -173,12 +148,11 @@ func (sep *StreamingEventParser) ParseEvent(event *inpb.InvocationEvent) {
 		}
 	case *build_event_stream.BuildEvent_StructuredCommandLine:
 		{
-			sep.structuredCommandLines = append(sep.structuredCommandLines, p.StructuredCommandLine)
+			sep.structuredCommandLines = append(sep.structuredCommandLines, proto.Clone(p.StructuredCommandLine).(*command_line.CommandLine))
+			sep.structuredCommandLineEvents = append(sep.structuredCommandLineEvents, p.StructuredCommandLine)
 		}
 	case *build_event_stream.BuildEvent_OptionsParsed:
 		{
-			p.OptionsParsed.CmdLine = stripURLSecretsFromList(p.OptionsParsed.CmdLine)
-			p.OptionsParsed.ExplicitCmdLine = stripURLSecretsFromList(p.OptionsParsed.ExplicitCmdLine)
 		}
 	case *build_event_stream.BuildEvent_WorkspaceStatus:
 		{
@@ -198,27 +172,18 @@ func (sep *StreamingEventParser) ParseEvent(event *inpb.InvocationEvent) {
 		}
 	case *build_event_stream.BuildEvent_Action:
 		{
-			p.Action.Stdout = stripURLSecretsFromFile(p.Action.Stdout)
-			p.Action.Stderr = stripURLSecretsFromFile(p.Action.Stderr)
-			p.Action.PrimaryOutput = stripURLSecretsFromFile(p.Action.PrimaryOutput)
-			p.Action.ActionMetadataLogs = stripURLSecretsFromFiles(p.Action.ActionMetadataLogs)
 		}
 	case *build_event_stream.BuildEvent_NamedSetOfFiles:
 		{
-			p.NamedSetOfFiles.Files = stripURLSecretsFromFiles(p.NamedSetOfFiles.Files)
 		}
 	case *build_event_stream.BuildEvent_Completed:
 		{
-			p.Completed.ImportantOutput = stripURLSecretsFromFiles(p.Completed.ImportantOutput)
 		}
 	case *build_event_stream.BuildEvent_TestResult:
 		{
-			p.TestResult.TestActionOutput = stripURLSecretsFromFiles(p.TestResult.TestActionOutput)
 		}
 	case *build_event_stream.BuildEvent_TestSummary:
 		{
-			p.TestSummary.Passed = stripURLSecretsFromFiles(p.TestSummary.Passed)
-			p.TestSummary.Failed = stripURLSecretsFromFiles(p.TestSummary.Failed)
 		}
 	case *build_event_stream.BuildEvent_Finished:
 		{
@@ -227,11 +192,11 @@ func (sep *StreamingEventParser) ParseEvent(event *inpb.InvocationEvent) {
 		}
 	case *build_event_stream.BuildEvent_BuildToolLogs:
 		{
-			p.BuildToolLogs.Log = stripURLSecretsFromFiles(p.BuildToolLogs.Log)
 		}
 	case *build_event_stream.BuildEvent_BuildMetrics:
 		{
-			sep.actionCount = p.BuildMetrics.ActionSummary.ActionsExecuted
+			sep.actionCount = p.BuildMetrics.GetActionSummary().GetActionsExecuted()
+			sep.buildMetrics = p.BuildMetrics
 		}
 	case *build_event_stream.BuildEvent_WorkspaceInfo:
 		{
@@ -253,20 +218,39 @@ func (sep *StreamingEventParser) ParseEvent(event *inpb.InvocationEvent) {
 	}
 }
 
+// RedactCommandLine redacts the env vars in commandLine in place, except for
+// those allowed by the events parsed so far. Env vars allowed by events
+// parsed later stay redacted.
+func (sep *StreamingEventParser) RedactCommandLine(commandLine *command_line.CommandLine) {
+	parseAndFilterCommandLine(commandLine, sep.allowedEnvVars)
+}
+
+// RestoreConsoleBuffer writes the console buffer filled in by an earlier
+// parser of the same invocation back to the screen. Progress output is
+// stripped from the events as they're parsed, so a parser rebuilt from
+// stored events can't recover it otherwise.
+func (sep *StreamingEventParser) RestoreConsoleBuffer(consoleBuffer string) {
+	sep.screenWriter.Write([]byte(consoleBuffer))
+}
+
 func (sep *StreamingEventParser) FillInvocation(invocation *inpb.Invocation) {
 	invocation.Command = sep.command
 	invocation.Pattern = sep.pattern
-	invocation.Event = sep.events
 	invocation.Success = sep.success
 	invocation.ActionCount = sep.actionCount
+	if sep.buildMetrics != nil {
+		invocation.BuildMetrics = sep.buildMetrics
+	}
 
 	// Fill invocation in a deterministic order:
 	// - Environment variables
 	// - Workspace status
 	// - Build metadata
 
-	for _, commandLine := range sep.structuredCommandLines {
+	for i, commandLine := range sep.structuredCommandLines {
+		commandLine = proto.Clone(commandLine).(*command_line.CommandLine)
 		fillInvocationFromStructuredCommandLine(commandLine, invocation, sep.allowedEnvVars)
+		parseAndFilterCommandLine(sep.structuredCommandLineEvents[i], sep.allowedEnvVars)
 	}
 	for _, workspaceStatus := range sep.workspaceStatuses {
 		fillInvocationFromWorkspaceStatus(workspaceStatus, invocation)
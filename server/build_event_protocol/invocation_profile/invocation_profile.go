@@ -0,0 +1,221 @@
+package invocation_profile
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/bytestream"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	// The name of the profile in the BuildToolLogs event.
+	profileLogName = "command.profile.gz"
+
+	buildPhaseMarkerCategory      = "build phase marker"
+	criticalPathComponentCategory = "critical path component"
+)
+
+// ProfileURI returns the URI that bazel uploaded the invocation's timing
+// profile to, if event is the BuildToolLogs event referencing it.
+func ProfileURI(event *build_event_stream.BuildEvent) string {
+	for _, log := range event.GetBuildToolLogs().GetLog() {
+		if log.GetName() == profileLogName {
+			return log.GetUri()
+		}
+	}
+	return ""
+}
+
+// profileBlobName returns the name of the blob holding the summary of an
+// invocation's timing profile.
+func profileBlobName(iid string) string {
+	return filepath.Join(iid, "profile")
+}
+
+// FetchAndStore fetches the timing profile bazel uploaded to uri, and stores
+// its summary for the invocation.
+func FetchAndStore(ctx context.Context, env environment.Env, iid, uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		err := bytestream.StreamBytestreamFile(ctx, env, u, func(data []byte) error {
+			// Fails once parsing stops early.
+			_, err := pw.Write(data)
+			return err
+		})
+		pw.CloseWithError(err)
+	}()
+	profile, err := Parse(pr)
+	// Unblock the stream if parsing stopped early.
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+	protoBytes, err := proto.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	_, err = env.GetBlobstore().WriteBlob(ctx, profileBlobName(iid), protoBytes)
+	return err
+}
+
+// Read returns the summary of an invocation's timing profile.
+func Read(ctx context.Context, env environment.Env, iid string) (*inpb.InvocationProfile, error) {
+	bs := env.GetBlobstore()
+	exists, err := bs.BlobExists(ctx, profileBlobName(iid))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, status.NotFoundErrorf("No timing profile was uploaded for invocation %s", iid)
+	}
+	protoBytes, err := bs.ReadBlob(ctx, profileBlobName(iid))
+	if err != nil {
+		return nil, err
+	}
+	profile := &inpb.InvocationProfile{}
+	if err := proto.Unmarshal(protoBytes, profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// traceEvent is an event in the Chrome trace format bazel writes its profile
+// in, with the fields we're interested in.
+type traceEvent struct {
+	Name     string `json:"name"`
+	Category string `json:"cat"`
+	Phase    string `json:"ph"`
+
+	// In microseconds.
+	Timestamp float64 `json:"ts"`
+	Duration  float64 `json:"dur"`
+}
+
+// Parse summarizes a gzipped timing profile.
+func Parse(r io.Reader) (*inpb.InvocationProfile, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	var markers, criticalPath []*traceEvent
+	start, end := -1.0, 0.0
+	err = readTraceEvents(json.NewDecoder(gr), func(e *traceEvent) {
+		// Metadata events, like thread names, have no timestamp.
+		if e.Phase == "M" {
+			return
+		}
+		if start < 0 || e.Timestamp < start {
+			start = e.Timestamp
+		}
+		if e.Timestamp+e.Duration > end {
+			end = e.Timestamp + e.Duration
+		}
+		switch e.Category {
+		case buildPhaseMarkerCategory:
+			markers = append(markers, e)
+		case criticalPathComponentCategory:
+			if e.Phase == "X" {
+				criticalPath = append(criticalPath, e)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &inpb.InvocationProfile{}
+	if start < 0 {
+		return profile, nil
+	}
+	profile.DurationUsec = int64(end - start)
+	sort.SliceStable(markers, func(i, j int) bool { return markers[i].Timestamp < markers[j].Timestamp })
+	for i, m := range markers {
+		phaseEnd := end
+		if i+1 < len(markers) {
+			phaseEnd = markers[i+1].Timestamp
+		}
+		profile.Phase = append(profile.Phase, &inpb.InvocationProfile_Phase{
+			Name:            m.Name,
+			StartOffsetUsec: int64(m.Timestamp - start),
+			DurationUsec:    int64(phaseEnd - m.Timestamp),
+		})
+	}
+	sort.SliceStable(criticalPath, func(i, j int) bool { return criticalPath[i].Timestamp < criticalPath[j].Timestamp })
+	for _, c := range criticalPath {
+		profile.CriticalPath = append(profile.CriticalPath, &inpb.InvocationProfile_CriticalPathComponent{
+			Description:     c.Name,
+			StartOffsetUsec: int64(c.Timestamp - start),
+			DurationUsec:    int64(c.Duration),
+		})
+		profile.CriticalPathDurationUsec += int64(c.Duration)
+	}
+	return profile, nil
+}
+
+// readTraceEvents calls fn with each event of a trace, one at a time, since
+// the profiles of large builds can hold millions of them. A trace is either
+// an array of events, or an object with the events under "traceEvents".
+func readTraceEvents(d *json.Decoder, fn func(e *traceEvent)) error {
+	t, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if t == json.Delim('[') {
+		return readTraceEventArray(d, fn)
+	}
+	if t != json.Delim('{') {
+		return status.InvalidArgumentError("Timing profile is not a JSON trace")
+	}
+	for d.More() {
+		key, err := d.Token()
+		if err != nil {
+			return err
+		}
+		if key != "traceEvents" {
+			var skipped json.RawMessage
+			if err := d.Decode(&skipped); err != nil {
+				return err
+			}
+			continue
+		}
+		if t, err := d.Token(); err != nil {
+			return err
+		} else if t != json.Delim('[') {
+			return status.InvalidArgumentError("Timing profile traceEvents is not an array")
+		}
+		if err := readTraceEventArray(d, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readTraceEventArray(d *json.Decoder, fn func(e *traceEvent)) error {
+	for d.More() {
+		e := &traceEvent{}
+		if err := d.Decode(e); err != nil {
+			return err
+		}
+		fn(e)
+	}
+	// Consume the closing bracket.
+	_, err := d.Token()
+	return err
+}
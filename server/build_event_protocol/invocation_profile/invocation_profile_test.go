@@ -0,0 +1,74 @@
+package invocation_profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/stretchr/testify/assert"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const testProfile = `{"otherData":{"build_id":"abc","output_base":"/tmp"},"traceEvents":[
+{"name":"thread_name","ph":"M","pid":1,"tid":0,"args":{"name":"Critical Path"}},
+{"name":"Launch Blaze","cat":"build phase marker","ph":"i","ts":1000,"pid":1,"tid":1},
+{"name":"Load packages","cat":"build phase marker","ph":"i","ts":1500,"pid":1,"tid":1},
+{"name":"action 'Compiling a.cc'","cat":"action processing","ph":"X","ts":2000,"dur":3000,"pid":1,"tid":2},
+{"name":"Execute actions","cat":"build phase marker","ph":"i","ts":2000,"pid":1,"tid":1},
+{"name":"action 'Linking a'","cat":"critical path component","ph":"X","ts":5000,"dur":1000,"pid":1,"tid":0},
+{"name":"action 'Compiling a.cc'","cat":"critical path component","ph":"X","ts":2000,"dur":3000,"pid":1,"tid":0}
+]}`
+
+func gzipped(t *testing.T, s string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	if _, err := gw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestParse(t *testing.T) {
+	profile, err := Parse(gzipped(t, testProfile))
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(5000), profile.DurationUsec)
+	assert.Equal(t, []*inpb.InvocationProfile_Phase{
+		{Name: "Launch Blaze", StartOffsetUsec: 0, DurationUsec: 500},
+		{Name: "Load packages", StartOffsetUsec: 500, DurationUsec: 500},
+		{Name: "Execute actions", StartOffsetUsec: 1000, DurationUsec: 4000},
+	}, profile.Phase)
+	assert.Equal(t, []*inpb.InvocationProfile_CriticalPathComponent{
+		{Description: "action 'Compiling a.cc'", StartOffsetUsec: 1000, DurationUsec: 3000},
+		{Description: "action 'Linking a'", StartOffsetUsec: 4000, DurationUsec: 1000},
+	}, profile.CriticalPath)
+	assert.Equal(t, int64(4000), profile.CriticalPathDurationUsec)
+}
+
+func TestParseEventArray(t *testing.T) {
+	profile, err := Parse(gzipped(t, `[{"name":"Launch Blaze","cat":"build phase marker","ph":"i","ts":0},{"name":"a","ph":"X","ts":10,"dur":20}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(30), profile.DurationUsec)
+	assert.Equal(t, 1, len(profile.Phase))
+	assert.Equal(t, int64(30), profile.Phase[0].DurationUsec)
+}
+
+func TestProfileURI(t *testing.T) {
+	event := &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_BuildToolLogs{
+			BuildToolLogs: &build_event_stream.BuildToolLogs{
+				Log: []*build_event_stream.File{
+					{Name: "elapsed time", File: &build_event_stream.File_Contents{Contents: []byte("1.0")}},
+					{Name: "command.profile.gz", File: &build_event_stream.File_Uri{Uri: "bytestream://localhost:1985/blobs/abc/123"}},
+				},
+			},
+		},
+	}
+	assert.Equal(t, "bytestream://localhost:1985/blobs/abc/123", ProfileURI(event))
+	assert.Equal(t, "", ProfileURI(&build_event_stream.BuildEvent{}))
+}
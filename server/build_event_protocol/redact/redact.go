@@ -0,0 +1,307 @@
+package redact
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_parser"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	RedactedPlaceholder = "<REDACTED>"
+
+	headerFlagRuleName = "header_flag"
+	clientEnvRuleName  = "client_env"
+)
+
+var (
+	// The flags bazel sends headers with, which often carry credentials.
+	headerOptionNames = map[string]bool{
+		"remote_header":            true,
+		"remote_cache_header":      true,
+		"remote_exec_header":       true,
+		"remote_downloader_header": true,
+		"bes_header":               true,
+	}
+
+	// The env vars whose values are kept in structured command lines, in
+	// addition to those allowed with --build_metadata=ALLOW_ENV=... in the
+	// same command line: the ones the event parser shows by default, and
+	// the ones it fills in the invocation's user, repo, commit and role
+	// from, which are shown anyway.
+	allowedEnvVars = []string{
+		"USER", "GITHUB_ACTOR", "GITHUB_REPOSITORY", "GITHUB_SHA", "GITHUB_RUN_ID", "BUILDKITE_BUILD_URL",
+		"TRAVIS_REPO_SLUG", "GIT_URL", "BUILDKITE_REPO", "CIRCLE_REPOSITORY_URL", "CI_REPOSITORY_URL",
+		"TRAVIS_COMMIT", "GIT_COMMIT", "BUILDKITE_COMMIT", "CIRCLE_SHA1", "CI_COMMIT_SHA",
+		"CI", "CI_RUNNER",
+	}
+)
+
+// rule redacts the secrets matching a regular expression.
+type rule struct {
+	name  string
+	regex *regexp.Regexp
+	// What each match is replaced by, which may refer to the submatches of
+	// the regex to keep the text around the secret.
+	replacement string
+}
+
+func builtinRules() []*rule {
+	return []*rule{
+		{
+			// Ex: "grpcs://<API key>@remote.buildbuddy.io".
+			// Credentials are stripped rather than replaced so that
+			// bytestream URIs can still be fetched. The scheme is
+			// required so that bzlmod's "name@version" is left alone.
+			name:        "url_credentials",
+			regex:       regexp.MustCompile(`(://)[a-zA-Z0-9_=:-]+@`),
+			replacement: "$1",
+		},
+		{
+			// Ex: "--bes_backend=<API key>@remote.buildbuddy.io".
+			// Flag values may leave out the scheme, so API keys (20
+			// alphanumeric characters) are stripped at the start of
+			// values too.
+			name:        "flag_credentials",
+			regex:       regexp.MustCompile(`(^|[=\s'"])[[:alnum:]]{20}@`),
+			replacement: "$1",
+		},
+		{
+			// Ex: "--remote_header=x-buildbuddy-api-key=<API key>"
+			name:        headerFlagRuleName,
+			regex:       regexp.MustCompile(`(--(?:remote|remote_cache|remote_exec|remote_downloader|bes)_header)(=|\s+)[^\s'"]+`),
+			replacement: "${1}${2}" + RedactedPlaceholder,
+		},
+		{
+			// NB: this depends on the way we generate API keys (20
+			// alphanumeric characters).
+			name:        "buildbuddy_api_key",
+			regex:       regexp.MustCompile(`(x-buildbuddy-api-key[=:]\s*)[[:alnum:]]{20}`),
+			replacement: "${1}" + RedactedPlaceholder,
+		},
+		{
+			name:        "github_token",
+			regex:       regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,255}|github_pat_[A-Za-z0-9_]{22,255})\b`),
+			replacement: RedactedPlaceholder,
+		},
+		{
+			name:        "aws_access_key_id",
+			regex:       regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+			replacement: RedactedPlaceholder,
+		},
+		{
+			name:        "aws_secret_access_key",
+			regex:       regexp.MustCompile(`(?i)(aws_secret_access_key["']?\s*[=:]\s*["']?)[A-Za-z0-9/+]{40}`),
+			replacement: "${1}" + RedactedPlaceholder,
+		},
+		{
+			name:        "gcp_api_key",
+			regex:       regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`),
+			replacement: RedactedPlaceholder,
+		},
+		{
+			// Ex: the private key of a GCP service account key file.
+			name:        "private_key",
+			regex:       regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----(?s:.*?)-----END [A-Z ]*PRIVATE KEY-----`),
+			replacement: RedactedPlaceholder,
+		},
+	}
+}
+
+func compileRules(confRules []config.RedactionRule) ([]*rule, error) {
+	rules := make([]*rule, 0, len(confRules))
+	for _, r := range confRules {
+		regex, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("Invalid pattern for redaction rule %q: %s", r.Name, err)
+		}
+		rules = append(rules, &rule{
+			name:        r.Name,
+			regex:       regex,
+			replacement: RedactedPlaceholder,
+		})
+	}
+	return rules, nil
+}
+
+// Redactor strips secrets from build events. Every event is redacted once,
+// as it's received and before it's parsed or persisted, so that secrets
+// never reach the blobstore.
+//
+// The values of env vars passed with --client_env are redacted from
+// structured command lines, unless they're allowed by default or with
+// --build_metadata=ALLOW_ENV=... in the same command line. The event parser
+// may redact more of them for display.
+type Redactor struct {
+	rules      []*rule
+	groupRules map[string][]*rule
+}
+
+// NewRedactor returns a Redactor applying the built-in rules, and the rules
+// configured for every group and for each group.
+func NewRedactor(env environment.Env) (*Redactor, error) {
+	apiKey := ""
+	if apiConfig := env.GetConfigurator().GetAPIConfig(); apiConfig != nil {
+		apiKey = apiConfig.APIKey
+	}
+	return newRedactor(apiKey, env.GetConfigurator().GetRedactionConfig())
+}
+
+func newRedactor(apiKey string, conf *config.RedactionConfig) (*Redactor, error) {
+	r := &Redactor{
+		rules:      builtinRules(),
+		groupRules: make(map[string][]*rule),
+	}
+	// The literal API key in the configuration does not need to conform to
+	// the way we generate API keys.
+	if apiKey != "" {
+		r.rules = append(r.rules, &rule{
+			name:        "configured_api_key",
+			regex:       regexp.MustCompile(regexp.QuoteMeta(apiKey)),
+			replacement: RedactedPlaceholder,
+		})
+	}
+	if conf == nil {
+		return r, nil
+	}
+	rules, err := compileRules(conf.Rules)
+	if err != nil {
+		return nil, err
+	}
+	r.rules = append(r.rules, rules...)
+	for _, g := range conf.Groups {
+		rules, err := compileRules(g.Rules)
+		if err != nil {
+			return nil, err
+		}
+		r.groupRules[g.GroupID] = append(r.groupRules[g.GroupID], rules...)
+	}
+	return r, nil
+}
+
+// RedactEvent redacts the secrets in every string of event in place, with
+// the rules that apply to groupID, which may be empty for anonymous builds.
+// It returns how many secrets were redacted.
+func (r *Redactor) RedactEvent(groupID string, event *build_event_stream.BuildEvent) int64 {
+	w := &walker{rules: r.rules, groupRules: r.groupRules[groupID]}
+	w.redactMessage(proto.MessageReflect(event))
+	return w.count
+}
+
+// walker redacts the strings of a message and counts the redactions.
+type walker struct {
+	rules      []*rule
+	groupRules []*rule
+	count      int64
+}
+
+func (w *walker) record(ruleName string, n int) {
+	w.count += int64(n)
+	metrics.RedactedSecretCount.With(prometheus.Labels{
+		metrics.RedactionRuleLabel: ruleName,
+	}).Add(float64(n))
+}
+
+func (w *walker) applyRules(rules []*rule, s string) string {
+	for _, r := range rules {
+		matches := r.regex.FindAllStringIndex(s, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		w.record(r.name, len(matches))
+		s = r.regex.ReplaceAllString(s, r.replacement)
+	}
+	return s
+}
+
+func (w *walker) redactString(s string) string {
+	if s == "" {
+		return s
+	}
+	return w.applyRules(w.groupRules, w.applyRules(w.rules, s))
+}
+
+func (w *walker) redactValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) (protoreflect.Value, bool) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		if redacted := w.redactString(v.String()); redacted != v.String() {
+			return protoreflect.ValueOfString(redacted), true
+		}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		w.redactMessage(v.Message())
+	}
+	return v, false
+}
+
+// redactEnvVars redacts the values of the env vars passed with --client_env
+// in commandLine that aren't allowed.
+func (w *walker) redactEnvVars(commandLine *command_line.CommandLine) {
+	allowed := append([]string{}, allowedEnvVars...)
+	var envVarOptions []*command_line.Option
+	for _, section := range commandLine.GetSections() {
+		for _, option := range section.GetOptionList().GetOption() {
+			switch option.OptionName {
+			case "build_metadata":
+				if v := strings.TrimPrefix(option.OptionValue, "ALLOW_ENV="); v != option.OptionValue && v != "" {
+					allowed = append(allowed, strings.Split(v, ",")...)
+				}
+			case "client_env":
+				envVarOptions = append(envVarOptions, option)
+			}
+		}
+	}
+	for _, option := range envVarOptions {
+		parts := strings.SplitN(option.OptionValue, "=", 2)
+		if len(parts) != 2 || parts[1] == RedactedPlaceholder || event_parser.IsAllowedEnvVar(parts[0], allowed) {
+			continue
+		}
+		option.OptionValue = parts[0] + "=" + RedactedPlaceholder
+		option.CombinedForm = "--client_env=" + option.OptionValue
+		w.record(clientEnvRuleName, 1)
+	}
+}
+
+func (w *walker) redactMessage(m protoreflect.Message) {
+	if commandLine, ok := m.Interface().(*command_line.CommandLine); ok {
+		w.redactEnvVars(commandLine)
+	}
+	// The values of header flags in structured command lines don't include
+	// the flag name, so they're not matched by the header flag rule.
+	if option, ok := m.Interface().(*command_line.Option); ok && headerOptionNames[option.OptionName] && option.OptionValue != RedactedPlaceholder {
+		option.OptionValue = RedactedPlaceholder
+		w.record(headerFlagRuleName, 1)
+	}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList():
+			l := v.List()
+			for i := 0; i < l.Len(); i++ {
+				if redacted, changed := w.redactValue(fd, l.Get(i)); changed {
+					l.Set(i, redacted)
+				}
+			}
+		case fd.IsMap():
+			mp := v.Map()
+			mp.Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+				if redacted, changed := w.redactValue(fd.MapValue(), mv); changed {
+					mp.Set(k, redacted)
+				}
+				return true
+			})
+		default:
+			if redacted, changed := w.redactValue(fd, v); changed {
+				m.Set(fd, redacted)
+			}
+		}
+		return true
+	})
+}
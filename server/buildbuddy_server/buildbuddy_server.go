@@ -7,10 +7,10 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
 
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_profile"
 	"github.com/buildbuddy-io/buildbuddy/server/bytestream"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/ssl"
@@ -19,14 +19,15 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
-	"github.com/golang/protobuf/proto"
 
 	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
 	bzpb "github.com/buildbuddy-io/buildbuddy/proto/bazel_config"
+	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
 	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	trpb "github.com/buildbuddy-io/buildbuddy/proto/target"
+	uapb "github.com/buildbuddy-io/buildbuddy/proto/usage"
 	uspb "github.com/buildbuddy-io/buildbuddy/proto/user"
 	wfpb "github.com/buildbuddy-io/buildbuddy/proto/workflow"
 	requestcontext "github.com/buildbuddy-io/buildbuddy/server/util/request_context"
@@ -50,52 +51,16 @@ func NewBuildBuddyServer(env environment.Env, sslService *ssl.SSLService) (*Buil
 	}, nil
 }
 
-func (s *BuildBuddyServer) getConfiguredAPIKey() string {
-	if apiConfig := s.env.GetConfigurator().GetAPIConfig(); apiConfig != nil {
-		return apiConfig.APIKey
-	}
-	return ""
-}
-
-func (s *BuildBuddyServer) redactAPIKeys(ctx context.Context, rsp *inpb.GetInvocationResponse) error {
-	proto.DiscardUnknown(rsp)
-	txt := proto.MarshalTextString(rsp)
-
-	// NB: this implementation depends on the way we generate API keys
-	// (20 alphanumeric characters).
-
-	// Replace x-buildbuddy-api-key header.
-	pat := regexp.MustCompile("x-buildbuddy-api-key=[[:alnum:]]{20}")
-	txt = pat.ReplaceAllLiteralString(txt, "x-buildbuddy-api-key=<REDACTED>")
-
-	// Replace sequences that look like API keys immediately followed by '@',
-	// to account for patterns like "grpc://$API_KEY@app.buildbuddy.io"
-	// or "bes_backend=$API_KEY@domain.com".
-
-	// Here we match 20 alphanum chars occurring at the start of a line.
-	pat = regexp.MustCompile("^[[:alnum:]]{20}@")
-	txt = pat.ReplaceAllLiteralString(txt, "<REDACTED>@")
-	// Here we match 20 alphanum chars anywhere in the line, preceded by a non-
-	// alphanum char (to ensure the match is exactly 20 alphanum chars long).
-	pat = regexp.MustCompile("([^[:alnum:]])[[:alnum:]]{20}@")
-	txt = pat.ReplaceAllString(txt, "$1<REDACTED>@")
-
-	// Replace the literal API key in the configuration, which does not need
-	// to conform to the way we generate API keys.
-	configuredKey := s.getConfiguredAPIKey()
-	if configuredKey != "" {
-		txt = strings.ReplaceAll(txt, configuredKey, "<REDACTED>")
-	}
-
-	return proto.UnmarshalText(txt, rsp)
-}
-
 func (s *BuildBuddyServer) GetInvocation(ctx context.Context, req *inpb.GetInvocationRequest) (*inpb.GetInvocationResponse, error) {
 	if req.GetLookup().GetInvocationId() == "" {
 		return nil, status.InvalidArgumentErrorf("GetInvocationRequest must contain a valid invocation_id")
 	}
 
-	inv, err := build_event_handler.LookupInvocation(s.env, ctx, req.GetLookup().GetInvocationId())
+	if req.GetPageSize() < 0 {
+		return nil, status.InvalidArgumentErrorf("GetInvocationRequest page_size must not be negative")
+	}
+
+	inv, nextSequenceNumber, err := build_event_handler.LookupInvocationWithEvents(s.env, ctx, req.GetLookup().GetInvocationId(), req.GetStartSequenceNumber(), int(req.GetPageSize()), req.GetEventFilter())
 	if err != nil {
 		return nil, err
 	}
@@ -104,11 +69,35 @@ func (s *BuildBuddyServer) GetInvocation(ctx context.Context, req *inpb.GetInvoc
 		Invocation: []*inpb.Invocation{
 			inv,
 		},
+		NextSequenceNumber: nextSequenceNumber,
 	}
-	if err := s.redactAPIKeys(ctx, rsp); err != nil {
+	return rsp, nil
+}
+
+func (s *BuildBuddyServer) StreamInvocationEvents(req *inpb.StreamInvocationEventsRequest, stream bbspb.BuildBuddyService_StreamInvocationEventsServer) error {
+	iid := req.GetLookup().GetInvocationId()
+	if iid == "" {
+		return status.InvalidArgumentErrorf("StreamInvocationEventsRequest must contain a valid invocation_id")
+	}
+	return build_event_handler.StreamInvocationEvents(s.env, stream.Context(), iid, req.GetStartSequenceNumber(), req.GetEventFilter(), func(events []*inpb.InvocationEvent) error {
+		return stream.Send(&inpb.StreamInvocationEventsResponse{Event: events})
+	})
+}
+
+func (s *BuildBuddyServer) GetInvocationProfile(ctx context.Context, req *inpb.GetInvocationProfileRequest) (*inpb.GetInvocationProfileResponse, error) {
+	iid := req.GetLookup().GetInvocationId()
+	if iid == "" {
+		return nil, status.InvalidArgumentErrorf("GetInvocationProfileRequest must contain a valid invocation_id")
+	}
+	// Make sure the invocation can be read.
+	if _, err := s.env.GetInvocationDB().LookupInvocation(ctx, iid); err != nil {
 		return nil, err
 	}
-	return rsp, nil
+	profile, err := invocation_profile.Read(ctx, s.env, iid)
+	if err != nil {
+		return nil, err
+	}
+	return &inpb.GetInvocationProfileResponse{Profile: profile}, nil
 }
 
 func (s *BuildBuddyServer) SearchInvocation(ctx context.Context, req *inpb.SearchInvocationRequest) (*inpb.SearchInvocationResponse, error) {
@@ -688,6 +677,13 @@ func (s *BuildBuddyServer) GetWorkflows(ctx context.Context, req *wfpb.GetWorkfl
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) GetUsage(ctx context.Context, req *uapb.GetUsageRequest) (*uapb.GetUsageResponse, error) {
+	if ut := s.env.GetUsageTracker(); ut != nil {
+		return ut.GetUsage(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 type bsLookup struct {
 	URL      *url.URL
 	Filename string
@@ -766,8 +762,9 @@ func (s *BuildBuddyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// TODO(siggisim): Figure out why this JWT is overriding authority auth and remove.
 	ctx := context.WithValue(r.Context(), "x-buildbuddy-jwt", nil)
 
-	err = bytestream.StreamBytestreamFile(ctx, s.env, lookup.URL, func(data []byte) {
-		w.Write(data)
+	err = bytestream.StreamBytestreamFile(ctx, s.env, lookup.URL, func(data []byte) error {
+		_, err := w.Write(data)
+		return err
 	})
 
 	if err != nil {
@@ -14,34 +14,42 @@ import (
 	bspb "google.golang.org/genproto/googleapis/bytestream"
 )
 
-func StreamBytestreamFile(ctx context.Context, env environment.Env, url *url.URL, callback func([]byte)) error {
+func StreamBytestreamFile(ctx context.Context, env environment.Env, url *url.URL, callback func([]byte) error) error {
 	if url.Scheme != "bytestream" {
 		return status.InvalidArgumentErrorf("Only bytestream:// uris are supported")
 	}
 
+	// Once the callback has been given any data, retrying with another url
+	// would give it the same data again, so the first error is returned.
+	delivered := false
+	cb := func(data []byte) error {
+		delivered = true
+		return callback(data)
+	}
+
 	err := error(nil)
 
 	// If we have a cache enabled, try connecting to that first
 	if env.GetCache() != nil {
 		localURL, _ := url.Parse(url.String())
 		localURL.Host = "localhost:" + getIntFlag("grpc_port", "1985")
-		err = streamFromUrl(ctx, localURL, false, callback)
+		err = streamFromUrl(ctx, localURL, false, cb)
 	}
 
 	// If that fails, try to connect over grpcs
-	if err != nil || env.GetCache() == nil {
-		err = streamFromUrl(ctx, url, true, callback)
+	if !delivered && (err != nil || env.GetCache() == nil) {
+		err = streamFromUrl(ctx, url, true, cb)
 	}
 
 	// If that fails, try grpc
-	if err != nil {
-		err = streamFromUrl(ctx, url, false, callback)
+	if !delivered && err != nil {
+		err = streamFromUrl(ctx, url, false, cb)
 	}
 
 	return err
 }
 
-func streamFromUrl(ctx context.Context, url *url.URL, grpcs bool, callback func([]byte)) error {
+func streamFromUrl(ctx context.Context, url *url.URL, grpcs bool, callback func([]byte) error) error {
 	if url.Port() == "" && grpcs {
 		url.Host = url.Hostname() + ":443"
 	} else if url.Port() == "" {
@@ -74,7 +82,9 @@ func streamFromUrl(ctx context.Context, url *url.URL, grpcs bool, callback func(
 		if err != nil {
 			return err
 		}
-		callback(rsp.Data)
+		if err := callback(rsp.Data); err != nil {
+			return err
+		}
 	}
 	return nil
 }
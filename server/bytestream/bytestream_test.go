@@ -0,0 +1,84 @@
+package bytestream
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/grpc"
+
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+)
+
+// The local cache is reached at the app's gRPC port, which is defined by
+// libmain.
+var grpcPort = flag.Int("grpc_port", 1985, "")
+
+// failingByteStreamServer sends the first chunk of every read, and then fails.
+type failingByteStreamServer struct {
+	bspb.UnimplementedByteStreamServer
+
+	mu    sync.Mutex
+	reads int
+}
+
+func (s *failingByteStreamServer) Read(req *bspb.ReadRequest, stream bspb.ByteStream_ReadServer) error {
+	s.mu.Lock()
+	s.reads++
+	s.mu.Unlock()
+	if err := stream.Send(&bspb.ReadResponse{Data: []byte("first chunk")}); err != nil {
+		return err
+	}
+	return status.UnavailableError("connection lost")
+}
+
+func (s *failingByteStreamServer) readCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+func TestStreamBytestreamFileDoesNotRetryAfterPartialRead(t *testing.T) {
+	te := environment.GetTestEnv(t)
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &failingByteStreamServer{}
+	grpcServer := grpc.NewServer()
+	bspb.RegisterByteStreamServer(grpcServer, server)
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	port := lis.Addr().(*net.TCPAddr).Port
+	oldPort := *grpcPort
+	*grpcPort = port
+	defer func() { *grpcPort = oldPort }()
+
+	// Both the local cache and the plain gRPC fallback reach the failing
+	// server.
+	u, err := url.Parse(fmt.Sprintf("bytestream://localhost:%d/blobs/1234/11", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []string
+	err = StreamBytestreamFile(context.Background(), te, u, func(data []byte) error {
+		chunks = append(chunks, string(data))
+		return nil
+	})
+	if !status.IsUnavailableError(err) {
+		t.Fatalf("StreamBytestreamFile returned %v, want an Unavailable error", err)
+	}
+	if len(chunks) != 1 {
+		t.Errorf("Callback got chunks %q, want the first chunk once", chunks)
+	}
+	if n := server.readCount(); n != 1 {
+		t.Errorf("Server got %d reads, want 1", n)
+	}
+}
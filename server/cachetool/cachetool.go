@@ -0,0 +1,162 @@
+// Package cachetool implements cachetool, which copies action cache and CAS
+// entries between deployments to warm up the cache of a new deployment:
+//
+//  1. `cachetool export --config_file=... --archive=...` writes the entries
+//     of the cache configured in a buildbuddy config file to an archive.
+//  2. `cachetool import --config_file=... --archive=...` writes the entries
+//     of the archive to the cache configured in another config file.
+//
+// Both commands can be interrupted and run again to pick up where they left
+// off. The cache is opened directly rather than through a running server, so
+// a disk cache should only be imported into while its server is stopped, and
+// an in-memory cache can't be copied. Entries can only be exported from
+// caches which can list them, which are the local ones.
+//
+// The open-source and enterprise builds of the tool only differ in the caches
+// they can open, so both run Main with the function that opens them.
+package cachetool
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/libmain"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cache_archive"
+	"github.com/buildbuddy-io/buildbuddy/server/util/crypter"
+)
+
+// A CacheGetter returns the cache configured in configurator, which encrypts
+// its entries with c if it is set, along with the local cache that stores
+// them, if any. Both are nil if no cache is configured.
+type CacheGetter func(configurator *config.Configurator, c *crypter.Crypter) (interfaces.Cache, interfaces.Cache, error)
+
+const usage = `usage:
+  cachetool export --config_file=<path> --archive=<path> [--group_ids=<ids>] [--instance_names=<names>]
+  cachetool import --config_file=<path> --archive=<path> [--group_ids=<ids>] [--instance_names=<names>]`
+
+// Main runs the command in os.Args, opening caches with getCache.
+func Main(getCache CacheGetter) {
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = export(getCache, os.Args[2:])
+	case "import":
+		err = importArchive(getCache, os.Args[2:])
+	default:
+		log.Fatal(usage)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type commonFlags struct {
+	configFile    *string
+	archive       *string
+	groupIDs      *string
+	instanceNames *string
+}
+
+func parseFlags(name string, args []string) (*commonFlags, error) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	f := &commonFlags{
+		configFile:    flags.String("config_file", "/config.yaml", "The path to the buildbuddy config file of the servers whose cache should be used."),
+		archive:       flags.String("archive", "", "The path of the archive."),
+		groupIDs:      flags.String("group_ids", "", "If set, a comma-separated list of the groups whose entries are copied, like GR123. Anonymous entries belong to ANON."),
+		instanceNames: flags.String("instance_names", "", "If set, a comma-separated list of the remote instance names whose entries are copied. Include an empty name, like ',linux', for the default instance name."),
+	}
+	flags.Parse(args)
+	if *f.archive == "" {
+		return nil, fmt.Errorf("--archive is required")
+	}
+	return f, nil
+}
+
+func (f *commonFlags) filter() *cache_archive.Filter {
+	filter := &cache_archive.Filter{}
+	if *f.groupIDs != "" {
+		filter.GroupIDs = strings.Split(*f.groupIDs, ",")
+	}
+	if *f.instanceNames != "" {
+		filter.InstanceNames = strings.Split(*f.instanceNames, ",")
+	}
+	return filter
+}
+
+// openCache returns the cache configured in configFile, built by getCache
+// the same way the server builds it, along with the local cache that stores
+// its entries.
+func openCache(getCache CacheGetter, configFile string) (interfaces.Cache, interfaces.Cache, error) {
+	configurator, err := config.NewConfigurator(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := libmain.GetConfiguredCrypter(configurator)
+	if err != nil {
+		return nil, nil, err
+	}
+	cache, local, err := getCache(configurator, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cache == nil {
+		return nil, nil, fmt.Errorf("%s doesn't configure a cache", configFile)
+	}
+	if configurator.GetCacheInMemory() {
+		log.Printf("%s configures an in-memory cache, which only holds the entries copied by this command", configFile)
+	}
+	return cache, local, nil
+}
+
+func logStats(verb string, stats *cache_archive.Stats) error {
+	log.Printf("%s %d entries (%d bytes), skipped %d already present, %d failed", verb, stats.Copied, stats.CopiedBytes, stats.Skipped, stats.Failed)
+	if stats.Failed > 0 {
+		return fmt.Errorf("Failed to copy %d entries", stats.Failed)
+	}
+	return nil
+}
+
+func export(getCache CacheGetter, args []string) error {
+	f, err := parseFlags("export", args)
+	if err != nil {
+		return err
+	}
+	cache, local, err := openCache(getCache, *f.configFile)
+	if err != nil {
+		return err
+	}
+	scanner, ok := local.(interfaces.KeyScanner)
+	if !ok {
+		return fmt.Errorf("the cache configured in %s can't list its entries; only disk caches can be exported", *f.configFile)
+	}
+	stats, err := cache_archive.Export(context.Background(), cache, scanner, *f.archive, f.filter())
+	if err != nil {
+		return err
+	}
+	return logStats("Exported", stats)
+}
+
+func importArchive(getCache CacheGetter, args []string) error {
+	f, err := parseFlags("import", args)
+	if err != nil {
+		return err
+	}
+	cache, _, err := openCache(getCache, *f.configFile)
+	if err != nil {
+		return err
+	}
+	stats, err := cache_archive.Import(context.Background(), cache, *f.archive, f.filter())
+	if err != nil {
+		return err
+	}
+	return logStats("Imported", stats)
+}
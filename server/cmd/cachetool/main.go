@@ -0,0 +1,12 @@
+package main
+
+import (
+	"github.com/buildbuddy-io/buildbuddy/server/cachetool"
+	"github.com/buildbuddy-io/buildbuddy/server/libmain"
+)
+
+// The open-source cachetool copies the entries of the caches the open-source
+// server supports: the disk and in-memory caches.
+func main() {
+	cachetool.Main(libmain.GetConfiguredCache)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/crypter"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/healthcheck"
+	"github.com/google/uuid"
+)
+
+// rekey manages the master keys that blobs and cache entries are encrypted
+// under. Rotating a key is done in three steps:
+//
+//   1. `rekey rotate --key_file=...` adds a new version of the master key.
+//   2. Every server is restarted to pick up the new version, so that new
+//      data is encrypted under it.
+//   3. `rekey reencrypt --config_file=...` reencrypts stored blobs whose
+//      data keys are wrapped by an older version under the new one. It also
+//      encrypts invocation blobs which were written before encryption was
+//      enabled.
+//
+// Old versions must stay in the keyfile until both the reencrypt step has
+// finished and every cache entry written under them has expired.
+
+const usage = `usage:
+  rekey rotate --key_file=<path> [--group_id=<group>]
+  rekey reencrypt --config_file=<path>`
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+	var err error
+	switch os.Args[1] {
+	case "rotate":
+		err = rotate(os.Args[2:])
+	case "reencrypt":
+		err = reencrypt(os.Args[2:])
+	default:
+		log.Fatal(usage)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func rotate(args []string) error {
+	flags := flag.NewFlagSet("rotate", flag.ExitOnError)
+	keyFile := flags.String("key_file", "", "The keyfile to add a master key version to. It is created if it doesn't exist.")
+	groupID := flags.String("group_id", "", "If set, rotate this group's own master key rather than the default one.")
+	flags.Parse(args)
+	if *keyFile == "" {
+		return fmt.Errorf("--key_file is required")
+	}
+
+	kf := &crypter.Keyfile{}
+	if _, err := os.Stat(*keyFile); err == nil {
+		if kf, err = crypter.ReadKeyfile(*keyFile); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	version, err := kf.Rotate(*groupID)
+	if err != nil {
+		return err
+	}
+	if err := crypter.WriteKeyfile(*keyFile, kf); err != nil {
+		return err
+	}
+	if *groupID != "" {
+		log.Printf("Added master key version %d for group %q to %s", version, *groupID, *keyFile)
+	} else {
+		log.Printf("Added default master key version %d to %s", version, *keyFile)
+	}
+	return nil
+}
+
+// groupIDContextKey holds the group that groupSealer encrypts blobs for.
+const groupIDContextKey = "rekey.groupID"
+
+// groupSealer encrypts blobs for the group attached to the context, rather
+// than that of an authenticated user as the server does.
+type groupSealer struct {
+	crypter *crypter.Crypter
+}
+
+func (s *groupSealer) NewSealWriter(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	groupID, ok := ctx.Value(groupIDContextKey).(string)
+	if !ok {
+		return nil, fmt.Errorf("No group to encrypt blob for")
+	}
+	return s.crypter.NewEncryptWriter(ctx, w, groupID)
+}
+
+func (s *groupSealer) NewOpenReader(ctx context.Context, r io.Reader) (io.Reader, error) {
+	return s.crypter.NewDecryptReader(ctx, r)
+}
+
+type reencrypter struct {
+	// bs reads blobs as they are stored, which for encrypted blobs is
+	// still encrypted. sealedBS reads and writes their contents.
+	bs       interfaces.Blobstore
+	sealedBS interfaces.Blobstore
+	dbh      *db.DBHandle
+	kms      interfaces.KMS
+
+	numRekeyed   int
+	numEncrypted int
+}
+
+// invocationGroupID returns the group an invocation blob belongs to, or ""
+// if it doesn't belong to a known invocation. It matches the group that
+// the server would have encrypted the blob under: anonymous invocations
+// belong to ANON, and those of users without a group to the user.
+func (r *reencrypter) invocationGroupID(blobName string) (string, error) {
+	iid := strings.SplitN(blobName, "/", 2)[0]
+	if _, err := uuid.Parse(iid); err != nil {
+		return "", nil
+	}
+	rows, err := r.dbh.Raw(`SELECT group_id, user_id FROM Invocations WHERE invocation_id = ?`, iid).Rows()
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return "", rows.Err()
+	}
+	var groupID, userID string
+	if err := rows.Scan(&groupID, &userID); err != nil {
+		return "", err
+	}
+	if groupID != "" {
+		return groupID, nil
+	}
+	if userID != "" {
+		return userID, nil
+	}
+	return "ANON", nil
+}
+
+func (r *reencrypter) reencryptBlob(ctx context.Context, blobName string) error {
+	// Encrypted blobs don't look compressed, so they're read as stored.
+	stored, err := r.bs.ReadBlob(ctx, blobName)
+	if err != nil {
+		return err
+	}
+	var groupID string
+	if crypter.IsEncrypted(stored) {
+		h, err := crypter.ReadHeader(bufio.NewReader(bytes.NewReader(stored)))
+		if err != nil {
+			return err
+		}
+		current, err := r.kms.CurrentKeyVersion(ctx, h.GroupID)
+		if err != nil || h.KeyVersion >= current {
+			return err
+		}
+		groupID = h.GroupID
+	} else {
+		// Blobs outside of invocations, like the telemetry installation
+		// ID, may be read by code which doesn't decrypt them, so they're
+		// left alone.
+		if groupID, err = r.invocationGroupID(blobName); err != nil || groupID == "" {
+			return err
+		}
+	}
+
+	// Blobs are reencrypted rather than having their data keys rewrapped,
+	// since they are encrypted after being compressed.
+	data, err := r.sealedBS.ReadBlob(ctx, blobName)
+	if err != nil {
+		return err
+	}
+	if _, err := r.sealedBS.WriteBlob(context.WithValue(ctx, groupIDContextKey, groupID), blobName, data); err != nil {
+		return err
+	}
+	if crypter.IsEncrypted(stored) {
+		r.numRekeyed++
+	} else {
+		r.numEncrypted++
+	}
+	return nil
+}
+
+func reencrypt(args []string) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	configFile := flags.String("config_file", "/config.yaml", "The path to the buildbuddy config file of the servers whose storage should be reencrypted.")
+	flags.Parse(args)
+
+	configurator, err := config.NewConfigurator(*configFile)
+	if err != nil {
+		return err
+	}
+	encryptionConfig := configurator.GetEncryptionConfig()
+	if encryptionConfig == nil {
+		return fmt.Errorf("Encryption isn't configured in %s", *configFile)
+	}
+	kf, err := crypter.ReadKeyfile(encryptionConfig.KeyFile)
+	if err != nil {
+		return err
+	}
+	kms, err := crypter.NewKeyfileKMS(kf)
+	if err != nil {
+		return err
+	}
+	bs, err := blobstore.GetConfiguredBlobstore(configurator, nil)
+	if err != nil {
+		return err
+	}
+	sealedBS, err := blobstore.GetConfiguredBlobstore(configurator, &groupSealer{crypter.New(kms)})
+	if err != nil {
+		return err
+	}
+	dbh, err := db.GetConfiguredDatabase(configurator, healthcheck.NewHealthChecker("rekey"))
+	if err != nil {
+		return err
+	}
+	r := &reencrypter{
+		bs:       bs,
+		sealedBS: sealedBS,
+		dbh:      dbh,
+		kms:      kms,
+	}
+
+	ctx := context.Background()
+	numChecked := 0
+	numFailed := 0
+	err = bs.ListBlobs(ctx, "", func(name string, modTime time.Time) error {
+		numChecked++
+		if err := r.reencryptBlob(ctx, name); err != nil {
+			log.Printf("Error reencrypting blob %s: %s", name, err)
+			numFailed++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Checked %d blobs: reencrypted %d, encrypted %d previously unencrypted, %d failed", numChecked, r.numRekeyed, r.numEncrypted, numFailed)
+	if numFailed > 0 {
+		return fmt.Errorf("Failed to reencrypt %d blobs", numFailed)
+	}
+	return nil
+}
@@ -19,6 +19,7 @@ type generalConfig struct {
 	BuildEventProxy buildEventProxy       `yaml:"build_event_proxy"`
 	Database        DatabaseConfig        `yaml:"database"`
 	Storage         storageConfig         `yaml:"storage"`
+	Encryption      EncryptionConfig      `yaml:"encryption"`
 	Integrations    integrationsConfig    `yaml:"integrations"`
 	Cache           cacheConfig           `yaml:"cache"`
 	Auth            authConfig            `yaml:"auth"`
@@ -28,6 +29,7 @@ type generalConfig struct {
 	API             APIConfig             `yaml:"api"`
 	Github          GithubConfig          `yaml:"github"`
 	Org             OrgConfig             `yaml:"org"`
+	Redaction       RedactionConfig       `yaml:"redaction"`
 }
 
 type appConfig struct {
@@ -42,11 +44,30 @@ type appConfig struct {
 	DefaultToDenseMode      bool   `yaml:"default_to_dense_mode" usage:"Enables the dense UI mode by default."`
 	GRPCMaxRecvMsgSizeBytes int    `yaml:"grpc_max_recv_msg_size_bytes" usage:"Configures the max GRPC receive message size [bytes]"`
 	EnableTargetTracking    bool   `yaml:"enable_target_tracking" usage:"Cloud-Only"`
+
+	BuildEventUploadMaxSizeBytes         int64 `yaml:"build_event_upload_max_size_bytes" usage:"The largest build event file upload, including its artifacts, that is accepted [bytes]"`
+	BuildEventUploadMaxArtifactSizeBytes int64 `yaml:"build_event_upload_max_artifact_size_bytes" usage:"The largest artifact accepted along with an uploaded build event file [bytes]"`
 }
 
 type buildEventProxy struct {
 	Hosts      []string `yaml:"hosts" usage:"The list of hosts to pass build events onto."`
 	BufferSize int      `yaml:"buffer_size" usage:"The number of build events to buffer locally when proxying build events."`
+	SpoolDir   string   `yaml:"spool_dir" usage:"If set, build events are spooled to this directory and retried until each host has acked them, instead of being dropped when a host is slow or unavailable."`
+
+	// Hosts that only the build events of some invocations are forwarded to.
+	Routes []BuildEventProxyRoute `yaml:"routes"`
+}
+
+// BuildEventProxyRoute forwards the build events of the invocations matching
+// all of its filters to hosts, in addition to the hosts that every build event
+// is forwarded to. An empty filter matches every invocation.
+type BuildEventProxyRoute struct {
+	Hosts          []string `yaml:"hosts" usage:"The hosts to forward the build events of matching invocations to."`
+	GroupIDs       []string `yaml:"group_ids" usage:"The groups whose invocations match."`
+	RepoURLs       []string `yaml:"repo_urls" usage:"The repos whose invocations match."`
+	Roles          []string `yaml:"roles" usage:"The roles of the invocations that match, ex. CI. LOCAL matches invocations without a role."`
+	Commands       []string `yaml:"commands" usage:"The bazel commands whose invocations match, ex. test."`
+	ExcludedEvents []string `yaml:"excluded_events" usage:"The types of build events to forward without their payload, named after the BuildEvent payload field, ex. progress."`
 }
 
 type DatabaseConfig struct {
@@ -63,8 +84,14 @@ type storageConfig struct {
 	Disk               DiskConfig  `yaml:"disk"`
 	GCS                GCSConfig   `yaml:"gcs"`
 	AwsS3              AwsS3Config `yaml:"aws_s3"`
+	Azure              AzureConfig `yaml:"azure"`
 	TTLSeconds         int         `yaml:"ttl_seconds" usage:"The time, in seconds, to keep invocations before deletion"`
 	ChunkFileSizeBytes int         `yaml:"chunk_file_size_bytes" usage:"How many bytes to buffer in memory before flushing a chunk of build protocol data to disk."`
+	Compression        string      `yaml:"compression" usage:"The codec to compress newly written blobs with, either gzip (the default) or zstd. Blobs written with either codec can always be read."`
+}
+
+type EncryptionConfig struct {
+	KeyFile string `yaml:"key_file" usage:"A keyfile holding the master keys that stored blobs and cache entries are encrypted under. If set, everything written to storage and the cache is encrypted."`
 }
 
 type DiskConfig struct {
@@ -78,9 +105,23 @@ type GCSConfig struct {
 }
 
 type AwsS3Config struct {
-	Region             string `yaml:"region" usage:"The AWS region."`
-	Bucket             string `yaml:"bucket" usage:"The AWS S3 bucket to store files in."`
-	CredentialsProfile string `yaml:"credentials_profile" usage:"A custom credentials profile to use."`
+	Region                  string `yaml:"region" usage:"The AWS region."`
+	Bucket                  string `yaml:"bucket" usage:"The AWS S3 bucket to store files in."`
+	CredentialsProfile      string `yaml:"credentials_profile" usage:"A custom credentials profile to use."`
+	Endpoint                string `yaml:"endpoint" usage:"A custom endpoint URL for an S3-compatible store like MinIO or Ceph, e.g. http://minio.local:9000. Defaults to AWS."`
+	ForcePathStyle          bool   `yaml:"force_path_style" usage:"Whether to address buckets as endpoint/bucket rather than bucket.endpoint. Usually required for S3-compatible stores."`
+	CredentialsFile         string `yaml:"credentials_file" usage:"A shared credentials file to read credentials_profile from. Defaults to ~/.aws/credentials."`
+	StaticCredentialsID     string `yaml:"static_credentials_id" usage:"An access key ID to authenticate with, instead of shared credentials."`
+	StaticCredentialsSecret string `yaml:"static_credentials_secret" usage:"The secret access key for static_credentials_id."`
+	StaticCredentialsToken  string `yaml:"static_credentials_token" usage:"An optional session token for static_credentials_id."`
+	CACertFile              string `yaml:"ca_cert_file" usage:"A PEM file of CA certificates to trust when connecting to the endpoint over TLS."`
+}
+
+type AzureConfig struct {
+	AccountName   string `yaml:"account_name" usage:"The name of the Azure storage account."`
+	AccountKey    string `yaml:"account_key" usage:"The shared key of the Azure storage account."`
+	ContainerName string `yaml:"container_name" usage:"The Azure blob container to store files in (will be created automatically)."`
+	Endpoint      string `yaml:"endpoint" usage:"A custom blob service URL, e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite. Defaults to https://<account_name>.blob.core.windows.net."`
 }
 
 type integrationsConfig struct {
@@ -99,28 +140,98 @@ type GCSCacheConfig struct {
 }
 
 type S3CacheConfig struct {
-	Region             string `yaml:"region" usage:"The AWS region."`
-	Bucket             string `yaml:"bucket" usage:"The AWS S3 bucket to store files in."`
-	CredentialsProfile string `yaml:"credentials_profile" usage:"A custom credentials profile to use."`
-	TTLDays            int64  `yaml:"ttl_days" usage:"The period after which cache files should be TTLd. Disabled if 0."`
+	Region                  string `yaml:"region" usage:"The AWS region."`
+	Bucket                  string `yaml:"bucket" usage:"The AWS S3 bucket to store files in."`
+	CredentialsProfile      string `yaml:"credentials_profile" usage:"A custom credentials profile to use."`
+	TTLDays                 int64  `yaml:"ttl_days" usage:"The period after which cache files should be TTLd. Disabled if 0."`
+	Endpoint                string `yaml:"endpoint" usage:"A custom endpoint URL for an S3-compatible store like MinIO or Ceph, e.g. http://minio.local:9000. Defaults to AWS."`
+	ForcePathStyle          bool   `yaml:"force_path_style" usage:"Whether to address buckets as endpoint/bucket rather than bucket.endpoint. Usually required for S3-compatible stores."`
+	CredentialsFile         string `yaml:"credentials_file" usage:"A shared credentials file to read credentials_profile from. Defaults to ~/.aws/credentials."`
+	StaticCredentialsID     string `yaml:"static_credentials_id" usage:"An access key ID to authenticate with, instead of shared credentials."`
+	StaticCredentialsSecret string `yaml:"static_credentials_secret" usage:"The secret access key for static_credentials_id."`
+	StaticCredentialsToken  string `yaml:"static_credentials_token" usage:"An optional session token for static_credentials_id."`
+	CACertFile              string `yaml:"ca_cert_file" usage:"A PEM file of CA certificates to trust when connecting to the endpoint over TLS."`
+}
+
+type AzureCacheConfig struct {
+	AccountName   string `yaml:"account_name" usage:"The name of the Azure storage account."`
+	AccountKey    string `yaml:"account_key" usage:"The shared key of the Azure storage account."`
+	ContainerName string `yaml:"container_name" usage:"The Azure blob container to store cache files in (will be created automatically)."`
+	Endpoint      string `yaml:"endpoint" usage:"A custom blob service URL, e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite. Defaults to https://<account_name>.blob.core.windows.net."`
+	TTLDays       int64  `yaml:"ttl_days" usage:"The period after which unused cache files may be deleted by a lifecycle management rule on the storage account. Blobs in use are touched so that they stay younger than this. Disabled if 0."`
 }
 
 type DistributedCacheConfig struct {
-	ListenAddr        string `yaml:"listen_addr" usage:"The address to listen for local BuildBuddy distributed cache traffic on."`
-	RedisTarget       string `yaml:"redis_target" usage:"A redis target for improved Caching/RBE performance. ** Enterprise only **"`
-	GroupName         string `yaml:"group_name" usage:"A unique name for this distributed cache group. ** Enterprise only **"`
-	ReplicationFactor int    `yaml:"replication_factor" usage:"How many total servers the data should be replicated to. Must be >= 1. ** Enterprise only **"`
+	ListenAddr                       string   `yaml:"listen_addr" usage:"The address to listen for local BuildBuddy distributed cache traffic on."`
+	RedisTarget                      string   `yaml:"redis_target" usage:"A redis target for improved Caching/RBE performance. ** Enterprise only **"`
+	GroupName                        string   `yaml:"group_name" usage:"A unique name for this distributed cache group. ** Enterprise only **"`
+	ReplicationFactor                int      `yaml:"replication_factor" usage:"How many total servers the data should be replicated to. Must be >= 1. ** Enterprise only **"`
+	RebalanceBandwidthBytesPerSecond int64    `yaml:"rebalance_bandwidth_bytes_per_second" usage:"The maximum rate at which data is moved to new peers when the peer set changes. Defaults to 10MB/s if unset. ** Enterprise only **"`
+	CertFile                         string   `yaml:"cert_file" usage:"Path to a PEM encoded certificate file. If set, distributed cache traffic is encrypted with TLS. ** Enterprise only **"`
+	KeyFile                          string   `yaml:"key_file" usage:"Path to a PEM encoded key file for cert_file. ** Enterprise only **"`
+	CACertFile                       string   `yaml:"ca_cert_file" usage:"Path to a PEM encoded certificate authority file. If set along with cert_file and key_file, peers must present a certificate signed by this authority (mTLS). ** Enterprise only **"`
+	PeerSecret                       string   `yaml:"peer_secret" usage:"A secret shared by all servers in this distributed cache group, which they use to authenticate each other when moving data between them. Not needed if ca_cert_file is set. ** Enterprise only **"`
+	PeerDiscovery                    string   `yaml:"peer_discovery" usage:"How to find the other servers in this distributed cache group: heartbeat (over redis, the default), static or dns. ** Enterprise only **"`
+	Peers                            []string `yaml:"peers" usage:"The listen addresses of all servers in this distributed cache group, if peer_discovery is static. An address may be followed by =weight (e.g. 10.0.0.1:1991=200) to give that server a share of the data proportional to its weight. ** Enterprise only **"`
+	DNSName                          string   `yaml:"dns_name" usage:"If peer_discovery is dns, a host:port whose A records list the servers in this group, or a name whose SRV records list them. ** Enterprise only **"`
+	DNSPollIntervalSeconds           int      `yaml:"dns_poll_interval_seconds" usage:"If peer_discovery is dns, how often to re-resolve dns_name. Defaults to 10 seconds. ** Enterprise only **"`
+	Weight                           int      `yaml:"weight" usage:"If peer_discovery is heartbeat, the capacity of this server relative to its peers (e.g. proportional to disk size). Servers get a share of the data proportional to their weight. Defaults to 100. Only set this once all servers in the group support weights. ** Enterprise only **"`
 }
 
 type cacheConfig struct {
 	Disk             DiskConfig             `yaml:"disk"`
 	GCS              GCSCacheConfig         `yaml:"gcs"`
 	S3               S3CacheConfig          `yaml:"s3"`
+	Azure            AzureCacheConfig       `yaml:"azure"`
 	DistributedCache DistributedCacheConfig `yaml:"distributed_cache"`
 	InMemory         bool                   `yaml:"in_memory" usage:"Whether or not to use the in_memory cache."`
 	MaxSizeBytes     int64                  `yaml:"max_size_bytes" usage:"How big to allow the cache to be (in bytes)."`
 	MemcacheTargets  []string               `yaml:"memcache_targets" usage:"Deprecated. Use Redis Target instead."`
-	RedisTarget      string                 `yaml:"redis_target" usage:"A redis target for improved Caching/RBE performance. ** Enterprise only **"`
+	RedisTarget      string                 `yaml:"redis_target" usage:"A redis target for improved Caching/RBE performance. Either host:port, redis-cluster://host:port[,host:port...] for a Redis Cluster, or redis-sentinel://mastername@host:port[,host:port...] for Redis Sentinel. ** Enterprise only **"`
+	MemcacheHotTier  HotTierConfig          `yaml:"memcache_hot_tier"`
+	RedisHotTier     HotTierConfig          `yaml:"redis_hot_tier"`
+	Quota            QuotaConfig            `yaml:"quota"`
+}
+
+type QuotaConfig struct {
+	Default QuotaLimits        `yaml:"default"`
+	Groups  []GroupQuotaConfig `yaml:"groups"`
+}
+
+// QuotaLimits bound how much a group may use the cache. Limits that are 0 are
+// not enforced.
+type QuotaLimits struct {
+	StorageSoftLimitBytes   int64 `yaml:"storage_soft_limit_bytes" usage:"Once a group stores more than this many bytes in the cache, its invocations are warned and its oldest entries are evicted until it is back under the limit."`
+	StorageHardLimitBytes   int64 `yaml:"storage_hard_limit_bytes" usage:"Once a group stores more than this many bytes in the cache, its uploads fail with RESOURCE_EXHAUSTED. Reads keep working."`
+	BandwidthSoftLimitBytes int64 `yaml:"bandwidth_soft_limit_bytes" usage:"Once a group has uploaded and downloaded more than this many bytes in a day (UTC), its invocations are warned."`
+	BandwidthHardLimitBytes int64 `yaml:"bandwidth_hard_limit_bytes" usage:"Once a group has uploaded and downloaded more than this many bytes in a day (UTC), its uploads fail with RESOURCE_EXHAUSTED until the next day. Reads keep working."`
+}
+
+type GroupQuotaConfig struct {
+	GroupID     string `yaml:"group_id" usage:"The group these limits apply to, instead of the default limits."`
+	QuotaLimits `yaml:",inline"`
+}
+
+type RedactionConfig struct {
+	Rules  []RedactionRule        `yaml:"rules"`
+	Groups []GroupRedactionConfig `yaml:"groups"`
+}
+
+// RedactionRule matches secrets to redact from build events, in addition to
+// the known token formats that are always redacted.
+type RedactionRule struct {
+	Name    string `yaml:"name" usage:"The name the rule is reported under in metrics."`
+	Pattern string `yaml:"pattern" usage:"A regular expression matching the secrets to redact from build events."`
+}
+
+type GroupRedactionConfig struct {
+	GroupID string          `yaml:"group_id" usage:"The group whose build events these rules apply to, in addition to the global rules."`
+	Rules   []RedactionRule `yaml:"rules"`
+}
+
+type HotTierConfig struct {
+	NegativeCacheTTLSeconds int `yaml:"negative_cache_ttl_seconds" usage:"If > 0, digests which are confirmed missing from the cache are remembered as missing for this many seconds, so repeated lookups don't reach the durable cache. Entries are invalidated when the digest is written. ** Enterprise only **"`
+	ActionCacheTTLSeconds   int `yaml:"action_cache_ttl_seconds" usage:"If > 0, action cache entries which are read are kept in this tier for this many seconds, shared by all app replicas. ** Enterprise only **"`
 }
 
 type authConfig struct {
@@ -231,7 +342,7 @@ func defineFlagsForMembers(parentStructNames []string, T reflect.Value) {
 		default:
 			// We know this is not flag compatible and it's here for
 			// long-term support reasons, so don't warn about it.
-			if fqFieldName != "auth.oauth_providers" {
+			if fqFieldName != "auth.oauth_providers" && fqFieldName != "cache.quota.groups" && fqFieldName != "redaction.rules" && fqFieldName != "redaction.groups" && fqFieldName != "build_event_proxy.routes" {
 				log.Printf("Skipping flag: --%s, kind: %s", fqFieldName, f.Type().Kind())
 			}
 			continue
@@ -299,6 +410,17 @@ func (c *Configurator) GetStorageChunkFileSizeBytes() int {
 	return c.gc.Storage.ChunkFileSizeBytes
 }
 
+func (c *Configurator) GetStorageCompression() string {
+	return c.gc.Storage.Compression
+}
+
+func (c *Configurator) GetEncryptionConfig() *EncryptionConfig {
+	if c.gc.Encryption.KeyFile == "" {
+		return nil
+	}
+	return &c.gc.Encryption
+}
+
 func (c *Configurator) GetStorageDiskRootDir() string {
 	return c.gc.Storage.Disk.RootDirectory
 }
@@ -311,6 +433,10 @@ func (c *Configurator) GetStorageAWSS3Config() *AwsS3Config {
 	return &c.gc.Storage.AwsS3
 }
 
+func (c *Configurator) GetStorageAzureConfig() *AzureConfig {
+	return &c.gc.Storage.Azure
+}
+
 func (c *Configurator) GetDatabaseConfig() *DatabaseConfig {
 	return &c.gc.Database
 }
@@ -368,6 +494,22 @@ func (c *Configurator) GetGRPCMaxRecvMsgSizeBytes() int {
 	return n
 }
 
+func (c *Configurator) GetBuildEventUploadMaxSizeBytes() int64 {
+	n := c.gc.App.BuildEventUploadMaxSizeBytes
+	if n == 0 {
+		return 1 << 30
+	}
+	return n
+}
+
+func (c *Configurator) GetBuildEventUploadMaxArtifactSizeBytes() int64 {
+	n := c.gc.App.BuildEventUploadMaxArtifactSizeBytes
+	if n == 0 {
+		return 256 << 20
+	}
+	return n
+}
+
 func (c *Configurator) EnableTargetTracking() bool {
 	return c.gc.App.EnableTargetTracking
 }
@@ -384,6 +526,14 @@ func (c *Configurator) GetBuildEventProxyBufferSize() int {
 	return c.gc.BuildEventProxy.BufferSize
 }
 
+func (c *Configurator) GetBuildEventProxySpoolDir() string {
+	return c.gc.BuildEventProxy.SpoolDir
+}
+
+func (c *Configurator) GetBuildEventProxyRoutes() []BuildEventProxyRoute {
+	return c.gc.BuildEventProxy.Routes
+}
+
 func (c *Configurator) GetCacheMaxSizeBytes() int64 {
 	return c.gc.Cache.MaxSizeBytes
 }
@@ -409,6 +559,13 @@ func (c *Configurator) GetCacheS3Config() *S3CacheConfig {
 	return nil
 }
 
+func (c *Configurator) GetCacheAzureConfig() *AzureCacheConfig {
+	if c.gc.Cache.Azure.ContainerName != "" {
+		return &c.gc.Cache.Azure
+	}
+	return nil
+}
+
 func (c *Configurator) GetDistributedCacheConfig() *DistributedCacheConfig {
 	if c.gc.Cache.DistributedCache.ListenAddr != "" {
 		return &c.gc.Cache.DistributedCache
@@ -424,6 +581,28 @@ func (c *Configurator) GetCacheRedisTarget() string {
 	return c.gc.Cache.RedisTarget
 }
 
+func (c *Configurator) GetCacheMemcacheHotTierConfig() *HotTierConfig {
+	return &c.gc.Cache.MemcacheHotTier
+}
+
+func (c *Configurator) GetCacheRedisHotTierConfig() *HotTierConfig {
+	return &c.gc.Cache.RedisHotTier
+}
+
+func (c *Configurator) GetCacheQuotaConfig() *QuotaConfig {
+	if c.gc.Cache.Quota.Default != (QuotaLimits{}) || len(c.gc.Cache.Quota.Groups) > 0 {
+		return &c.gc.Cache.Quota
+	}
+	return nil
+}
+
+func (c *Configurator) GetRedactionConfig() *RedactionConfig {
+	if len(c.gc.Redaction.Rules) > 0 || len(c.gc.Redaction.Groups) > 0 {
+		return &c.gc.Redaction
+	}
+	return nil
+}
+
 func (c *Configurator) GetCacheInMemory() bool {
 	return c.gc.Cache.InMemory
 }
@@ -40,6 +40,7 @@ type Env interface {
 	GetWebhooks() []interfaces.Webhook
 	GetBuildEventHandler() interfaces.BuildEventHandler
 	GetBuildEventProxyClients() []pepb.PublishBuildEventClient
+	GetBuildEventProxyRouter() interfaces.BuildEventProxyRouter
 	GetCache() interfaces.Cache
 	GetUserDB() interfaces.UserDB
 	GetAuthDB() interfaces.AuthDB
@@ -60,4 +61,5 @@ type Env interface {
 	GetMetricsCollector() interfaces.MetricsCollector
 	GetRepoDownloader() interfaces.RepoDownloader
 	GetWorkflowService() interfaces.WorkflowService
+	GetUsageTracker() interfaces.UsageTracker
 }
@@ -18,6 +18,7 @@ import (
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 	telpb "github.com/buildbuddy-io/buildbuddy/proto/telemetry"
+	uapb "github.com/buildbuddy-io/buildbuddy/proto/usage"
 	wfpb "github.com/buildbuddy-io/buildbuddy/proto/workflow"
 )
 
@@ -87,10 +88,52 @@ type BuildEventChannel interface {
 	MarkInvocationDisconnected(ctx context.Context, iid string) error
 	FinalizeInvocation(iid string) error
 	HandleEvent(event *pepb.PublishBuildToolEventStreamRequest) error
+
+	// PersistedSequenceNumber returns the sequence number up to which the
+	// events handled by the channel have been persisted, and so can be
+	// acked.
+	PersistedSequenceNumber() int64
+
+	// LastSequenceNumber returns the sequence number of the last event
+	// handled by the channel, including the events persisted by earlier
+	// streams of the invocation. Events resent with a sequence number up to
+	// it are dropped by HandleEvent.
+	LastSequenceNumber() int64
+
+	// RoutingInfo returns what the invocation's events are routed to build
+	// event proxies by, as far as it's known from the events handled so far,
+	// and whether all of it is known: once the workspace status event has
+	// been handled.
+	RoutingInfo() (*BuildEventRoutingInfo, bool)
+}
+
+// BuildEventRoutingInfo holds what the events of an invocation are routed to
+// build event proxies by.
+type BuildEventRoutingInfo struct {
+	GroupID string
+	RepoURL string
+	Role    string
+	Command string
+}
+
+// A BuildEventProxyRouter picks the build event proxies that only the events
+// of some invocations are forwarded to.
+type BuildEventProxyRouter interface {
+	// HasRoutes returns whether the events of any invocation may be routed
+	// to proxies. If not, streams don't need to wait until they know what
+	// to route their events by.
+	HasRoutes(ctx context.Context) (bool, error)
+
+	// OpenRoutedStreams opens a stream to each of the proxies that the events
+	// of the invocation described by info are routed to.
+	OpenRoutedStreams(ctx context.Context, info *BuildEventRoutingInfo) ([]pepb.PublishBuildEvent_PublishBuildToolEventStreamClient, error)
 }
 
 type BuildEventHandler interface {
-	OpenChannel(ctx context.Context, iid string) BuildEventChannel
+	// OpenChannel opens a channel to handle a stream of events for an
+	// invocation. If events were already persisted for the invocation by an
+	// earlier stream, the channel picks up where that stream left off.
+	OpenChannel(ctx context.Context, iid string) (BuildEventChannel, error)
 }
 
 // A Blobstore must allow for reading, writing, and deleting blobs.
@@ -102,6 +145,37 @@ type Blobstore interface {
 	ReadBlob(ctx context.Context, blobName string) ([]byte, error)
 	WriteBlob(ctx context.Context, blobName string, data []byte) (int, error)
 	DeleteBlob(ctx context.Context, blobName string) error
+
+	// ListBlobs calls fn with the name and last modification time of each
+	// blob whose name starts with prefix. Blobs are listed by name, such
+	// that the blobs under any "dir/" prefix are listed together. The
+	// listing is fetched a page at a time, so it's never held in memory
+	// whole. It stops at, and returns, the first error returned by fn.
+	ListBlobs(ctx context.Context, prefix string, fn func(name string, modTime time.Time) error) error
+	// DeletePrefix deletes all blobs whose names start with prefix.
+	DeletePrefix(ctx context.Context, prefix string) error
+
+	// BlobReader streams the contents of a blob. The caller must close the
+	// reader.
+	BlobReader(ctx context.Context, blobName string) (io.ReadCloser, error)
+	// BlobWriter streams the contents of a new blob, which is stored when
+	// the writer is closed. Close returns an error if storing it failed.
+	BlobWriter(ctx context.Context, blobName string) (io.WriteCloser, error)
+}
+
+// A KMS holds per-group master keys, which wrap the data keys that blobs and
+// cache entries are encrypted with. Master keys are versioned so that they
+// can be rotated: new data keys are wrapped with the current version, and
+// older versions are kept to unwrap existing ones.
+type KMS interface {
+	// WrapKey encrypts dataKey under the current version of groupID's
+	// master key, and returns the wrapped key along with that version.
+	WrapKey(ctx context.Context, groupID string, dataKey []byte) ([]byte, int, error)
+	// UnwrapKey decrypts a data key wrapped by WrapKey.
+	UnwrapKey(ctx context.Context, groupID string, keyVersion int, wrappedKey []byte) ([]byte, error)
+	// CurrentKeyVersion returns the version of groupID's master key that
+	// WrapKey uses.
+	CurrentKeyVersion(ctx context.Context, groupID string) (int, error)
 }
 
 // Similar to a blobstore, a cache allows for reading and writing data, but
@@ -130,6 +204,14 @@ type Cache interface {
 	Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error)
 }
 
+// A KeyScanner is a cache which can enumerate its contents.
+type KeyScanner interface {
+	// ScanKeys calls fn with every key stored in the cache, regardless of
+	// prefix, along with the size of its value, from least to most
+	// recently used. Keys are formatted as userPrefix + prefix + hash.
+	ScanKeys(ctx context.Context, fn func(key string, sizeBytes int64) error) error
+}
+
 type InvocationDB interface {
 	// Invocations API
 	InsertOrUpdateInvocation(ctx context.Context, in *tables.Invocation) error
@@ -137,6 +219,12 @@ type InvocationDB interface {
 	LookupInvocation(ctx context.Context, invocationID string) (*tables.Invocation, error)
 	LookupGroupFromInvocation(ctx context.Context, invocationID string) (*tables.Group, error)
 	LookupExpiredInvocations(ctx context.Context, cutoffTime time.Time, limit int) ([]*tables.Invocation, error)
+	// InvocationExists returns whether an invocation row exists, without
+	// checking whether the caller may read it.
+	InvocationExists(ctx context.Context, invocationID string) (bool, error)
+	// LookupInvocationOwner returns the user, group, perms and status of an
+	// invocation, without checking whether the caller may read it.
+	LookupInvocationOwner(ctx context.Context, invocationID string) (*tables.Invocation, error)
 	DeleteInvocation(ctx context.Context, invocationID string) error
 	DeleteInvocationWithPermsCheck(ctx context.Context, authenticatedUser *UserInfo, invocationID string) error
 	FillCounts(ctx context.Context, log *telpb.TelemetryStat) error
@@ -204,6 +292,14 @@ type InvocationSearchService interface {
 	QueryInvocations(ctx context.Context, req *inpb.SearchInvocationRequest) (*inpb.SearchInvocationResponse, error)
 }
 
+// Allows accounting for cache usage per group and remote instance name.
+type UsageTracker interface {
+	// Increment adds counts to the usage of the group that ctx is
+	// authenticated as, under the given remote instance name.
+	Increment(ctx context.Context, instanceName string, counts *tables.UsageCounts) error
+	GetUsage(ctx context.Context, req *uapb.GetUsageRequest) (*uapb.GetUsageResponse, error)
+}
+
 type ApiService interface {
 	apipb.ApiServiceServer
 	http.Handler
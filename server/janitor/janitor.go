@@ -4,21 +4,26 @@ import (
 	"context"
 	"flag"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/google/uuid"
 )
 
 var (
-	cleanupInterval   = flag.Duration("cleanup_interval", 10*60*time.Second, "How often the janitor cleanup tasks will run")
-	cleanupWorkers    = flag.Int("cleanup_workers", 1, "How many cleanup tasks to run")
-	logDeletionErrors = flag.Bool("log_deletion_errors", false, "If true; log errors when ttl-deleting expired data")
+	cleanupInterval     = flag.Duration("cleanup_interval", 10*60*time.Second, "How often the janitor cleanup tasks will run")
+	cleanupWorkers      = flag.Int("cleanup_workers", 1, "How many cleanup tasks to run")
+	logDeletionErrors   = flag.Bool("log_deletion_errors", false, "If true; log errors when ttl-deleting expired data")
+	orphanSweepInterval = flag.Duration("orphan_sweep_interval", 24*time.Hour, "How often the janitor deletes blobstore data belonging to invocations that no longer exist, if a storage TTL is configured. 0 disables the sweep.")
+	orphanGracePeriod   = flag.Duration("orphan_sweep_grace_period", 24*time.Hour, "How long the blobs of an invocation must go unmodified before the orphan sweep may delete them, so that invocations which are still being written are never swept.")
 )
 
 type Janitor struct {
-	ticker *time.Ticker
-	quit   chan struct{}
+	ticker      *time.Ticker
+	sweepTicker *time.Ticker
+	quit        chan struct{}
 
 	env environment.Env
 	ttl time.Duration
@@ -31,10 +36,29 @@ func NewJanitor(env environment.Env) *Janitor {
 	}
 }
 
+// deleteInvocationBlobs deletes everything an invocation stored in the
+// blobstore: the chunks its build events were written to while it was in
+// progress, the summary of those events, the summary of its timing profile
+// and, for older invocations, the completed-invocation blob.
+func (j *Janitor) deleteInvocationBlobs(ctx context.Context, invocationID, blobID string) error {
+	bs := j.env.GetBlobstore()
+	if err := bs.DeletePrefix(ctx, invocationID+"/"); err != nil {
+		return err
+	}
+	if blobID == "" {
+		return nil
+	}
+	exists, err := bs.BlobExists(ctx, blobID)
+	if err != nil || !exists {
+		return err
+	}
+	return bs.DeleteBlob(ctx, blobID)
+}
+
 func (j *Janitor) deleteInvocation(invocation *tables.Invocation) {
 	ctx := context.Background()
-	if err := j.env.GetBlobstore().DeleteBlob(ctx, invocation.BlobID); err != nil && *logDeletionErrors {
-		log.Printf("Error deleting blob (%s): %s", invocation.BlobID, err)
+	if err := j.deleteInvocationBlobs(ctx, invocation.InvocationID, invocation.BlobID); err != nil && *logDeletionErrors {
+		log.Printf("Error deleting blobs for invocation (%s): %s", invocation.InvocationID, err)
 	}
 
 	// Try to delete the row too, even if blob deletion failed.
@@ -57,6 +81,71 @@ func (j *Janitor) deleteExpiredInvocations() {
 	}
 }
 
+// sweepOrphanedInvocation deletes the blobs of an invocation if it has no
+// invocation row, and returns whether it did.
+func (j *Janitor) sweepOrphanedInvocation(ctx context.Context, iid string) bool {
+	exists, err := j.env.GetInvocationDB().InvocationExists(ctx, iid)
+	if err != nil {
+		log.Printf("Error looking up invocation (%s): %s", iid, err)
+		return false
+	}
+	if exists {
+		return false
+	}
+	// Completed-invocation blobs are named after the invocation.
+	if err := j.deleteInvocationBlobs(ctx, iid, iid); err != nil {
+		if *logDeletionErrors {
+			log.Printf("Error deleting orphaned blobs for invocation (%s): %s", iid, err)
+		}
+		return false
+	}
+	return true
+}
+
+// sweepOrphanedBlobs deletes the blobs of invocations which no longer have
+// an invocation row: these are left behind when blob deletion fails after
+// the row has been deleted, or when invocations are deleted by users. Blobs
+// which aren't stored under an invocation ID (like certificates) are never
+// touched, and neither are the blobs of invocations modified within the grace
+// period, which may not have a row yet.
+func (j *Janitor) sweepOrphanedBlobs() {
+	ctx := context.Background()
+	cutoff := time.Now().Add(-*orphanGracePeriod)
+	numDeleted := 0
+
+	// The blobs of each invocation are listed together, so invocations are
+	// checked one at a time, as soon as all of their blobs have been seen.
+	iid := ""
+	lastModified := time.Time{}
+	sweep := func() {
+		if iid != "" && lastModified.Before(cutoff) && j.sweepOrphanedInvocation(ctx, iid) {
+			numDeleted++
+		}
+	}
+	err := j.env.GetBlobstore().ListBlobs(ctx, "", func(name string, modTime time.Time) error {
+		blobIID := strings.SplitN(name, "/", 2)[0]
+		if _, err := uuid.Parse(blobIID); err != nil {
+			return nil
+		}
+		if blobIID != iid {
+			sweep()
+			iid = blobIID
+			lastModified = modTime
+		} else if modTime.After(lastModified) {
+			lastModified = modTime
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error listing blobs: %s", err)
+	} else {
+		sweep()
+	}
+	if numDeleted > 0 {
+		log.Printf("Deleted blobs of %d orphaned invocations", numDeleted)
+	}
+}
+
 func (j *Janitor) Start() {
 	j.ticker = time.NewTicker(*cleanupInterval)
 	j.quit = make(chan struct{})
@@ -66,6 +155,20 @@ func (j *Janitor) Start() {
 		return
 	}
 
+	if *orphanSweepInterval > 0 {
+		j.sweepTicker = time.NewTicker(*orphanSweepInterval)
+		go func() {
+			for {
+				select {
+				case <-j.sweepTicker.C:
+					j.sweepOrphanedBlobs()
+				case <-j.quit:
+					return
+				}
+			}
+		}()
+	}
+
 	for i := 0; i < *cleanupWorkers; i++ {
 		go func() {
 			for {
@@ -84,4 +187,7 @@ func (j *Janitor) Start() {
 func (j *Janitor) Stop() {
 	close(j.quit)
 	j.ticker.Stop()
+	if j.sweepTicker != nil {
+		j.sweepTicker.Stop()
+	}
 }
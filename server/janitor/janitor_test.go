@@ -0,0 +1,111 @@
+package janitor
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/google/uuid"
+
+	testenv "github.com/buildbuddy-io/buildbuddy/server/testutil/environment"
+)
+
+func writeInvocationBlobs(t *testing.T, te *testenv.TestEnv, iid string) {
+	ctx := context.Background()
+	for _, name := range []string{iid + "/chunks/" + iid + "-0.chunk", iid + "/chunks/" + iid + "-1.chunk"} {
+		if _, err := te.GetBlobstore().WriteBlob(ctx, name, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func insertInvocation(t *testing.T, te *testenv.TestEnv, iid string, pk int64) {
+	ti := &tables.Invocation{InvocationID: iid, InvocationPK: pk, BlobID: iid}
+	if err := te.GetInvocationDB().InsertOrUpdateInvocation(context.Background(), ti); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func listBlobs(t *testing.T, te *testenv.TestEnv) []string {
+	names := make([]string, 0)
+	err := te.GetBlobstore().ListBlobs(context.Background(), "", func(name string, modTime time.Time) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDeleteExpiredInvocations(t *testing.T) {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := testenv.GetTestEnv(t)
+	expired := uuid.New().String()
+	live := uuid.New().String()
+	for i, iid := range []string{expired, live} {
+		insertInvocation(t, te, iid, int64(i))
+		writeInvocationBlobs(t, te, iid)
+	}
+	if err := te.GetDBHandle().Exec(`UPDATE Invocations SET created_at_usec = 0 WHERE invocation_id = ?`, expired).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	j := &Janitor{env: te, ttl: time.Hour}
+	j.deleteExpiredInvocations()
+
+	want := []string{live + "/chunks/" + live + "-0.chunk", live + "/chunks/" + live + "-1.chunk"}
+	if got := listBlobs(t, te); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Blobs after deleting expired invocation = %v, want %v", got, want)
+	}
+	exists, err := te.GetInvocationDB().InvocationExists(context.Background(), expired)
+	if err != nil || exists {
+		t.Fatalf("InvocationExists(expired) = %t, %v; want false", exists, err)
+	}
+}
+
+func TestSweepOrphanedBlobs(t *testing.T) {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	flags.Set(t, "orphan_sweep_grace_period", "0")
+	te := testenv.GetTestEnv(t)
+	orphaned := uuid.New().String()
+	live := uuid.New().String()
+	insertInvocation(t, te, live, 1)
+	writeInvocationBlobs(t, te, live)
+	writeInvocationBlobs(t, te, orphaned)
+	// Blobs which don't belong to an invocation must survive the sweep.
+	if _, err := te.GetBlobstore().WriteBlob(context.Background(), "buildbuddy_installation_uuid", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	j := &Janitor{env: te}
+	j.sweepOrphanedBlobs()
+
+	want := []string{"buildbuddy_installation_uuid", live + "/chunks/" + live + "-0.chunk", live + "/chunks/" + live + "-1.chunk"}
+	sort.Strings(want)
+	if got := listBlobs(t, te); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Blobs after sweep = %v, want %v", got, want)
+	}
+}
+
+func TestSweepOrphanedBlobsSkipsRecentlyModifiedInvocations(t *testing.T) {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	flags.Set(t, "orphan_sweep_grace_period", "1h")
+	te := testenv.GetTestEnv(t)
+	// An invocation whose blobs are written before its row is inserted.
+	inProgress := uuid.New().String()
+	writeInvocationBlobs(t, te, inProgress)
+
+	j := &Janitor{env: te}
+	j.sweepOrphanedBlobs()
+
+	want := []string{inProgress + "/chunks/" + inProgress + "-0.chunk", inProgress + "/chunks/" + inProgress + "-1.chunk"}
+	if got := listBlobs(t, te); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Blobs after sweep = %v, want %v", got, want)
+	}
+}
@@ -10,15 +10,19 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/disk_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/encrypted"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/github"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/invocationdb"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_metrics_collector"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/quota"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/repo_downloader"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/slack"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/usage_tracker"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_proxy"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_server"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_upload"
 	"github.com/buildbuddy-io/buildbuddy/server/buildbuddy_server"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
@@ -35,6 +39,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/splash"
 	"github.com/buildbuddy-io/buildbuddy/server/ssl"
 	"github.com/buildbuddy-io/buildbuddy/server/static"
+	"github.com/buildbuddy-io/buildbuddy/server/util/crypter"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_server"
 	"github.com/buildbuddy-io/buildbuddy/server/util/healthcheck"
@@ -86,15 +91,57 @@ func init() {
 	grpc.EnableTracing = false
 }
 
+// GetConfiguredCrypter returns the crypter that blobs and cache entries are
+// encrypted at rest with, or nil if encryption is not configured.
+func GetConfiguredCrypter(configurator *config.Configurator) (*crypter.Crypter, error) {
+	encryptionConfig := configurator.GetEncryptionConfig()
+	if encryptionConfig == nil {
+		return nil, nil
+	}
+	kf, err := crypter.ReadKeyfile(encryptionConfig.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption keyfile: %s", err)
+	}
+	kms, err := crypter.NewKeyfileKMS(kf)
+	if err != nil {
+		return nil, err
+	}
+	return crypter.New(kms), nil
+}
+
+// GetConfiguredCache returns the cache configured in configurator, which
+// encrypts its entries with c if it is set, along with the local cache that
+// stores them. Both are nil if no cache is configured.
+func GetConfiguredCache(configurator *config.Configurator, c *crypter.Crypter) (interfaces.Cache, interfaces.Cache, error) {
+	var local interfaces.Cache
+	if configurator.GetCacheInMemory() {
+		maxSizeBytes := configurator.GetCacheMaxSizeBytes()
+		if maxSizeBytes == 0 {
+			return nil, nil, fmt.Errorf("cache size must be greater than 0 if in_memory cache is enabled")
+		}
+		mc, err := memory_cache.NewMemoryCache(maxSizeBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		local = mc
+	} else if diskConfig := configurator.GetCacheDiskConfig(); diskConfig != nil {
+		dc, err := disk_cache.NewDiskCache(diskConfig.RootDirectory, configurator.GetCacheMaxSizeBytes())
+		if err != nil {
+			return nil, nil, err
+		}
+		local = dc
+	}
+	if local == nil || c == nil {
+		return local, local, nil
+	}
+	return encrypted.NewCache(local, c), local, nil
+}
+
 // Normally this code would live in main.go -- we put it here for now because
 // the environments used by the open-core version and the enterprise version are
 // not substantially different enough yet to warrant the extra complexity of
 // always updating both main files.
 func GetConfiguredEnvironmentOrDie(configurator *config.Configurator, healthChecker *healthcheck.HealthChecker) *real_environment.RealEnv {
-	bs, err := blobstore.GetConfiguredBlobstore(configurator)
-	if err != nil {
-		log.Fatalf("Error configuring blobstore: %s", err)
-	}
 	dbHandle, err := db.GetConfiguredDatabase(configurator, healthChecker)
 	if err != nil {
 		log.Fatalf("Error configuring database: %s", err)
@@ -102,6 +149,22 @@ func GetConfiguredEnvironmentOrDie(configurator *config.Configurator, healthChec
 
 	realEnv := real_environment.NewRealEnv(configurator, healthChecker)
 	realEnv.SetDBHandle(dbHandle)
+
+	// If configured, encrypt everything written to storage and the cache.
+	// Blobs are encrypted by the blobstore after it compresses them.
+	c, err := GetConfiguredCrypter(configurator)
+	if err != nil {
+		log.Fatalf("Error configuring encryption: %s", err)
+	}
+	var sealer blobstore.Sealer
+	if c != nil {
+		sealer = encrypted.NewSealer(realEnv, c)
+		log.Printf("Encryption: blobs and cache entries are encrypted at rest.")
+	}
+	bs, err := blobstore.GetConfiguredBlobstore(configurator, sealer)
+	if err != nil {
+		log.Fatalf("Error configuring blobstore: %s", err)
+	}
 	realEnv.SetBlobstore(bs)
 	realEnv.SetInvocationDB(invocationdb.NewInvocationDB(realEnv, dbHandle))
 	realEnv.SetAuthenticator(&nullauth.NullAuthenticator{})
@@ -116,36 +179,50 @@ func GetConfiguredEnvironmentOrDie(configurator *config.Configurator, healthChec
 	realEnv.SetWebhooks(webhooks)
 
 	buildEventProxyClients := make([]pepb.PublishBuildEventClient, 0)
+	buildEventProxyClientsByHost := make(map[string]pepb.PublishBuildEventClient)
 	for _, target := range configurator.GetBuildEventProxyHosts() {
 		// NB: This can block for up to a second on connecting. This would be a
 		// great place to have our health checker and mark these as optional.
-		buildEventProxyClients = append(buildEventProxyClients, build_event_proxy.NewBuildEventProxyClient(realEnv, target))
+		client, err := build_event_proxy.NewClient(realEnv, target)
+		if err != nil {
+			log.Fatalf("Error configuring build event proxy for %s: %s", target, err)
+		}
+		buildEventProxyClients = append(buildEventProxyClients, client)
+		buildEventProxyClientsByHost[target] = client
 		log.Printf("Proxy: forwarding build events to: %s", target)
 	}
 	realEnv.SetBuildEventProxyClients(buildEventProxyClients)
-	realEnv.SetBuildEventHandler(build_event_handler.NewBuildEventHandler(realEnv))
+	buildEventProxyRouter, err := build_event_proxy.NewRouter(realEnv, buildEventProxyClientsByHost)
+	if err != nil {
+		log.Fatalf("Error configuring build event proxy routes: %s", err)
+	}
+	if buildEventProxyRouter != nil {
+		realEnv.SetBuildEventProxyRouter(buildEventProxyRouter)
+	}
+	buildEventHandler, err := build_event_handler.NewBuildEventHandler(realEnv)
+	if err != nil {
+		log.Fatalf("Error configuring build event handler: %s", err)
+	}
+	realEnv.SetBuildEventHandler(buildEventHandler)
 
 	// If configured, enable the cache.
-	var cache interfaces.Cache
-	if configurator.GetCacheInMemory() {
-		maxSizeBytes := configurator.GetCacheMaxSizeBytes()
-		if maxSizeBytes == 0 {
-			log.Fatalf("Cache size must be greater than 0 if in_memory cache is enabled!")
-		}
-		c, err := memory_cache.NewMemoryCache(maxSizeBytes)
-		if err != nil {
-			log.Fatalf("Error configuring in-memory cache: %s", err)
-		}
-		cache = c
-	} else if configurator.GetCacheDiskConfig() != nil {
-		diskConfig := configurator.GetCacheDiskConfig()
-		c, err := disk_cache.NewDiskCache(diskConfig.RootDirectory, configurator.GetCacheMaxSizeBytes())
-		if err != nil {
-			log.Fatalf("Error configuring cache: %s", err)
-		}
-		cache = c
+	cache, local, err := GetConfiguredCache(configurator, c)
+	if err != nil {
+		log.Fatalf("Error configuring cache: %s", err)
 	}
+	var scanner interfaces.KeyScanner
 	if cache != nil {
+		scanner, _ = local.(interfaces.KeyScanner)
+		if quotaConfig := configurator.GetCacheQuotaConfig(); quotaConfig != nil {
+			quotaManager := quota.NewManager(realEnv, local, quotaConfig)
+			quotaManager.Start()
+			healthChecker.RegisterShutdownFunction(func(ctx context.Context) error {
+				quotaManager.Stop()
+				return nil
+			})
+			cache = quota.NewCache(quotaManager, cache)
+			log.Printf("Cache: enforcing per-group quotas.")
+		}
 		realEnv.SetCache(cache)
 		log.Printf("Cache: BuildBuddy cache API enabled!")
 	}
@@ -157,6 +234,13 @@ func GetConfiguredEnvironmentOrDie(configurator *config.Configurator, healthChec
 		log.Fatalf("Error configuring in-memory metrics collector: %s", err.Error())
 	}
 	realEnv.SetMetricsCollector(collector)
+
+	usageTracker := usage_tracker.NewUsageTracker(realEnv, dbHandle, scanner)
+	usageTracker.Start()
+	healthChecker.RegisterShutdownFunction(func(ctx context.Context) error {
+		return usageTracker.Stop()
+	})
+	realEnv.SetUsageTracker(usageTracker)
 	realEnv.SetRepoDownloader(repo_downloader.NewRepoDownloader())
 	return realEnv
 }
@@ -312,6 +396,13 @@ func StartAndRunServices(env environment.Env) {
 	mux.Handle("/app/", httpfilters.WrapExternalHandler(env, http.StripPrefix("/app", afs)))
 	mux.Handle("/rpc/BuildBuddyService/", httpfilters.WrapAuthenticatedExternalProtoletHandler(env, "/rpc/BuildBuddyService/", buildBuddyProtoHandlers))
 	mux.Handle("/file/download", httpfilters.WrapAuthenticatedExternalHandler(env, buildBuddyServer))
+	// Build event files are uploaded over HTTP, since protolet doesn't
+	// support streaming RPCs.
+	buildEventUploadHandler, err := build_event_upload.NewBuildEventUploadHandler(env)
+	if err != nil {
+		log.Fatalf("Error initializing build event upload handler: %s", err)
+	}
+	mux.Handle("/upload/build_event_file", httpfilters.WrapAuthenticatedExternalHandler(env, buildEventUploadHandler))
 	mux.Handle("/healthz", env.GetHealthChecker().LivenessHandler())
 	mux.Handle("/readyz", env.GetHealthChecker().ReadinessHandler())
 
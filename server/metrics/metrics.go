@@ -81,6 +81,14 @@ const (
 	/// Type of event sent to BuildBuddy's webhook handler: `push` or
 	/// `pull_request`.
 	WebhookEventName = "event"
+
+	/// Name of the rule that a secret redacted from build events matched:
+	/// `url_credentials`, `github_token`, ... or the name of a configured rule.
+	RedactionRuleLabel = "redaction_rule"
+
+	/// Host that build events are forwarded to, as configured in
+	/// `build_event_proxy.hosts` but without credentials.
+	BuildEventProxyTargetLabel = "target"
 )
 
 const (
@@ -156,6 +164,59 @@ var (
 	/// sum(rate(buildbuddy_invocation_build_event_count[5m]))
 	/// ```
 
+	RedactedSecretCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "redacted_secret_count",
+		Help:      "Number of secrets redacted from build events as they were received.",
+	}, []string{
+		RedactionRuleLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Secrets redacted per second, by rule
+	/// sum by (redaction_rule) (rate(buildbuddy_invocation_redacted_secret_count[5m]))
+	/// ```
+
+	/// ## Build event proxy metrics
+	///
+	/// These metrics are only recorded when `build_event_proxy.spool_dir` is
+	/// set.
+
+	BuildEventProxyUnackedEvents = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "build_event_proxy",
+		Name:      "unacked_events",
+		Help:      "Number of spooled build events that the target hasn't acked yet.",
+	}, []string{
+		BuildEventProxyTargetLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Build events waiting to be forwarded, by target
+	/// sum by (target) (buildbuddy_build_event_proxy_unacked_events)
+	/// ```
+
+	BuildEventProxyRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "build_event_proxy",
+		Name:      "retries",
+		Help:      "Number of times forwarding a spooled build event stream to the target failed and was retried.",
+	}, []string{
+		BuildEventProxyTargetLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Forwarding retries per second, by target
+	/// sum by (target) (rate(buildbuddy_build_event_proxy_retries[5m]))
+	/// ```
+
 	/// ## Remote cache metrics
 	///
 	/// NOTE: Cache metrics are recorded at the end of each invocation,
@@ -969,4 +1030,72 @@ var (
 		CacheTierLabel,
 		CacheBackendLabel,
 	})
+
+	CacheNegativeLookupCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "cache",
+		Name:      "negative_lookup_count",
+		Help:      "Number of digests looked up in the negative-result cache. A `hit` means the digest was recently confirmed missing, so the durable cache was not checked.",
+	}, []string{
+		CacheBackendLabel,
+		CacheEventTypeLabel,
+	})
+
+	CacheActionCacheHotTierLookupCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "cache",
+		Name:      "action_cache_hot_tier_lookup_count",
+		Help:      "Number of action cache entries looked up in the action cache hot tier. A `miss` is read from the durable cache and added to the hot tier.",
+	}, []string{
+		CacheBackendLabel,
+		CacheEventTypeLabel,
+	})
+
+	/// ## Distributed cache metrics
+	///
+	/// When the set of distributed cache peers changes, each node scans its
+	/// local cache and streams entries it no longer owns to their new
+	/// owners.
+
+	DistributedCacheRebalanceInProgress = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "distributed_cache",
+		Name:      "rebalance_in_progress",
+		Help:      "Whether or not this node is currently rebalancing its local cache (1 if rebalancing, 0 otherwise).",
+	})
+
+	DistributedCacheRebalanceScannedKeys = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "distributed_cache",
+		Name:      "rebalance_scanned_keys",
+		Help:      "Number of local cache entries checked for ownership while rebalancing.",
+	})
+
+	DistributedCacheRebalanceMovedKeys = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "distributed_cache",
+		Name:      "rebalance_moved_keys",
+		Help:      "Number of cache entries copied to a new owner while rebalancing.",
+	})
+
+	DistributedCacheRebalanceMovedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "distributed_cache",
+		Name:      "rebalance_moved_bytes",
+		Help:      "Number of bytes copied to a new owner while rebalancing.",
+	})
+
+	DistributedCacheRebalanceErrorCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "distributed_cache",
+		Name:      "rebalance_error_count",
+		Help:      "Number of cache entries that could not be moved to a new owner while rebalancing.",
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Rebalancing throughput (bytes per second) across all nodes
+	/// sum(rate(buildbuddy_distributed_cache_rebalance_moved_bytes[5m]))
+	/// ```
 )
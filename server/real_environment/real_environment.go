@@ -39,6 +39,7 @@ type RealEnv struct {
 	authenticator                   interfaces.Authenticator
 	webhooks                        []interfaces.Webhook
 	buildEventProxyClients          []pepb.PublishBuildEventClient
+	buildEventProxyRouter           interfaces.BuildEventProxyRouter
 	cache                           interfaces.Cache
 	userDB                          interfaces.UserDB
 	authDB                          interfaces.AuthDB
@@ -61,6 +62,7 @@ type RealEnv struct {
 	executionService                interfaces.ExecutionService
 	repoDownloader                  interfaces.RepoDownloader
 	workflowService                 interfaces.WorkflowService
+	usageTracker                    interfaces.UsageTracker
 }
 
 func NewRealEnv(c *config.Configurator, h interfaces.HealthChecker) *RealEnv {
@@ -130,6 +132,12 @@ func (r *RealEnv) GetBuildEventProxyClients() []pepb.PublishBuildEventClient {
 func (r *RealEnv) SetBuildEventProxyClients(clients []pepb.PublishBuildEventClient) {
 	r.buildEventProxyClients = clients
 }
+func (r *RealEnv) GetBuildEventProxyRouter() interfaces.BuildEventProxyRouter {
+	return r.buildEventProxyRouter
+}
+func (r *RealEnv) SetBuildEventProxyRouter(router interfaces.BuildEventProxyRouter) {
+	r.buildEventProxyRouter = router
+}
 
 func (r *RealEnv) GetCache() interfaces.Cache {
 	return r.cache
@@ -262,3 +270,9 @@ func (r *RealEnv) GetWorkflowService() interfaces.WorkflowService {
 func (r *RealEnv) SetWorkflowService(wf interfaces.WorkflowService) {
 	r.workflowService = wf
 }
+func (r *RealEnv) GetUsageTracker() interfaces.UsageTracker {
+	return r.usageTracker
+}
+func (r *RealEnv) SetUsageTracker(t interfaces.UsageTracker) {
+	r.usageTracker = t
+}
@@ -143,7 +143,7 @@ func (s *ActionCacheServer) GetActionResult(ctx context.Context, req *repb.GetAc
 	cache := s.getCache(req.GetInstanceName())
 	casCache := s.getCASCache(req.GetInstanceName())
 
-	ht := hit_tracker.NewHitTracker(ctx, s.env, true)
+	ht := hit_tracker.NewHitTracker(ctx, s.env, req.GetInstanceName(), true)
 	// Fetch the "ActionResult" object which enumerates all the files in the action.
 	d := req.GetActionDigest()
 	downloadTracker := ht.TrackDownload(d)
@@ -205,7 +205,7 @@ func (s *ActionCacheServer) UpdateActionResult(ctx context.Context, req *repb.Up
 		return req.ActionResult, nil
 	}
 
-	ht := hit_tracker.NewHitTracker(ctx, s.env, true)
+	ht := hit_tracker.NewHitTracker(ctx, s.env, req.GetInstanceName(), true)
 	d := req.GetActionDigest()
 	uploadTracker := ht.TrackUpload(d)
 	cache := s.getCache(req.GetInstanceName())
@@ -91,7 +91,7 @@ func (s *ByteStreamServer) Read(req *bspb.ReadRequest, stream bspb.ByteStream_Re
 		return err
 	}
 
-	ht := hit_tracker.NewHitTracker(ctx, s.env, false)
+	ht := hit_tracker.NewHitTracker(ctx, s.env, instanceName, false)
 	cache := s.getCache(instanceName)
 	if d.GetHash() == digest.EmptySha256 {
 		ht.TrackEmptyHit()
@@ -136,6 +136,7 @@ func (s *ByteStreamServer) Read(req *bspb.ReadRequest, stream bspb.ByteStream_Re
 
 type writeState struct {
 	activeResourceName string
+	instanceName       string
 	d                  *repb.Digest
 	writer             io.WriteCloser
 	bytesWritten       int64
@@ -193,6 +194,7 @@ func (s *ByteStreamServer) initStreamState(ctx context.Context, req *bspb.WriteR
 
 	ws := &writeState{
 		activeResourceName: req.ResourceName,
+		instanceName:       instanceName,
 		d:                  d,
 	}
 
@@ -269,7 +271,7 @@ func (s *ByteStreamServer) Write(stream bspb.ByteStream_WriteServer) error {
 					CommittedSize: streamState.bytesWritten,
 				})
 			}
-			ht := hit_tracker.NewHitTracker(ctx, s.env, false)
+			ht := hit_tracker.NewHitTracker(ctx, s.env, streamState.instanceName, false)
 			uploadTracker := ht.TrackUpload(streamState.d)
 			defer uploadTracker.Close()
 		} else { // Subsequent messages
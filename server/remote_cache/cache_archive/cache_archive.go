@@ -0,0 +1,462 @@
+package cache_archive
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// An archive is a tar file with one file per cache entry, named after the
+// entry's cache key: userPrefix + [instanceName + "/"] + ["ac/"] + hash. For
+// example, "GR123/ac/<hash>" is an action cache entry of group GR123, and
+// "ANON/linux/<hash>" is a CAS entry written anonymously under the instance
+// name "linux". Entries are archived as they are read through the cache, so an
+// archive exported from an encrypted cache is not encrypted, and can be
+// imported into a deployment with different keys.
+
+const (
+	// How many digests to check for with each ContainsMulti call during
+	// import.
+	containsBatchSize = 1000
+
+	acPrefix = namespace.ACCachePrefix + "/"
+)
+
+// Filter selects which entries are exported or imported. Empty lists match
+// everything.
+type Filter struct {
+	// Group IDs, like "GR123", or "ANON" for anonymous entries.
+	GroupIDs []string
+	// Remote instance names. The empty instance name is matched by "".
+	InstanceNames []string
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) matches(e *entry) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.GroupIDs) > 0 && !contains(f.GroupIDs, e.groupID()) {
+		return false
+	}
+	if len(f.InstanceNames) > 0 && !contains(f.InstanceNames, e.instanceName) {
+		return false
+	}
+	return true
+}
+
+// Stats counts what happened to the entries selected by a Filter.
+type Stats struct {
+	// Entries which were copied.
+	Copied      int
+	CopiedBytes int64
+	// Entries which were already present in the archive (on export) or in
+	// the cache (on import).
+	Skipped int
+	// Entries which could not be read or written, or didn't match their
+	// digest.
+	Failed int
+}
+
+type entry struct {
+	key          string
+	userPrefix   string
+	cachePrefix  string
+	instanceName string
+	actionCache  bool
+	d            *repb.Digest
+}
+
+func parseEntry(key string, sizeBytes int64) (*entry, error) {
+	userPrefix, cachePrefix, hash, err := prefix.ParseCacheKey(key)
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{
+		key:         key,
+		userPrefix:  userPrefix,
+		cachePrefix: cachePrefix,
+		d: &repb.Digest{
+			Hash:      hash,
+			SizeBytes: sizeBytes,
+		},
+	}
+	instancePrefix := cachePrefix
+	if cachePrefix == acPrefix || strings.HasSuffix(cachePrefix, "/"+acPrefix) {
+		e.actionCache = true
+		instancePrefix = strings.TrimSuffix(cachePrefix, acPrefix)
+	}
+	e.instanceName = strings.TrimSuffix(instancePrefix, "/")
+	if _, err := digest.Validate(e.d); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *entry) groupID() string {
+	return strings.TrimSuffix(e.userPrefix, "/")
+}
+
+// cache returns the cache that e is stored in, and a context to access it
+// with.
+func (e *entry) cache(ctx context.Context, c interfaces.Cache) (context.Context, interfaces.Cache) {
+	ctx = prefix.AttachExplicitUserPrefixToContext(ctx, e.userPrefix)
+	if e.cachePrefix == "" {
+		return ctx, c
+	}
+	return ctx, c.WithPrefix(e.cachePrefix)
+}
+
+// spool is a temporary file that entries are buffered in, so that they can be
+// verified before they are archived or written to the cache.
+type spool struct {
+	f *os.File
+}
+
+func newSpool() (*spool, error) {
+	f, err := ioutil.TempFile("", "cache_archive-")
+	if err != nil {
+		return nil, err
+	}
+	return &spool{f: f}, nil
+}
+
+// fill replaces the contents of the spool with r, and returns their digest.
+func (s *spool) fill(r io.Reader) (*repb.Digest, error) {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := s.f.Truncate(0); err != nil {
+		return nil, err
+	}
+	return digest.Compute(io.TeeReader(r, s.f))
+}
+
+// copyTo writes the contents of the spool to w.
+func (s *spool) copyTo(w io.Writer) error {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, s.f)
+	return err
+}
+
+func (s *spool) Close() error {
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
+
+// verify returns an error if e is a CAS entry whose contents don't match its
+// hash. Action cache entries are keyed by the digest of their action rather
+// than their contents, so they can't be verified.
+func verify(e *entry, d *repb.Digest) error {
+	if !e.actionCache && d.GetHash() != e.d.GetHash() {
+		return status.DataLossErrorf("CAS entry %q has digest %s/%d", e.key, d.GetHash(), d.GetSizeBytes())
+	}
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readIndex returns the names of the entries that are completely written to
+// the archive in f, and the offset just past the last of them.
+func readIndex(f *os.File) (map[string]bool, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	names := make(map[string]bool)
+	end := int64(0)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			// Either the end of the archive or an entry that was cut
+			// off when an earlier export was interrupted.
+			break
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			break
+		}
+		names[hdr.Name] = true
+		// Entries are padded to a multiple of the block size.
+		end = cr.n + (512-hdr.Size%512)%512
+	}
+	return names, end, nil
+}
+
+type exporter struct {
+	cache interfaces.Cache
+	tw    *tar.Writer
+	spool *spool
+}
+
+// export archives e, and returns its size.
+func (x *exporter) export(ctx context.Context, e *entry) (int64, error) {
+	ctx, c := e.cache(ctx, x.cache)
+	r, err := c.Reader(ctx, e.d, 0)
+	if err != nil {
+		return 0, err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+	d, err := x.spool.fill(r)
+	if err != nil {
+		return 0, err
+	}
+	if err := verify(e, d); err != nil {
+		return 0, err
+	}
+	hdr := &tar.Header{
+		Name:    e.key,
+		Size:    d.GetSizeBytes(),
+		Mode:    0644,
+		ModTime: time.Now(),
+		Format:  tar.FormatPAX,
+	}
+	if err := x.tw.WriteHeader(hdr); err != nil {
+		return 0, err
+	}
+	if err := x.spool.copyTo(x.tw); err != nil {
+		return 0, err
+	}
+	// Flush pads the entry to a full block, so that the archive ends on
+	// an entry boundary if the export is interrupted.
+	return d.GetSizeBytes(), x.tw.Flush()
+}
+
+// Export appends the entries of cache selected by filter to the archive at
+// archivePath, which is created if it doesn't exist. Entries are enumerated
+// with scanner, which must scan the cache that cache reads from.
+//
+// If the archive was left incomplete by an interrupted export, the entries
+// that were completely written are kept and skipped, so that the export
+// resumes where it left off.
+func Export(ctx context.Context, cache interfaces.Cache, scanner interfaces.KeyScanner, archivePath string, filter *Filter) (*Stats, error) {
+	f, err := os.OpenFile(archivePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	archived, end, err := readIndex(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(archived) > 0 {
+		log.Printf("Resuming export: %d entries are already archived", len(archived))
+	}
+	if err := f.Truncate(end); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		return nil, err
+	}
+	s, err := newSpool()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	x := &exporter{
+		cache: cache,
+		tw:    tar.NewWriter(f),
+		spool: s,
+	}
+	stats := &Stats{}
+	err = scanner.ScanKeys(ctx, func(key string, sizeBytes int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e, err := parseEntry(key, sizeBytes)
+		if err != nil || !filter.matches(e) {
+			return nil
+		}
+		if archived[key] {
+			stats.Skipped++
+			return nil
+		}
+		n, err := x.export(ctx, e)
+		if err != nil {
+			if status.IsNotFoundError(err) {
+				// Evicted since the keys were scanned.
+				return nil
+			}
+			log.Printf("Error exporting %q: %s", key, err)
+			stats.Failed++
+			return nil
+		}
+		archived[key] = true
+		stats.Copied++
+		stats.CopiedBytes += n
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	if err := x.tw.Close(); err != nil {
+		return stats, err
+	}
+	return stats, f.Sync()
+}
+
+// findPresent returns the keys of the entries in the archive at f, selected by
+// filter, which are already present in cache.
+func findPresent(ctx context.Context, cache interfaces.Cache, f *os.File, filter *Filter) (map[string]bool, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// Entries can only be looked up in batches which share a user prefix
+	// and a cache prefix.
+	batches := make(map[string][]*entry)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		e, err := parseEntry(hdr.Name, hdr.Size)
+		if err != nil || !filter.matches(e) {
+			continue
+		}
+		batchKey := e.userPrefix + e.cachePrefix
+		batches[batchKey] = append(batches[batchKey], e)
+	}
+
+	present := make(map[string]bool)
+	for _, entries := range batches {
+		for start := 0; start < len(entries); start += containsBatchSize {
+			end := start + containsBatchSize
+			if end > len(entries) {
+				end = len(entries)
+			}
+			batch := entries[start:end]
+			digests := make([]*repb.Digest, 0, len(batch))
+			for _, e := range batch {
+				digests = append(digests, e.d)
+			}
+			ctx, c := batch[0].cache(ctx, cache)
+			found, err := c.ContainsMulti(ctx, digests)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range batch {
+				if found[e.d] {
+					present[e.key] = true
+				}
+			}
+		}
+	}
+	return present, nil
+}
+
+func importEntry(ctx context.Context, cache interfaces.Cache, s *spool, e *entry, r io.Reader) error {
+	d, err := s.fill(r)
+	if err != nil {
+		return err
+	}
+	if err := verify(e, d); err != nil {
+		return err
+	}
+	ctx, c := e.cache(ctx, cache)
+	w, err := c.Writer(ctx, e.d)
+	if err != nil {
+		return err
+	}
+	if err := s.copyTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Import writes the entries of the archive at archivePath selected by filter
+// to cache. Entries which are already present in cache are skipped, so an
+// interrupted import can be resumed by running it again.
+func Import(ctx context.Context, cache interfaces.Cache, archivePath string, filter *Filter) (*Stats, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	present, err := findPresent(ctx, cache, f, filter)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	s, err := newSpool()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	stats := &Stats{}
+	tr := tar.NewReader(f)
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		e, err := parseEntry(hdr.Name, hdr.Size)
+		if err != nil {
+			log.Printf("Skipping archive entry %q: %s", hdr.Name, err)
+			continue
+		}
+		if !filter.matches(e) {
+			continue
+		}
+		if present[e.key] {
+			stats.Skipped++
+			continue
+		}
+		if err := importEntry(ctx, cache, s, e, tr); err != nil {
+			log.Printf("Error importing %q: %s", e.key, err)
+			stats.Failed++
+			continue
+		}
+		stats.Copied++
+		stats.CopiedBytes += hdr.Size
+	}
+	return stats, nil
+}
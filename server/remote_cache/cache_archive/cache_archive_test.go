@@ -0,0 +1,176 @@
+package cache_archive
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	testdigest "github.com/buildbuddy-io/buildbuddy/server/testutil/digest"
+)
+
+type testEntry struct {
+	userPrefix   string
+	instanceName string
+	actionCache  bool
+	d            *repb.Digest
+	data         []byte
+}
+
+func (e *testEntry) cache(ctx context.Context, c interfaces.Cache) (context.Context, interfaces.Cache) {
+	ctx = prefix.AttachExplicitUserPrefixToContext(ctx, e.userPrefix)
+	if e.actionCache {
+		return ctx, namespace.ActionCache(c, e.instanceName)
+	}
+	return ctx, namespace.CASCache(c, e.instanceName)
+}
+
+func newMemoryCache(t *testing.T) *memory_cache.MemoryCache {
+	mc, err := memory_cache.NewMemoryCache(1000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mc
+}
+
+func writeTestEntries(t *testing.T, c interfaces.Cache) []*testEntry {
+	var entries []*testEntry
+	for _, e := range []*testEntry{
+		{userPrefix: "GR1/"},
+		{userPrefix: "GR1/", actionCache: true},
+		{userPrefix: "GR1/", instanceName: "linux"},
+		{userPrefix: "GR1/", instanceName: "linux", actionCache: true},
+		{userPrefix: "GR2/"},
+		{userPrefix: "ANON/"},
+	} {
+		e.d, e.data = testdigest.NewRandomDigestBuf(t, 1000)
+		ctx, c := e.cache(context.Background(), c)
+		if err := c.Set(ctx, e.d, e.data); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func checkEntries(t *testing.T, c interfaces.Cache, entries []*testEntry, want func(e *testEntry) bool) {
+	for _, e := range entries {
+		ctx, c := e.cache(context.Background(), c)
+		data, err := c.Get(ctx, e.d)
+		if !want(e) {
+			if err == nil {
+				t.Errorf("Entry %+v was copied, want it filtered out", e)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Entry %+v was not copied: %s", e, err)
+			continue
+		}
+		if !bytes.Equal(data, e.data) {
+			t.Errorf("Entry %+v was copied with different data", e)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := newMemoryCache(t)
+	entries := writeTestEntries(t, src)
+	archivePath := filepath.Join(t.TempDir(), "cache.tar")
+
+	ctx := context.Background()
+	stats, err := Export(ctx, src, src, archivePath, &Filter{GroupIDs: []string{"GR1", "ANON"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 5 || stats.CopiedBytes != 5000 || stats.Failed != 0 {
+		t.Fatalf("Export stats: %+v, want 5 entries copied", stats)
+	}
+
+	dst := newMemoryCache(t)
+	stats, err = Import(ctx, dst, archivePath, &Filter{InstanceNames: []string{"linux"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 2 || stats.Failed != 0 {
+		t.Fatalf("Import stats: %+v, want 2 entries copied", stats)
+	}
+	checkEntries(t, dst, entries, func(e *testEntry) bool {
+		return e.instanceName == "linux"
+	})
+
+	// Importing everything skips the entries which are already present.
+	stats, err = Import(ctx, dst, archivePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 3 || stats.Skipped != 2 {
+		t.Fatalf("Import stats: %+v, want 3 entries copied and 2 skipped", stats)
+	}
+	checkEntries(t, dst, entries, func(e *testEntry) bool {
+		return e.userPrefix != "GR2/"
+	})
+}
+
+func TestExportResumesAfterInterruption(t *testing.T) {
+	src := newMemoryCache(t)
+	entries := writeTestEntries(t, src)
+	archivePath := filepath.Join(t.TempDir(), "cache.tar")
+
+	ctx := context.Background()
+	if _, err := Export(ctx, src, src, archivePath, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Cut off the archive in the middle of an entry.
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(archivePath, info.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := Export(ctx, src, src, archivePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied == 0 || stats.Skipped == 0 || stats.Copied+stats.Skipped != len(entries) {
+		t.Fatalf("Export stats: %+v, want some of the %d entries to be skipped", stats, len(entries))
+	}
+
+	dst := newMemoryCache(t)
+	stats, err = Import(ctx, dst, archivePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != len(entries) || stats.Failed != 0 {
+		t.Fatalf("Import stats: %+v, want all %d entries copied once", stats, len(entries))
+	}
+	checkEntries(t, dst, entries, func(e *testEntry) bool { return true })
+}
+
+func TestExportVerifiesDigests(t *testing.T) {
+	src := newMemoryCache(t)
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	ctx := prefix.AttachExplicitUserPrefixToContext(context.Background(), "GR1/")
+	// Store data under the wrong digest.
+	if err := src.Set(ctx, d, append(buf[1:], 'x')); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(t.TempDir(), "cache.tar")
+
+	stats, err := Export(context.Background(), src, src, archivePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 0 || stats.Failed != 1 {
+		t.Fatalf("Export stats: %+v, want the corrupt entry to fail", stats)
+	}
+}
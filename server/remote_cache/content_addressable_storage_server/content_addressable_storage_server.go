@@ -133,7 +133,7 @@ func (s *ContentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context,
 	cache := s.getCache(req.GetInstanceName())
 	rsp.Responses = make([]*repb.BatchUpdateBlobsResponse_Response, 0, len(req.Requests))
 
-	ht := hit_tracker.NewHitTracker(ctx, s.env, false)
+	ht := hit_tracker.NewHitTracker(ctx, s.env, req.GetInstanceName(), false)
 	kvs := make(map[*repb.Digest][]byte, len(req.Requests))
 	for _, uploadRequest := range req.Requests {
 		uploadDigest := uploadRequest.GetDigest()
@@ -199,7 +199,7 @@ func (s *ContentAddressableStorageServer) BatchReadBlobs(ctx context.Context, re
 	cache := s.getCache(req.GetInstanceName())
 	cacheRequest := make([]*repb.Digest, 0, len(req.Digests))
 	rsp.Responses = make([]*repb.BatchReadBlobsResponse_Response, 0, len(req.Digests))
-	ht := hit_tracker.NewHitTracker(ctx, s.env, false)
+	ht := hit_tracker.NewHitTracker(ctx, s.env, req.GetInstanceName(), false)
 	for _, readDigest := range req.GetDigests() {
 		_, err := digest.Validate(readDigest)
 		if err != nil {
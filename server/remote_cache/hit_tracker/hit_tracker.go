@@ -8,6 +8,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/prometheus/client_golang/prometheus"
 
 	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
@@ -46,6 +47,9 @@ const (
 
 	UploadThroughputBytesPerSecond
 	DownloadThroughputBytesPerSecond
+
+	QuotaSoftLimitExceeded
+	QuotaHardLimitExceeded
 	// New counter types go here!
 )
 
@@ -79,6 +83,10 @@ func rawCounterName(actionCache bool, ct counterType) string {
 		return "download-throughput-bytes-per-second"
 	case UploadThroughputBytesPerSecond:
 		return "upload-throughput-bytes-per-second"
+	case QuotaSoftLimitExceeded:
+		return "quota-soft-limit-exceeded"
+	case QuotaHardLimitExceeded:
+		return "quota-hard-limit-exceeded"
 	default:
 		return "UNKNOWN-COUNTER-TYPE"
 	}
@@ -89,18 +97,22 @@ func counterName(actionCache bool, ct counterType, iid string) string {
 }
 
 type HitTracker struct {
-	iid         string
-	c           interfaces.MetricsCollector
-	ctx         context.Context
-	actionCache bool
+	iid          string
+	c            interfaces.MetricsCollector
+	ut           interfaces.UsageTracker
+	ctx          context.Context
+	instanceName string
+	actionCache  bool
 }
 
-func NewHitTracker(ctx context.Context, env environment.Env, actionCache bool) *HitTracker {
+func NewHitTracker(ctx context.Context, env environment.Env, instanceName string, actionCache bool) *HitTracker {
 	return &HitTracker{
-		c:           env.GetMetricsCollector(),
-		ctx:         ctx,
-		iid:         digest.GetInvocationIDFromMD(ctx),
-		actionCache: actionCache,
+		c:            env.GetMetricsCollector(),
+		ut:           env.GetUsageTracker(),
+		ctx:          ctx,
+		iid:          digest.GetInvocationIDFromMD(ctx),
+		instanceName: instanceName,
+		actionCache:  actionCache,
 	}
 }
 
@@ -115,13 +127,48 @@ func (h *HitTracker) cacheTypeLabel() string {
 	return casLabel
 }
 
+// trackUsage adds a request of type ct, which transferred sizeBytes, to the
+// usage of the authenticated group.
+func (h *HitTracker) trackUsage(ct counterType, sizeBytes int64) error {
+	if h.ut == nil {
+		return nil
+	}
+	counts := &tables.UsageCounts{}
+	switch ct {
+	case Hit:
+		if h.actionCache {
+			counts.ActionCacheHits = 1
+		} else {
+			counts.CasCacheHits = 1
+		}
+		counts.TotalDownloadSizeBytes = sizeBytes
+	case Miss:
+		if h.actionCache {
+			counts.ActionCacheMisses = 1
+		} else {
+			counts.CasCacheMisses = 1
+		}
+	case Upload:
+		if h.actionCache {
+			counts.ActionCacheUploads = 1
+		} else {
+			counts.CasCacheUploads = 1
+		}
+		counts.TotalUploadSizeBytes = sizeBytes
+	}
+	return h.ut.Increment(h.ctx, h.instanceName, counts)
+}
+
 // Example Usage:
 //
-// ht := NewHitTracker(env, invocationID, false /*=actionCache*/)
+// ht := NewHitTracker(ctx, env, instanceName, false /*=actionCache*/)
 // if err := ht.TrackMiss(); err != nil {
 //   log.Printf("Error counting cache miss.")
 // }
 func (h *HitTracker) TrackMiss(d *repb.Digest) error {
+	if err := h.trackUsage(Miss, 0); err != nil {
+		return err
+	}
 	if h.c == nil || h.iid == "" {
 		return nil
 	}
@@ -138,6 +185,9 @@ func (h *HitTracker) TrackEmptyHit() error {
 		metrics.CacheTypeLabel:      h.cacheTypeLabel(),
 		metrics.CacheEventTypeLabel: hitLabel,
 	}).Inc()
+	if err := h.trackUsage(Hit, 0); err != nil {
+		return err
+	}
 	if h.c == nil || h.iid == "" {
 		return nil
 	}
@@ -196,6 +246,10 @@ func (h *HitTracker) makeCloseFunc(actionCache bool, d *repb.Digest, start time.
 			metrics.CacheTypeLabel: ct,
 		}).Observe(float64(dur.Microseconds()))
 
+		if err := h.trackUsage(actionCounter, d.GetSizeBytes()); err != nil {
+			return err
+		}
+
 		if h.c == nil || h.iid == "" {
 			return nil
 		}
@@ -231,7 +285,7 @@ func (h *HitTracker) makeCloseFunc(actionCache bool, d *repb.Digest, start time.
 
 // Example Usage:
 //
-// ht := NewHitTracker(env, invocationID, false /*=actionCache*/)
+// ht := NewHitTracker(ctx, env, instanceName, false /*=actionCache*/)
 // dlt := ht.TrackDownload(d)
 // defer dlt.Close()
 // ... body of download logic ...
@@ -244,7 +298,7 @@ func (h *HitTracker) TrackDownload(d *repb.Digest) *transferTimer {
 
 // Example Usage:
 //
-// ht := NewHitTracker(env, invocationID, false /*=actionCache*/)
+// ht := NewHitTracker(ctx, env, instanceName, false /*=actionCache*/)
 // ult := ht.TrackUpload(d)
 // defer ult.Close()
 // ... body of download logic ...
@@ -255,6 +309,22 @@ func (h *HitTracker) TrackUpload(d *repb.Digest) *transferTimer {
 	}
 }
 
+// TrackQuotaExceeded counts a cache request, made by the invocation in ctx,
+// while its group was over the soft (or hard) limit of one of its quotas.
+func TrackQuotaExceeded(ctx context.Context, env environment.Env, hardLimit bool) error {
+	c := env.GetMetricsCollector()
+	iid := digest.GetInvocationIDFromMD(ctx)
+	if c == nil || iid == "" {
+		return nil
+	}
+	ct := QuotaSoftLimitExceeded
+	if hardLimit {
+		ct = QuotaHardLimitExceeded
+	}
+	_, err := c.IncrementCount(ctx, counterName(false, ct, iid), 1)
+	return err
+}
+
 func CollectCacheStats(ctx context.Context, env environment.Env, iid string) *capb.CacheStats {
 	c := env.GetMetricsCollector()
 	if c == nil || iid == "" {
@@ -280,5 +350,8 @@ func CollectCacheStats(ctx context.Context, env environment.Env, iid string) *ca
 
 	cs.TotalCachedActionExecUsec, _ = c.ReadCount(ctx, counterName(false, CachedActionExecUsec, iid))
 
+	cs.QuotaSoftLimitExceededCount, _ = c.ReadCount(ctx, counterName(false, QuotaSoftLimitExceeded, iid))
+	cs.QuotaHardLimitExceededCount, _ = c.ReadCount(ctx, counterName(false, QuotaHardLimitExceeded, iid))
+
 	return cs
 }
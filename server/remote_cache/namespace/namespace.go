@@ -5,7 +5,8 @@ import (
 )
 
 const (
-	acCachePrefix = "ac"
+	// ACCachePrefix is the prefix which ActionCache adds to the cache.
+	ACCachePrefix = "ac"
 )
 
 func CASCache(cache interfaces.Cache, instanceName string) interfaces.Cache {
@@ -21,5 +22,5 @@ func ActionCache(cache interfaces.Cache, instanceName string) interfaces.Cache {
 	if instanceName != "" {
 		c = c.WithPrefix(instanceName)
 	}
-	return c.WithPrefix(acCachePrefix)
+	return c.WithPrefix(ACCachePrefix)
 }
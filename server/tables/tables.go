@@ -118,6 +118,16 @@ type Invocation struct {
 	TotalCachedActionExecUsec        int64
 	DownloadThroughputBytesPerSecond int64
 	UploadThroughputBytesPerSecond   int64
+	QuotaSoftLimitExceededCount      int64
+	QuotaHardLimitExceededCount      int64
+	ActionsCreated                   int64
+	TargetsLoaded                    int64
+	TargetsConfigured                int64
+	PackagesLoaded                   int64
+	UsedHeapSizePostBuild            int64
+	CPUTimeUsec                      int64
+	WallTimeUsec                     int64
+	AnalysisPhaseTimeUsec            int64
 	InvocationPK                     int64 `gorm:"uniqueIndex:invocation_invocation_pk"`
 }
 
@@ -125,18 +135,54 @@ func (i *Invocation) TableName() string {
 	return "Invocations"
 }
 
+// CacheEntry holds how many bytes a group stores under one remote instance
+// name in the local cache of one app replica, as of that replica's last scan
+// of its cache. Rows of replicas which stop scanning expire.
 type CacheEntry struct {
 	Model
+	// The replica, group and remote instance name, joined with "/".
 	EntryID            string `gorm:"primaryKey;"`
-	ExpirationTimeUsec int64
+	ReplicaID          string `gorm:"index:cache_entry_replica_id"`
+	GroupID            string
+	InstanceName       string
+	ExpirationTimeUsec int64 `gorm:"index:cache_entry_expiration_time_usec"`
 	SizeBytes          int64
-	ReadCount          int64
 }
 
 func (c *CacheEntry) TableName() string {
 	return "CacheEntries"
 }
 
+// UsageCounts are the cache usage counters that are aggregated into Usage
+// rows.
+type UsageCounts struct {
+	ActionCacheHits        int64
+	ActionCacheMisses      int64
+	ActionCacheUploads     int64
+	CasCacheHits           int64
+	CasCacheMisses         int64
+	CasCacheUploads        int64
+	TotalDownloadSizeBytes int64
+	TotalUploadSizeBytes   int64
+}
+
+// Usage holds the cache usage of a group under one remote instance name,
+// during one day (UTC).
+type Usage struct {
+	Model
+	GroupID         string `gorm:"primaryKey"`
+	InstanceName    string `gorm:"primaryKey"`
+	PeriodStartUsec int64  `gorm:"primaryKey;autoIncrement:false;index:usage_period_start_usec"`
+	UsageCounts
+	// The bytes stored in the cache as of the last time they were
+	// totaled during the day. Unlike the counts, this is not additive.
+	StoredSizeBytes int64
+}
+
+func (u *Usage) TableName() string {
+	return "Usages"
+}
+
 // NOTE: Do not use `url_identifier_index` as an index name for Group.
 // It is removed as part of a migration.
 
@@ -434,6 +480,30 @@ func (wf *Workflow) TableName() string {
 	return "Workflows"
 }
 
+// BuildEventProxyRoute forwards the build events of a group's invocations to
+// a host. A group's routes override the routes configured in
+// build_event_proxy.routes for that group.
+type BuildEventProxyRoute struct {
+	Model
+	RouteID string `gorm:"primaryKey"`
+	GroupID string `gorm:"index:build_event_proxy_route_group_id_index"`
+	Host    string
+
+	// Only the invocations matching all of these filters that are set are
+	// forwarded.
+	RepoURL string
+	Role    string
+	Command string
+
+	// Comma-separated types of the build events to forward without their
+	// payload, ex. "progress".
+	ExcludedEvents string
+}
+
+func (r *BuildEventProxyRoute) TableName() string {
+	return "BuildEventProxyRoutes"
+}
+
 type PostAutoMigrateLogic func() error
 
 // Manual migration called before auto-migration.
@@ -535,4 +605,6 @@ func init() {
 	registerTable("TA", &Target{})
 	registerTable("TS", &TargetStatus{})
 	registerTable("WF", &Workflow{})
+	registerTable("UA", &Usage{})
+	registerTable("PR", &BuildEventProxyRoute{})
 }
@@ -164,7 +164,7 @@ func getAppVersion() string {
 
 func getInstallationUUID(env environment.Env) string {
 	ctx := context.Background()
-	store, err := blobstore.GetConfiguredBlobstore(env.GetConfigurator())
+	store, err := blobstore.GetConfiguredBlobstore(env.GetConfigurator(), nil)
 	if err != nil {
 		printIfVerbose("Error getting blobstore: %s", err)
 		return unknownFieldValue
@@ -0,0 +1,372 @@
+// Package azure provides an in-process stand-in for Azurite, the Azure
+// Storage emulator, for tests. It serves the blob service with Azurite's
+// path-style URLs and well-known development account, and implements just
+// enough of the REST API for the Azure cache and blobstore: containers,
+// blob listing, ranged blob reads, single-shot and block uploads, metadata
+// updates and deletion. Request signatures are not checked.
+package azure
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// The development account built into Azurite.
+	AccountName = "devstoreaccount1"
+	AccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// Stats counts the requests served since the last ResetStats.
+type Stats struct {
+	BytesServed     int64
+	NumPutBlobs     int
+	NumStagedBlocks int
+}
+
+type blob struct {
+	data         []byte
+	lastModified time.Time
+	etag         int
+}
+
+type Server struct {
+	// The blob service endpoint clients should connect to, like
+	// http://127.0.0.1:10000/devstoreaccount1 for Azurite.
+	URL string
+
+	mu           sync.Mutex
+	containers   map[string]map[string]*blob
+	blocks       map[string][]byte
+	stats        Stats
+	nextETag     int
+	failRequests bool
+}
+
+// Run starts a server which is stopped when the test finishes.
+func Run(t *testing.T) *Server {
+	s := &Server{
+		containers: make(map[string]map[string]*blob),
+		blocks:     make(map[string][]byte),
+	}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	s.URL = server.URL + "/" + AccountName
+	return s
+}
+
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+func (s *Server) ResetStats() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats = Stats{}
+}
+
+// SetFailRequests makes every request fail. Requests are rejected as
+// unauthorized rather than with a server error, which the client would
+// retry with backoff.
+func (s *Server) SetFailRequests(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failRequests = fail
+}
+
+// Blob returns the contents of a blob, if it exists.
+func (s *Server) Blob(container, name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.containers[container][name]
+	if !ok {
+		return nil, false
+	}
+	return b.data, true
+}
+
+// BlobNames returns the names of all blobs in a container.
+func (s *Server) BlobNames(container string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.containers[container]))
+	for name := range s.containers[container] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LastModified returns when a blob was last modified.
+func (s *Server) LastModified(container, name string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.containers[container][name]; ok {
+		return b.lastModified
+	}
+	return time.Time{}
+}
+
+// SetLastModified overrides when a blob was last modified, to simulate
+// blobs which were written a while ago.
+func (s *Server) SetLastModified(container, name string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.containers[container][name]; ok {
+		b.lastModified = t
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, serviceCode string) {
+	w.Header().Set("x-ms-error-code", serviceCode)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>%s</Message></Error>", serviceCode, serviceCode)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failRequests {
+		writeError(w, http.StatusForbidden, "AuthorizationFailure")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/"+AccountName+"/")
+	if path == r.URL.Path {
+		writeError(w, http.StatusBadRequest, "InvalidUri")
+		return
+	}
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) == 1 || parts[1] == "" {
+		s.serveContainer(w, r, parts[0])
+		return
+	}
+	container, ok := s.containers[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	s.serveBlob(w, r, container, parts[1])
+}
+
+func (s *Server) serveContainer(w http.ResponseWriter, r *http.Request, name string) {
+	if r.URL.Query().Get("restype") != "container" {
+		writeError(w, http.StatusBadRequest, "InvalidQueryParameterValue")
+		return
+	}
+	container, exists := s.containers[name]
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if exists && r.URL.Query().Get("comp") == "list" {
+			s.listBlobs(w, r.URL.Query(), container)
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusNotFound, "ContainerNotFound")
+		}
+	case http.MethodPut:
+		if exists {
+			writeError(w, http.StatusConflict, "ContainerAlreadyExists")
+			return
+		}
+		s.containers[name] = make(map[string]*blob)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+type listedBlob struct {
+	Name       string
+	Properties struct {
+		LastModified  string `xml:"Last-Modified"`
+		ContentLength int    `xml:"Content-Length"`
+		BlobType      string
+	}
+}
+
+type enumerationResults struct {
+	XMLName    xml.Name     `xml:"EnumerationResults"`
+	Blobs      []listedBlob `xml:"Blobs>Blob"`
+	NextMarker string
+}
+
+// listBlobs implements a flat listing of a container. The marker is the
+// name of the last blob on the previous page.
+func (s *Server) listBlobs(w http.ResponseWriter, q url.Values, container map[string]*blob) {
+	maxResults := 5000
+	if v := q.Get("maxresults"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidQueryParameterValue")
+			return
+		}
+		maxResults = n
+	}
+	names := make([]string, 0)
+	for name := range container {
+		if strings.HasPrefix(name, q.Get("prefix")) && name > q.Get("marker") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	result := &enumerationResults{}
+	if len(names) > maxResults {
+		names = names[:maxResults]
+		result.NextMarker = names[len(names)-1]
+	}
+	for _, name := range names {
+		b := container[name]
+		lb := listedBlob{Name: name}
+		lb.Properties.LastModified = b.lastModified.UTC().Format(http.TimeFormat)
+		lb.Properties.ContentLength = len(b.data)
+		lb.Properties.BlobType = "BlockBlob"
+		result.Blobs = append(result.Blobs, lb)
+	}
+	out, err := xml.Marshal(result)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(out)
+}
+
+func (s *Server) setBlob(container map[string]*blob, name string, data []byte) {
+	s.nextETag++
+	container[name] = &blob{data: data, lastModified: time.Now(), etag: s.nextETag}
+}
+
+func setBlobHeaders(w http.ResponseWriter, b *blob) {
+	w.Header().Set("ETag", fmt.Sprintf("\"%d\"", b.etag))
+	w.Header().Set("Last-Modified", b.lastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("x-ms-blob-type", "BlockBlob")
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request, container map[string]*blob, name string) {
+	q := r.URL.Query()
+	b, exists := container[name]
+	switch {
+	case r.Method == http.MethodGet:
+		if !exists {
+			writeError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		s.getBlob(w, r, b)
+	case r.Method == http.MethodHead:
+		if !exists {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		setBlobHeaders(w, b)
+		w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+	case r.Method == http.MethodDelete:
+		if !exists {
+			writeError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(container, name)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut && q.Get("comp") == "metadata":
+		if !exists {
+			writeError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		b.lastModified = time.Now()
+		setBlobHeaders(w, b)
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidInput")
+			return
+		}
+		s.stats.NumStagedBlocks++
+		s.blocks[name+"/"+q.Get("blockid")] = data
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidInput")
+			return
+		}
+		blockList := struct {
+			IDs []string `xml:",any"`
+		}{}
+		if err := xml.Unmarshal(body, &blockList); err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		var data []byte
+		for _, id := range blockList.IDs {
+			block, ok := s.blocks[name+"/"+id]
+			if !ok {
+				writeError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		for _, id := range blockList.IDs {
+			delete(s.blocks, name+"/"+id)
+		}
+		s.setBlob(container, name, data)
+		setBlobHeaders(w, container[name])
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && q.Get("comp") == "":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidInput")
+			return
+		}
+		s.stats.NumPutBlobs++
+		s.setBlob(container, name, data)
+		setBlobHeaders(w, container[name])
+		w.WriteHeader(http.StatusCreated)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *Server) getBlob(w http.ResponseWriter, r *http.Request, b *blob) {
+	setBlobHeaders(w, b)
+	rangeHeader := r.Header.Get("x-ms-range")
+	if rangeHeader == "" {
+		rangeHeader = r.Header.Get("Range")
+	}
+	if rangeHeader == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+		s.stats.BytesServed += int64(len(b.data))
+		w.Write(b.data)
+		return
+	}
+	bounds := strings.SplitN(strings.TrimPrefix(rangeHeader, "bytes="), "-", 2)
+	start, err := strconv.Atoi(bounds[0])
+	end := len(b.data) - 1
+	if err == nil && len(bounds) == 2 && bounds[1] != "" {
+		end, err = strconv.Atoi(bounds[1])
+	}
+	if err != nil || !strings.HasPrefix(rangeHeader, "bytes=") || start >= len(b.data) {
+		writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+		return
+	}
+	if end >= len(b.data) {
+		end = len(b.data) - 1
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(b.data)))
+	w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+	w.WriteHeader(http.StatusPartialContent)
+	s.stats.BytesServed += int64(end - start + 1)
+	w.Write(b.data[start : end+1])
+}
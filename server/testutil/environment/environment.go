@@ -132,7 +132,7 @@ func GetTestEnv(t *testing.T) *TestEnv {
 	}
 	te.SetDBHandle(dbHandle)
 	te.RealEnv.SetInvocationDB(invocationdb.NewInvocationDB(te, dbHandle))
-	bs, err := blobstore.GetConfiguredBlobstore(configurator)
+	bs, err := blobstore.GetConfiguredBlobstore(configurator, nil)
 	if err != nil {
 		log.Fatalf("Error configuring blobstore: %s", err)
 	}
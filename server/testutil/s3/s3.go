@@ -0,0 +1,365 @@
+// Package s3 provides an in-process stand-in for an S3-compatible object
+// store (like MinIO) for tests. It only supports path-style addressing and
+// implements just enough of the S3 REST API for the S3 cache and blobstore:
+// bucket creation, listing, ranged object reads, PutObject, multipart
+// uploads and single and batch deletion.
+package s3
+
+import (
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Options struct {
+	// If set, requests must be signed with this access key ID.
+	AccessKeyID string
+
+	// If set, the server is served over HTTPS with a self-signed
+	// certificate. Use CACertFile to trust it.
+	TLS bool
+}
+
+// Stats counts the requests served since the last ResetStats.
+type Stats struct {
+	BytesServed    int64
+	NumPutObjects  int
+	NumUploadParts int
+}
+
+type Server struct {
+	// The endpoint URL clients should connect to.
+	URL string
+
+	server      *httptest.Server
+	accessKeyID string
+
+	mu           sync.Mutex
+	buckets      map[string]map[string][]byte
+	uploads      map[string]map[int][]byte
+	stats        Stats
+	failRequests bool
+}
+
+// Run starts a server which is stopped when the test finishes.
+func Run(t *testing.T, opts *Options) *Server {
+	s := &Server{
+		accessKeyID: opts.AccessKeyID,
+		buckets:     make(map[string]map[string][]byte),
+		uploads:     make(map[string]map[int][]byte),
+	}
+	if opts.TLS {
+		s.server = httptest.NewTLSServer(s)
+	} else {
+		s.server = httptest.NewServer(s)
+	}
+	t.Cleanup(s.server.Close)
+	s.URL = s.server.URL
+	return s
+}
+
+// CACertFile writes the server's TLS certificate to a PEM file, which is
+// removed when the test finishes, and returns its path.
+func (s *Server) CACertFile(t *testing.T) string {
+	cert := s.server.Certificate()
+	if cert == nil {
+		t.Fatalf("S3 test server is not serving TLS")
+	}
+	f, err := ioutil.TempFile("", "s3-ca-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+func (s *Server) ResetStats() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats = Stats{}
+}
+
+// SetFailRequests makes every request fail with an internal error.
+func (s *Server) SetFailRequests(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failRequests = fail
+}
+
+// Object returns the contents of an object, if it exists.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucket][key]
+	return b, ok
+}
+
+// Keys returns the keys of all objects in a bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeError(w http.ResponseWriter, code int, s3Code string) {
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", s3Code, s3Code)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failRequests {
+		writeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	if s.accessKeyID != "" && !strings.Contains(r.Header.Get("Authorization"), "Credential="+s.accessKeyID+"/") {
+		writeError(w, http.StatusForbidden, "InvalidAccessKeyId")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucketName := parts[0]
+	if len(parts) == 1 || parts[1] == "" {
+		s.serveBucket(w, r, bucketName)
+		return
+	}
+	bucket, ok := s.buckets[bucketName]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	s.serveObject(w, r, bucket, parts[1])
+}
+
+func (s *Server) serveBucket(w http.ResponseWriter, r *http.Request, name string) {
+	_, exists := s.buckets[name]
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodHead && exists:
+		return
+	case r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodPut && len(q) == 0:
+		if exists {
+			writeError(w, http.StatusConflict, "BucketAlreadyOwnedByYou")
+			return
+		}
+		s.buckets[name] = make(map[string][]byte)
+	case !exists:
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+	case r.Method == http.MethodGet && hasParam(q, "lifecycle"):
+		writeError(w, http.StatusNotFound, "NoSuchLifecycleConfiguration")
+	case r.Method == http.MethodPut && hasParam(q, "lifecycle"):
+		return
+	case r.Method == http.MethodGet && q.Get("list-type") == "2":
+		s.listObjects(w, q, s.buckets[name])
+	case r.Method == http.MethodPost && hasParam(q, "delete"):
+		s.deleteObjects(w, r, s.buckets[name])
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, bucket map[string][]byte, key string) {
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet:
+		s.getObject(w, r, bucket, key)
+	case r.Method == http.MethodHead:
+		data, ok := bucket[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+	case r.Method == http.MethodDelete:
+		delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && hasParam(q, "uploads"):
+		id := strconv.Itoa(len(s.uploads))
+		s.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, id)
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		parts, ok := s.uploads[q.Get("uploadId")]
+		partNumber, err := strconv.Atoi(q.Get("partNumber"))
+		if !ok || err != nil {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.stats.NumUploadParts++
+		parts[partNumber] = b
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", partNumber))
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		parts, ok := s.uploads[q.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNumbers := make([]int, 0, len(parts))
+		for n := range parts {
+			partNumbers = append(partNumbers, n)
+		}
+		sort.Ints(partNumbers)
+		var data []byte
+		for _, n := range partNumbers {
+			data = append(data, parts[n]...)
+		}
+		bucket[key] = data
+		delete(s.uploads, q.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>", key)
+	case r.Method == http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.stats.NumPutObjects++
+		bucket[key] = b
+		w.Header().Set("ETag", "\"etag\"")
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+type listedObject struct {
+	Key  string
+	Size int
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Contents              []listedObject
+	KeyCount              int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+}
+
+// listObjects implements ListObjectsV2. The continuation token is the last
+// key of the previous page.
+func (s *Server) listObjects(w http.ResponseWriter, q url.Values, bucket map[string][]byte) {
+	prefix := q.Get("prefix")
+	after := q.Get("continuation-token")
+	maxKeys := 1000
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		maxKeys = n
+	}
+	keys := make([]string, 0)
+	for k := range bucket {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	result := &listBucketResult{}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		result.Contents = append(result.Contents, listedObject{Key: k, Size: len(bucket[k])})
+	}
+	result.KeyCount = len(keys)
+	b, err := xml.Marshal(result)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Write(b)
+}
+
+// deleteObjects implements DeleteObjects in quiet mode.
+func (s *Server) deleteObjects(w http.ResponseWriter, r *http.Request, bucket map[string][]byte) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	req := struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}{}
+	if err := xml.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	for _, o := range req.Objects {
+		delete(bucket, o.Key)
+	}
+	fmt.Fprint(w, "<DeleteResult></DeleteResult>")
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, bucket map[string][]byte, key string) {
+	data, ok := bucket[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		s.stats.BytesServed += int64(len(data))
+		w.Write(data)
+		return
+	}
+	bounds := strings.SplitN(strings.TrimPrefix(rangeHeader, "bytes="), "-", 2)
+	start, err := strconv.Atoi(bounds[0])
+	end := len(data) - 1
+	if err == nil && len(bounds) == 2 && bounds[1] != "" {
+		end, err = strconv.Atoi(bounds[1])
+	}
+	if err != nil || !strings.HasPrefix(rangeHeader, "bytes=") || start >= len(data) {
+		writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+		return
+	}
+	if end >= len(data) {
+		end = len(data) - 1
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+	w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+	w.WriteHeader(http.StatusPartialContent)
+	s.stats.BytesServed += int64(end - start + 1)
+	w.Write(data[start : end+1])
+}
+
+func hasParam(q map[string][]string, name string) bool {
+	_, ok := q[name]
+	return ok
+}
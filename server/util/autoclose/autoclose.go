@@ -0,0 +1,32 @@
+package autoclose
+
+import (
+	"io"
+)
+
+// Reader closes the underlying ReadCloser as soon as it has been fully read
+// (or fails), for callers that only see an io.Reader and have no way to
+// release it themselves, such as the readers of remote cache backends,
+// which hold a connection open until their response body is closed.
+type Reader struct {
+	rc io.ReadCloser
+	// The error the underlying reader failed with, or io.EOF, which every
+	// later Read returns.
+	err error
+}
+
+func NewReader(rc io.ReadCloser) *Reader {
+	return &Reader{rc: rc}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.rc.Read(p)
+	if err != nil {
+		r.rc.Close()
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,60 @@
+package autoclose_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/autoclose"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingCloser struct {
+	io.Reader
+	numCloses int
+}
+
+func (c *countingCloser) Close() error {
+	c.numCloses++
+	return nil
+}
+
+type failingReader struct {
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	return 0, f.err
+}
+
+func TestReaderClosesOnceFullyRead(t *testing.T) {
+	rc := &countingCloser{Reader: strings.NewReader("hello")}
+	r := autoclose.NewReader(rc)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	assert.Equal(t, 1, rc.numCloses)
+
+	n, err := r.Read(make([]byte, 1))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 1, rc.numCloses)
+}
+
+func TestReaderKeepsReturningReadErrors(t *testing.T) {
+	readErr := errors.New("connection reset")
+	rc := &countingCloser{Reader: io.MultiReader(strings.NewReader("he"), &failingReader{readErr})}
+	r := autoclose.NewReader(rc)
+	b, err := ioutil.ReadAll(r)
+	assert.Equal(t, readErr, err)
+	assert.Equal(t, "he", string(b))
+	assert.Equal(t, 1, rc.numCloses)
+
+	// A retried read doesn't look like the end of the stream.
+	n, err := r.Read(make([]byte, 1))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, readErr, err)
+	assert.Equal(t, 1, rc.numCloses)
+}
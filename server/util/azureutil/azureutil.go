@@ -0,0 +1,64 @@
+package azureutil
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// NewContainerURL returns a handle to a blob container, authenticated with
+// the storage account's shared key. If endpoint is empty, the account's
+// public blob service URL is used; set it to point at Azurite or another
+// emulator, e.g. "http://127.0.0.1:10000/devstoreaccount1".
+func NewContainerURL(accountName, accountKey, endpoint, containerName string) (azblob.ContainerURL, error) {
+	if accountName == "" || containerName == "" {
+		return azblob.ContainerURL{}, status.InvalidArgumentError("Azure storage needs an account name and a container name")
+	}
+	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return azblob.ContainerURL{}, status.InvalidArgumentErrorf("Invalid Azure account key: %s", err)
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", accountName)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return azblob.ContainerURL{}, status.InvalidArgumentErrorf("Invalid Azure endpoint %q: %s", endpoint, err)
+	}
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	return azblob.NewServiceURL(*u, pipeline).NewContainerURL(containerName), nil
+}
+
+// CreateContainerIfNotExists creates the container if it doesn't already
+// exist.
+func CreateContainerIfNotExists(ctx context.Context, containerURL azblob.ContainerURL) error {
+	if _, err := containerURL.GetProperties(ctx, azblob.LeaseAccessConditions{}); err == nil {
+		return nil
+	} else if !IsNotFoundErr(err) {
+		return err
+	}
+	log.Printf("Creating storage container: %s", containerURL.String())
+	_, err := containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone)
+	if serr, ok := err.(azblob.StorageError); ok && serr.ServiceCode() == azblob.ServiceCodeContainerAlreadyExists {
+		// Someone else created it first.
+		return nil
+	}
+	return err
+}
+
+// IsNotFoundErr returns whether err means a blob or container doesn't exist.
+func IsNotFoundErr(err error) bool {
+	serr, ok := err.(azblob.StorageError)
+	if !ok {
+		return false
+	}
+	switch serr.ServiceCode() {
+	case azblob.ServiceCodeBlobNotFound, azblob.ServiceCodeContainerNotFound, azblob.ServiceCodeResourceNotFound:
+		return true
+	}
+	return false
+}
@@ -8,22 +8,23 @@ import (
 	"sync"
 )
 
-const defaultNumReplicas = 100
+// DefaultWeight is the weight of items added with Set. An item's weight is
+// the number of virtual nodes it has on the ring, so an item with twice the
+// weight of another will be responsible for roughly twice as many keys.
+const DefaultWeight = 100
 
 type ConsistentHash struct {
-	numReplicas int
-	keys        []int
-	ring        map[int]string
-	items       []string
-	mu          sync.RWMutex
+	keys  []int
+	ring  map[int]string
+	items []string
+	mu    sync.RWMutex
 }
 
 func NewConsistentHash() *ConsistentHash {
 	return &ConsistentHash{
-		numReplicas: defaultNumReplicas,
-		keys:        make([]int, 0),
-		ring:        make(map[int]string, 0),
-		items:       make([]string, 0),
+		keys:  make([]int, 0),
+		ring:  make(map[int]string, 0),
+		items: make([]string, 0),
 	}
 }
 
@@ -31,20 +32,47 @@ func (c *ConsistentHash) hashKey(key string) int {
 	return int(crc32.ChecksumIEEE([]byte(key)))
 }
 
+// Set replaces the items on the ring with the specified items, each with
+// DefaultWeight.
 func (c *ConsistentHash) Set(items ...string) {
+	weights := make(map[string]int, len(items))
+	for _, item := range items {
+		weights[item] = DefaultWeight
+	}
+	c.SetWeighted(weights)
+}
+
+// SetWeighted replaces the items on the ring with the keys of weights. Each
+// item gets as many virtual nodes as its weight; items with a weight <= 0 get
+// DefaultWeight. An item's virtual nodes don't depend on any other item, and
+// changing an item's weight only adds or removes virtual nodes at the end of
+// its own sequence, so only keys owned by those virtual nodes change owner.
+// If the virtual nodes of two items hash to the same point on the ring, the
+// item that sorts first owns it, so that every node builds the same ring.
+func (c *ConsistentHash) SetWeighted(weights map[string]int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.keys = make([]int, 0)
 	c.ring = make(map[int]string, 0)
-	c.items = items
-	for _, key := range items {
-		for i := 0; i < c.numReplicas; i++ {
+	c.items = make([]string, 0, len(weights))
+	for key := range weights {
+		c.items = append(c.items, key)
+	}
+	sort.Strings(c.items)
+	for _, key := range c.items {
+		weight := weights[key]
+		if weight <= 0 {
+			weight = DefaultWeight
+		}
+		for i := 0; i < weight; i++ {
 			h := c.hashKey(strconv.Itoa(i) + key)
+			if _, ok := c.ring[h]; ok {
+				continue
+			}
 			c.keys = append(c.keys, h)
 			c.ring[h] = key
 		}
 	}
-	sort.Strings(c.items)
 	sort.Ints(c.keys)
 }
 
@@ -67,7 +95,8 @@ func (c *ConsistentHash) Get(key string) string {
 
 // GetNReplicas returns the N "items" responsible for the specified key, in
 // order. It does this by walking the consistent hash ring, in order,
-// until N unique replicas have been found.
+// until N unique replicas have been found. Fewer than N items are returned
+// if there aren't N items on the ring.
 func (c *ConsistentHash) GetNReplicas(key string, n int) []string {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -88,16 +117,13 @@ func (c *ConsistentHash) GetNReplicas(key string, n int) []string {
 	replicas = append(replicas, original)
 	seen[original] = struct{}{}
 
-	for offset := 1; offset < len(c.keys); offset += 1 {
+	for offset := 1; offset < len(c.keys) && len(replicas) < n; offset += 1 {
 		newIdx := (idx + offset) % len(c.keys)
 		v := c.ring[c.keys[newIdx]]
 		if _, ok := seen[v]; !ok {
 			replicas = append(replicas, v)
 			seen[v] = struct{}{}
 		}
-		if len(replicas) == n {
-			break
-		}
 	}
 	if len(replicas) < n {
 		log.Printf("Warning: client requested %d replicas but only %d were available.", n, len(replicas))
@@ -0,0 +1,105 @@
+package consistent_hash_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/consistent_hash"
+)
+
+func owners(ch *consistent_hash.ConsistentHash, numKeys int) map[string]string {
+	m := make(map[string]string, numKeys)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		m[key] = ch.Get(key)
+	}
+	return m
+}
+
+func TestGetNReplicasReturnsDistinctItems(t *testing.T) {
+	ch := consistent_hash.NewConsistentHash()
+	ch.SetWeighted(map[string]int{"a": 10, "b": 500, "c": 100})
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		for n := 1; n <= 4; n++ {
+			replicas := ch.GetNReplicas(key, n)
+			wantLen := n
+			if wantLen > 3 {
+				wantLen = 3
+			}
+			if len(replicas) != wantLen {
+				t.Fatalf("GetNReplicas(%q, %d) returned %v, want %d replicas", key, n, replicas, wantLen)
+			}
+			if replicas[0] != ch.Get(key) {
+				t.Fatalf("GetNReplicas(%q, %d)[0] = %q, want %q", key, n, replicas[0], ch.Get(key))
+			}
+			seen := make(map[string]bool)
+			for _, r := range replicas {
+				if seen[r] {
+					t.Fatalf("GetNReplicas(%q, %d) returned duplicate item: %v", key, n, replicas)
+				}
+				seen[r] = true
+			}
+		}
+	}
+}
+
+func TestWeightsAreProportional(t *testing.T) {
+	ch := consistent_hash.NewConsistentHash()
+	ch.SetWeighted(map[string]int{"small": 100, "large": 300})
+	counts := make(map[string]int)
+	numKeys := 20000
+	for _, owner := range owners(ch, numKeys) {
+		counts[owner]++
+	}
+	frac := float64(counts["large"]) / float64(numKeys)
+	if frac < 0.65 || frac > 0.85 {
+		t.Fatalf("Item with 3/4 of the weight owns %.2f of the keys: %v", frac, counts)
+	}
+}
+
+func TestSetUsesDefaultWeight(t *testing.T) {
+	a := consistent_hash.NewConsistentHash()
+	a.Set("x", "y", "z")
+	b := consistent_hash.NewConsistentHash()
+	b.SetWeighted(map[string]int{"x": consistent_hash.DefaultWeight, "y": 0, "z": -1})
+	ownersA, ownersB := owners(a, 1000), owners(b, 1000)
+	for key, owner := range ownersA {
+		if ownersB[key] != owner {
+			t.Fatalf("Key %q is owned by %q with Set, but %q with SetWeighted", key, owner, ownersB[key])
+		}
+	}
+}
+
+func TestWeightChangeOnlyMovesKeysToThatItem(t *testing.T) {
+	ch := consistent_hash.NewConsistentHash()
+	ch.SetWeighted(map[string]int{"a": 100, "b": 100, "c": 100})
+	before := owners(ch, 5000)
+	ch.SetWeighted(map[string]int{"a": 100, "b": 100, "c": 200})
+	after := owners(ch, 5000)
+	moved := 0
+	for key, owner := range after {
+		if owner == before[key] {
+			continue
+		}
+		moved++
+		if owner != "c" {
+			t.Fatalf("Key %q moved from %q to %q, but only c's weight increased", key, before[key], owner)
+		}
+	}
+	if moved == 0 {
+		t.Fatalf("Expected some keys to move to c")
+	}
+}
+
+func TestVirtualNodeCollisionsAreResolvedDeterministically(t *testing.T) {
+	// The 28th virtual node of "peer-60160" has the same hash as one of
+	// "peer-3"'s, so "28peer-60160" hashes to exactly that point on the ring.
+	for i := 0; i < 20; i++ {
+		ch := consistent_hash.NewConsistentHash()
+		ch.SetWeighted(map[string]int{"peer-60160": 100, "peer-3": 100})
+		if owner := ch.Get("28peer-60160"); owner != "peer-3" {
+			t.Fatalf("Colliding virtual node is owned by %q, want %q", owner, "peer-3")
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package crypter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// Encrypted data starts with a header identifying the master key its data
+// key was wrapped with:
+//
+//	magic (4 bytes) | format version (1 byte)
+//	group ID length (2 bytes) | group ID
+//	master key version (4 bytes)
+//	wrapped data key length (2 bytes) | wrapped data key
+//
+// followed by the data itself, split into chunks which are sealed
+// separately with AES-GCM so that it can be streamed. Every chunk but the
+// last holds chunkSize bytes of plaintext. Chunk nonces count up from zero
+// and mark the last chunk, so chunks can't be reordered or dropped without
+// failing to decrypt. Each blob has its own data key, so nonces are never
+// reused under the same key.
+const (
+	headerMagic   = "\x00BBE"
+	formatVersion = 1
+
+	dataKeySize = 32
+	chunkSize   = 64 * 1024
+	// sealedChunkSize is the size of an encrypted chunk, which AES-GCM
+	// follows with a 16 byte tag.
+	sealedChunkSize = chunkSize + 16
+)
+
+// Header describes how a blob was encrypted.
+type Header struct {
+	GroupID    string
+	KeyVersion int
+	WrappedKey []byte
+}
+
+func (h *Header) marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(headerMagic)
+	buf.WriteByte(formatVersion)
+	binary.Write(&buf, binary.BigEndian, uint16(len(h.GroupID)))
+	buf.WriteString(h.GroupID)
+	binary.Write(&buf, binary.BigEndian, uint32(h.KeyVersion))
+	binary.Write(&buf, binary.BigEndian, uint16(len(h.WrappedKey)))
+	buf.Write(h.WrappedKey)
+	return buf.Bytes()
+}
+
+// ChunkStart returns where the chunk holding the plaintext byte at offset
+// starts, both in the plaintext and in the encrypted data with header h.
+// Offsets at the end of a chunk belong to it rather than to the next one, so
+// that the end of the data can be read from its last chunk.
+func ChunkStart(h *Header, offset int64) (plainOffset, sealedOffset int64) {
+	n := offset / chunkSize
+	if n > 0 && offset%chunkSize == 0 {
+		n--
+	}
+	return n * chunkSize, int64(len(h.marshal())) + n*sealedChunkSize
+}
+
+// IsEncrypted returns whether data starts with an encryption header. Data
+// stored before encryption was enabled doesn't.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(headerMagic))
+}
+
+// ReadHeader reads the encryption header from r. If r doesn't start with
+// one, nothing is consumed and a nil header is returned.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	magic, err := r.Peek(len(headerMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(magic) != headerMagic {
+		return nil, nil
+	}
+	r.Discard(len(headerMagic))
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, truncatedHeaderError(err)
+	}
+	if version != formatVersion {
+		return nil, status.DataLossErrorf("Unknown encryption format version %d", version)
+	}
+	h := &Header{}
+	groupID, err := readLengthPrefixed(r)
+	if err != nil {
+		return nil, err
+	}
+	h.GroupID = string(groupID)
+	var keyVersion uint32
+	if err := binary.Read(r, binary.BigEndian, &keyVersion); err != nil {
+		return nil, truncatedHeaderError(err)
+	}
+	h.KeyVersion = int(keyVersion)
+	if h.WrappedKey, err = readLengthPrefixed(r); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func readLengthPrefixed(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, truncatedHeaderError(err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, truncatedHeaderError(err)
+	}
+	return b, nil
+}
+
+func truncatedHeaderError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return status.DataLossError("Encryption header is truncated")
+	}
+	return err
+}
+
+// Crypter encrypts data with envelope encryption: each blob is encrypted
+// with a fresh data key, which is stored alongside it wrapped by its
+// group's master key. Master keys are held by a KMS.
+type Crypter struct {
+	kms interfaces.KMS
+}
+
+func New(kms interfaces.KMS) *Crypter {
+	return &Crypter{
+		kms: kms,
+	}
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(aead cipher.AEAD, counter uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// NewEncryptWriter writes an encryption header for a new data key wrapped
+// by groupID's current master key to w, and returns a writer which
+// encrypts everything written to it onto w. The returned writer must be
+// closed to write the final chunk; closing it doesn't close w.
+func (c *Crypter) NewEncryptWriter(ctx context.Context, w io.Writer, groupID string) (io.WriteCloser, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrappedKey, keyVersion, err := c.kms.WrapKey(ctx, groupID, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	h := &Header{GroupID: groupID, KeyVersion: keyVersion, WrappedKey: wrappedKey}
+	if _, err := w.Write(h.marshal()); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, chunkSize),
+	}, nil
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	err     error
+}
+
+func (e *encryptWriter) flush(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.aead, e.counter, last), e.buf, nil)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, since the
+		// last chunk is sealed differently.
+		if len(e.buf) == chunkSize {
+			if e.err = e.flush(false); e.err != nil {
+				return written, e.err
+			}
+		}
+		n := copy(e.buf[len(e.buf):chunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	e.err = e.flush(true)
+	if e.err != nil {
+		return e.err
+	}
+	e.err = status.FailedPreconditionError("Encrypt writer is closed")
+	return nil
+}
+
+// NewDecryptReader returns a reader for the decrypted contents of r. Data
+// without an encryption header was stored before encryption was enabled
+// and is returned as-is.
+func (c *Crypter) NewDecryptReader(ctx context.Context, r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, chunkSize+64)
+	h, err := ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return br, nil
+	}
+	return c.newDecryptReader(ctx, h, br, 0)
+}
+
+// NewDecryptReaderAt returns a reader for the decrypted contents of data
+// encrypted with header h, from the chunk starting at plainOffset on. r
+// must read the encrypted data from the corresponding offset, as returned
+// by ChunkStart.
+func (c *Crypter) NewDecryptReaderAt(ctx context.Context, h *Header, r io.Reader, plainOffset int64) (io.Reader, error) {
+	if plainOffset%chunkSize != 0 {
+		return nil, status.InvalidArgumentErrorf("Offset %d is not the start of a chunk", plainOffset)
+	}
+	return c.newDecryptReader(ctx, h, bufio.NewReaderSize(r, chunkSize+64), uint64(plainOffset/chunkSize))
+}
+
+func (c *Crypter) newDecryptReader(ctx context.Context, h *Header, br *bufio.Reader, counter uint64) (io.Reader, error) {
+	dataKey, err := c.kms.UnwrapKey(ctx, h.GroupID, h.KeyVersion, h.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:       br,
+		aead:    aead,
+		sealed:  make([]byte, sealedChunkSize),
+		counter: counter,
+	}, nil
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	sealed  []byte
+	plain   []byte
+	counter uint64
+	done    bool
+}
+
+func (d *decryptReader) readChunk() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	last := false
+	switch err {
+	case nil:
+		// A full chunk is the last one if nothing follows it.
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return status.DataLossError("Encrypted data is truncated")
+	default:
+		return err
+	}
+	plain, err := d.aead.Open(d.sealed[:0], chunkNonce(d.aead, d.counter, last), d.sealed[:n], nil)
+	if err != nil {
+		return status.DataLossError("Encrypted data is corrupt or truncated")
+	}
+	d.counter++
+	d.plain = plain
+	d.done = last
+	return nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// Encrypt encrypts data under groupID's current master key.
+func (c *Crypter) Encrypt(ctx context.Context, groupID string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := c.NewEncryptWriter(ctx, &buf, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decrypt decrypts data returned by Encrypt. Data without an encryption
+// header is returned as-is.
+func (c *Crypter) Decrypt(ctx context.Context, data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	r, err := c.NewDecryptReader(ctx, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// Rekey rewraps the data key of encrypted data with the current version of
+// its group's master key, so that older versions can be retired. The data
+// itself isn't re-encrypted. If the data key is already wrapped with the
+// current version (or a newer one), Rekey returns nil.
+func (c *Crypter) Rekey(ctx context.Context, data []byte) ([]byte, error) {
+	br := bufio.NewReader(bytes.NewReader(data))
+	h, err := ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return nil, status.FailedPreconditionError("Data isn't encrypted")
+	}
+	current, err := c.kms.CurrentKeyVersion(ctx, h.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	if h.KeyVersion >= current {
+		return nil, nil
+	}
+	dataKey, err := c.kms.UnwrapKey(ctx, h.GroupID, h.KeyVersion, h.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	rewrapped := &Header{GroupID: h.GroupID}
+	if rewrapped.WrappedKey, rewrapped.KeyVersion, err = c.kms.WrapKey(ctx, h.GroupID, dataKey); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(rewrapped.marshal())
+	if _, err := br.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
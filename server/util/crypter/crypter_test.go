@@ -0,0 +1,177 @@
+package crypter
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+func newTestKeyfile(t *testing.T) *Keyfile {
+	kf := &Keyfile{}
+	if _, err := kf.Rotate(""); err != nil {
+		t.Fatal(err)
+	}
+	return kf
+}
+
+func newTestCrypter(t *testing.T, kf *Keyfile) *Crypter {
+	kms, err := NewKeyfileKMS(kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(kms)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCrypter(t, newTestKeyfile(t))
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		data := make([]byte, size)
+		rand.Read(data)
+		encrypted, err := c.Encrypt(ctx, "GR1", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsEncrypted(encrypted) {
+			t.Fatalf("Encrypted %d bytes without a header", size)
+		}
+		if size > 0 && bytes.Contains(encrypted, data) {
+			t.Fatalf("Encrypted %d bytes contain the plaintext", size)
+		}
+		got, err := c.Decrypt(ctx, encrypted)
+		if err != nil {
+			t.Fatalf("Decrypt(%d bytes) returned error: %s", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("Decrypt(%d bytes) returned different data than was encrypted", size)
+		}
+
+		// Dropping bytes, or the whole last chunk, must be detected.
+		truncated := [][]byte{encrypted[:len(encrypted)-1]}
+		if numChunks := (size + chunkSize - 1) / chunkSize; numChunks > 1 {
+			lastChunkSize := size - (numChunks-1)*chunkSize + 16
+			truncated = append(truncated, encrypted[:len(encrypted)-lastChunkSize])
+		}
+		for _, tr := range truncated {
+			if _, err := c.Decrypt(ctx, tr); !status.IsDataLossError(err) {
+				t.Fatalf("Decrypt(%d bytes truncated to %d) returned %v, want DataLoss", size, len(tr), err)
+			}
+		}
+	}
+}
+
+func TestDecryptUnencryptedData(t *testing.T) {
+	c := newTestCrypter(t, newTestKeyfile(t))
+	data := []byte("stored before encryption was enabled")
+	got, err := c.Decrypt(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Decrypt(unencrypted data) = %q, want %q", got, data)
+	}
+}
+
+func TestGroupsHaveDifferentKeys(t *testing.T) {
+	ctx := context.Background()
+	kf := newTestKeyfile(t)
+	kms, err := NewKeyfileKMS(kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey := make([]byte, dataKeySize)
+	wrapped, version, err := kms.WrapKey(ctx, "GR1", dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kms.UnwrapKey(ctx, "GR2", version, wrapped); !status.IsDataLossError(err) {
+		t.Fatalf("Unwrapping GR1's data key as GR2 returned %v, want DataLoss", err)
+	}
+	got, err := kms.UnwrapKey(ctx, "GR1", version, wrapped)
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("UnwrapKey() = %v, %v; want the wrapped data key", got, err)
+	}
+}
+
+func TestRotateAndRekey(t *testing.T) {
+	ctx := context.Background()
+	kf := newTestKeyfile(t)
+	data := []byte("hello world")
+	encrypted, err := newTestCrypter(t, kf).Encrypt(ctx, "GR1", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Data is rekeyed when the default key is rotated, and again when the
+	// group is given a key of its own.
+	for _, groupID := range []string{"", "GR1"} {
+		if _, err := kf.Rotate(groupID); err != nil {
+			t.Fatal(err)
+		}
+		path := writeTestKeyfile(t, kf)
+		reread, err := ReadKeyfile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := newTestCrypter(t, reread)
+		rekeyed, err := c.Rekey(ctx, encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rekeyed == nil {
+			t.Fatalf("Data wasn't rekeyed after rotating key of group %q", groupID)
+		}
+		if again, err := c.Rekey(ctx, rekeyed); err != nil || again != nil {
+			t.Fatalf("Rekey(rekeyed data) = %v, %v; want nil", again, err)
+		}
+		// Data encrypted under older versions can still be read.
+		for _, d := range [][]byte{encrypted, rekeyed} {
+			got, err := c.Decrypt(ctx, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("Decrypt() = %q, want %q", got, data)
+			}
+		}
+		encrypted = rekeyed
+	}
+}
+
+func writeTestKeyfile(t *testing.T, kf *Keyfile) string {
+	dir, err := ioutil.TempDir("", "crypter-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "keys.yaml")
+	if err := WriteKeyfile(path, kf); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Keyfile was written with mode %s, want 0600", info.Mode())
+	}
+	return path
+}
+
+func TestNewKeyfileKMSRejectsInvalidKeys(t *testing.T) {
+	for _, kf := range []*Keyfile{
+		{},
+		{Keys: []*MasterKey{{Version: 1, Key: "not base64!"}}},
+		{Keys: []*MasterKey{{Version: 1, Key: "c2hvcnQ="}}},
+	} {
+		if _, err := NewKeyfileKMS(kf); !status.IsInvalidArgumentError(err) {
+			t.Fatalf("NewKeyfileKMS(%v) returned %v, want InvalidArgument", kf, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package crypter
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"gopkg.in/yaml.v2"
+)
+
+const masterKeySize = 32
+
+// MasterKey is one version of a master key, as stored in a keyfile.
+type MasterKey struct {
+	Version int `yaml:"version"`
+	// Key is the base64 encoded 256 bit AES key.
+	Key string `yaml:"key"`
+}
+
+// Keyfile holds the master keys used by a KeyfileKMS.
+type Keyfile struct {
+	// Keys are the versions of the default master key. Groups without keys
+	// of their own use a key derived from it and their group ID, so every
+	// group is encrypted under a different key.
+	Keys []*MasterKey `yaml:"keys"`
+	// GroupKeys optionally give groups master keys of their own, keyed by
+	// group ID.
+	GroupKeys map[string][]*MasterKey `yaml:"group_keys"`
+}
+
+// ReadKeyfile reads a keyfile written by WriteKeyfile.
+func ReadKeyfile(path string) (*Keyfile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kf := &Keyfile{}
+	if err := yaml.UnmarshalStrict(b, kf); err != nil {
+		return nil, status.InvalidArgumentErrorf("Error parsing keyfile %q: %s", path, err)
+	}
+	return kf, nil
+}
+
+// WriteKeyfile writes a keyfile which is only readable by its owner.
+func WriteKeyfile(path string, kf *Keyfile) error {
+	b, err := yaml.Marshal(kf)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Rotate adds a new, random version of the default master key, or of
+// groupID's own master key if groupID is set, and returns its version. The
+// new version is used to wrap data keys from then on; older versions are
+// kept so that existing data can still be decrypted.
+func (kf *Keyfile) Rotate(groupID string) (int, error) {
+	key := make([]byte, masterKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return 0, err
+	}
+	keys := kf.Keys
+	if groupID != "" {
+		keys = kf.GroupKeys[groupID]
+	}
+	version := 1
+	for _, k := range keys {
+		if k.Version >= version {
+			version = k.Version + 1
+		}
+	}
+	// A group's own versions must follow the derived versions its existing
+	// data may have been wrapped with, which remain usable.
+	if groupID != "" {
+		for _, k := range kf.Keys {
+			if k.Version >= version {
+				version = k.Version + 1
+			}
+		}
+	}
+	keys = append(keys, &MasterKey{Version: version, Key: base64.StdEncoding.EncodeToString(key)})
+	if groupID != "" {
+		if kf.GroupKeys == nil {
+			kf.GroupKeys = make(map[string][]*MasterKey)
+		}
+		kf.GroupKeys[groupID] = keys
+	} else {
+		kf.Keys = keys
+	}
+	return version, nil
+}
+
+type keyVersions struct {
+	keys    map[int][]byte
+	current int
+}
+
+func parseKeyVersions(keys []*MasterKey) (*keyVersions, error) {
+	kv := &keyVersions{keys: make(map[int][]byte, len(keys))}
+	for _, k := range keys {
+		key, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("Master key version %d isn't valid base64: %s", k.Version, err)
+		}
+		if len(key) != masterKeySize {
+			return nil, status.InvalidArgumentErrorf("Master key version %d is %d bytes, must be %d", k.Version, len(key), masterKeySize)
+		}
+		if k.Version <= 0 {
+			return nil, status.InvalidArgumentErrorf("Master key versions must be positive, got %d", k.Version)
+		}
+		if _, ok := kv.keys[k.Version]; ok {
+			return nil, status.InvalidArgumentErrorf("Master key version %d is listed twice", k.Version)
+		}
+		kv.keys[k.Version] = key
+		if k.Version > kv.current {
+			kv.current = k.Version
+		}
+	}
+	if kv.current == 0 {
+		return nil, status.InvalidArgumentError("No master keys listed")
+	}
+	return kv, nil
+}
+
+// KeyfileKMS is a KMS whose master keys are read from a local keyfile.
+type KeyfileKMS struct {
+	defaultKeys *keyVersions
+	groupKeys   map[string]*keyVersions
+}
+
+func NewKeyfileKMS(kf *Keyfile) (*KeyfileKMS, error) {
+	defaultKeys, err := parseKeyVersions(kf.Keys)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("Invalid default keys: %s", err)
+	}
+	k := &KeyfileKMS{
+		defaultKeys: defaultKeys,
+		groupKeys:   make(map[string]*keyVersions, len(kf.GroupKeys)),
+	}
+	for groupID, keys := range kf.GroupKeys {
+		if k.groupKeys[groupID], err = parseKeyVersions(keys); err != nil {
+			return nil, status.InvalidArgumentErrorf("Invalid keys for group %q: %s", groupID, err)
+		}
+	}
+	return k, nil
+}
+
+// groupKey returns the given version of groupID's master key. Versions
+// which aren't among the group's own keys are derived from the default
+// master key, as an HMAC of the group ID.
+func (k *KeyfileKMS) groupKey(groupID string, version int) ([]byte, error) {
+	if keys, ok := k.groupKeys[groupID]; ok {
+		if key, ok := keys.keys[version]; ok {
+			return key, nil
+		}
+	}
+	if key, ok := k.defaultKeys.keys[version]; ok {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("buildbuddy group key\x00" + groupID))
+		return mac.Sum(nil), nil
+	}
+	return nil, status.NotFoundErrorf("Master key version %d for group %q not found", version, groupID)
+}
+
+func (k *KeyfileKMS) CurrentKeyVersion(ctx context.Context, groupID string) (int, error) {
+	if keys, ok := k.groupKeys[groupID]; ok {
+		return keys.current, nil
+	}
+	return k.defaultKeys.current, nil
+}
+
+// WrapKey seals dataKey with AES-GCM under the group's master key. The
+// group ID is authenticated too, so a data key can't be passed off as
+// belonging to another group.
+func (k *KeyfileKMS) WrapKey(ctx context.Context, groupID string, dataKey []byte) ([]byte, int, error) {
+	version, err := k.CurrentKeyVersion(ctx, groupID)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, err := k.groupKey(groupID, version)
+	if err != nil {
+		return nil, 0, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, 0, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(groupID)), version, nil
+}
+
+func (k *KeyfileKMS) UnwrapKey(ctx context.Context, groupID string, keyVersion int, wrappedKey []byte) ([]byte, error) {
+	key, err := k.groupKey(groupID, keyVersion)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrappedKey) < aead.NonceSize() {
+		return nil, status.DataLossError("Wrapped data key is truncated")
+	}
+	nonce, sealed := wrappedKey[:aead.NonceSize()], wrappedKey[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(groupID))
+	if err != nil {
+		return nil, status.DataLossErrorf("Error unwrapping data key with master key version %d for group %q", keyVersion, groupID)
+	}
+	return dataKey, nil
+}
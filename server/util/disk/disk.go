@@ -104,6 +104,13 @@ func (w *writeMover) Close() error {
 	return os.Rename(tmpName, w.finalPath)
 }
 
+// Abort closes and removes the temp file without moving it into place.
+func (w *writeMover) Abort() {
+	tmpName := w.File.Name()
+	w.File.Close()
+	DeleteLocalFileIfExists(tmpName)
+}
+
 func FileWriter(ctx context.Context, fullPath string) (io.WriteCloser, error) {
 	if err := EnsureDirectoryExists(filepath.Dir(fullPath)); err != nil {
 		return nil, err
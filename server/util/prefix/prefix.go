@@ -3,6 +3,7 @@ package prefix
 import (
 	"context"
 	"log"
+	"strings"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -50,3 +51,23 @@ func UserPrefixFromContext(ctx context.Context) (string, error) {
 	log.Print("No user prefix on context -- did you forget to call AttachUserPrefixToContext")
 	return "", status.PermissionDeniedErrorf("Anonymous access disabled, permission denied.")
 }
+
+// AttachExplicitUserPrefixToContext attaches the provided user prefix to the
+// context without consulting the authenticator. It should only be used by
+// internal processes that move data which was already authorized when it was
+// first written, like distributed cache rebalancing.
+func AttachExplicitUserPrefixToContext(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, userPrefix, prefix)
+}
+
+// ParseCacheKey splits a key returned by an interfaces.KeyScanner into the user
+// prefix (for example "GR123/"), the cache prefix (for example "ac/", possibly
+// empty) and the hash.
+func ParseCacheKey(key string) (string, string, string, error) {
+	first := strings.Index(key, "/")
+	last := strings.LastIndex(key, "/")
+	if first == -1 || last == len(key)-1 {
+		return "", "", "", status.InvalidArgumentErrorf("Malformed cache key %q", key)
+	}
+	return key[:first+1], key[first+1 : last+1], key[last+1:], nil
+}
@@ -0,0 +1,37 @@
+package prefix
+
+import (
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		key         string
+		userPrefix  string
+		cachePrefix string
+		hash        string
+		wantErr     bool
+	}{
+		{"ANON/abc123", "ANON/", "", "abc123", false},
+		{"GR123/ac/abc123", "GR123/", "ac/", "abc123", false},
+		{"GR123/foo/ac/abc123", "GR123/", "foo/ac/", "abc123", false},
+		{"abc123", "", "", "", true},
+		{"GR123/", "", "", "", true},
+	}
+	for _, tc := range tests {
+		userPrefix, cachePrefix, hash, err := ParseCacheKey(tc.key)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseCacheKey(%q) succeeded, expected error", tc.key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCacheKey(%q) returned error: %s", tc.key, err)
+			continue
+		}
+		if userPrefix != tc.userPrefix || cachePrefix != tc.cachePrefix || hash != tc.hash {
+			t.Errorf("ParseCacheKey(%q) = (%q, %q, %q), want (%q, %q, %q)", tc.key, userPrefix, cachePrefix, hash, tc.userPrefix, tc.cachePrefix, tc.hash)
+		}
+	}
+}
@@ -49,10 +49,64 @@ type BufferedProtoReader struct {
 }
 
 func NewBufferedProtoReader(bs interfaces.Blobstore, streamID string) *BufferedProtoReader {
+	return NewBufferedProtoReaderAt(bs, streamID, 0)
+}
+
+// NewBufferedProtoReaderAt returns a BufferedProtoReader that starts reading
+// at the chunk with the given sequence number, skipping the ones before it.
+func NewBufferedProtoReaderAt(bs interfaces.Blobstore, streamID string, chunkSequenceNumber int) *BufferedProtoReader {
+	q := newBlobQueue(bs, streamID)
+	q.startSequenceNumber = chunkSequenceNumber
 	return &BufferedProtoReader{
 		streamID: streamID,
 		bs:       bs,
-		q:        newBlobQueue(bs, streamID),
+		q:        q,
+	}
+}
+
+// ReadFirstProtoInChunk reads the first proto of the chunk with the given
+// sequence number into msg. It returns io.EOF if the chunk hasn't been
+// written.
+func ReadFirstProtoInChunk(ctx context.Context, bs interfaces.Blobstore, streamID string, chunkSequenceNumber int, msg proto.Message) error {
+	data, err := bs.ReadBlob(ctx, chunkName(streamID, chunkSequenceNumber))
+	if err != nil {
+		if gstatus.Code(err) == gcodes.NotFound {
+			return io.EOF
+		}
+		return err
+	}
+	buf := bytes.NewBuffer(data)
+	count, err := binary.ReadVarint(buf)
+	if err != nil {
+		return io.EOF
+	}
+	return proto.Unmarshal(buf.Next(int(count)), msg)
+}
+
+// ReadProtosInChunk calls fn with each of the protos in the chunk with the
+// given sequence number, read into a message returned by newMsg. It returns
+// io.EOF if the chunk hasn't been written.
+func ReadProtosInChunk(ctx context.Context, bs interfaces.Blobstore, streamID string, chunkSequenceNumber int, newMsg func() proto.Message, fn func(msg proto.Message) error) error {
+	data, err := bs.ReadBlob(ctx, chunkName(streamID, chunkSequenceNumber))
+	if err != nil {
+		if gstatus.Code(err) == gcodes.NotFound {
+			return io.EOF
+		}
+		return err
+	}
+	buf := bytes.NewBuffer(data)
+	for {
+		count, err := binary.ReadVarint(buf)
+		if err != nil {
+			return nil
+		}
+		msg := newMsg()
+		if err := proto.Unmarshal(buf.Next(int(count)), msg); err != nil {
+			return err
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
 	}
 }
 
@@ -68,6 +122,47 @@ func NewBufferedProtoWriter(bs interfaces.Blobstore, streamID string, bufferSize
 	}
 }
 
+// StreamExists returns whether any chunk has been written for streamID.
+func StreamExists(ctx context.Context, bs interfaces.Blobstore, streamID string) (bool, error) {
+	return bs.BlobExists(ctx, chunkName(streamID, 0))
+}
+
+// NewResumedBufferedProtoWriter returns a BufferedProtoWriter that appends to
+// the chunks an earlier writer wrote for streamID.
+func NewResumedBufferedProtoWriter(ctx context.Context, bs interfaces.Blobstore, streamID string, bufferSizeBytes int) (*BufferedProtoWriter, error) {
+	w := NewBufferedProtoWriter(bs, streamID, bufferSizeBytes)
+	exists := func(sequenceNumber int) (bool, error) {
+		return bs.BlobExists(ctx, chunkName(streamID, sequenceNumber))
+	}
+	// Chunks are numbered from 0 without gaps, so find a chunk past the
+	// last one, then binary search for the first missing one.
+	lo, hi := -1, 0
+	for {
+		ok, err := exists(hi)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		lo, hi = hi, 2*hi+1
+	}
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		ok, err := exists(mid)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	w.writeSequenceNumber = hi
+	return w, nil
+}
+
 func chunkName(streamID string, sequenceNumber int) string {
 	chunkFileName := fmt.Sprintf("%s-%d.chunk", streamID, sequenceNumber)
 	return filepath.Join(streamID, "/chunks/", chunkFileName)
@@ -95,6 +190,14 @@ func (w *BufferedProtoWriter) Flush(ctx context.Context) error {
 	return w.internalFlush(ctx)
 }
 
+// IsFlushed returns whether every proto written to the stream has been
+// written to blobstore.
+func (w *BufferedProtoWriter) IsFlushed() bool {
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+	return w.writeBuf.Len() == 0
+}
+
 func (w *BufferedProtoWriter) TimeSinceLastWrite() time.Duration {
 	return time.Now().Sub(w.lastWriteTime)
 }
@@ -137,9 +240,11 @@ type blobQueue struct {
 	blobstore      interfaces.Blobstore
 	streamID       string
 	maxConnections int
-	futures        []blobFuture
-	numPopped      int
-	done           bool
+	// The sequence number of the first chunk in the queue.
+	startSequenceNumber int
+	futures             []blobFuture
+	numPopped           int
+	done                bool
 }
 
 func newBlobQueue(blobstore interfaces.Blobstore, streamID string) *blobQueue {
@@ -159,7 +264,7 @@ func newBlobFuture() blobFuture {
 
 func (q *blobQueue) pushNewFuture(ctx context.Context) {
 	future := newBlobFuture()
-	sequenceNumber := len(q.futures)
+	sequenceNumber := q.startSequenceNumber + len(q.futures)
 	q.futures = append(q.futures, future)
 	go func() {
 		defer close(future)
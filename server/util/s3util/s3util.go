@@ -0,0 +1,75 @@
+package s3util
+
+import (
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// SessionConfig holds the connection settings shared by everything that
+// talks to S3 or an S3-compatible store like MinIO or Ceph.
+type SessionConfig struct {
+	Region string
+
+	// An endpoint URL, like "http://minio.local:9000", to use instead of
+	// AWS. Plain HTTP is used if the URL's scheme is http.
+	Endpoint string
+
+	// Addresses buckets as endpoint/bucket rather than bucket.endpoint,
+	// which most S3-compatible stores require.
+	ForcePathStyle bool
+
+	// A profile, and optionally a file, to read shared credentials from.
+	// The default file (~/.aws/credentials) is used if only a profile is
+	// set.
+	CredentialsProfile string
+	CredentialsFile    string
+
+	// Static credentials, which take precedence over shared credentials.
+	StaticCredentialsID     string
+	StaticCredentialsSecret string
+	StaticCredentialsToken  string
+
+	// A PEM file of CA certificates to trust when connecting over TLS, for
+	// endpoints serving a certificate signed by a private CA.
+	CACertFile string
+}
+
+// NewSession returns an AWS session for c. Credentials which aren't set in
+// c are looked up the usual way, see
+// https://docs.aws.amazon.com/sdk-for-go/v1/developer-guide/configuring-sdk.html#specifying-credentials
+func NewSession(c *SessionConfig) (*session.Session, error) {
+	awsConfig := &aws.Config{
+		Region: aws.String(c.Region),
+	}
+	if c.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(c.Endpoint)
+	}
+	if c.ForcePathStyle {
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	switch {
+	case c.StaticCredentialsID != "" || c.StaticCredentialsSecret != "":
+		if c.StaticCredentialsID == "" || c.StaticCredentialsSecret == "" {
+			return nil, status.InvalidArgumentError("S3 static credentials need both an ID and a secret")
+		}
+		awsConfig.Credentials = credentials.NewStaticCredentials(c.StaticCredentialsID, c.StaticCredentialsSecret, c.StaticCredentialsToken)
+	case c.CredentialsProfile != "" || c.CredentialsFile != "":
+		awsConfig.Credentials = credentials.NewSharedCredentials(c.CredentialsFile, c.CredentialsProfile)
+	}
+
+	opts := session.Options{Config: *awsConfig}
+	if c.CACertFile != "" {
+		f, err := os.Open(c.CACertFile)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("Error opening S3 CA cert file: %s", err)
+		}
+		defer f.Close()
+		opts.CustomCABundle = f
+	}
+	return session.NewSessionWithOptions(opts)
+}
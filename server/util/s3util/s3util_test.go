@@ -0,0 +1,46 @@
+package s3util_test
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/s3util"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+func TestNewSession(t *testing.T) {
+	sess, err := s3util.NewSession(&s3util.SessionConfig{
+		Region:                  "us-east-1",
+		Endpoint:                "http://minio.local:9000",
+		ForcePathStyle:          true,
+		StaticCredentialsID:     "id",
+		StaticCredentialsSecret: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := *sess.Config.Endpoint; got != "http://minio.local:9000" {
+		t.Errorf("Endpoint = %q, want http://minio.local:9000", got)
+	}
+	if !*sess.Config.S3ForcePathStyle {
+		t.Errorf("S3ForcePathStyle = false, want true")
+	}
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "id" || creds.SecretAccessKey != "secret" {
+		t.Errorf("Got credentials %q/%q, want id/secret", creds.AccessKeyID, creds.SecretAccessKey)
+	}
+}
+
+func TestNewSessionInvalidConfig(t *testing.T) {
+	for _, c := range []*s3util.SessionConfig{
+		{Region: "us-east-1", StaticCredentialsID: "id"},
+		{Region: "us-east-1", StaticCredentialsSecret: "secret"},
+		{Region: "us-east-1", CACertFile: "/does/not/exist.pem"},
+	} {
+		if _, err := s3util.NewSession(c); !status.IsInvalidArgumentError(err) {
+			t.Errorf("NewSession(%+v) returned %v, want InvalidArgument", c, err)
+		}
+	}
+}
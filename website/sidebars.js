@@ -1,11 +1,11 @@
 module.exports = {
   someSidebar: {
     "Getting Started": ['introduction', 'cloud', 'on-prem', 'contributing'],
-    "Guides": ['guides', 'guide-auth', 'guide-metadata'],
+    "Guides": ['guides', 'guide-auth', 'guide-metadata', 'guide-build-event-files'],
     "Remote Build Execution": ['remote-build-execution', 'rbe-setup', 'rbe-platforms', 'rbe-github-actions', 'rbe-pools'],
     "Troubleshooting": ['troubleshooting', 'troubleshooting-rbe', 'troubleshooting-slow-upload'],
     "Enterprise": ['enterprise', 'enterprise-setup', 'enterprise-config', 'enterprise-helm', 'enterprise-rbe'],
     "Monitoring": ['prometheus-metrics'],
-    "Configuration": ['config', 'config-samples', 'config-app', 'config-database', 'config-storage', 'config-cache', 'config-github', 'config-ssl', 'config-auth', 'config-integrations', 'config-org', 'config-rbe', 'config-misc', 'config-api', 'config-telemetry', 'config-flags'],
+    "Configuration": ['config', 'config-samples', 'config-app', 'config-database', 'config-storage', 'config-cache', 'config-github', 'config-ssl', 'config-encryption', 'config-redaction', 'config-auth', 'config-integrations', 'config-org', 'config-rbe', 'config-misc', 'config-api', 'config-telemetry', 'config-flags'],
   },
 };